@@ -0,0 +1,76 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "maunium.net/go/mauflag"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/gomuks/pkg/hicli"
+)
+
+func runExport(args []string) {
+	flags := flag.New(args)
+	flags.SetHelpTitles(
+		"gomuks export - Export the history of a room into a file.",
+		"gomuks export [-h] -r <room ID> -o <output file> [-f html|json|text] [--local-only] [--no-media]",
+	)
+	exportWantHelp, _ := flags.MakeHelpFlag()
+	roomID := flags.MakeFull("r", "room", "ID of the room to export.", "").String()
+	output := flags.MakeFull("o", "output", "Path to write the export to.", "").String()
+	format := flags.MakeFull("f", "format", "Output format: html, json or text.", "html").String()
+	localOnly := flags.MakeFull("l", "local-only", "Only export history that is already in the local database.", "false").Bool()
+	noMedia := flags.MakeFull("m", "no-media", "Don't embed media files in HTML exports.", "false").Bool()
+	err := flags.Parse()
+
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		flags.PrintHelp()
+		os.Exit(1)
+	} else if *exportWantHelp {
+		flags.PrintHelp()
+		os.Exit(0)
+	} else if *roomID == "" || *output == "" {
+		_, _ = fmt.Fprintln(os.Stderr, "Room ID and output path are required")
+		flags.PrintHelp()
+		os.Exit(1)
+	} else if !hicli.ExportFormat(*format).IsValid() {
+		_, _ = fmt.Fprintln(os.Stderr, "Invalid export format", *format)
+		os.Exit(1)
+	}
+
+	gmx := gomuks.NewGomuks()
+	gmx.Version = Version
+	gmx.Commit = Commit
+	gmx.LinkifiedVersion = LinkifiedVersion
+	gmx.BuildTime = ParsedBuildTime
+	err = gmx.RunExport(&gomuks.ExportParams{
+		RoomID:       id.RoomID(*roomID),
+		Format:       hicli.ExportFormat(*format),
+		FetchHistory: !*localOnly,
+		IncludeMedia: !*noMedia,
+	}, *output)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to export room:", err)
+		os.Exit(2)
+	}
+	_, _ = fmt.Fprintln(os.Stderr, "Exported room to", *output)
+}
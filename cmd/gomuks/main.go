@@ -55,9 +55,13 @@ var version = flag.MakeFull("v", "version", "View gomuks version and quit.", "fa
 func main() {
 	hicli.InitialDeviceDisplayName = "gomuks web"
 	initVersion(Tag, Commit, BuildTime)
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		runExport(os.Args[2:])
+		return
+	}
 	flag.SetHelpTitles(
 		"gomuks - A Matrix client written in Go.",
-		"gomuks [-hv]",
+		"gomuks [-hv] | gomuks export [-h] <flags>",
 	)
 	err := flag.Parse()
 
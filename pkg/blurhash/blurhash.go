@@ -0,0 +1,134 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package blurhash implements an encoder for the BlurHash image placeholder format.
+// See https://github.com/woltapp/blurhash/blob/master/Algorithm.md for the algorithm.
+package blurhash
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Encode calculates the blurhash of the given image using the given number of components.
+//
+// The whole image is iterated for every component, so large images should be downscaled before encoding.
+func Encode(xComponents, yComponents int, img image.Image) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("invalid component count %dx%d", xComponents, yComponents)
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return "", fmt.Errorf("image is empty")
+	}
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*width+x] = [3]float64{
+				sRGBToLinear(r >> 8),
+				sRGBToLinear(g >> 8),
+				sRGBToLinear(b >> 8),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			factors = append(factors, multiplyBasisFunction(linear, width, height, i, j))
+		}
+	}
+
+	var buf strings.Builder
+	buf.Grow(4 + 2*len(factors))
+	encode83(&buf, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximumValue := 0.0
+		for _, factor := range ac {
+			actualMaximumValue = max(actualMaximumValue, math.Abs(factor[0]), math.Abs(factor[1]), math.Abs(factor[2]))
+		}
+		quantisedMaximumValue := clampInt(int(math.Floor(actualMaximumValue*166-0.5)), 0, 82)
+		maximumValue = float64(quantisedMaximumValue+1) / 166
+		encode83(&buf, quantisedMaximumValue, 1)
+	} else {
+		encode83(&buf, 0, 1)
+	}
+
+	encode83(&buf, linearTosRGB(dc[0])<<16+linearTosRGB(dc[1])<<8+linearTosRGB(dc[2]), 4)
+	for _, factor := range ac {
+		encode83(&buf, quantiseAC(factor[0], maximumValue)*19*19+quantiseAC(factor[1], maximumValue)*19+quantiseAC(factor[2], maximumValue), 2)
+	}
+	return buf.String(), nil
+}
+
+func multiplyBasisFunction(linear [][3]float64, width, height, xComponent, yComponent int) (out [3]float64) {
+	normalisation := 2.0
+	if xComponent == 0 && yComponent == 0 {
+		normalisation = 1
+	}
+	for y := 0; y < height; y++ {
+		yBasis := math.Cos(math.Pi * float64(yComponent) * float64(y) / float64(height))
+		for x := 0; x < width; x++ {
+			basis := math.Cos(math.Pi*float64(xComponent)*float64(x)/float64(width)) * yBasis
+			pixel := linear[y*width+x]
+			out[0] += basis * pixel[0]
+			out[1] += basis * pixel[1]
+			out[2] += basis * pixel[2]
+		}
+	}
+	scale := normalisation / float64(width*height)
+	out[0] *= scale
+	out[1] *= scale
+	out[2] *= scale
+	return
+}
+
+func quantiseAC(value, maximumValue float64) int {
+	return clampInt(int(math.Floor(signPow(value/maximumValue, 0.5)*9+9.5)), 0, 18)
+}
+
+func encode83(buf *strings.Builder, value, length int) {
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+	for ; divisor > 0; divisor /= 83 {
+		buf.WriteByte(base83Chars[(value/divisor)%83])
+	}
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearTosRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(math.Round(v * 12.92 * 255))
+	}
+	return int(math.Round((1.055*math.Pow(v, 1/2.4) - 0.055) * 255))
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+func clampInt(value, minVal, maxVal int) int {
+	return min(max(value, minVal), maxVal)
+}
@@ -32,9 +32,10 @@ import (
 )
 
 type Config struct {
-	Web     WebConfig         `yaml:"web"`
-	Matrix  MatrixConfig      `yaml:"matrix"`
-	Logging zeroconfig.Config `yaml:"logging"`
+	Web      WebConfig         `yaml:"web"`
+	Matrix   MatrixConfig      `yaml:"matrix"`
+	Webhooks []*WebhookConfig  `yaml:"webhooks"`
+	Logging  zeroconfig.Config `yaml:"logging"`
 }
 
 type MatrixConfig struct {
@@ -46,6 +47,7 @@ type WebConfig struct {
 	Username       string `yaml:"username"`
 	PasswordHash   string `yaml:"password_hash"`
 	TokenKey       string `yaml:"token_key"`
+	APIToken       string `yaml:"api_token"`
 	DebugEndpoints bool   `yaml:"debug_endpoints"`
 }
 
@@ -92,6 +94,10 @@ func (gmx *Gomuks) LoadConfig() error {
 	} else {
 		changed = true
 	}
+	err = gmx.compileWebhooks()
+	if err != nil {
+		return err
+	}
 	if gmx.Config.Web.TokenKey == "" {
 		gmx.Config.Web.TokenKey = random.String(64)
 		changed = true
@@ -0,0 +1,965 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/exhttp"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+const (
+	// Finished exports that haven't been downloaded in this long are deleted
+	exportTimeout = 1 * time.Hour
+	// Minimum interval between export_progress events for a single export
+	exportProgressInterval = 500 * time.Millisecond
+	// Number of events to load from the database at once when writing an export
+	exportBatchSize = 100
+	// Media files larger than this are linked instead of being embedded in HTML exports
+	exportMaxInlineMediaSize = 50 * 1024 * 1024
+)
+
+var (
+	ErrExportNotFound    = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.EXPORT_NOT_FOUND", Err: "Export not found", StatusCode: http.StatusNotFound}
+	ErrExportNotFinished = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.EXPORT_NOT_FINISHED", Err: "Export hasn't finished yet", StatusCode: http.StatusConflict}
+	errExportCancelled   = errors.New("export cancelled")
+	errMediaTooLarge     = errors.New("media is too large to embed")
+)
+
+type ExportParams struct {
+	RoomID id.RoomID          `json:"room_id"`
+	Format hicli.ExportFormat `json:"format"`
+	// If true, history that isn't in the local database will be fetched from the server.
+	FetchHistory bool `json:"fetch_history"`
+	// If true, media files will be embedded in HTML exports.
+	IncludeMedia bool `json:"include_media"`
+}
+
+type exportJob struct {
+	ID     string
+	Params ExportParams
+	Path   string
+
+	stage      hicli.ExportStage
+	finishedAt time.Time
+	lock       sync.Mutex
+
+	cancel context.CancelCauseFunc
+}
+
+type respExport struct {
+	ExportID string `json:"export_id"`
+}
+
+func (gmx *Gomuks) StartExport(w http.ResponseWriter, r *http.Request) {
+	var params ExportParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		mautrix.MBadJSON.WithMessage("Failed to decode request JSON").Write(w)
+		return
+	} else if !params.Format.IsValid() {
+		mautrix.MInvalidParam.WithMessage("Invalid export format").Write(w)
+		return
+	}
+	room, err := gmx.Client.DB.Room.Get(r.Context(), params.RoomID)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get room for export")
+		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to get room: %v", err)).Write(w)
+		return
+	} else if room == nil {
+		mautrix.MNotFound.WithMessage("Room not found").Write(w)
+		return
+	}
+	job, err := gmx.newExportJob(&params)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to create export")
+		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to create export: %v", err)).Write(w)
+		return
+	}
+	exhttp.WriteJSONResponse(w, http.StatusAccepted, &respExport{ExportID: job.ID})
+}
+
+func (gmx *Gomuks) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	job := gmx.getExportJob(r.PathValue("export_id"))
+	if job == nil {
+		ErrExportNotFound.Write(w)
+		return
+	}
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.stage != hicli.ExportStageDone {
+		ErrExportNotFinished.Write(w)
+		return
+	}
+	job.finishedAt = time.Now()
+	file, err := os.Open(job.Path)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to open export file")
+		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to open export file: %v", err)).Write(w)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to stat export file: %v", err)).Write(w)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFileName(&job.Params)))
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
+
+func (gmx *Gomuks) CancelExport(w http.ResponseWriter, r *http.Request) {
+	job := gmx.getExportJob(r.PathValue("export_id"))
+	if job == nil {
+		ErrExportNotFound.Write(w)
+		return
+	}
+	job.cancel(errExportCancelled)
+	gmx.removeExportJob(job)
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func exportFileName(params *ExportParams) string {
+	safeRoomID := strings.NewReplacer("!", "", ":", "_", "/", "_").Replace(params.RoomID.String())
+	return fmt.Sprintf("%s-%s.%s", safeRoomID, time.Now().Format("2006-01-02"), params.Format.Extension())
+}
+
+func (gmx *Gomuks) newExportJob(params *ExportParams) (*exportJob, error) {
+	tempFile, err := os.CreateTemp(gmx.TempDir, "export-*."+params.Format.Extension())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	job := &exportJob{
+		ID:     random.String(16),
+		Params: *params,
+		Path:   tempFile.Name(),
+		stage:  hicli.ExportStageCollecting,
+	}
+	log := gmx.Log.With().
+		Str("action", "export room").
+		Str("export_id", job.ID).
+		Stringer("room_id", params.RoomID).
+		Logger()
+	var ctx context.Context
+	ctx, job.cancel = context.WithCancelCause(log.WithContext(context.Background()))
+	gmx.exportsLock.Lock()
+	gmx.cleanupExportJobs()
+	gmx.exports[job.ID] = job
+	gmx.exportsLock.Unlock()
+	go gmx.runExportJob(ctx, job, tempFile)
+	return job, nil
+}
+
+func (gmx *Gomuks) runExportJob(ctx context.Context, job *exportJob, file *os.File) {
+	log := zerolog.Ctx(ctx)
+	sendProgress := gmx.makeExportProgressFunc(job)
+	err := gmx.ExportRoom(ctx, &job.Params, file, sendProgress)
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close export file: %w", closeErr)
+	}
+	job.lock.Lock()
+	job.finishedAt = time.Now()
+	if err != nil {
+		job.stage = hicli.ExportStageFailed
+		_ = os.Remove(job.Path)
+	} else {
+		job.stage = hicli.ExportStageDone
+	}
+	job.lock.Unlock()
+	if errors.Is(context.Cause(ctx), errExportCancelled) {
+		log.Debug().Msg("Export cancelled")
+		return
+	} else if err != nil {
+		log.Err(err).Msg("Failed to export room")
+		gmx.Client.EventHandler(&hicli.ExportProgress{
+			ExportID: job.ID,
+			RoomID:   job.Params.RoomID,
+			Format:   job.Params.Format,
+			Stage:    hicli.ExportStageFailed,
+			Error:    err.Error(),
+		})
+		return
+	}
+	log.Info().Msg("Room export finished")
+	sendProgress(hicli.ExportStageDone, 0, 0)
+}
+
+func (gmx *Gomuks) makeExportProgressFunc(job *exportJob) func(stage hicli.ExportStage, events, total int) {
+	var lastSent time.Time
+	var lastStage hicli.ExportStage
+	var lastEvents, lastTotal int
+	return func(stage hicli.ExportStage, events, total int) {
+		if stage == hicli.ExportStageDone {
+			events, total = lastEvents, lastTotal
+		}
+		lastEvents, lastTotal = events, total
+		if stage == lastStage && time.Since(lastSent) < exportProgressInterval {
+			return
+		}
+		lastSent = time.Now()
+		lastStage = stage
+		job.lock.Lock()
+		if job.stage != hicli.ExportStageFailed {
+			job.stage = stage
+		}
+		job.lock.Unlock()
+		gmx.Client.EventHandler(&hicli.ExportProgress{
+			ExportID: job.ID,
+			RoomID:   job.Params.RoomID,
+			Format:   job.Params.Format,
+			Stage:    stage,
+			Events:   events,
+			Total:    total,
+		})
+	}
+}
+
+func (gmx *Gomuks) getExportJob(exportID string) *exportJob {
+	gmx.exportsLock.Lock()
+	defer gmx.exportsLock.Unlock()
+	return gmx.exports[exportID]
+}
+
+// cleanupExportJobs removes finished exports that haven't been touched in a while. The caller must hold exportsLock.
+func (gmx *Gomuks) cleanupExportJobs() {
+	for exportID, job := range gmx.exports {
+		job.lock.Lock()
+		if !job.finishedAt.IsZero() && time.Since(job.finishedAt) > exportTimeout {
+			_ = os.Remove(job.Path)
+			delete(gmx.exports, exportID)
+		}
+		job.lock.Unlock()
+	}
+}
+
+func (gmx *Gomuks) removeExportJob(job *exportJob) {
+	gmx.exportsLock.Lock()
+	if gmx.exports[job.ID] == job {
+		delete(gmx.exports, job.ID)
+	}
+	gmx.exportsLock.Unlock()
+	job.lock.Lock()
+	_ = os.Remove(job.Path)
+	job.lock.Unlock()
+}
+
+// RunExport loads the client without syncing or starting the web server, exports a single room into the given file and exits.
+func (gmx *Gomuks) RunExport(params *ExportParams, outputPath string) error {
+	gmx.InitDirectories()
+	err := gmx.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	gmx.SetupLog()
+	userID := gmx.initClient()
+	defer gmx.Client.Stop()
+	err = gmx.Client.Load(gmx.Log.WithContext(context.Background()), userID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load client: %w", err)
+	}
+	if !gmx.Client.IsLoggedIn() {
+		return fmt.Errorf("not logged in")
+	}
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	var lastPrinted time.Time
+	err = gmx.ExportRoom(gmx.Log.WithContext(context.Background()), params, file, func(stage hicli.ExportStage, events, total int) {
+		if time.Since(lastPrinted) < time.Second {
+			return
+		}
+		lastPrinted = time.Now()
+		if stage == hicli.ExportStageCollecting {
+			_, _ = fmt.Fprintf(os.Stderr, "Collecting history: found %d events\n", events)
+		} else {
+			_, _ = fmt.Fprintf(os.Stderr, "Writing export: %d/%d events\n", events, total)
+		}
+	})
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close output file: %w", closeErr)
+	}
+	if err != nil {
+		_ = os.Remove(outputPath)
+		return err
+	}
+	return nil
+}
+
+// ExportRoom writes the history of a room into the given writer in the requested format.
+func (gmx *Gomuks) ExportRoom(
+	ctx context.Context,
+	params *ExportParams,
+	output io.Writer,
+	progress func(stage hicli.ExportStage, events, total int),
+) error {
+	room, err := gmx.Client.DB.Room.Get(ctx, params.RoomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room: %w", err)
+	} else if room == nil {
+		return fmt.Errorf("room not found")
+	}
+	rowIDs, err := gmx.Client.CollectRoomHistory(ctx, params.RoomID, params.FetchHistory, func(count int) {
+		progress(hicli.ExportStageCollecting, count, 0)
+	})
+	if err != nil {
+		return err
+	}
+	bufOutput := bufio.NewWriter(output)
+	exp := &roomExporter{
+		gmx:         gmx,
+		params:      params,
+		room:        room,
+		out:         bufOutput,
+		names:       make(map[id.UserID]string),
+		memberships: make(map[id.UserID]event.Membership),
+		media:       make(map[id.ContentURI]string),
+		inlineImgRe: makeInlineImageRegex(),
+	}
+	err = exp.writeHeader(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	progress(hicli.ExportStageWriting, 0, len(rowIDs))
+	for i := 0; i < len(rowIDs); i += exportBatchSize {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		batch := rowIDs[i:min(i+exportBatchSize, len(rowIDs))]
+		err = exp.writeBatch(ctx, batch)
+		if err != nil {
+			return err
+		}
+		progress(hicli.ExportStageWriting, i+len(batch), len(rowIDs))
+	}
+	err = exp.writeFooter()
+	if err != nil {
+		return fmt.Errorf("failed to write footer: %w", err)
+	}
+	return bufOutput.Flush()
+}
+
+func makeInlineImageRegex() *regexp.Regexp {
+	pattern := strings.ReplaceAll(regexp.QuoteMeta(hicli.HTMLSanitizerImgSrcTemplate), "%s", `([^/?"]+)`)
+	return regexp.MustCompile(`src="` + pattern + `"`)
+}
+
+type roomExporter struct {
+	gmx    *Gomuks
+	params *ExportParams
+	room   *database.Room
+	out    *bufio.Writer
+
+	written     int
+	names       map[id.UserID]string
+	memberships map[id.UserID]event.Membership
+	// Element IDs of media files that have already been embedded, so that later uses can reference them
+	media       map[id.ContentURI]string
+	inlineImgRe *regexp.Regexp
+}
+
+func (exp *roomExporter) roomName() string {
+	if exp.room.Name != nil && *exp.room.Name != "" {
+		return *exp.room.Name
+	}
+	return exp.room.ID.String()
+}
+
+const exportHTMLStyle = `
+body { font-family: sans-serif; max-width: 60rem; margin: 0 auto; padding: 1rem; line-height: 1.4; }
+header { border-bottom: 1px solid #ccc; margin-bottom: 1rem; }
+div.event { padding: .25rem 0; }
+div.event > div.meta { font-size: .875rem; color: #666; }
+div.event > div.meta > span.sender { font-weight: bold; color: #000; }
+div.event.state { font-style: italic; color: #666; }
+div.content img, div.content video { max-width: 100%; max-height: 30rem; }
+div.content img[data-mx-emoticon] { height: 1.5em; vertical-align: middle; }
+div.content.redacted, div.content.error { color: #999; font-style: italic; }
+div.reactions > span { display: inline-block; border: 1px solid #ccc; border-radius: .5rem; padding: 0 .25rem; margin-right: .25rem; }
+span.edited { font-size: .75rem; color: #999; }
+blockquote { border-left: 2px solid #ccc; margin: 0; padding-left: .5rem; }
+pre { overflow-x: auto; }
+`
+
+// Each media file is only embedded once, and later uses of the same file are filled in from the first one.
+const exportHTMLMediaRefScript = `<script>
+document.querySelectorAll("[data-media-ref]").forEach(elem => {
+	const orig = document.getElementById(elem.dataset.mediaRef)
+	const uri = orig?.getAttribute("src") ?? orig?.getAttribute("href")
+	if (uri) {
+		elem.setAttribute(elem.tagName === "A" ? "href" : "src", uri)
+	}
+})
+</script>
+`
+
+func (exp *roomExporter) writeHeader(ctx context.Context) error {
+	var err error
+	switch exp.params.Format {
+	case hicli.ExportFormatHTML:
+		_, err = fmt.Fprintf(
+			exp.out,
+			"<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>%s</style>\n</head>\n<body>\n<header>\n<h1>%s</h1>\n",
+			html.EscapeString(exp.roomName()), exportHTMLStyle, html.EscapeString(exp.roomName()),
+		)
+		if err == nil && exp.room.Topic != nil {
+			_, err = fmt.Fprintf(exp.out, "<p>%s</p>\n", html.EscapeString(*exp.room.Topic))
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(
+				exp.out, "<p><code>%s</code> &middot; exported on %s</p>\n</header>\n<main>\n",
+				html.EscapeString(exp.room.ID.String()), time.Now().Format(time.DateTime),
+			)
+		}
+	case hicli.ExportFormatJSON:
+		var roomData []byte
+		roomData, err = json.Marshal(exp.room)
+		if err == nil {
+			_, err = fmt.Fprintf(exp.out, "{\"room\":%s,\"exported_at\":%d,\"events\":[", roomData, time.Now().UnixMilli())
+		}
+	case hicli.ExportFormatText:
+		_, err = fmt.Fprintf(exp.out, "%s (%s)\n", exp.roomName(), exp.room.ID)
+		if err == nil && exp.room.Topic != nil {
+			_, err = fmt.Fprintf(exp.out, "Topic: %s\n", *exp.room.Topic)
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(exp.out, "Exported on %s\n\n", time.Now().Format(time.DateTime))
+		}
+	}
+	return err
+}
+
+func (exp *roomExporter) writeFooter() error {
+	var err error
+	switch exp.params.Format {
+	case hicli.ExportFormatHTML:
+		_, err = fmt.Fprintf(exp.out, "</main>\n<footer><p>%d events</p></footer>\n", exp.written)
+		if err == nil && len(exp.media) > 0 {
+			_, err = exp.out.WriteString(exportHTMLMediaRefScript)
+		}
+		if err == nil {
+			_, err = exp.out.WriteString("</body>\n</html>\n")
+		}
+	case hicli.ExportFormatJSON:
+		_, err = exp.out.WriteString("]}\n")
+	}
+	return err
+}
+
+func (exp *roomExporter) writeBatch(ctx context.Context, rowIDs []database.EventRowID) error {
+	events, err := exp.gmx.Client.GetEventsByRowIDs(ctx, rowIDs)
+	if err != nil {
+		return fmt.Errorf("failed to get events: %w", err)
+	}
+	eventMap := make(map[database.EventRowID]*database.Event, len(events))
+	var editRowIDs []database.EventRowID
+	for _, evt := range events {
+		eventMap[evt.RowID] = evt
+		if evt.LastEditRowID != nil && *evt.LastEditRowID != 0 {
+			editRowIDs = append(editRowIDs, *evt.LastEditRowID)
+		}
+	}
+	edits := make(map[database.EventRowID]*database.Event, len(editRowIDs))
+	if len(editRowIDs) > 0 && exp.params.Format != hicli.ExportFormatJSON {
+		editEvents, err := exp.gmx.Client.GetEventsByRowIDs(ctx, editRowIDs)
+		if err != nil {
+			return fmt.Errorf("failed to get edits: %w", err)
+		}
+		for _, edit := range editEvents {
+			edits[edit.RowID] = edit
+		}
+	}
+	for _, rowID := range rowIDs {
+		evt, ok := eventMap[rowID]
+		if !ok {
+			continue
+		}
+		var edit *database.Event
+		if evt.LastEditRowID != nil {
+			edit = edits[*evt.LastEditRowID]
+		}
+		err = exp.writeEvent(ctx, evt, edit)
+		if err != nil {
+			return fmt.Errorf("failed to write event %s: %w", evt.ID, err)
+		}
+	}
+	return nil
+}
+
+func getTypeAndContent(evt *database.Event) (string, json.RawMessage) {
+	if evt.DecryptedType != "" {
+		return evt.DecryptedType, evt.Decrypted
+	}
+	return evt.Type, evt.Content
+}
+
+func (exp *roomExporter) getName(ctx context.Context, userID id.UserID) string {
+	if name, ok := exp.names[userID]; ok {
+		return name
+	}
+	name := userID.String()
+	memberEvt, err := exp.gmx.Client.DB.CurrentState.Get(ctx, exp.room.ID, event.StateMember, userID.String())
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("user_id", userID).Msg("Failed to get member event for export")
+	} else if memberEvt != nil {
+		var content event.MemberEventContent
+		if json.Unmarshal(memberEvt.Content, &content) == nil && content.Displayname != "" {
+			name = content.Displayname
+		}
+	}
+	exp.names[userID] = name
+	return name
+}
+
+// describeStateEvent returns a human-readable description of a state event, or an empty string for unsupported types.
+func (exp *roomExporter) describeStateEvent(ctx context.Context, evt *database.Event) string {
+	switch evt.Type {
+	case event.StateMember.Type:
+		var content event.MemberEventContent
+		if evt.StateKey == nil || json.Unmarshal(evt.Content, &content) != nil {
+			return ""
+		}
+		target := id.UserID(*evt.StateKey)
+		prevMembership := exp.memberships[target]
+		exp.memberships[target] = content.Membership
+		var description string
+		switch content.Membership {
+		case event.MembershipJoin:
+			if prevMembership == event.MembershipJoin {
+				description = "updated their profile"
+			} else {
+				description = "joined the room"
+			}
+		case event.MembershipInvite:
+			description = fmt.Sprintf("invited %s", content.Displayname)
+		case event.MembershipLeave:
+			if evt.Sender == target {
+				description = "left the room"
+			} else {
+				description = fmt.Sprintf("removed %s", exp.getName(ctx, target))
+			}
+		case event.MembershipBan:
+			description = fmt.Sprintf("banned %s", exp.getName(ctx, target))
+		case event.MembershipKnock:
+			description = "asked to join the room"
+		default:
+			return ""
+		}
+		if content.Membership == event.MembershipJoin && evt.Sender == target {
+			exp.names[target] = cmp.Or(content.Displayname, target.String())
+		}
+		if content.Reason != "" {
+			description += fmt.Sprintf(" (%s)", content.Reason)
+		}
+		return description
+	case event.StateRoomName.Type:
+		var content event.RoomNameEventContent
+		if json.Unmarshal(evt.Content, &content) != nil {
+			return ""
+		}
+		return fmt.Sprintf("changed the room name to %s", content.Name)
+	case event.StateTopic.Type:
+		var content event.TopicEventContent
+		if json.Unmarshal(evt.Content, &content) != nil {
+			return ""
+		}
+		return fmt.Sprintf("changed the topic to %s", content.Topic)
+	case event.StateCreate.Type:
+		return "created the room"
+	case event.StateEncryption.Type:
+		return "enabled encryption"
+	default:
+		return ""
+	}
+}
+
+func (exp *roomExporter) writeEvent(ctx context.Context, evt *database.Event, edit *database.Event) error {
+	if exp.params.Format == hicli.ExportFormatJSON {
+		if exp.written > 0 {
+			_ = exp.out.WriteByte(',')
+		}
+		exp.written++
+		data, err := json.Marshal(evt)
+		if err != nil {
+			return err
+		}
+		_, err = exp.out.Write(data)
+		return err
+	}
+	if evt.StateKey != nil {
+		if evt.RedactedBy != "" {
+			return nil
+		}
+		// Get the name before describing the event, so that profile changes are attributed to the old name
+		name := exp.getName(ctx, evt.Sender)
+		description := exp.describeStateEvent(ctx, evt)
+		if description == "" {
+			return nil
+		}
+		exp.written++
+		return exp.writeStateLine(evt, name, description)
+	}
+	evtType, rawContent := getTypeAndContent(evt)
+	switch evtType {
+	case event.EventMessage.Type, event.EventSticker.Type, event.EventEncrypted.Type,
+		hicli.EventPollStart.Type, hicli.EventUnstablePollStart.Type:
+	default:
+		return nil
+	}
+	if evt.RelationType == event.RelReplace {
+		return nil
+	}
+	exp.written++
+	var content event.MessageEventContent
+	localContent := evt.LocalContent
+	if edit != nil {
+		_, editContent := getTypeAndContent(edit)
+		var parsedEdit event.MessageEventContent
+		if json.Unmarshal(editContent, &parsedEdit) == nil && parsedEdit.NewContent != nil {
+			content = *parsedEdit.NewContent
+			localContent = edit.LocalContent
+		} else {
+			edit = nil
+		}
+	}
+	if edit == nil {
+		_ = json.Unmarshal(rawContent, &content)
+	}
+	if evtType == event.EventSticker.Type {
+		content.MsgType = event.MsgImage
+	}
+	if exp.params.Format == hicli.ExportFormatHTML {
+		return exp.writeHTMLMessage(ctx, evt, evtType, &content, localContent, edit != nil)
+	}
+	return exp.writeTextMessage(ctx, evt, evtType, &content, edit != nil)
+}
+
+func (exp *roomExporter) writeStateLine(evt *database.Event, name, description string) error {
+	var err error
+	if exp.params.Format == hicli.ExportFormatHTML {
+		_, err = fmt.Fprintf(
+			exp.out, "<div class=\"event state\" id=\"%s\"><time datetime=\"%s\">%s</time> %s %s</div>\n",
+			html.EscapeString(evt.ID.String()), evt.Timestamp.UTC().Format(time.RFC3339),
+			evt.Timestamp.Local().Format(time.DateTime), html.EscapeString(name), html.EscapeString(description),
+		)
+	} else {
+		_, err = fmt.Fprintf(exp.out, "[%s] * %s %s\n", evt.Timestamp.Local().Format(time.DateTime), name, description)
+	}
+	return err
+}
+
+func (exp *roomExporter) writeTextMessage(
+	ctx context.Context,
+	evt *database.Event,
+	evtType string,
+	content *event.MessageEventContent,
+	edited bool,
+) error {
+	name := exp.getName(ctx, evt.Sender)
+	var body string
+	separator := ":"
+	switch {
+	case evt.RedactedBy != "":
+		body = "(message deleted)"
+	case evtType == event.EventEncrypted.Type:
+		body = "(unable to decrypt message)"
+	case evt.Poll != nil:
+		body = "(poll) " + formatPollText(evt.Poll)
+	case content.MsgType == event.MsgEmote:
+		separator = ""
+		body = content.Body
+	case content.MsgType.IsMedia():
+		body = fmt.Sprintf("(%s) %s", strings.TrimPrefix(string(content.MsgType), "m."), content.Body)
+	default:
+		body = content.Body
+	}
+	if edited {
+		body += " (edited)"
+	}
+	if len(evt.Reactions) > 0 {
+		body += " [" + formatReactionsText(evt.Reactions) + "]"
+	}
+	body = strings.ReplaceAll(body, "\n", "\n    ")
+	prefix := ""
+	if separator == "" {
+		prefix = "* "
+	}
+	_, err := fmt.Fprintf(exp.out, "[%s] %s%s%s %s\n", evt.Timestamp.Local().Format(time.DateTime), prefix, name, separator, body)
+	return err
+}
+
+func formatPollText(poll *database.PollSummary) string {
+	parts := make([]string, len(poll.Start.Answers))
+	for i, answer := range poll.Start.Answers {
+		parts[i] = fmt.Sprintf("%s: %d", answer.Text, poll.Tallies[answer.ID])
+	}
+	return fmt.Sprintf("%s (%s)", poll.Start.Question, strings.Join(parts, ", "))
+}
+
+func formatReactionsText(reactions map[string]int) string {
+	parts := make([]string, 0, len(reactions))
+	for key, count := range reactions {
+		parts = append(parts, fmt.Sprintf("%s %d", key, count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (exp *roomExporter) writeHTMLMessage(
+	ctx context.Context,
+	evt *database.Event,
+	evtType string,
+	content *event.MessageEventContent,
+	localContent *database.LocalContent,
+	edited bool,
+) error {
+	var body string
+	contentClass := "content"
+	switch {
+	case evt.RedactedBy != "":
+		contentClass += " redacted"
+		body = "Message deleted"
+	case evtType == event.EventEncrypted.Type:
+		contentClass += " error"
+		body = html.EscapeString(fmt.Sprintf("Unable to decrypt message: %s", evt.DecryptionError))
+	case evt.Poll != nil:
+		body = exp.formatPollHTML(evt.Poll)
+	case content.MsgType.IsMedia():
+		body = exp.formatMediaHTML(ctx, content)
+	case localContent != nil && localContent.SanitizedHTML != "":
+		body = exp.embedInlineImages(ctx, localContent.SanitizedHTML)
+	default:
+		body = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+	}
+	if content.MsgType == event.MsgEmote && evt.RedactedBy == "" {
+		body = "* " + html.EscapeString(exp.getName(ctx, evt.Sender)) + " " + body
+	}
+	if edited {
+		body += ` <span class="edited">(edited)</span>`
+	}
+	_, err := fmt.Fprintf(
+		exp.out,
+		"<div class=\"event\" id=\"%s\">\n<div class=\"meta\"><span class=\"sender\" title=\"%s\">%s</span> <time datetime=\"%s\">%s</time></div>\n<div class=\"%s\">%s</div>\n",
+		html.EscapeString(evt.ID.String()), html.EscapeString(evt.Sender.String()),
+		html.EscapeString(exp.getName(ctx, evt.Sender)), evt.Timestamp.UTC().Format(time.RFC3339),
+		evt.Timestamp.Local().Format(time.DateTime), contentClass, body,
+	)
+	if err != nil {
+		return err
+	}
+	if len(evt.Reactions) > 0 {
+		_, _ = exp.out.WriteString(`<div class="reactions">`)
+		for key, count := range evt.Reactions {
+			_, _ = fmt.Fprintf(exp.out, "<span>%s %d</span>", html.EscapeString(key), count)
+		}
+		_, _ = exp.out.WriteString("</div>\n")
+	}
+	_, err = exp.out.WriteString("</div>\n")
+	return err
+}
+
+func (exp *roomExporter) formatPollHTML(poll *database.PollSummary) string {
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "<p><strong>%s</strong></p><ul>", html.EscapeString(poll.Start.Question))
+	for _, answer := range poll.Start.Answers {
+		_, _ = fmt.Fprintf(&buf, "<li>%s: %d</li>", html.EscapeString(answer.Text), poll.Tallies[answer.ID])
+	}
+	buf.WriteString("</ul>")
+	if poll.Ended {
+		buf.WriteString("<p>Poll ended</p>")
+	}
+	return buf.String()
+}
+
+func (exp *roomExporter) formatMediaHTML(ctx context.Context, content *event.MessageEventContent) string {
+	fileName := content.GetFileName()
+	mxc := content.URL
+	var file *event.EncryptedFileInfo
+	if content.File != nil {
+		mxc = content.File.URL
+		file = content.File
+	}
+	var mimeType string
+	if content.Info != nil {
+		mimeType = content.Info.MimeType
+	}
+	attr := "src"
+	if content.MsgType != event.MsgImage && content.MsgType != event.MsgVideo && content.MsgType != event.MsgAudio {
+		attr = "href"
+	}
+	var mediaAttrs string
+	if exp.params.IncludeMedia {
+		if parsedMXC, err := mxc.Parse(); err == nil {
+			mediaAttrs, err = exp.getMediaAttrs(ctx, parsedMXC, file, mimeType, attr)
+			if err != nil && !errors.Is(err, errMediaTooLarge) {
+				zerolog.Ctx(ctx).Warn().Err(err).Stringer("mxc", parsedMXC).Msg("Failed to embed media in export")
+			}
+		}
+	}
+	escapedName := html.EscapeString(fileName)
+	if mediaAttrs == "" {
+		return fmt.Sprintf("%s <code>%s</code>", escapedName, html.EscapeString(string(mxc)))
+	}
+	switch content.MsgType {
+	case event.MsgImage:
+		return fmt.Sprintf(`<img %s alt="%s" title="%s">`, mediaAttrs, escapedName, escapedName)
+	case event.MsgVideo:
+		return fmt.Sprintf(`<video controls %s title="%s"></video>`, mediaAttrs, escapedName)
+	case event.MsgAudio:
+		return fmt.Sprintf(`<audio controls %s title="%s"></audio>`, mediaAttrs, escapedName)
+	default:
+		return fmt.Sprintf(`<a %s download="%s">%s</a>`, mediaAttrs, escapedName, escapedName)
+	}
+}
+
+func (exp *roomExporter) embedInlineImages(ctx context.Context, sanitizedHTML string) string {
+	if !exp.params.IncludeMedia {
+		return sanitizedHTML
+	}
+	return exp.inlineImgRe.ReplaceAllStringFunc(sanitizedHTML, func(match string) string {
+		parts := exp.inlineImgRe.FindStringSubmatch(match)
+		mxc := id.ContentURI{Homeserver: parts[1], FileID: parts[2]}
+		mediaAttrs, err := exp.getMediaAttrs(ctx, mxc, nil, "", "src")
+		if err != nil {
+			if !errors.Is(err, errMediaTooLarge) {
+				zerolog.Ctx(ctx).Warn().Err(err).Stringer("mxc", mxc).Msg("Failed to embed inline image in export")
+			}
+			return match
+		}
+		return mediaAttrs
+	})
+}
+
+// getMediaAttrs returns the HTML attributes for embedding the given media file in an element.
+// The first use of a file gets the data URI in the given attribute along with an element ID,
+// while later uses only reference that ID to avoid embedding the same file many times.
+func (exp *roomExporter) getMediaAttrs(
+	ctx context.Context,
+	mxc id.ContentURI,
+	file *event.EncryptedFileInfo,
+	mimeType, attr string,
+) (string, error) {
+	if elemID, ok := exp.media[mxc]; ok {
+		return fmt.Sprintf(`data-media-ref="%s"`, elemID), nil
+	}
+	dataURI, err := exp.getMediaDataURI(ctx, mxc, file, mimeType)
+	if err != nil {
+		return "", err
+	}
+	elemID := fmt.Sprintf("media-%d", len(exp.media)+1)
+	exp.media[mxc] = elemID
+	return fmt.Sprintf(`%s="%s" id="%s"`, attr, html.EscapeString(dataURI), elemID), nil
+}
+
+func (exp *roomExporter) getMediaDataURI(
+	ctx context.Context,
+	mxc id.ContentURI,
+	file *event.EncryptedFileInfo,
+	mimeType string,
+) (string, error) {
+	data, cachedMimeType, err := exp.gmx.readMediaForExport(ctx, mxc, file)
+	if err != nil {
+		return "", err
+	}
+	if mimeType == "" {
+		mimeType = cachedMimeType
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// readMediaForExport returns the decrypted contents of a media file, preferring the local media cache.
+func (gmx *Gomuks) readMediaForExport(ctx context.Context, mxc id.ContentURI, file *event.EncryptedFileInfo) ([]byte, string, error) {
+	cacheEntry, err := gmx.Client.DB.Media.Get(ctx, mxc)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get cached media entry: %w", err)
+	} else if cacheEntry != nil && cacheEntry.Hash != nil {
+		if cacheEntry.Size > exportMaxInlineMediaSize {
+			return nil, "", errMediaTooLarge
+		}
+		data, err := os.ReadFile(gmx.cacheEntryToPath(cacheEntry.Hash[:]))
+		if err == nil {
+			return data, cacheEntry.MimeType, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, "", fmt.Errorf("failed to read cached media: %w", err)
+		}
+	}
+	if file == nil && cacheEntry != nil && cacheEntry.EncFile != nil {
+		file = &event.EncryptedFileInfo{EncryptedFile: *cacheEntry.EncFile, URL: mxc.CUString()}
+	}
+	resp, err := gmx.Client.Client.Download(ctx, mxc)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download media: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > exportMaxInlineMediaSize {
+		return nil, "", errMediaTooLarge
+	}
+	reader := io.Reader(resp.Body)
+	var decryptStream io.ReadCloser
+	if file != nil {
+		err = file.PrepareForDecryption()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to prepare media for decryption: %w", err)
+		}
+		decryptStream = file.DecryptStream(resp.Body)
+		reader = decryptStream
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, exportMaxInlineMediaSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read media: %w", err)
+	} else if len(data) > exportMaxInlineMediaSize {
+		return nil, "", errMediaTooLarge
+	}
+	if decryptStream != nil {
+		err = decryptStream.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decrypt media: %w", err)
+		}
+	}
+	mimeType := resp.Header.Get("Content-Type")
+	if file != nil {
+		mimeType = ""
+	}
+	return data, mimeType, nil
+}
@@ -0,0 +1,163 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/util/jsontime"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func newExportTestGomuks(t *testing.T) *Gomuks {
+	t.Helper()
+	const roomID = id.RoomID("!room:example.com")
+	gmx := newWebhookTestGomuks(t)
+	gmx.Client.Account = &database.Account{UserID: "@alice:example.com"}
+	ctx := context.Background()
+	err := gmx.Client.DB.Room.CreateRow(ctx, roomID)
+	if err != nil {
+		t.Fatalf("failed to create room: %v", err)
+	}
+	err = gmx.Client.DB.Room.Upsert(ctx, &database.Room{
+		ID:    roomID,
+		Name:  ptr.Ptr("Test <room>"),
+		Topic: ptr.Ptr("Room for testing"),
+	})
+	if err != nil {
+		t.Fatalf("failed to update room: %v", err)
+	}
+	ts := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	events := []*database.Event{{
+		ID:       "$join",
+		Type:     "m.room.member",
+		Sender:   "@alice:example.com",
+		StateKey: ptr.Ptr("@alice:example.com"),
+		Content:  json.RawMessage(`{"membership":"join","displayname":"Alice"}`),
+	}, {
+		ID:      "$message",
+		Type:    "m.room.message",
+		Sender:  "@alice:example.com",
+		Content: json.RawMessage(`{"msgtype":"m.text","body":"hello <b>world</b>"}`),
+	}, {
+		ID:      "$emote",
+		Type:    "m.room.message",
+		Sender:  "@alice:example.com",
+		Content: json.RawMessage(`{"msgtype":"m.emote","body":"waves"}`),
+	}, {
+		ID:           "$reaction",
+		Type:         "m.reaction",
+		Sender:       "@alice:example.com",
+		Content:      json.RawMessage(`{"m.relates_to":{"rel_type":"m.annotation","event_id":"$message","key":"👍"}}`),
+		RelatesTo:    "$message",
+		RelationType: event.RelAnnotation,
+	}}
+	rowIDs := make([]database.EventRowID, len(events))
+	for i, evt := range events {
+		evt.RoomID = roomID
+		evt.Unsigned = json.RawMessage("{}")
+		evt.Timestamp = jsontime.UM(ts.Add(time.Duration(i) * time.Minute))
+		rowIDs[i], err = gmx.Client.DB.Event.Insert(ctx, evt)
+		if err != nil {
+			t.Fatalf("failed to insert event %s: %v", evt.ID, err)
+		}
+	}
+	_, err = gmx.Client.DB.Timeline.Append(ctx, roomID, rowIDs)
+	if err != nil {
+		t.Fatalf("failed to append events to timeline: %v", err)
+	}
+	return gmx
+}
+
+func TestGomuks_ExportRoom(t *testing.T) {
+	tests := []struct {
+		format      hicli.ExportFormat
+		wantContain []string
+		wantExclude []string
+	}{
+		{
+			format: hicli.ExportFormatJSON,
+			wantContain: []string{
+				`"room":{"room_id":"!room:example.com"`,
+				`"event_id":"$join"`,
+				`"event_id":"$message"`,
+				`"event_id":"$emote"`,
+				`"event_id":"$reaction"`,
+			},
+		},
+		{
+			format: hicli.ExportFormatHTML,
+			wantContain: []string{
+				"<title>Test &lt;room&gt;</title>",
+				"<p>Room for testing</p>",
+				// Profile changes are attributed to the name the user had before the event
+				"@alice:example.com joined the room</div>",
+				`<div class="content">hello &lt;b&gt;world&lt;/b&gt;</div>`,
+				`<div class="content">* Alice waves</div>`,
+				`<div class="reactions"><span>👍 1</span></div>`,
+				"<footer><p>3 events</p></footer>",
+				"</html>\n",
+			},
+			wantExclude: []string{"$reaction", "<b>world</b>"},
+		},
+		{
+			format: hicli.ExportFormatText,
+			wantContain: []string{
+				"Test <room> (!room:example.com)\nTopic: Room for testing\n",
+				"] * @alice:example.com joined the room\n",
+				"] Alice: hello <b>world</b> [👍 1]\n",
+				"] * Alice waves\n",
+			},
+			wantExclude: []string{"m.annotation"},
+		},
+	}
+	gmx := newExportTestGomuks(t)
+	for _, test := range tests {
+		t.Run(string(test.format), func(t *testing.T) {
+			var buf bytes.Buffer
+			params := &ExportParams{RoomID: "!room:example.com", Format: test.format}
+			err := gmx.ExportRoom(context.Background(), params, &buf, func(hicli.ExportStage, int, int) {})
+			if err != nil {
+				t.Fatalf("ExportRoom() error = %v", err)
+			}
+			output := buf.String()
+			if test.format == hicli.ExportFormatJSON && !json.Valid(buf.Bytes()) {
+				t.Errorf("JSON export isn't valid JSON:\n%s", output)
+			}
+			for _, want := range test.wantContain {
+				if !strings.Contains(output, want) {
+					t.Errorf("export doesn't contain %q:\n%s", want, output)
+				}
+			}
+			for _, exclude := range test.wantExclude {
+				if strings.Contains(output, exclude) {
+					t.Errorf("export contains %q:\n%s", exclude, output)
+				}
+			}
+		})
+	}
+}
@@ -37,6 +37,7 @@ import (
 	"go.mau.fi/util/exerrors"
 	"go.mau.fi/util/exzerolog"
 	"golang.org/x/net/http2"
+	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/gomuks/pkg/hicli"
 )
@@ -68,6 +69,15 @@ type Gomuks struct {
 	eventListeners     map[uint64]func(*hicli.JSONCommand)
 	nextListenerID     uint64
 	eventListenersLock sync.RWMutex
+
+	uploads      map[string]*pendingUpload
+	asyncUploads map[string]*asyncUpload
+	uploadsLock  sync.Mutex
+
+	exports     map[string]*exportJob
+	exportsLock sync.Mutex
+
+	stopWebhooks context.CancelFunc
 }
 
 func NewGomuks() *Gomuks {
@@ -75,6 +85,9 @@ func NewGomuks() *Gomuks {
 		stopChan:         make(chan struct{}),
 		eventListeners:   make(map[uint64]func(*hicli.JSONCommand)),
 		websocketClosers: make(map[uint64]WebsocketCloseFunc),
+		uploads:          make(map[string]*pendingUpload),
+		asyncUploads:     make(map[string]*asyncUpload),
+		exports:          make(map[string]*exportJob),
 	}
 }
 
@@ -156,6 +169,18 @@ func (gmx *Gomuks) SetupLog() {
 }
 
 func (gmx *Gomuks) StartClient() {
+	userID := gmx.initClient()
+	gmx.StartWebhooks()
+	err := gmx.Client.Start(gmx.Log.WithContext(context.Background()), userID, nil)
+	if err != nil {
+		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to start client")
+		os.Exit(12)
+	}
+	gmx.Log.Info().Stringer("user_id", userID).Msg("Client started")
+}
+
+// initClient opens the database and creates the client, but doesn't start it. It returns the ID of the stored user.
+func (gmx *Gomuks) initClient() id.UserID {
 	hicli.HTMLSanitizerImgSrcTemplate = "_gomuks/media/%s/%s?encrypted=false"
 	rawDB, err := dbutil.NewFromConfig("gomuks", dbutil.Config{
 		PoolConfig: dbutil.PoolConfig{
@@ -177,6 +202,7 @@ func (gmx *Gomuks) StartClient() {
 		[]byte("meow"),
 		hicli.JSONEventHandler(gmx.OnEvent).HandleEvent,
 	)
+	gmx.Client.PendingUploadResult = gmx.pendingUploadResult
 	httpClient := gmx.Client.Client.Client
 	httpClient.Transport.(*http.Transport).ForceAttemptHTTP2 = false
 	if !gmx.Config.Matrix.DisableHTTP2 {
@@ -191,12 +217,7 @@ func (gmx *Gomuks) StartClient() {
 		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to get first user ID")
 		os.Exit(11)
 	}
-	err = gmx.Client.Start(ctx, userID, nil)
-	if err != nil {
-		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to start client")
-		os.Exit(12)
-	}
-	gmx.Log.Info().Stringer("user_id", userID).Msg("Client started")
+	return userID
 }
 
 func (gmx *Gomuks) Stop() {
@@ -221,6 +242,8 @@ func (gmx *Gomuks) DirectStop() {
 	for _, closer := range closers {
 		closer(websocket.StatusServiceRestart, "Server shutting down")
 	}
+	gmx.stopAsyncUploads()
+	gmx.StopWebhooks()
 	gmx.Client.Stop()
 	err := gmx.Server.Close()
 	if err != nil {
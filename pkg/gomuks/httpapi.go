@@ -0,0 +1,178 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exerrors"
+	"maunium.net/go/mautrix"
+
+	"go.mau.fi/gomuks/pkg/hicli"
+)
+
+const (
+	maxHTTPCommandSize = 128 * 1024
+	sseQueueSize       = 128
+	sseKeepalivePeriod = 30 * time.Second
+)
+
+var (
+	ErrCommandFailed   = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.COMMAND_FAILED", StatusCode: http.StatusInternalServerError}
+	ErrCommandTooLarge = mautrix.RespError{ErrCode: mautrix.MTooLarge.ErrCode, Err: "Request body too large", StatusCode: http.StatusRequestEntityTooLarge}
+)
+
+// HTTP commands use negative request IDs so that they don't conflict with IDs chosen by websocket clients.
+var httpCommandCounter atomic.Int64
+
+// HandleHTTPCommand runs a single JSON command, the same way as if it was sent through the websocket.
+// The request body is used as the command data and the response data is returned as the response body.
+func (gmx *Gomuks) HandleHTTPCommand(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPCommandSize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			ErrCommandTooLarge.Write(w)
+		} else {
+			mautrix.MBadJSON.WithMessage(fmt.Sprintf("Failed to read request body: %v", err)).Write(w)
+		}
+		return
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		data = emptyObject
+	} else if !json.Valid(data) {
+		mautrix.MNotJSON.WithMessage("Request body is not valid JSON").Write(w)
+		return
+	}
+	cmd := &hicli.JSONCommand{
+		Command:   r.PathValue("command"),
+		RequestID: -httpCommandCounter.Add(1),
+		Data:      data,
+	}
+	zerolog.Ctx(r.Context()).Trace().
+		Int64("req_id", cmd.RequestID).
+		Str("command", cmd.Command).
+		RawJSON("data", cmd.Data).
+		Msg("Received HTTP command")
+	resp := gmx.Client.SubmitJSONCommand(r.Context(), cmd)
+	if r.Context().Err() != nil {
+		return
+	}
+	if resp.Command == "error" {
+		var errMsg string
+		_ = json.Unmarshal(resp.Data, &errMsg)
+		ErrCommandFailed.WithMessage(errMsg).Write(w)
+		return
+	}
+	respData := resp.Data
+	if respData == nil {
+		respData = emptyObject
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(respData)
+}
+
+// HandleEventStream streams the same events as the websocket using server-sent events.
+// Each event uses the command name as the SSE event type and the full JSON command as the data.
+func (gmx *Gomuks) HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	log := zerolog.Ctx(r.Context())
+	rc := http.NewResponseController(w)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	evts := make(chan *hicli.JSONCommand, sseQueueSize)
+	unsubscribe := gmx.SubscribeEvents(func(_ websocket.StatusCode, _ string) {
+		cancel()
+	}, func(evt *hicli.JSONCommand) {
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case evts <- evt:
+		default:
+			log.Warn().Msg("Event queue full, closing event stream")
+			cancel()
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Err(err).Msg("Failed to flush event stream headers")
+		return
+	}
+	log.Info().Msg("Started new event stream")
+	defer log.Debug().Msg("Event stream closed")
+
+	writeEvent := func(cmd *hicli.JSONCommand) bool {
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			log.Err(err).Str("command", cmd.Command).Msg("Failed to marshal event for event stream")
+			return true
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", cmd.Command, data)
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to write to event stream")
+			return false
+		}
+		return true
+	}
+	ok := writeEvent(&hicli.JSONCommand{
+		Command: "client_state",
+		Data:    exerrors.Must(json.Marshal(gmx.Client.State())),
+	}) && writeEvent(&hicli.JSONCommand{
+		Command: "sync_status",
+		Data:    exerrors.Must(json.Marshal(gmx.Client.SyncStatus.Load())),
+	})
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(sseKeepalivePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case evt := <-evts:
+			if !writeEvent(evt) {
+				return
+			}
+		case <-ticker.C:
+			// Comments are ignored by clients, but keep proxies from closing idle connections
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/rs/zerolog"
+	"golang.org/x/image/draw"
+
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/gomuks/pkg/blurhash"
+)
+
+const (
+	// Images larger than this won't be decoded at all to avoid using too much memory
+	maxDecodePixels = 64 * 1000 * 1000
+	// Thumbnails will be generated at this size if the original image is larger
+	thumbnailMaxSize = 800
+	// Images are downscaled to this size before calculating the blurhash
+	blurhashMaxSize = 64
+
+	defaultJPEGQuality   = 90
+	thumbnailJPEGQuality = 80
+)
+
+type imageUploadOptions struct {
+	StripMetadata bool
+	MaxDimension  int
+	Quality       int
+	Thumbnail     bool
+}
+
+func parseImageUploadOptions(query url.Values) (opts imageUploadOptions) {
+	opts.StripMetadata, _ = strconv.ParseBool(query.Get("strip_metadata"))
+	opts.Thumbnail, _ = strconv.ParseBool(query.Get("thumbnail"))
+	opts.MaxDimension, _ = strconv.Atoi(query.Get("max_dimension"))
+	opts.Quality, _ = strconv.Atoi(query.Get("quality"))
+	opts.Quality = min(max(opts.Quality, 0), 100)
+	return
+}
+
+func (opts *imageUploadOptions) needsReencode() bool {
+	return opts.StripMetadata || opts.MaxDimension > 0 || opts.Quality > 0
+}
+
+var (
+	errImageTooLarge            = errors.New("image is too large to decode")
+	errStripMetadataUnsupported = errors.New("stripping metadata is not supported for this file type")
+)
+
+// decodeImageConfig reads the dimensions of the given image without decoding it.
+// The dimensions are swapped if the EXIF orientation of a JPEG says the image is rotated 90°.
+func decodeImageConfig(file io.ReadSeeker, mimeType string) (width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to decode image config: %w", err)
+	}
+	width, height = cfg.Width, cfg.Height
+	if mimeType == "image/jpeg" {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to seek to start of file: %w", err)
+		}
+		if readJPEGOrientation(bufio.NewReader(file)) >= 5 {
+			width, height = height, width
+		}
+	}
+	return
+}
+
+// decodeImage decodes the given image and applies the EXIF orientation if the image is a JPEG.
+func decodeImage(file io.ReadSeeker, mimeType string) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %w", err)
+	} else if cfg.Width*cfg.Height > maxDecodePixels {
+		return nil, errImageTooLarge
+	}
+	orientation := 1
+	if mimeType == "image/jpeg" {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek to start of file: %w", err)
+		}
+		orientation = readJPEGOrientation(bufio.NewReader(file))
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seek to start of file: %w", err)
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return applyOrientation(img, orientation), nil
+}
+
+// reencodeImage decodes the image at the given path and writes it back in the same place with metadata removed,
+// optionally downscaling it and changing the JPEG quality. The checksum of the new file is returned along with
+// a blurhash of the image.
+//
+// Only JPEG and PNG images are supported. If metadata stripping was requested for any other type of file,
+// an error is returned, otherwise the file is left untouched and a nil checksum is returned.
+func (gmx *Gomuks) reencodeImage(ctx context.Context, path string, opts imageUploadOptions) ([]byte, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	mimeType, err := mimetype.DetectReader(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to detect mime type: %w", err)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to seek to start of file: %w", err)
+	}
+	if !mimeType.Is("image/jpeg") && !mimeType.Is("image/png") {
+		if opts.StripMetadata {
+			return nil, "", fmt.Errorf("%w (%s)", errStripMetadataUnsupported, mimeType.String())
+		}
+		zerolog.Ctx(ctx).Debug().Str("mime_type", mimeType.String()).Msg("Not re-encoding unsupported image type")
+		return nil, "", nil
+	}
+	img, err := decodeImage(file, mimeType.String())
+	if err != nil {
+		return nil, "", err
+	}
+	_ = file.Close()
+	if opts.MaxDimension > 0 {
+		img = downscaleImage(img, opts.MaxDimension, draw.CatmullRom)
+	}
+	blurhashStr, err := calculateBlurhash(img)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to calculate blurhash")
+	}
+	tempFile, err := os.CreateTemp(gmx.TempDir, "reencode-*")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+	hasher := sha256.New()
+	writer := bufio.NewWriter(io.MultiWriter(tempFile, hasher))
+	if mimeType.Is("image/jpeg") {
+		quality := opts.Quality
+		if quality == 0 {
+			quality = defaultJPEGQuality
+		}
+		err = jpeg.Encode(writer, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(writer, img)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode image: %w", err)
+	}
+	err = writer.Flush()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to write image: %w", err)
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to close temp file: %w", err)
+	}
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to replace original file: %w", err)
+	}
+	return hasher.Sum(nil), blurhashStr, nil
+}
+
+// generateImageThumbnail calculates a blurhash of the image and uploads a downscaled thumbnail
+// if the image is larger than the thumbnail size.
+func (gmx *Gomuks) generateImageThumbnail(ctx context.Context, filePath string, encrypt bool, saveInto *event.FileInfo) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	img, err := decodeImage(file, saveInto.MimeType)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	img = downscaleImage(img, thumbnailMaxSize, draw.ApproxBiLinear)
+	saveInto.AnoaBlurhash, err = calculateBlurhash(img)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to calculate blurhash")
+	}
+	if saveInto.Width <= thumbnailMaxSize && saveInto.Height <= thumbnailMaxSize {
+		return nil
+	}
+	var buf bytes.Buffer
+	mimeType := "image/jpeg"
+	if saveInto.MimeType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		// Other formats may have transparency, so use PNG for them
+		mimeType = "image/png"
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	tempPath := filepath.Join(gmx.TempDir, "thumbnail-"+random.String(12))
+	defer os.Remove(tempPath)
+	err = os.WriteFile(tempPath, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write thumbnail: %w", err)
+	}
+	return gmx.uploadThumbnail(ctx, tempPath, mimeType, encrypt, saveInto)
+}
+
+func calculateBlurhash(img image.Image) (string, error) {
+	img = downscaleImage(img, blurhashMaxSize, draw.ApproxBiLinear)
+	bounds := img.Bounds()
+	if bounds.Dx() >= bounds.Dy() {
+		return blurhash.Encode(4, 3, img)
+	}
+	return blurhash.Encode(3, 4, img)
+}
+
+func downscaleImage(img image.Image, maxSize int, scaler draw.Scaler) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return img
+	}
+	if width > height {
+		height = max(height*maxSize/width, 1)
+		width = maxSize
+	} else {
+		width = max(width*maxSize/height, 1)
+		height = maxSize
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	scaler.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// applyOrientation rotates and/or flips the image according to the given EXIF orientation value.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := srcWidth, srcHeight
+	if orientation >= 5 {
+		dstWidth, dstHeight = srcHeight, srcWidth
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Flip horizontally
+				sx, sy = srcWidth-1-x, y
+			case 3: // Rotate 180°
+				sx, sy = srcWidth-1-x, srcHeight-1-y
+			case 4: // Flip vertically
+				sx, sy = x, srcHeight-1-y
+			case 5: // Transpose
+				sx, sy = y, x
+			case 6: // Rotate 90° clockwise
+				sx, sy = y, srcHeight-1-x
+			case 7: // Transverse
+				sx, sy = srcWidth-1-y, srcHeight-1-x
+			case 8: // Rotate 90° counter-clockwise
+				sx, sy = srcWidth-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+const exifOrientationTag = 0x0112
+
+// readJPEGOrientation finds the orientation tag in the EXIF data of a JPEG file.
+// If the orientation can't be found, 1 (i.e. no transformation) is returned.
+func readJPEGOrientation(reader io.Reader) int {
+	var marker [2]byte
+	if _, err := io.ReadFull(reader, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(reader, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		// Start of scan or end of image, there won't be any more metadata
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+		var segmentLength uint16
+		if err := binary.Read(reader, binary.BigEndian, &segmentLength); err != nil || segmentLength < 2 {
+			return 1
+		}
+		segment := make([]byte, segmentLength-2)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			return 1
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseEXIFOrientation(segment[6:])
+		}
+	}
+}
+
+func parseEXIFOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifdOffset := int(order.Uint32(tiff[4:8]))
+	if ifdOffset+2 > len(tiff) || ifdOffset < 8 {
+		return 1
+	}
+	entryCount := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entryCount; i++ {
+		entryOffset := ifdOffset + 2 + i*12
+		if entryOffset+12 > len(tiff) {
+			break
+		}
+		entry := tiff[entryOffset : entryOffset+12]
+		if order.Uint16(entry[0:2]) == exifOrientationTag {
+			return int(order.Uint16(entry[8:10]))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,235 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// makeTIFF builds a minimal TIFF header with a single IFD containing the given tag.
+func makeTIFF(order binary.ByteOrder, tag, value uint16) []byte {
+	buf := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(buf, "II")
+	} else {
+		copy(buf, "MM")
+	}
+	order.PutUint16(buf[2:], 42)
+	order.PutUint32(buf[4:], 8)
+	order.PutUint16(buf[8:], 1)
+	entry := buf[10:22]
+	order.PutUint16(entry[0:], tag)
+	order.PutUint16(entry[2:], 3) // SHORT
+	order.PutUint32(entry[4:], 1)
+	order.PutUint16(entry[8:], value)
+	return buf
+}
+
+func TestParseEXIFOrientation(t *testing.T) {
+	truncated := makeTIFF(binary.LittleEndian, exifOrientationTag, 6)
+	badOffset := makeTIFF(binary.BigEndian, exifOrientationTag, 6)
+	binary.BigEndian.PutUint32(badOffset[4:], 1000)
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"Little endian", makeTIFF(binary.LittleEndian, exifOrientationTag, 6), 6},
+		{"Big endian", makeTIFF(binary.BigEndian, exifOrientationTag, 8), 8},
+		{"No orientation tag", makeTIFF(binary.LittleEndian, 0x010F, 3), 1},
+		{"Invalid byte order", append([]byte("XX"), makeTIFF(binary.LittleEndian, exifOrientationTag, 6)[2:]...), 1},
+		{"Too short", []byte("II*\x00"), 1},
+		{"Empty", nil, 1},
+		{"Truncated entry", truncated[:len(truncated)-8], 1},
+		{"IFD offset out of bounds", badOffset, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseEXIFOrientation(test.tiff); got != test.want {
+				t.Errorf("parseEXIFOrientation() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func makeJPEGSegment(marker byte, data []byte) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(data)+2))
+	return append(seg, data...)
+}
+
+func TestReadJPEGOrientation(t *testing.T) {
+	soi := []byte{0xFF, 0xD8}
+	exif := append([]byte("Exif\x00\x00"), makeTIFF(binary.BigEndian, exifOrientationTag, 6)...)
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"EXIF segment", concat(soi, makeJPEGSegment(0xE1, exif)), 6},
+		{"EXIF after JFIF segment", concat(soi, makeJPEGSegment(0xE0, []byte("JFIF\x00")), makeJPEGSegment(0xE1, exif)), 6},
+		{"XMP APP1 segment is skipped", concat(soi, makeJPEGSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00")), makeJPEGSegment(0xE1, exif)), 6},
+		{"EXIF after start of scan is ignored", concat(soi, makeJPEGSegment(0xDA, []byte{0}), makeJPEGSegment(0xE1, exif)), 1},
+		{"No EXIF", concat(soi, makeJPEGSegment(0xE0, []byte("JFIF\x00"))), 1},
+		{"Not a JPEG", []byte("\x89PNG\r\n\x1a\n"), 1},
+		{"Truncated segment", concat(soi, makeJPEGSegment(0xE1, exif)[:10]), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := readJPEGOrientation(bytes.NewReader(test.data)); got != test.want {
+				t.Errorf("readJPEGOrientation() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 2x1 image: red on the left, blue on the right
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(0, 0, red)
+	src.SetNRGBA(1, 0, blue)
+	tests := []struct {
+		orientation int
+		wantSize    image.Point
+		// Expected colors in row-major order
+		want []color.NRGBA
+	}{
+		{1, image.Pt(2, 1), []color.NRGBA{red, blue}},
+		{2, image.Pt(2, 1), []color.NRGBA{blue, red}},
+		{3, image.Pt(2, 1), []color.NRGBA{blue, red}},
+		{4, image.Pt(2, 1), []color.NRGBA{red, blue}},
+		{5, image.Pt(1, 2), []color.NRGBA{red, blue}},
+		{6, image.Pt(1, 2), []color.NRGBA{red, blue}},
+		{7, image.Pt(1, 2), []color.NRGBA{blue, red}},
+		{8, image.Pt(1, 2), []color.NRGBA{blue, red}},
+		{9, image.Pt(2, 1), []color.NRGBA{red, blue}},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.orientation), func(t *testing.T) {
+			img := applyOrientation(src, test.orientation)
+			if size := img.Bounds().Size(); size != test.wantSize {
+				t.Fatalf("applyOrientation() size = %v, want %v", size, test.wantSize)
+			}
+			i := 0
+			for y := 0; y < test.wantSize.Y; y++ {
+				for x := 0; x < test.wantSize.X; x++ {
+					if got := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); got != test.want[i] {
+						t.Errorf("pixel (%d, %d) = %v, want %v", x, y, got, test.want[i])
+					}
+					i++
+				}
+			}
+		})
+	}
+}
+
+func TestDownscaleImage(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    image.Point
+		maxSize int
+		want    image.Point
+	}{
+		{"Small image is unchanged", image.Pt(100, 50), 800, image.Pt(100, 50)},
+		{"Landscape", image.Pt(1600, 900), 800, image.Pt(800, 450)},
+		{"Portrait", image.Pt(900, 1600), 800, image.Pt(450, 800)},
+		{"Very wide keeps at least one pixel", image.Pt(10000, 1), 100, image.Pt(100, 1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rectangle{Max: test.size})
+			if got := downscaleImage(img, test.maxSize, draw.ApproxBiLinear).Bounds().Size(); got != test.want {
+				t.Errorf("downscaleImage() size = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseImageUploadOptions(t *testing.T) {
+	tests := []struct {
+		query        string
+		want         imageUploadOptions
+		wantReencode bool
+	}{
+		{"", imageUploadOptions{}, false},
+		{"thumbnail=true", imageUploadOptions{Thumbnail: true}, false},
+		{"strip_metadata=true", imageUploadOptions{StripMetadata: true}, true},
+		{"max_dimension=1024", imageUploadOptions{MaxDimension: 1024}, true},
+		{"quality=150", imageUploadOptions{Quality: 100}, true},
+		{"quality=-5", imageUploadOptions{}, false},
+		{"strip_metadata=maybe&max_dimension=abc", imageUploadOptions{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(test.query)
+			opts := parseImageUploadOptions(query)
+			if opts != test.want {
+				t.Errorf("parseImageUploadOptions() = %+v, want %+v", opts, test.want)
+			}
+			if got := opts.needsReencode(); got != test.wantReencode {
+				t.Errorf("needsReencode() = %v, want %v", got, test.wantReencode)
+			}
+		})
+	}
+}
+
+func TestReencodeImage_Unsupported(t *testing.T) {
+	gmx := &Gomuks{TempDir: t.TempDir()}
+	path := filepath.Join(gmx.TempDir, "image.gif")
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black}), nil); err != nil {
+		t.Fatalf("failed to encode gif: %v", err)
+	} else if err = os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("failed to write gif: %v", err)
+	}
+	tests := []struct {
+		name    string
+		opts    imageUploadOptions
+		wantErr error
+	}{
+		{"Strip metadata is an error", imageUploadOptions{StripMetadata: true}, errStripMetadataUnsupported},
+		{"Downscaling is skipped", imageUploadOptions{MaxDimension: 2}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checksum, _, err := gmx.reencodeImage(context.Background(), path, test.opts)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("reencodeImage() error = %v, want %v", err, test.wantErr)
+			} else if checksum != nil {
+				t.Errorf("reencodeImage() returned a checksum for an unsupported image")
+			}
+		})
+	}
+}
@@ -34,6 +34,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/rs/zerolog"
@@ -347,26 +348,72 @@ func (gmx *Gomuks) DownloadMedia(w http.ResponseWriter, r *http.Request) {
 
 func (gmx *Gomuks) UploadMedia(w http.ResponseWriter, r *http.Request) {
 	log := hlog.FromRequest(r)
-	tempFile, err := os.CreateTemp(gmx.TempDir, "upload-*")
-	if err != nil {
+	upload, err := gmx.newPendingUpload(r.URL.Query().Get("upload_id"))
+	if errors.Is(err, ErrUploadInUse) {
+		ErrUploadInUse.Write(w)
+		return
+	} else if err != nil {
 		log.Err(err).Msg("Failed to create temporary file")
 		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to create temp file: %v", err)).Write(w)
 		return
 	}
-	defer func() {
-		_ = tempFile.Close()
-		_ = os.Remove(tempFile.Name())
-	}()
-	hasher := sha256.New()
-	_, err = io.Copy(tempFile, io.TeeReader(r.Body, hasher))
+	defer gmx.removePendingUpload(upload)
+	writer, err := upload.reserveWrite(0)
+	if err == nil {
+		_, err = writer.copyFrom(w, r.Body)
+	}
 	if err != nil {
 		log.Err(err).Msg("Failed to copy upload media to temporary file")
 		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to copy media to temp file: %v", err)).Write(w)
 		return
 	}
-	_ = tempFile.Close()
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	if upload.removed {
+		ErrUploadNotFound.Write(w)
+		return
+	}
+	gmx.finishUpload(w, r, upload)
+}
 
-	checksum := hasher.Sum(nil)
+// finishUpload processes a fully received upload and sends it to the homeserver.
+// The caller must hold the upload lock.
+func (gmx *Gomuks) finishUpload(w http.ResponseWriter, r *http.Request, upload *pendingUpload) {
+	log := hlog.FromRequest(r)
+	ctx, cancel := upload.wrapContext(r.Context())
+	defer cancel()
+	_ = upload.file.Close()
+	checksum, err := hashFile(upload.Path)
+	if err != nil {
+		log.Err(err).Msg("Failed to hash upload media")
+		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to hash media: %v", err)).Write(w)
+		return
+	}
+	voice, _ := strconv.ParseBool(r.URL.Query().Get("voice"))
+	var waveform []int
+	var blurhash string
+	imageOpts := parseImageUploadOptions(r.URL.Query())
+	if voice {
+		checksum, waveform, err = gmx.convertVoiceMessage(ctx, upload.Path)
+		if err != nil {
+			log.Err(err).Msg("Failed to convert voice message")
+			mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to convert voice message: %v", err)).Write(w)
+			return
+		}
+	} else if imageOpts.needsReencode() {
+		var newChecksum []byte
+		newChecksum, blurhash, err = gmx.reencodeImage(ctx, upload.Path, imageOpts)
+		if errors.Is(err, errStripMetadataUnsupported) {
+			mautrix.MInvalidParam.WithMessage(err.Error()).Write(w)
+			return
+		} else if err != nil {
+			log.Err(err).Msg("Failed to re-encode image")
+			mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to re-encode image: %v", err)).Write(w)
+			return
+		} else if newChecksum != nil {
+			checksum = newChecksum
+		}
+	}
 	cachePath := gmx.cacheEntryToPath(checksum)
 	if _, err = os.Stat(cachePath); err == nil {
 		log.Debug().Str("path", cachePath).Msg("Media already exists in cache, removing temp file")
@@ -377,7 +424,7 @@ func (gmx *Gomuks) UploadMedia(w http.ResponseWriter, r *http.Request) {
 			mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to create cache directory: %v", err)).Write(w)
 			return
 		}
-		err = os.Rename(tempFile.Name(), cachePath)
+		err = os.Rename(upload.Path, cachePath)
 		if err != nil {
 			log.Err(err).Msg("Failed to rename temporary file")
 			mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to rename temp file: %v", err)).Write(w)
@@ -392,7 +439,7 @@ func (gmx *Gomuks) UploadMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msgType, info, defaultFileName, err := gmx.generateFileInfo(r.Context(), cacheFile)
+	msgType, info, defaultFileName, err := gmx.generateFileInfo(ctx, cacheFile)
 	if err != nil {
 		log.Err(err).Msg("Failed to generate file info")
 		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to generate file info: %v", err)).Write(w)
@@ -400,13 +447,23 @@ func (gmx *Gomuks) UploadMedia(w http.ResponseWriter, r *http.Request) {
 	}
 	encrypt, _ := strconv.ParseBool(r.URL.Query().Get("encrypt"))
 	if msgType == event.MsgVideo {
-		err = gmx.generateVideoThumbnail(r.Context(), cacheFile.Name(), encrypt, info)
+		err = gmx.generateVideoThumbnail(ctx, cacheFile.Name(), encrypt, info)
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to generate video thumbnail")
 		}
+	} else if msgType == event.MsgImage && imageOpts.Thumbnail {
+		err = gmx.generateImageThumbnail(ctx, cacheFile.Name(), encrypt, info)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to generate image thumbnail")
+		}
+	}
+	if msgType == event.MsgImage && info.AnoaBlurhash == "" {
+		info.AnoaBlurhash = blurhash
 	}
 	fileName := r.URL.Query().Get("filename")
-	if fileName == "" {
+	if voice {
+		fileName = voiceMessageFileName(fileName)
+	} else if fileName == "" {
 		fileName = defaultFileName
 	}
 	content := &event.MessageEventContent{
@@ -415,57 +472,226 @@ func (gmx *Gomuks) UploadMedia(w http.ResponseWriter, r *http.Request) {
 		Info:     info,
 		FileName: fileName,
 	}
-	content.File, content.URL, err = gmx.uploadFile(r.Context(), checksum, cacheFile, encrypt, int64(info.Size), info.MimeType, fileName)
-	if err != nil {
+	if voice {
+		content.MSC1767Audio = &event.MSC1767Audio{
+			Duration: info.Duration,
+			Waveform: waveform,
+		}
+		content.MSC3245Voice = &event.MSC3245Voice{}
+	}
+	progress := gmx.makeUploadProgressFunc(upload.ID)
+	roomID := id.RoomID(r.URL.Query().Get("room_id"))
+	var async *asyncUpload
+	if versions := gmx.Client.Client.SpecVersions; versions != nil && versions.Supports(mautrix.FeatureAsyncUploads) {
+		content.File, content.URL, async, err = gmx.uploadFileAsync(ctx, upload.ID, checksum, cacheFile, encrypt, int64(info.Size), info.MimeType, fileName, progress)
+	} else {
+		content.File, content.URL, err = gmx.uploadFile(ctx, checksum, cacheFile, encrypt, int64(info.Size), info.MimeType, fileName, progress)
+	}
+	if errors.Is(context.Cause(ctx), errUploadCancelled) {
+		log.Debug().Msg("Upload was cancelled")
+		mautrix.MUnknown.WithMessage("Upload cancelled").Write(w)
+		return
+	} else if err != nil {
 		log.Err(err).Msg("Failed to upload media")
 		writeMaybeRespError(err, w)
 		return
 	}
-	exhttp.WriteJSONResponse(w, http.StatusOK, content)
+	if roomID == "" {
+		if async != nil {
+			// The message is sent later with the reserved media ID, and sending it waits for the upload to finish
+			async.detach()
+		}
+		exhttp.WriteJSONResponse(w, http.StatusOK, content)
+		return
+	}
+	content.Mentions = &event.Mentions{}
+	if replyTo := id.EventID(r.URL.Query().Get("reply_to")); replyTo != "" {
+		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(replyTo)
+	}
+	var uploadResult <-chan error
+	if async != nil {
+		async.sent.Store(true)
+		uploadResult = async.result()
+	}
+	dbEvt, err := gmx.Client.SendWithPendingUpload(ctx, roomID, event.EventMessage, content, uploadResult)
+	if err != nil {
+		if async != nil {
+			async.cancel(err)
+		}
+		log.Err(err).Msg("Failed to send uploaded media")
+		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to send event: %v", err)).Write(w)
+		return
+	}
+	if async != nil {
+		// The event has been sent, so the upload must continue even if the client disconnects now
+		async.detach()
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, dbEvt)
 }
 
-func (gmx *Gomuks) uploadFile(ctx context.Context, checksum []byte, cacheFile *os.File, encrypt bool, fileSize int64, mimeType, fileName string) (*event.EncryptedFileInfo, id.ContentURIString, error) {
+func newUploadCacheEntry(checksum []byte, encrypt bool, fileSize int64, mimeType, fileName string) *database.Media {
 	cm := &database.Media{
 		FileName: fileName,
 		MimeType: mimeType,
 		Size:     fileSize,
 		Hash:     (*[32]byte)(checksum),
 	}
-	var cacheReader io.ReadSeekCloser = cacheFile
 	if encrypt {
 		cm.EncFile = attachment.NewEncryptedFile()
+	}
+	return cm
+}
+
+func makeUploadRequest(cm *database.Media, cacheFile *os.File, progress func(uploaded, total int64)) mautrix.ReqUploadMedia {
+	var cacheReader io.ReadSeekCloser = cacheFile
+	mimeType, fileName := cm.MimeType, cm.FileName
+	if cm.EncFile != nil {
 		cacheReader = cm.EncFile.EncryptStream(cacheReader)
 		mimeType = "application/octet-stream"
 		fileName = ""
 	}
-	resp, err := gmx.Client.Client.UploadMedia(ctx, mautrix.ReqUploadMedia{
+	if progress != nil {
+		cacheReader = &progressReader{ReadSeekCloser: cacheReader, total: cm.Size, callback: progress}
+	}
+	return mautrix.ReqUploadMedia{
 		Content:       cacheReader,
-		ContentLength: fileSize,
+		ContentLength: cm.Size,
 		ContentType:   mimeType,
 		FileName:      fileName,
-	})
-	err2 := cacheReader.Close()
+	}
+}
+
+func (gmx *Gomuks) doUpload(ctx context.Context, cm *database.Media, req mautrix.ReqUploadMedia) error {
+	resp, err := gmx.Client.Client.UploadMedia(ctx, req)
+	err2 := req.Content.(io.Closer).Close()
 	if err != nil {
-		return nil, "", err
+		return err
 	} else if err2 != nil {
-		return nil, "", fmt.Errorf("failed to close cache reader: %w", err)
+		return fmt.Errorf("failed to close cache reader: %w", err)
 	}
-	cm.MXC = resp.ContentURI
-	err = gmx.Client.DB.Media.Put(ctx, cm)
+	if cm.MXC.IsEmpty() {
+		cm.MXC = resp.ContentURI
+	}
+	return nil
+}
+
+func (gmx *Gomuks) saveUploadCacheEntry(ctx context.Context, cm *database.Media) {
+	err := gmx.Client.DB.Media.Put(ctx, cm)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).
 			Stringer("mxc", cm.MXC).
-			Hex("checksum", checksum).
+			Hex("checksum", cm.Hash[:]).
 			Msg("Failed to save cache entry")
 	}
+}
+
+func uploadCacheEntryToContent(cm *database.Media) (*event.EncryptedFileInfo, id.ContentURIString) {
 	if cm.EncFile != nil {
 		return &event.EncryptedFileInfo{
 			EncryptedFile: *cm.EncFile,
-			URL:           resp.ContentURI.CUString(),
-		}, "", nil
+			URL:           cm.MXC.CUString(),
+		}, ""
 	} else {
-		return nil, resp.ContentURI.CUString(), nil
+		return nil, cm.MXC.CUString()
+	}
+}
+
+func (gmx *Gomuks) uploadFile(
+	ctx context.Context,
+	checksum []byte,
+	cacheFile *os.File,
+	encrypt bool,
+	fileSize int64,
+	mimeType, fileName string,
+	progress func(uploaded, total int64),
+) (*event.EncryptedFileInfo, id.ContentURIString, error) {
+	cm := newUploadCacheEntry(checksum, encrypt, fileSize, mimeType, fileName)
+	err := gmx.doUpload(ctx, cm, makeUploadRequest(cm, cacheFile, progress))
+	if err != nil {
+		return nil, "", err
+	}
+	gmx.saveUploadCacheEntry(ctx, cm)
+	fileInfo, url := uploadCacheEntryToContent(cm)
+	return fileInfo, url, nil
+}
+
+// uploadFileAsync reserves a media ID using MSC2246 and uploads the file in the background.
+// The upload is cancelled if the given context is done before the returned upload is detached,
+// and it can be cancelled later using the upload ID.
+func (gmx *Gomuks) uploadFileAsync(
+	ctx context.Context,
+	uploadID string,
+	checksum []byte,
+	cacheFile *os.File,
+	encrypt bool,
+	fileSize int64,
+	mimeType, fileName string,
+	progress func(uploaded, total int64),
+) (*event.EncryptedFileInfo, id.ContentURIString, *asyncUpload, error) {
+	createResp, err := gmx.Client.Client.CreateMXC(ctx)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to reserve media ID: %w", err)
+	}
+	cm := newUploadCacheEntry(checksum, encrypt, fileSize, mimeType, fileName)
+	cm.MXC = createResp.ContentURI
+	if cm.EncFile != nil {
+		// The event includes the hash of the encrypted file, so it has to be encrypted once before the real upload
+		err = precomputeEncryptedHash(cm.EncFile, cacheFile.Name())
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("failed to hash encrypted file: %w", err)
+		}
 	}
+	gmx.saveUploadCacheEntry(ctx, cm)
+	req := makeUploadRequest(cm, cacheFile, progress)
+	req.MXC = cm.MXC
+	uploadCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	upload := &asyncUpload{
+		mxc:    cm.MXC.CUString(),
+		done:   make(chan struct{}),
+		cancel: cancel,
+		detach: context.AfterFunc(ctx, func() {
+			cancel(context.Cause(ctx))
+		}),
+	}
+	gmx.addAsyncUpload(uploadID, upload)
+	go func() {
+		defer upload.detach()
+		defer cancel(nil)
+		err := gmx.doUpload(uploadCtx, cm, req)
+		if err != nil {
+			if cause := context.Cause(uploadCtx); cause != nil {
+				err = cause
+			}
+			log := zerolog.Ctx(uploadCtx)
+			log.Err(err).Stringer("mxc", cm.MXC).Msg("Failed to upload media to reserved media ID")
+			// Nothing will ever be uploaded to the reserved ID, so don't keep the cache entry around
+			if dbErr := gmx.Client.DB.Media.Delete(context.WithoutCancel(uploadCtx), cm.MXC); dbErr != nil {
+				log.Err(dbErr).Stringer("mxc", cm.MXC).Msg("Failed to delete cache entry of failed upload")
+			}
+		} else {
+			// Failed uploads are kept around until cleanup, so that sending the media later reports the error
+			gmx.removeAsyncUpload(uploadID, upload)
+		}
+		upload.err = err
+		upload.finishedAt = time.Now()
+		close(upload.done)
+	}()
+	fileInfo, url := uploadCacheEntryToContent(cm)
+	return fileInfo, url, upload, nil
+}
+
+func precomputeEncryptedHash(encFile *attachment.EncryptedFile, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	reader := encFile.EncryptStream(file)
+	_, err = io.Copy(io.Discard, reader)
+	err2 := reader.Close()
+	if err != nil {
+		return err
+	}
+	return err2
 }
 
 func (gmx *Gomuks) generateFileInfo(ctx context.Context, file *os.File) (event.MessageType, *event.FileInfo, string, error) {
@@ -491,12 +717,10 @@ func (gmx *Gomuks) generateFileInfo(ctx context.Context, file *os.File) (event.M
 	case "image":
 		msgType = event.MsgImage
 		defaultFileName = "image" + mimeType.Extension()
-		cfg, _, err := image.DecodeConfig(file)
+		info.Width, info.Height, err = decodeImageConfig(file, info.MimeType)
 		if err != nil {
 			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to decode image config")
 		}
-		info.Width = cfg.Width
-		info.Height = cfg.Height
 	case "video":
 		msgType = event.MsgVideo
 		defaultFileName = "video" + mimeType.Extension()
@@ -540,6 +764,10 @@ func (gmx *Gomuks) generateVideoThumbnail(ctx context.Context, filePath string,
 	if err != nil {
 		return err
 	}
+	return gmx.uploadThumbnail(ctx, tempPath, "image/jpeg", encrypt, saveInto)
+}
+
+func (gmx *Gomuks) uploadThumbnail(ctx context.Context, tempPath, mimeType string, encrypt bool, saveInto *event.FileInfo) error {
 	tempFile, err := os.Open(tempPath)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
@@ -555,7 +783,7 @@ func (gmx *Gomuks) generateVideoThumbnail(ctx context.Context, filePath string,
 		return fmt.Errorf("failed to hash file: %w", err)
 	}
 	thumbnailInfo := &event.FileInfo{
-		MimeType: "image/jpeg",
+		MimeType: mimeType,
 		Size:     int(fileInfo.Size()),
 	}
 	_, err = tempFile.Seek(0, io.SeekStart)
@@ -588,7 +816,11 @@ func (gmx *Gomuks) generateVideoThumbnail(ctx context.Context, filePath string,
 	if err != nil {
 		return fmt.Errorf("failed to open renamed file: %w", err)
 	}
-	saveInto.ThumbnailFile, saveInto.ThumbnailURL, err = gmx.uploadFile(ctx, checksum, tempFile, encrypt, fileInfo.Size(), "image/jpeg", "thumbnail.jpeg")
+	fileName := "thumbnail.jpeg"
+	if mimeType == "image/png" {
+		fileName = "thumbnail.png"
+	}
+	saveInto.ThumbnailFile, saveInto.ThumbnailURL, err = gmx.uploadFile(ctx, checksum, tempFile, encrypt, fileInfo.Size(), mimeType, fileName, nil)
 	if err != nil {
 		return fmt.Errorf("failed to upload: %w", err)
 	}
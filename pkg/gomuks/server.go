@@ -44,8 +44,18 @@ import (
 func (gmx *Gomuks) StartServer() {
 	api := http.NewServeMux()
 	api.HandleFunc("GET /websocket", gmx.HandleWebsocket)
+	api.HandleFunc("GET /events", gmx.HandleEventStream)
+	api.HandleFunc("POST /command/{command}", gmx.HandleHTTPCommand)
 	api.HandleFunc("POST /auth", gmx.Authenticate)
 	api.HandleFunc("POST /upload", gmx.UploadMedia)
+	api.HandleFunc("POST /upload/chunked", gmx.CreateChunkedUpload)
+	api.HandleFunc("GET /upload/chunked/{upload_id}", gmx.GetChunkedUpload)
+	api.HandleFunc("PUT /upload/chunked/{upload_id}", gmx.WriteChunkedUpload)
+	api.HandleFunc("POST /upload/chunked/{upload_id}/complete", gmx.CompleteChunkedUpload)
+	api.HandleFunc("DELETE /upload/{upload_id}", gmx.CancelUpload)
+	api.HandleFunc("POST /export", gmx.StartExport)
+	api.HandleFunc("GET /export/{export_id}", gmx.DownloadExport)
+	api.HandleFunc("DELETE /export/{export_id}", gmx.CancelExport)
 	api.HandleFunc("GET /sso", gmx.HandleSSOComplete)
 	api.HandleFunc("POST /sso", gmx.PrepareSSO)
 	api.HandleFunc("GET /media/{server}/{media_id}", gmx.DownloadMedia)
@@ -105,6 +115,7 @@ var (
 	ErrInvalidHeader = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.INVALID_HEADER", StatusCode: http.StatusForbidden}
 	ErrMissingCookie = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.MISSING_COOKIE", Err: "Missing gomuks_auth cookie", StatusCode: http.StatusUnauthorized}
 	ErrInvalidCookie = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.INVALID_COOKIE", Err: "Invalid gomuks_auth cookie", StatusCode: http.StatusUnauthorized}
+	ErrInvalidToken  = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.INVALID_TOKEN", Err: "Invalid API token", StatusCode: http.StatusUnauthorized}
 )
 
 type tokenData struct {
@@ -225,9 +236,28 @@ func isImageFetch(header http.Header) bool {
 		header.Get("Sec-Fetch-Dest") == "image"
 }
 
+func (gmx *Gomuks) validateAPIToken(authHeader string) bool {
+	token, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok || gmx.Config.Web.APIToken == "" {
+		return false
+	}
+	tokenHash := sha256.Sum256([]byte(token))
+	expectedTokenHash := sha256.Sum256([]byte(gmx.Config.Web.APIToken))
+	return hmac.Equal(tokenHash[:], expectedTokenHash[:])
+}
+
 func (gmx *Gomuks) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasPrefix(r.URL.Path, "/media") &&
+		if authHeader := r.Header.Get("Authorization"); gmx.Config.Web.APIToken != "" && strings.HasPrefix(authHeader, "Bearer ") {
+			// API tokens are meant for scripts, which don't send Sec-Fetch headers or cookies.
+			// They're disabled unless the user has set a token in the config.
+			if !gmx.validateAPIToken(authHeader) {
+				ErrInvalidToken.Write(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		} else if strings.HasPrefix(r.URL.Path, "/media") &&
 			isImageFetch(r.Header) &&
 			gmx.validateAuth(r.URL.Query().Get("image_auth"), true) &&
 			r.URL.Query().Get("encrypted") == "false" {
@@ -0,0 +1,85 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGomuks_ValidateAPIToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		header     string
+		want       bool
+	}{
+		{"Valid token", "meow", "Bearer meow", true},
+		{"Wrong token", "meow", "Bearer hmm", false},
+		{"Token prefix", "meow", "Bearer meo", false},
+		{"Token with extra data", "meow", "Bearer meow ", false},
+		{"Missing scheme", "meow", "meow", false},
+		{"Wrong scheme", "meow", "Basic meow", false},
+		{"Lowercase scheme", "meow", "bearer meow", false},
+		{"Empty header", "meow", "", false},
+		{"No token configured", "", "Bearer ", false},
+		{"No token configured with token", "", "Bearer meow", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gmx := &Gomuks{Config: Config{Web: WebConfig{APIToken: test.configured}}}
+			if got := gmx.validateAPIToken(test.header); got != test.want {
+				t.Errorf("validateAPIToken(%q) = %v, want %v", test.header, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGomuks_AuthMiddlewareAPIToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"Valid token", "meow", map[string]string{"Authorization": "Bearer meow"}, http.StatusOK},
+		{"Valid token with cross-site fetch metadata", "meow", map[string]string{"Authorization": "Bearer meow", "Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+		{"Invalid token", "meow", map[string]string{"Authorization": "Bearer hmm"}, ErrInvalidToken.StatusCode},
+		{"No token or cookie", "meow", nil, ErrMissingCookie.StatusCode},
+		{"Other auth scheme falls back to cookie", "meow", map[string]string{"Authorization": "Basic meow"}, ErrMissingCookie.StatusCode},
+		{"No token configured falls back to cookie", "", map[string]string{"Authorization": "Bearer meow"}, ErrMissingCookie.StatusCode},
+		{"No token configured with empty token", "", map[string]string{"Authorization": "Bearer "}, ErrMissingCookie.StatusCode},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gmx := &Gomuks{Config: Config{Web: WebConfig{APIToken: test.configured}}}
+			handler := gmx.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/sync", nil)
+			for key, value := range test.headers {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != test.wantStatus {
+				t.Errorf("AuthMiddleware() status = %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,470 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/exhttp"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli"
+)
+
+const (
+	// Chunked uploads that haven't been touched in this long are deleted
+	pendingUploadTimeout = 1 * time.Hour
+	// Minimum interval between upload_progress events for a single upload
+	uploadProgressInterval = 500 * time.Millisecond
+)
+
+var (
+	ErrUploadNotFound  = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.UPLOAD_NOT_FOUND", Err: "Upload not found", StatusCode: http.StatusNotFound}
+	ErrUploadInUse     = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.UPLOAD_IN_USE", Err: "Upload ID is already in use", StatusCode: http.StatusConflict}
+	ErrInvalidOffset   = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.INVALID_OFFSET", StatusCode: http.StatusRequestedRangeNotSatisfiable}
+	ErrUploadBusy      = mautrix.RespError{ErrCode: "FI.MAU.GOMUKS.UPLOAD_BUSY", Err: "Another request is already writing to the upload", StatusCode: http.StatusConflict}
+	errUploadCancelled = errors.New("upload cancelled")
+)
+
+type pendingUpload struct {
+	ID   string
+	Path string
+
+	file     *os.File
+	size     int64
+	lastUsed time.Time
+	removed  bool
+	// writing is set while a chunk is being copied into the file. The copy itself doesn't hold the lock,
+	// so this is used to reserve the file for a single writer at a time.
+	writing bool
+	lock    sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// asyncUpload is an MSC2246 upload that keeps running in the background after the event referencing it is sent.
+type asyncUpload struct {
+	mxc    id.ContentURIString
+	cancel context.CancelCauseFunc
+	// detach stops the upload from being cancelled when the request that started it ends.
+	detach func() bool
+	// sent is set when an event referencing the upload has been sent. Such uploads aren't cancelled on shutdown.
+	sent atomic.Bool
+
+	done       chan struct{}
+	err        error
+	finishedAt time.Time
+}
+
+// result returns a channel that receives the error of the upload once it finishes.
+func (upload *asyncUpload) result() <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		<-upload.done
+		ch <- upload.err
+	}()
+	return ch
+}
+
+func (upload *asyncUpload) finished() bool {
+	select {
+	case <-upload.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type respChunkedUpload struct {
+	UploadID string `json:"upload_id"`
+	Size     int64  `json:"size"`
+}
+
+func (gmx *Gomuks) newPendingUpload(uploadID string) (*pendingUpload, error) {
+	if uploadID == "" {
+		uploadID = random.String(16)
+	}
+	gmx.uploadsLock.Lock()
+	defer gmx.uploadsLock.Unlock()
+	gmx.cleanupPendingUploads()
+	if _, exists := gmx.uploads[uploadID]; exists {
+		return nil, ErrUploadInUse
+	} else if async, exists := gmx.asyncUploads[uploadID]; exists && !async.finished() {
+		return nil, ErrUploadInUse
+	}
+	tempFile, err := os.CreateTemp(gmx.TempDir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	upload := &pendingUpload{
+		ID:       uploadID,
+		Path:     tempFile.Name(),
+		file:     tempFile,
+		lastUsed: time.Now(),
+	}
+	upload.ctx, upload.cancel = context.WithCancelCause(context.Background())
+	gmx.uploads[uploadID] = upload
+	return upload, nil
+}
+
+func (gmx *Gomuks) getPendingUpload(uploadID string) *pendingUpload {
+	gmx.uploadsLock.Lock()
+	defer gmx.uploadsLock.Unlock()
+	return gmx.uploads[uploadID]
+}
+
+func (gmx *Gomuks) getAsyncUpload(uploadID string) *asyncUpload {
+	gmx.uploadsLock.Lock()
+	defer gmx.uploadsLock.Unlock()
+	return gmx.asyncUploads[uploadID]
+}
+
+func (gmx *Gomuks) addAsyncUpload(uploadID string, upload *asyncUpload) {
+	gmx.uploadsLock.Lock()
+	gmx.asyncUploads[uploadID] = upload
+	gmx.uploadsLock.Unlock()
+}
+
+func (gmx *Gomuks) removeAsyncUpload(uploadID string, upload *asyncUpload) {
+	gmx.uploadsLock.Lock()
+	if gmx.asyncUploads[uploadID] == upload {
+		delete(gmx.asyncUploads, uploadID)
+	}
+	gmx.uploadsLock.Unlock()
+}
+
+// pendingUploadResult finds the background upload of the given media ID and marks it as sent.
+// Uploads that already finished successfully aren't tracked, so nil is returned for them.
+func (gmx *Gomuks) pendingUploadResult(mxc id.ContentURIString) <-chan error {
+	gmx.uploadsLock.Lock()
+	defer gmx.uploadsLock.Unlock()
+	for _, upload := range gmx.asyncUploads {
+		if upload.mxc == mxc {
+			upload.sent.Store(true)
+			return upload.result()
+		}
+	}
+	return nil
+}
+
+// stopAsyncUploads cancels background uploads that haven't been sent yet. Uploads referenced by a sent event
+// are allowed to finish, as the event already points at the reserved media ID.
+func (gmx *Gomuks) stopAsyncUploads() {
+	gmx.uploadsLock.Lock()
+	var sent []*asyncUpload
+	for _, upload := range gmx.asyncUploads {
+		if upload.finished() {
+			continue
+		} else if upload.sent.Load() {
+			sent = append(sent, upload)
+		} else {
+			upload.cancel(errUploadCancelled)
+		}
+	}
+	gmx.uploadsLock.Unlock()
+	if len(sent) > 0 {
+		gmx.Log.Info().Int("count", len(sent)).Msg("Waiting for background uploads of sent events to finish")
+		for _, upload := range sent {
+			<-upload.done
+		}
+	}
+}
+
+// cleanupPendingUploads removes chunked uploads that have been abandoned. The caller must hold uploadsLock.
+//
+// Uploads whose lock is held are being completed and are skipped. Chunk writers don't hold the lock,
+// so a writer that has stalled for longer than the timeout is aborted by cancelling the upload.
+// Failed background uploads are kept for the same time, so that sending an event with them reports the error.
+func (gmx *Gomuks) cleanupPendingUploads() {
+	for uploadID, upload := range gmx.asyncUploads {
+		if upload.finished() && time.Since(upload.finishedAt) > pendingUploadTimeout {
+			delete(gmx.asyncUploads, uploadID)
+		}
+	}
+	for uploadID, upload := range gmx.uploads {
+		if upload.lock.TryLock() {
+			if time.Since(upload.lastUsed) > pendingUploadTimeout {
+				upload.cancel(errUploadCancelled)
+				upload.remove()
+				delete(gmx.uploads, uploadID)
+			}
+			upload.lock.Unlock()
+		}
+	}
+}
+
+func (gmx *Gomuks) removePendingUpload(upload *pendingUpload) {
+	gmx.uploadsLock.Lock()
+	if gmx.uploads[upload.ID] == upload {
+		delete(gmx.uploads, upload.ID)
+	}
+	gmx.uploadsLock.Unlock()
+	upload.cancel(nil)
+	upload.lock.Lock()
+	upload.remove()
+	upload.lock.Unlock()
+}
+
+// remove deletes the temp file of the upload. The caller must hold the upload lock.
+func (upload *pendingUpload) remove() {
+	if upload.removed {
+		return
+	}
+	upload.removed = true
+	_ = upload.file.Close()
+	_ = os.Remove(upload.Path)
+}
+
+// wrapContext returns a context that is cancelled when either the given context or the upload is cancelled.
+func (upload *pendingUpload) wrapContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(upload.ctx, func() {
+		cancel(context.Cause(upload.ctx))
+	})
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+func (gmx *Gomuks) makeUploadProgressFunc(uploadID string) func(uploaded, total int64) {
+	var lastSent time.Time
+	return func(uploaded, total int64) {
+		if uploaded < total && time.Since(lastSent) < uploadProgressInterval {
+			return
+		}
+		lastSent = time.Now()
+		gmx.Client.EventHandler(&hicli.UploadProgress{
+			UploadID: uploadID,
+			Uploaded: uploaded,
+			Total:    total,
+		})
+	}
+}
+
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// chunkWriter writes to a pending upload file at a fixed offset without holding the upload lock for the whole copy.
+type chunkWriter struct {
+	upload *pendingUpload
+	offset int64
+}
+
+func (cw *chunkWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.upload.file.WriteAt(p, cw.offset)
+	cw.offset += int64(n)
+	cw.upload.lock.Lock()
+	cw.upload.size = cw.offset
+	cw.upload.lastUsed = time.Now()
+	cw.upload.lock.Unlock()
+	return
+}
+
+// copyFrom copies the request body into the upload file and releases the write reservation afterwards.
+// Cancelling the upload closes the file, which makes any further writes fail,
+// and the read deadline unblocks the copy if it's waiting for the client.
+func (cw *chunkWriter) copyFrom(w http.ResponseWriter, body io.Reader) (int64, error) {
+	rc := http.NewResponseController(w)
+	stopAbort := context.AfterFunc(cw.upload.ctx, func() {
+		_ = rc.SetReadDeadline(time.Now())
+	})
+	written, err := io.Copy(cw, body)
+	stopAbort()
+	cw.upload.lock.Lock()
+	cw.upload.writing = false
+	cw.upload.lastUsed = time.Now()
+	cw.upload.lock.Unlock()
+	return written, err
+}
+
+type progressReader struct {
+	io.ReadSeekCloser
+	read     int64
+	total    int64
+	callback func(uploaded, total int64)
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.ReadSeekCloser.Read(p)
+	pr.read += int64(n)
+	if n > 0 {
+		pr.callback(pr.read, pr.total)
+	}
+	return
+}
+
+func (pr *progressReader) Seek(offset int64, whence int) (int64, error) {
+	newOffset, err := pr.ReadSeekCloser.Seek(offset, whence)
+	if err == nil {
+		pr.read = newOffset
+	}
+	return newOffset, err
+}
+
+func (gmx *Gomuks) CreateChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := gmx.newPendingUpload(r.URL.Query().Get("upload_id"))
+	if errors.Is(err, ErrUploadInUse) {
+		ErrUploadInUse.Write(w)
+		return
+	} else if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to create chunked upload")
+		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to create temp file: %v", err)).Write(w)
+		return
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &respChunkedUpload{UploadID: upload.ID})
+}
+
+func (gmx *Gomuks) GetChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	upload := gmx.getPendingUpload(r.PathValue("upload_id"))
+	if upload == nil {
+		ErrUploadNotFound.Write(w)
+		return
+	}
+	upload.lock.Lock()
+	size := upload.size
+	upload.lock.Unlock()
+	exhttp.WriteJSONResponse(w, http.StatusOK, &respChunkedUpload{UploadID: upload.ID, Size: size})
+}
+
+func (gmx *Gomuks) WriteChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	upload := gmx.getPendingUpload(r.PathValue("upload_id"))
+	if upload == nil {
+		ErrUploadNotFound.Write(w)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		mautrix.MInvalidParam.WithMessage("Invalid or missing offset").Write(w)
+		return
+	}
+	writer, err := upload.reserveWrite(offset)
+	if err != nil {
+		var respErr mautrix.RespError
+		if errors.As(err, &respErr) {
+			respErr.Write(w)
+		} else {
+			log.Err(err).Msg("Failed to prepare upload file for writing")
+			mautrix.MUnknown.WithMessage(err.Error()).Write(w)
+		}
+		return
+	}
+	// Keep whatever was written even if the connection drops, so the client can resume from there.
+	written, err := writer.copyFrom(w, r.Body)
+	upload.lock.Lock()
+	size := upload.size
+	removed := upload.removed
+	upload.lock.Unlock()
+	if removed {
+		ErrUploadNotFound.Write(w)
+		return
+	} else if err != nil {
+		log.Err(err).Int64("written", written).Msg("Failed to write chunk to upload file")
+		mautrix.MUnknown.WithMessage(fmt.Sprintf("Failed to write chunk: %v", err)).Write(w)
+		return
+	}
+	exhttp.WriteJSONResponse(w, http.StatusOK, &respChunkedUpload{UploadID: upload.ID, Size: size})
+}
+
+// reserveWrite marks the upload as being written to and returns a writer that continues from the given offset.
+// If the client is resuming from an earlier point, everything after the offset is thrown away.
+func (upload *pendingUpload) reserveWrite(offset int64) (*chunkWriter, error) {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	if upload.removed {
+		return nil, ErrUploadNotFound
+	} else if upload.writing {
+		return nil, ErrUploadBusy
+	} else if offset < 0 || offset > upload.size {
+		return nil, ErrInvalidOffset.WithMessage(fmt.Sprintf("Offset must be between 0 and %d", upload.size))
+	}
+	if offset < upload.size {
+		err := upload.file.Truncate(offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to truncate file: %w", err)
+		}
+		upload.size = offset
+	}
+	upload.writing = true
+	upload.lastUsed = time.Now()
+	return &chunkWriter{upload: upload, offset: offset}, nil
+}
+
+func (gmx *Gomuks) CompleteChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	upload := gmx.getPendingUpload(r.PathValue("upload_id"))
+	if upload == nil {
+		ErrUploadNotFound.Write(w)
+		return
+	}
+	upload.lock.Lock()
+	if upload.removed {
+		upload.lock.Unlock()
+		ErrUploadNotFound.Write(w)
+		return
+	} else if upload.writing {
+		upload.lock.Unlock()
+		ErrUploadBusy.Write(w)
+		return
+	}
+	defer gmx.removePendingUpload(upload)
+	defer upload.lock.Unlock()
+	gmx.finishUpload(w, r, upload)
+}
+
+func (gmx *Gomuks) CancelUpload(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.PathValue("upload_id")
+	upload := gmx.getPendingUpload(uploadID)
+	async := gmx.getAsyncUpload(uploadID)
+	if upload == nil && async == nil {
+		ErrUploadNotFound.Write(w)
+		return
+	}
+	if async != nil {
+		async.cancel(errUploadCancelled)
+	}
+	if upload != nil {
+		upload.cancel(errUploadCancelled)
+		gmx.removePendingUpload(upload)
+	}
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
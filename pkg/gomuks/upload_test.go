@@ -0,0 +1,320 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+func newUploadTestServer(t *testing.T) (*Gomuks, *httptest.Server) {
+	t.Helper()
+	gmx := NewGomuks()
+	gmx.TempDir = t.TempDir()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /upload/chunked", gmx.CreateChunkedUpload)
+	mux.HandleFunc("GET /upload/chunked/{upload_id}", gmx.GetChunkedUpload)
+	mux.HandleFunc("PUT /upload/chunked/{upload_id}", gmx.WriteChunkedUpload)
+	mux.HandleFunc("DELETE /upload/{upload_id}", gmx.CancelUpload)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return gmx, srv
+}
+
+func doUploadRequest(t *testing.T, method, url string, body io.Reader) (int, *respChunkedUpload) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var data respChunkedUpload
+	_ = json.NewDecoder(resp.Body).Decode(&data)
+	return resp.StatusCode, &data
+}
+
+func TestPendingUpload_ReserveWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		offset   int64
+		writing  bool
+		removed  bool
+		wantErr  error
+		wantSize int64
+	}{
+		{"Append", 11, false, false, nil, 11},
+		{"Resume from earlier offset truncates", 5, false, false, nil, 5},
+		{"Restart from zero", 0, false, false, nil, 0},
+		{"Negative offset", -1, false, false, ErrInvalidOffset, 11},
+		{"Offset past end", 12, false, false, ErrInvalidOffset, 11},
+		{"Another writer is active", 11, true, false, ErrUploadBusy, 11},
+		{"Upload was removed", 11, false, true, ErrUploadNotFound, 11},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gmx := NewGomuks()
+			gmx.TempDir = t.TempDir()
+			upload, err := gmx.newPendingUpload("")
+			if err != nil {
+				t.Fatalf("newPendingUpload() error = %v", err)
+			}
+			defer gmx.removePendingUpload(upload)
+			_, _ = upload.file.WriteString("hello world")
+			upload.size = 11
+			upload.writing = test.writing
+			upload.removed = test.removed
+			writer, err := upload.reserveWrite(test.offset)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("reserveWrite() error = %v, want %v", err, test.wantErr)
+			} else if err != nil {
+				if writer != nil {
+					t.Errorf("reserveWrite() returned a writer with an error")
+				}
+				return
+			}
+			if !upload.writing {
+				t.Errorf("reserveWrite() didn't mark the upload as being written")
+			}
+			if upload.size != test.wantSize {
+				t.Errorf("upload size = %d, want %d", upload.size, test.wantSize)
+			}
+			if stat, _ := os.Stat(upload.Path); stat.Size() != test.wantSize {
+				t.Errorf("file size = %d, want %d", stat.Size(), test.wantSize)
+			}
+			if writer.offset != test.offset {
+				t.Errorf("writer offset = %d, want %d", writer.offset, test.offset)
+			}
+		})
+	}
+}
+
+func TestGomuks_WriteChunkedUpload(t *testing.T) {
+	gmx, srv := newUploadTestServer(t)
+	status, created := doUploadRequest(t, http.MethodPost, srv.URL+"/upload/chunked?upload_id=test", nil)
+	if status != http.StatusOK || created.UploadID != "test" {
+		t.Fatalf("failed to create upload: %d %+v", status, created)
+	}
+	uploadURL := srv.URL + "/upload/chunked/test"
+	steps := []struct {
+		name       string
+		offset     string
+		body       string
+		wantStatus int
+		wantSize   int64
+	}{
+		{"First chunk", "0", "hello ", http.StatusOK, 6},
+		{"Second chunk", "6", "wrold", http.StatusOK, 11},
+		{"Resume from earlier offset", "7", "orld", http.StatusOK, 11},
+		{"Offset past end", "20", "!", http.StatusRequestedRangeNotSatisfiable, 11},
+		{"Missing offset", "", "!", http.StatusBadRequest, 11},
+	}
+	for _, step := range steps {
+		status, resp := doUploadRequest(t, http.MethodPut, uploadURL+"?offset="+step.offset, strings.NewReader(step.body))
+		if status != step.wantStatus {
+			t.Errorf("%s: status = %d, want %d", step.name, status, step.wantStatus)
+		} else if status == http.StatusOK && resp.Size != step.wantSize {
+			t.Errorf("%s: size = %d, want %d", step.name, resp.Size, step.wantSize)
+		}
+		if status, resp = doUploadRequest(t, http.MethodGet, uploadURL, nil); status != http.StatusOK || resp.Size != step.wantSize {
+			t.Errorf("%s: GET returned %d with size %d, want size %d", step.name, status, resp.Size, step.wantSize)
+		}
+	}
+	upload := gmx.getPendingUpload("test")
+	data, err := os.ReadFile(upload.Path)
+	if err != nil {
+		t.Fatalf("failed to read upload file: %v", err)
+	} else if string(data) != "hello world" {
+		t.Errorf("upload file contains %q, want %q", data, "hello world")
+	}
+
+	status, _ = doUploadRequest(t, http.MethodDelete, srv.URL+"/upload/test", nil)
+	if status != http.StatusOK {
+		t.Errorf("cancel status = %d, want %d", status, http.StatusOK)
+	}
+	if _, err = os.Stat(upload.Path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("upload file still exists after cancelling: %v", err)
+	}
+	if status, _ = doUploadRequest(t, http.MethodGet, uploadURL, nil); status != http.StatusNotFound {
+		t.Errorf("GET after cancel status = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestGomuks_CancelStalledChunkedUpload(t *testing.T) {
+	gmx, srv := newUploadTestServer(t)
+	upload, err := gmx.newPendingUpload("stalled")
+	if err != nil {
+		t.Fatalf("newPendingUpload() error = %v", err)
+	}
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	writeDone := make(chan int, 1)
+	go func() {
+		status, _ := doUploadRequest(t, http.MethodPut, srv.URL+"/upload/chunked/stalled?offset=0", bodyReader)
+		writeDone <- status
+	}()
+	_, _ = bodyWriter.Write([]byte("partial"))
+	// Wait for the chunk to reach the file, the writer is then stalled waiting for more data
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		upload.lock.Lock()
+		size := upload.size
+		upload.lock.Unlock()
+		if size == int64(len("partial")) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("chunk wasn't written to the upload file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The stalled writer must not block reading or cancelling the upload
+	getDone := make(chan int, 1)
+	go func() {
+		status, _ := doUploadRequest(t, http.MethodGet, srv.URL+"/upload/chunked/stalled", nil)
+		getDone <- status
+	}()
+	select {
+	case status := <-getDone:
+		if status != http.StatusOK {
+			t.Errorf("GET status = %d, want %d", status, http.StatusOK)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GET was blocked by the stalled writer")
+	}
+	status, _ := doUploadRequest(t, http.MethodDelete, srv.URL+"/upload/stalled", nil)
+	if status != http.StatusOK {
+		t.Errorf("cancel status = %d, want %d", status, http.StatusOK)
+	}
+	select {
+	case status = <-writeDone:
+		if status != ErrUploadNotFound.StatusCode {
+			t.Errorf("stalled write status = %d, want %d", status, ErrUploadNotFound.StatusCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled writer wasn't aborted by cancelling the upload")
+	}
+}
+
+func TestGomuks_NewPendingUploadInUse(t *testing.T) {
+	gmx := NewGomuks()
+	gmx.TempDir = t.TempDir()
+	gmx.addAsyncUpload("async", &asyncUpload{})
+	finished := &asyncUpload{done: make(chan struct{})}
+	close(finished.done)
+	gmx.addAsyncUpload("finished", finished)
+	tests := []struct {
+		uploadID string
+		wantErr  error
+	}{
+		{"fresh", nil},
+		{"fresh", ErrUploadInUse},
+		{"async", ErrUploadInUse},
+		{"finished", nil},
+		{"", nil},
+	}
+	for i, test := range tests {
+		upload, err := gmx.newPendingUpload(test.uploadID)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%d: newPendingUpload(%q) error = %v, want %v", i, test.uploadID, err, test.wantErr)
+		}
+		if upload != nil {
+			// Uploads are kept until the end of the test so that later rows see them as taken
+			t.Cleanup(func() { gmx.removePendingUpload(upload) })
+			if test.uploadID == "" && upload.ID == "" {
+				t.Errorf("%d: newPendingUpload() didn't generate an ID", i)
+			}
+		}
+	}
+}
+
+func TestGomuks_StopAsyncUploads(t *testing.T) {
+	gmx := NewGomuks()
+	log := zerolog.Nop()
+	gmx.Log = &log
+	newUpload := func(uploadID string, mxc id.ContentURIString) (*asyncUpload, *error) {
+		var cancelled error
+		upload := &asyncUpload{mxc: mxc, done: make(chan struct{})}
+		upload.cancel = func(cause error) {
+			if cancelled == nil {
+				cancelled = cause
+				upload.err = cause
+				close(upload.done)
+			}
+		}
+		gmx.addAsyncUpload(uploadID, upload)
+		return upload, &cancelled
+	}
+	_, unsentCancelled := newUpload("unsent", "mxc://example.com/unsent")
+	sent, sentCancelled := newUpload("sent", "mxc://example.com/sent")
+
+	if result := gmx.pendingUploadResult("mxc://example.com/unknown"); result != nil {
+		t.Errorf("pendingUploadResult() returned a channel for an unknown media ID")
+	}
+	result := gmx.pendingUploadResult("mxc://example.com/sent")
+	if result == nil {
+		t.Fatalf("pendingUploadResult() didn't find the upload")
+	} else if !sent.sent.Load() {
+		t.Errorf("pendingUploadResult() didn't mark the upload as sent")
+	}
+
+	uploadErr := errors.New("upload failed")
+	time.AfterFunc(100*time.Millisecond, func() {
+		sent.err = uploadErr
+		close(sent.done)
+	})
+	stopped := make(chan struct{})
+	go func() {
+		gmx.stopAsyncUploads()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopAsyncUploads() didn't return after the sent upload finished")
+	}
+	if !sent.finished() {
+		t.Errorf("stopAsyncUploads() returned before the sent upload finished")
+	}
+	if !errors.Is(*unsentCancelled, errUploadCancelled) {
+		t.Errorf("unsent upload was cancelled with %v, want %v", *unsentCancelled, errUploadCancelled)
+	}
+	if *sentCancelled != nil {
+		t.Errorf("sent upload was cancelled with %v", *sentCancelled)
+	}
+	select {
+	case err := <-result:
+		if !errors.Is(err, uploadErr) {
+			t.Errorf("upload result = %v, want %v", err, uploadErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload result wasn't delivered")
+	}
+}
@@ -0,0 +1,139 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/util/ffmpeg"
+	"go.mau.fi/util/random"
+
+	"go.mau.fi/gomuks/pkg/hicli"
+)
+
+const (
+	// Number of bars in generated voice message waveforms
+	waveformSamples = 100
+	// Sample rate used when decoding audio for waveform generation
+	waveformSampleRate = 8000
+)
+
+var errFFmpegNotFound = errors.New("ffmpeg is required for voice messages, but it wasn't found")
+
+// convertVoiceMessage converts the audio file at the given path to Ogg/Opus in place
+// and returns the checksum of the new file as well as a waveform of the audio.
+func (gmx *Gomuks) convertVoiceMessage(ctx context.Context, path string) ([]byte, []int, error) {
+	if !ffmpeg.Supported() {
+		return nil, nil, errFFmpegNotFound
+	}
+	oggPath := filepath.Join(gmx.TempDir, "voice-"+random.String(12)+".ogg")
+	defer os.Remove(oggPath)
+	err := ffmpeg.ConvertPathWithDestination(
+		ctx, path, oggPath, nil,
+		[]string{"-vn", "-map_metadata", "-1", "-c:a", "libopus", "-b:a", "48k", "-application", "voip"},
+		false,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert to ogg: %w", err)
+	}
+	waveform, err := gmx.generateWaveform(ctx, oggPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate waveform: %w", err)
+	}
+	file, err := os.Open(oggPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open converted file: %w", err)
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	_ = file.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to hash converted file: %w", err)
+	}
+	err = os.Rename(oggPath, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to replace original file: %w", err)
+	}
+	return hasher.Sum(nil), waveform, nil
+}
+
+func (gmx *Gomuks) generateWaveform(ctx context.Context, path string) ([]int, error) {
+	pcmPath := filepath.Join(gmx.TempDir, "waveform-"+random.String(12)+".pcm")
+	defer os.Remove(pcmPath)
+	err := ffmpeg.ConvertPathWithDestination(
+		ctx, path, pcmPath, nil,
+		[]string{"-vn", "-f", "s16le", "-acodec", "pcm_s16le", "-ac", "1", "-ar", fmt.Sprint(waveformSampleRate)},
+		false,
+	)
+	if err != nil {
+		return nil, err
+	}
+	pcm, err := os.ReadFile(pcmPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decoded audio: %w", err)
+	}
+	samples := make([]int16, len(pcm)/2)
+	_, err = binary.Decode(pcm, binary.LittleEndian, samples)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decoded audio: %w", err)
+	}
+	return calculateWaveform(samples, waveformSamples), nil
+}
+
+// calculateWaveform splits the given samples into buckets and returns the RMS
+// amplitude of each bucket scaled so that the loudest bucket is hicli.MaxWaveformValue.
+func calculateWaveform(samples []int16, bucketCount int) []int {
+	if len(samples) == 0 {
+		return []int{}
+	}
+	bucketCount = min(bucketCount, len(samples))
+	amplitudes := make([]float64, bucketCount)
+	var maxAmplitude float64
+	for i := range amplitudes {
+		bucket := samples[i*len(samples)/bucketCount : (i+1)*len(samples)/bucketCount]
+		var sum float64
+		for _, sample := range bucket {
+			sum += float64(sample) * float64(sample)
+		}
+		amplitudes[i] = math.Sqrt(sum / float64(len(bucket)))
+		maxAmplitude = max(maxAmplitude, amplitudes[i])
+	}
+	waveform := make([]int, bucketCount)
+	if maxAmplitude == 0 {
+		return waveform
+	}
+	for i, amplitude := range amplitudes {
+		waveform[i] = int(math.Round(amplitude / maxAmplitude * hicli.MaxWaveformValue))
+	}
+	return waveform
+}
+
+func voiceMessageFileName(fileName string) string {
+	if fileName == "" {
+		return "Voice message.ogg"
+	}
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".ogg"
+}
@@ -0,0 +1,57 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"go.mau.fi/gomuks/pkg/hicli"
+)
+
+func TestCalculateWaveform(t *testing.T) {
+	constant := make([]int16, 1000)
+	for i := range constant {
+		constant[i] = 100
+	}
+	fullScale := make([]int, waveformSamples)
+	for i := range fullScale {
+		fullScale[i] = hicli.MaxWaveformValue
+	}
+	tests := []struct {
+		name        string
+		samples     []int16
+		bucketCount int
+		want        []int
+	}{
+		{"Empty", []int16{}, waveformSamples, []int{}},
+		{"All zero", []int16{0, 0, 0, 0}, 2, []int{0, 0}},
+		{"More buckets than samples", []int16{100, 50}, waveformSamples, []int{hicli.MaxWaveformValue, 512}},
+		{"Too many samples", constant, waveformSamples, fullScale},
+		{"Extreme sample values", []int16{math.MinInt16, math.MaxInt16, 0, 0}, 2, []int{hicli.MaxWaveformValue, 0}},
+		{"Negative samples", []int16{-100, -100, 50, -50}, 2, []int{hicli.MaxWaveformValue, 512}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := calculateWaveform(test.samples, test.bucketCount)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("calculateWaveform() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+const (
+	webhookQueueSize         = 256
+	webhookRequestTimeout    = 30 * time.Second
+	webhookMaxRetryDelay     = 5 * time.Minute
+	webhookDefaultMaxRetries = 5
+	webhookLogRetention      = 7 * 24 * time.Hour
+	webhookLogPruneInterval  = 1 * time.Hour
+)
+
+var (
+	webhookHTTPClient        = &http.Client{Timeout: webhookRequestTimeout}
+	webhookInitialRetryDelay = 1 * time.Second
+)
+
+type WebhookConfig struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Match rules. Empty lists match everything, and all rules must match for the event to be sent.
+	Rooms          []id.RoomID `yaml:"rooms,omitempty"`
+	Senders        []id.UserID `yaml:"senders,omitempty"`
+	Types          []string    `yaml:"types,omitempty"`
+	BodyRegex      string      `yaml:"body_regex,omitempty"`
+	OnlyHighlights bool        `yaml:"only_highlights,omitempty"`
+
+	MaxRetries int `yaml:"max_retries,omitempty"`
+
+	bodyRegex *regexp.Regexp
+	queue     chan *WebhookPayload
+}
+
+// WebhookPayload is the JSON body that is POSTed to webhooks.
+type WebhookPayload struct {
+	Webhook   string             `json:"webhook"`
+	RoomID    id.RoomID          `json:"room_id"`
+	EventID   id.EventID         `json:"event_id"`
+	Sender    id.UserID          `json:"sender"`
+	Type      string             `json:"type"`
+	Content   json.RawMessage    `json:"content"`
+	Timestamp jsontime.UnixMilli `json:"timestamp"`
+	Encrypted bool               `json:"encrypted"`
+	Highlight bool               `json:"highlight"`
+}
+
+func (wh *WebhookConfig) compile() error {
+	if wh.URL == "" {
+		return fmt.Errorf("url is required")
+	} else if parsed, err := url.Parse(wh.URL); err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("url must be http or https")
+	}
+	if wh.BodyRegex != "" {
+		var err error
+		wh.bodyRegex, err = regexp.Compile(wh.BodyRegex)
+		if err != nil {
+			return fmt.Errorf("invalid body_regex: %w", err)
+		}
+	}
+	if wh.MaxRetries == 0 {
+		wh.MaxRetries = webhookDefaultMaxRetries
+	}
+	return nil
+}
+
+func (wh *WebhookConfig) match(evt *database.Event) bool {
+	evtType := evt.Type
+	content := evt.Content
+	if evt.Decrypted != nil {
+		evtType = evt.DecryptedType
+		content = evt.Decrypted
+	}
+	if evt.Type == event.EventEncrypted.Type && evt.Decrypted == nil {
+		return false
+	} else if len(wh.Rooms) > 0 && !slices.Contains(wh.Rooms, evt.RoomID) {
+		return false
+	} else if len(wh.Senders) > 0 && !slices.Contains(wh.Senders, evt.Sender) {
+		return false
+	} else if len(wh.Types) > 0 && !slices.Contains(wh.Types, evtType) {
+		return false
+	} else if wh.OnlyHighlights && !evt.UnreadType.Is(database.UnreadTypeHighlight) {
+		return false
+	} else if wh.bodyRegex != nil {
+		body := gjson.GetBytes(content, "body")
+		if body.Type != gjson.String || !wh.bodyRegex.MatchString(body.Str) {
+			return false
+		}
+	}
+	return true
+}
+
+func (gmx *Gomuks) compileWebhooks() error {
+	for i, wh := range gmx.Config.Webhooks {
+		if wh.Name == "" {
+			wh.Name = fmt.Sprintf("webhook #%d", i+1)
+		}
+		if err := wh.compile(); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", wh.Name, err)
+		}
+	}
+	return nil
+}
+
+// StartWebhooks starts the delivery loops for all configured webhooks
+// and registers them to receive new events from the client.
+// The loops and any in-flight requests are cancelled by StopWebhooks.
+func (gmx *Gomuks) StartWebhooks() {
+	if len(gmx.Config.Webhooks) == 0 {
+		return
+	}
+	log := gmx.Log.With().Str("component", "webhooks").Logger()
+	ctx, cancel := context.WithCancel(log.WithContext(context.Background()))
+	gmx.stopWebhooks = cancel
+	for _, wh := range gmx.Config.Webhooks {
+		wh.queue = make(chan *WebhookPayload, webhookQueueSize)
+		go gmx.runWebhookQueue(ctx, wh)
+	}
+	go gmx.pruneWebhookLog(ctx)
+	gmx.Client.LiveEventHandler = gmx.dispatchWebhooks
+	log.Info().Int("count", len(gmx.Config.Webhooks)).Msg("Started outgoing webhooks")
+}
+
+func (gmx *Gomuks) dispatchWebhooks(ctx context.Context, evt *database.Event) {
+	for _, wh := range gmx.Config.Webhooks {
+		if !wh.match(evt) {
+			continue
+		}
+		payload := &WebhookPayload{
+			Webhook:   wh.Name,
+			RoomID:    evt.RoomID,
+			EventID:   evt.ID,
+			Sender:    evt.Sender,
+			Type:      evt.Type,
+			Content:   evt.Content,
+			Timestamp: evt.Timestamp,
+			Highlight: evt.UnreadType.Is(database.UnreadTypeHighlight),
+		}
+		if evt.Decrypted != nil {
+			payload.Type = evt.DecryptedType
+			payload.Content = evt.Decrypted
+			payload.Encrypted = true
+		}
+		select {
+		case wh.queue <- payload:
+		default:
+			zerolog.Ctx(ctx).Warn().
+				Str("webhook", wh.Name).
+				Stringer("event_id", evt.ID).
+				Msg("Webhook queue is full, dropping event")
+		}
+	}
+}
+
+// StopWebhooks stops the delivery loops and cancels any in-flight webhook requests.
+func (gmx *Gomuks) StopWebhooks() {
+	if gmx.stopWebhooks != nil {
+		gmx.stopWebhooks()
+	}
+}
+
+func (gmx *Gomuks) pruneWebhookLog(ctx context.Context) {
+	ticker := time.NewTicker(webhookLogPruneInterval)
+	defer ticker.Stop()
+	for {
+		err := gmx.Client.DB.Webhook.DeleteOlderThan(ctx, time.Now().Add(-webhookLogRetention))
+		if err != nil && ctx.Err() == nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to delete old webhook delivery log entries")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (gmx *Gomuks) runWebhookQueue(ctx context.Context, wh *WebhookConfig) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-wh.queue:
+			gmx.deliverWebhook(ctx, wh, payload)
+		}
+	}
+}
+
+func (gmx *Gomuks) deliverWebhook(ctx context.Context, wh *WebhookConfig, payload *WebhookPayload) {
+	log := zerolog.Ctx(ctx).With().
+		Str("webhook", wh.Name).
+		Stringer("room_id", payload.RoomID).
+		Stringer("event_id", payload.EventID).
+		Logger()
+	delivery := &database.WebhookDelivery{
+		Webhook:   wh.Name,
+		RoomID:    payload.RoomID,
+		EventID:   payload.EventID,
+		CreatedAt: jsontime.UnixMilliNow(),
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Err(err).Msg("Failed to marshal webhook payload")
+		return
+	}
+	retryDelay := webhookInitialRetryDelay
+	for {
+		delivery.Attempts++
+		var retryable bool
+		delivery.StatusCode, retryable, err = wh.send(ctx, body)
+		if ctx.Err() != nil {
+			return
+		} else if err == nil {
+			delivery.Error = ""
+			log.Debug().Int("attempts", delivery.Attempts).Msg("Delivered webhook")
+			break
+		}
+		delivery.Error = err.Error()
+		if !retryable || delivery.Attempts > wh.MaxRetries {
+			log.Err(err).Int("attempts", delivery.Attempts).Msg("Failed to deliver webhook")
+			break
+		}
+		log.Warn().Err(err).
+			Int("attempts", delivery.Attempts).
+			Dur("retry_in", retryDelay).
+			Msg("Failed to deliver webhook, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+		retryDelay = min(retryDelay*2, webhookMaxRetryDelay)
+	}
+	delivery.CompletedAt = jsontime.UnixMilliNow()
+	if err = gmx.Client.DB.Webhook.Insert(ctx, delivery); err != nil {
+		log.Err(err).Msg("Failed to save webhook delivery log entry")
+	}
+}
+
+// send makes a single delivery attempt. Network errors, rate limits and server errors are retryable,
+// while other non-2xx responses are not, as they likely mean the webhook is misconfigured.
+func (wh *WebhookConfig) send(ctx context.Context, body []byte) (statusCode int, retryable bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range wh.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, true, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return resp.StatusCode, retryable, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
@@ -0,0 +1,253 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gomuks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	_ "go.mau.fi/util/dbutil/litestream"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func TestWebhookConfig_Match(t *testing.T) {
+	msg := &database.Event{
+		RoomID:  "!room:example.com",
+		Sender:  "@alice:example.com",
+		Type:    event.EventMessage.Type,
+		Content: json.RawMessage(`{"msgtype":"m.text","body":"deploy finished"}`),
+	}
+	highlight := *msg
+	highlight.UnreadType = database.UnreadTypeNormal | database.UnreadTypeHighlight
+	decrypted := &database.Event{
+		RoomID:        "!room:example.com",
+		Sender:        "@alice:example.com",
+		Type:          event.EventEncrypted.Type,
+		Content:       json.RawMessage(`{"algorithm":"m.megolm.v1.aes-sha2"}`),
+		Decrypted:     json.RawMessage(`{"msgtype":"m.text","body":"deploy failed"}`),
+		DecryptedType: event.EventMessage.Type,
+	}
+	undecrypted := &database.Event{
+		RoomID:  "!room:example.com",
+		Sender:  "@alice:example.com",
+		Type:    event.EventEncrypted.Type,
+		Content: json.RawMessage(`{"algorithm":"m.megolm.v1.aes-sha2"}`),
+	}
+	reaction := &database.Event{
+		RoomID:  "!room:example.com",
+		Sender:  "@alice:example.com",
+		Type:    event.EventReaction.Type,
+		Content: json.RawMessage(`{}`),
+	}
+
+	tests := []struct {
+		name    string
+		webhook WebhookConfig
+		evt     *database.Event
+		want    bool
+	}{
+		{"Empty config matches everything", WebhookConfig{}, msg, true},
+		{"Room matches", WebhookConfig{Rooms: []id.RoomID{"!other:example.com", "!room:example.com"}}, msg, true},
+		{"Room doesn't match", WebhookConfig{Rooms: []id.RoomID{"!other:example.com"}}, msg, false},
+		{"Sender matches", WebhookConfig{Senders: []id.UserID{"@alice:example.com"}}, msg, true},
+		{"Sender doesn't match", WebhookConfig{Senders: []id.UserID{"@bob:example.com"}}, msg, false},
+		{"Type matches", WebhookConfig{Types: []string{event.EventMessage.Type}}, msg, true},
+		{"Type doesn't match", WebhookConfig{Types: []string{event.EventMessage.Type}}, reaction, false},
+		{"Type matches decrypted type", WebhookConfig{Types: []string{event.EventMessage.Type}}, decrypted, true},
+		{"Regex matches", WebhookConfig{BodyRegex: "^deploy (finished|failed)$"}, msg, true},
+		{"Regex doesn't match", WebhookConfig{BodyRegex: "^build"}, msg, false},
+		{"Regex matches decrypted body", WebhookConfig{BodyRegex: "failed"}, decrypted, true},
+		{"Regex requires a body", WebhookConfig{BodyRegex: ".*"}, reaction, false},
+		{"Highlight required but missing", WebhookConfig{OnlyHighlights: true}, msg, false},
+		{"Highlight required and present", WebhookConfig{OnlyHighlights: true}, &highlight, true},
+		{"Undecrypted events never match", WebhookConfig{}, undecrypted, false},
+		{"All rules must match", WebhookConfig{
+			Rooms:     []id.RoomID{"!room:example.com"},
+			Senders:   []id.UserID{"@alice:example.com"},
+			BodyRegex: "nope",
+		}, msg, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wh := test.webhook
+			wh.URL = "https://example.com/webhook"
+			if err := wh.compile(); err != nil {
+				t.Fatalf("compile() error = %v", err)
+			}
+			if got := wh.match(test.evt); got != test.want {
+				t.Errorf("match() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func newWebhookTestGomuks(t *testing.T) *Gomuks {
+	t.Helper()
+	rawDB, err := dbutil.NewFromConfig("gomuks", dbutil.Config{
+		PoolConfig: dbutil.PoolConfig{
+			Type:         "sqlite3-fk-wal",
+			URI:          ":memory:?_txlock=immediate",
+			MaxOpenConns: 1,
+			MaxIdleConns: 1,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	gmx := NewGomuks()
+	gmx.Client = hicli.New(rawDB, nil, zerolog.Nop(), []byte("meow"), func(any) {})
+	if err = gmx.Client.DB.Upgrade(context.Background()); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = gmx.Client.DB.Close()
+	})
+	return gmx
+}
+
+func TestGomuks_DeliverWebhook(t *testing.T) {
+	webhookInitialRetryDelay = 1 * time.Millisecond
+	tests := []struct {
+		name         string
+		statuses     []int
+		maxRetries   int
+		wantAttempts int
+		wantStatus   int
+		wantError    bool
+	}{
+		{"Success", []int{http.StatusOK}, 3, 1, http.StatusOK, false},
+		{"Retry on server error", []int{http.StatusBadGateway, http.StatusInternalServerError, http.StatusNoContent}, 3, 3, http.StatusNoContent, false},
+		{"Retry on rate limit", []int{http.StatusTooManyRequests, http.StatusOK}, 3, 2, http.StatusOK, false},
+		{"No retry on client error", []int{http.StatusBadRequest, http.StatusOK}, 3, 1, http.StatusBadRequest, true},
+		{"Give up after max retries", []int{http.StatusServiceUnavailable}, 2, 3, http.StatusServiceUnavailable, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int32
+			var gotPayload WebhookPayload
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(requests.Add(1))
+				if r.Header.Get("Authorization") != "Bearer meow" {
+					t.Errorf("missing custom header in request %d", n)
+				}
+				if err := json.NewDecoder(r.Body).Decode(&gotPayload); err != nil {
+					t.Errorf("failed to decode request %d: %v", n, err)
+				}
+				w.WriteHeader(test.statuses[min(n, len(test.statuses))-1])
+			}))
+			defer srv.Close()
+
+			gmx := newWebhookTestGomuks(t)
+			wh := &WebhookConfig{
+				Name:       "test",
+				URL:        srv.URL,
+				Headers:    map[string]string{"Authorization": "Bearer meow"},
+				MaxRetries: test.maxRetries,
+			}
+			if err := wh.compile(); err != nil {
+				t.Fatalf("compile() error = %v", err)
+			}
+			payload := &WebhookPayload{
+				Webhook: wh.Name,
+				RoomID:  "!room:example.com",
+				EventID: "$event",
+				Sender:  "@alice:example.com",
+				Type:    event.EventMessage.Type,
+				Content: json.RawMessage(`{"body":"hi"}`),
+			}
+			ctx := context.Background()
+			gmx.deliverWebhook(ctx, wh, payload)
+
+			if got := int(requests.Load()); got != test.wantAttempts {
+				t.Errorf("server got %d requests, want %d", got, test.wantAttempts)
+			}
+			if gotPayload.EventID != payload.EventID || gotPayload.Webhook != wh.Name {
+				t.Errorf("server got payload %+v", gotPayload)
+			}
+			deliveries, err := gmx.Client.DB.Webhook.GetRecent(ctx, 10)
+			if err != nil {
+				t.Fatalf("GetRecent() error = %v", err)
+			} else if len(deliveries) != 1 {
+				t.Fatalf("got %d delivery log entries, want 1", len(deliveries))
+			}
+			delivery := deliveries[0]
+			if delivery.Webhook != wh.Name || delivery.RoomID != payload.RoomID || delivery.EventID != payload.EventID {
+				t.Errorf("delivery log entry has wrong identifiers: %+v", delivery)
+			}
+			if delivery.Attempts != test.wantAttempts {
+				t.Errorf("delivery log has %d attempts, want %d", delivery.Attempts, test.wantAttempts)
+			}
+			if delivery.StatusCode != test.wantStatus {
+				t.Errorf("delivery log has status %d, want %d", delivery.StatusCode, test.wantStatus)
+			}
+			if (delivery.Error != "") != test.wantError {
+				t.Errorf("delivery log has error %q, want error: %v", delivery.Error, test.wantError)
+			}
+		})
+	}
+}
+
+func TestGomuks_DeliverWebhookCancelled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	gmx := newWebhookTestGomuks(t)
+	wh := &WebhookConfig{Name: "test", URL: srv.URL}
+	if err := wh.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		gmx.deliverWebhook(ctx, wh, &WebhookPayload{RoomID: "!room:example.com", EventID: "$event"})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliverWebhook didn't return after the context was cancelled")
+	}
+	deliveries, err := gmx.Client.DB.Webhook.GetRecent(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("GetRecent() error = %v", err)
+	} else if len(deliveries) != 0 {
+		t.Errorf("got %d delivery log entries for a cancelled delivery, want 0", len(deliveries))
+	}
+}
@@ -9,6 +9,7 @@ package hicli
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"slices"
 
@@ -21,8 +22,7 @@ import (
 
 func (c *HiClient) uploadKeysToBackup(ctx context.Context) {
 	log := zerolog.Ctx(ctx)
-	version := c.KeyBackupVersion
-	key := c.KeyBackupKey
+	version, key := c.KeyBackup()
 	if version == "" || key == nil {
 		return
 	}
@@ -37,7 +37,16 @@ func (c *HiClient) uploadKeysToBackup(ctx context.Context) {
 	log.Debug().Int("session_count", len(sessions)).Msg("Backing up megolm sessions")
 	for chunk := range slices.Chunk(sessions, 100) {
 		err = c.uploadKeyBackupBatch(ctx, version, key, chunk)
-		if err != nil {
+		if errors.Is(err, MWrongRoomKeysVersion) {
+			log.Warn().Err(err).Msg("Key backup version changed, checking new version")
+			err = c.CheckKeyBackupVersion(ctx, "")
+			if errors.Is(err, ErrRecoveryKeyRequired) {
+				log.Warn().Msg("Recovery key is needed to switch to the new key backup version")
+			} else if err != nil {
+				log.Err(err).Msg("Failed to switch to new key backup version")
+			}
+			return
+		} else if err != nil {
 			log.Err(err).Msg("Failed to upload key backup batch")
 			return
 		}
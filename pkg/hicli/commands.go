@@ -0,0 +1,491 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+	"go.mau.fi/gomuks/pkg/rainbow"
+)
+
+var ErrNotEnoughArguments = errors.New("not enough arguments")
+
+// CommandEvent contains the parameters of a single slash command invocation.
+type CommandEvent struct {
+	RoomID  id.RoomID
+	Command *Command
+	// The full text that was entered into the composer, including the command itself
+	Text string
+	// Everything after the command name, with whitespace preserved
+	RawArgs string
+	// RawArgs split by whitespace
+	Args []string
+}
+
+// CommandHandler executes a slash command. Handlers that send an event should return it,
+// while handlers that only perform an action (like joining a room) return nil.
+type CommandHandler func(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error)
+
+// CommandFormatter renders the arguments of a formatting command (like /rainbow) into message content.
+// Formatting commands can be combined with message type commands, e.g. `/me /rainbow text`.
+type CommandFormatter func(ctx context.Context, h *HiClient, roomID id.RoomID, text string) event.MessageEventContent
+
+type Command struct {
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases,omitempty"`
+	Args        string   `json:"args,omitempty"`
+	Description string   `json:"description"`
+	// The minimum number of whitespace-separated arguments that the command requires
+	MinArgs int `json:"min_args,omitempty"`
+
+	// Commands have either a handler, a formatter or a message type. Commands without a handler
+	// produce a message, which means they can also be used when scheduling messages.
+	Handler CommandHandler    `json:"-"`
+	Format  CommandFormatter  `json:"-"`
+	MsgType event.MessageType `json:"-"`
+}
+
+var slashCommands = []*Command{{
+	Name:        "me",
+	Args:        "<message>",
+	Description: "Send an emote message",
+	MinArgs:     1,
+	MsgType:     event.MsgEmote,
+}, {
+	Name:        "notice",
+	Args:        "<message>",
+	Description: "Send a notice message",
+	MinArgs:     1,
+	MsgType:     event.MsgNotice,
+}, {
+	Name:        "rainbow",
+	Args:        "<message>",
+	Description: "Send a message with rainbow colors",
+	MinArgs:     1,
+	Format:      formatRainbow,
+}, {
+	Name:        "plain",
+	Args:        "<message>",
+	Description: "Send a message without markdown formatting",
+	MinArgs:     1,
+	Format:      formatPlain,
+}, {
+	Name:        "html",
+	Args:        "<message>",
+	Description: "Send a message with raw HTML",
+	MinArgs:     1,
+	Format:      formatHTML,
+}, {
+	Name:        "spoiler",
+	Args:        "<message>",
+	Description: "Send a message hidden behind a spoiler",
+	MinArgs:     1,
+	Format:      formatSpoiler,
+}, {
+	Name:        "shrug",
+	Args:        "[message]",
+	Description: `Prepend ¯\_(ツ)_/¯ to a message`,
+	Format:      formatShrug,
+}, {
+	Name:        "raw",
+	Args:        "<event type> [JSON content]",
+	Description: "Send an event with arbitrary content",
+	MinArgs:     1,
+	Handler:     cmdRaw,
+}, {
+	Name:        "state",
+	Aliases:     []string{"devtools"},
+	Args:        "<event type> [state key] <JSON content>",
+	Description: "Send a state event with arbitrary content",
+	MinArgs:     2,
+	Handler:     cmdState,
+}, {
+	Name:        "join",
+	Args:        "<room ID or alias> [via server]",
+	Description: "Join a room",
+	MinArgs:     1,
+	Handler:     cmdJoin,
+}, {
+	Name:        "leave",
+	Aliases:     []string{"part"},
+	Args:        "[reason]",
+	Description: "Leave the current room",
+	Handler:     cmdLeave,
+}, {
+	Name:        "invite",
+	Args:        "<user ID> [reason]",
+	Description: "Invite a user to the current room",
+	MinArgs:     1,
+	Handler:     cmdInvite,
+}, {
+	Name:        "kick",
+	Args:        "<user ID> [reason]",
+	Description: "Remove a user from the current room",
+	MinArgs:     1,
+	Handler:     cmdKick,
+}, {
+	Name:        "ban",
+	Args:        "<user ID> [reason]",
+	Description: "Ban a user from the current room",
+	MinArgs:     1,
+	Handler:     cmdBan,
+}, {
+	Name:        "unban",
+	Args:        "<user ID> [reason]",
+	Description: "Unban a user from the current room",
+	MinArgs:     1,
+	Handler:     cmdUnban,
+}, {
+	Name:        "myroomnick",
+	Aliases:     []string{"roomnick"},
+	Args:        "<display name>",
+	Description: "Change your display name in the current room",
+	MinArgs:     1,
+	Handler:     cmdMyRoomNick,
+}, {
+	Name:        "myroomavatar",
+	Aliases:     []string{"roomavatar"},
+	Args:        "<mxc URI>",
+	Description: "Change your avatar in the current room",
+	MinArgs:     1,
+	Handler:     cmdMyRoomAvatar,
+}, {
+	Name:        "topic",
+	Args:        "<topic>",
+	Description: "Change the topic of the current room",
+	MinArgs:     1,
+	Handler:     cmdTopic,
+}, {
+	Name:        "converttodm",
+	Args:        "[user ID]",
+	Description: "Mark the current room as a direct chat",
+	Handler:     cmdConvertToDM,
+}, {
+	Name:        "converttoroom",
+	Description: "Unmark the current room as a direct chat",
+	Handler:     cmdConvertToRoom,
+}}
+
+var slashCommandsByName = make(map[string]*Command)
+
+func init() {
+	for _, cmd := range slashCommands {
+		slashCommandsByName[cmd.Name] = cmd
+		for _, alias := range cmd.Aliases {
+			slashCommandsByName[alias] = cmd
+		}
+	}
+}
+
+// ListCommands returns all slash commands that SendMessage understands.
+func (h *HiClient) ListCommands() []*Command {
+	return slashCommands
+}
+
+// parseCommand finds the command at the start of the given text. Unknown commands aren't treated as commands,
+// so that messages which just happen to start with a slash are sent normally.
+func parseCommand(text string) (cmd *Command, rawArgs string) {
+	if !strings.HasPrefix(text, "/") {
+		return nil, ""
+	}
+	name, rawArgs := text[1:], ""
+	if idx := strings.IndexFunc(name, unicode.IsSpace); idx >= 0 {
+		// Only drop the single separator character to preserve formatting in the rest of the message
+		name, rawArgs = name[:idx], name[idx+1:]
+	}
+	return slashCommandsByName[strings.ToLower(name)], rawArgs
+}
+
+// nextArg splits the first whitespace-separated word from the given text.
+func nextArg(text string) (arg, rest string) {
+	text = strings.TrimLeftFunc(text, unicode.IsSpace)
+	idx := strings.IndexFunc(text, unicode.IsSpace)
+	if idx < 0 {
+		return text, ""
+	}
+	return text[:idx], strings.TrimSpace(text[idx:])
+}
+
+func (cmd *Command) checkArgs(rawArgs string) error {
+	if len(strings.Fields(rawArgs)) < cmd.MinArgs {
+		return fmt.Errorf("%w, usage: /%s %s", ErrNotEnoughArguments, cmd.Name, cmd.Args)
+	}
+	return nil
+}
+
+func (h *HiClient) runCommand(ctx context.Context, ce *CommandEvent) (*database.Event, error) {
+	if err := ce.Command.checkArgs(ce.RawArgs); err != nil {
+		return nil, err
+	}
+	zerolog.Ctx(ctx).Debug().
+		Stringer("room_id", ce.RoomID).
+		Str("command", ce.Command.Name).
+		Msg("Running slash command")
+	return ce.Command.Handler(ctx, h, ce)
+}
+
+// formatCommand renders the arguments of a message command (i.e. one without a handler) into message content.
+func (h *HiClient) formatCommand(ctx context.Context, roomID id.RoomID, cmd *Command, rawArgs string) (event.MessageEventContent, error) {
+	if err := cmd.checkArgs(rawArgs); err != nil {
+		return event.MessageEventContent{}, err
+	} else if cmd.Format != nil {
+		return cmd.Format(ctx, h, roomID, rawArgs), nil
+	}
+	// Message type commands can be combined with formatting commands
+	var content event.MessageEventContent
+	if innerCmd, innerArgs := parseCommand(rawArgs); innerCmd != nil && innerCmd.Format != nil {
+		content = innerCmd.Format(ctx, h, roomID, innerArgs)
+	} else {
+		content = formatMarkdown(ctx, h, roomID, rawArgs)
+	}
+	content.MsgType = cmd.MsgType
+	return content, nil
+}
+
+func formatMarkdown(ctx context.Context, h *HiClient, roomID id.RoomID, text string) event.MessageEventContent {
+	return format.RenderMarkdownCustom(h.resolveShortcodes(ctx, roomID, text), defaultNoHTML)
+}
+
+func formatRainbow(ctx context.Context, h *HiClient, roomID id.RoomID, text string) event.MessageEventContent {
+	content := format.RenderMarkdownCustom(h.resolveShortcodes(ctx, roomID, text), rainbowWithHTML)
+	content.FormattedBody = rainbow.ApplyColor(content.FormattedBody)
+	return content
+}
+
+func formatPlain(_ context.Context, _ *HiClient, _ id.RoomID, text string) event.MessageEventContent {
+	return format.TextToContent(text)
+}
+
+func formatHTML(_ context.Context, _ *HiClient, _ id.RoomID, text string) event.MessageEventContent {
+	return format.HTMLToContent(strings.ReplaceAll(text, "\n", "<br>"))
+}
+
+func formatSpoiler(ctx context.Context, h *HiClient, roomID id.RoomID, text string) event.MessageEventContent {
+	content := formatMarkdown(ctx, h, roomID, text)
+	formattedBody := content.FormattedBody
+	if content.Format != event.FormatHTML {
+		formattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+	}
+	content.Format = event.FormatHTML
+	content.FormattedBody = fmt.Sprintf("<span data-mx-spoiler>%s</span>", formattedBody)
+	return content
+}
+
+func formatShrug(ctx context.Context, h *HiClient, roomID id.RoomID, text string) event.MessageEventContent {
+	const shrug = `¯\\\_(ツ)\_/¯`
+	if text == "" {
+		return formatMarkdown(ctx, h, roomID, shrug)
+	}
+	return formatMarkdown(ctx, h, roomID, shrug+" "+text)
+}
+
+func cmdRaw(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	evtType, rawContent := nextArg(ce.RawArgs)
+	content := json.RawMessage(rawContent)
+	if rawContent == "" {
+		content = json.RawMessage("{}")
+	} else if !json.Valid(content) {
+		return nil, fmt.Errorf("invalid JSON in /raw command")
+	}
+	return h.send(ctx, ce.RoomID, event.Type{Type: evtType}, content, "", nil)
+}
+
+func cmdState(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	evtType, rest := nextArg(ce.RawArgs)
+	var stateKey string
+	if !strings.HasPrefix(rest, "{") {
+		stateKey, rest = nextArg(rest)
+	}
+	content := json.RawMessage(rest)
+	if !json.Valid(content) {
+		return nil, fmt.Errorf("invalid JSON in /%s command", ce.Command.Name)
+	}
+	_, err := h.SetState(ctx, ce.RoomID, event.Type{Type: evtType, Class: event.StateEventType}, stateKey, content)
+	return nil, err
+}
+
+func cmdJoin(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	roomIDOrAlias, via := ce.Args[0], ""
+	if len(ce.Args) > 1 {
+		via = ce.Args[1]
+	}
+	if !strings.HasPrefix(roomIDOrAlias, "!") && !strings.HasPrefix(roomIDOrAlias, "#") {
+		return nil, fmt.Errorf("invalid room ID or alias %q", roomIDOrAlias)
+	}
+	resp, err := h.Client.JoinRoom(ctx, roomIDOrAlias, via, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join room: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().Stringer("joined_room_id", resp.RoomID).Msg("Joined room with command")
+	return nil, nil
+}
+
+func cmdLeave(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	_, err := h.Client.LeaveRoom(ctx, ce.RoomID, &mautrix.ReqLeave{Reason: strings.TrimSpace(ce.RawArgs)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to leave room: %w", err)
+	}
+	return nil, nil
+}
+
+// parseTargetUser parses the user ID and optional reason arguments used by membership commands.
+func parseTargetUser(ce *CommandEvent) (id.UserID, string, error) {
+	rawUserID, reason := nextArg(ce.RawArgs)
+	userID := id.UserID(rawUserID)
+	if _, _, err := userID.ParseAndValidate(); err != nil {
+		return "", "", fmt.Errorf("invalid user ID %q: %w", rawUserID, err)
+	}
+	return userID, reason, nil
+}
+
+// changeMembership checks that the user is allowed to change the target's membership from current to membership,
+// then calls fn to do it. An empty current membership means the target's membership isn't relevant for the check.
+func (h *HiClient) changeMembership(
+	ctx context.Context,
+	ce *CommandEvent,
+	current, membership event.Membership,
+	fn func(userID id.UserID, reason string) error,
+) (*database.Event, error) {
+	userID, reason, err := parseTargetUser(ce)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := h.GetRoomPermissions(ctx, ce.RoomID)
+	if err != nil {
+		return nil, err
+	} else if err = perms.CanChangeMembership(userID, current, membership); err != nil {
+		return nil, err
+	} else if err = fn(userID, reason); err != nil {
+		return nil, fmt.Errorf("failed to /%s user: %w", ce.Command.Name, err)
+	}
+	return nil, nil
+}
+
+func cmdInvite(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	return h.changeMembership(ctx, ce, "", event.MembershipInvite, func(userID id.UserID, reason string) error {
+		_, err := h.Client.InviteUser(ctx, ce.RoomID, &mautrix.ReqInviteUser{UserID: userID, Reason: reason})
+		return err
+	})
+}
+
+func cmdKick(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	return h.changeMembership(ctx, ce, "", event.MembershipLeave, func(userID id.UserID, reason string) error {
+		_, err := h.Client.KickUser(ctx, ce.RoomID, &mautrix.ReqKickUser{UserID: userID, Reason: reason})
+		return err
+	})
+}
+
+func cmdBan(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	return h.changeMembership(ctx, ce, "", event.MembershipBan, func(userID id.UserID, reason string) error {
+		_, err := h.Client.BanUser(ctx, ce.RoomID, &mautrix.ReqBanUser{UserID: userID, Reason: reason})
+		return err
+	})
+}
+
+func cmdUnban(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	return h.changeMembership(ctx, ce, event.MembershipBan, event.MembershipLeave, func(userID id.UserID, reason string) error {
+		_, err := h.Client.UnbanUser(ctx, ce.RoomID, &mautrix.ReqUnbanUser{UserID: userID, Reason: reason})
+		return err
+	})
+}
+
+func cmdMyRoomNick(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	return nil, h.SetRoomProfile(ctx, ce.RoomID, ptr.Ptr(strings.TrimSpace(ce.RawArgs)), nil, false)
+}
+
+func cmdMyRoomAvatar(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	return nil, h.SetRoomProfile(ctx, ce.RoomID, nil, ptr.Ptr(id.ContentURIString(ce.Args[0])), false)
+}
+
+func cmdTopic(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	_, err := h.SetState(ctx, ce.RoomID, event.StateTopic, "", &event.TopicEventContent{Topic: strings.TrimSpace(ce.RawArgs)})
+	return nil, err
+}
+
+// updateDirectChats changes the m.direct account data event. fn should return false if nothing was changed.
+func (h *HiClient) updateDirectChats(ctx context.Context, fn func(content map[id.UserID][]id.RoomID) bool) error {
+	content := make(map[id.UserID][]id.RoomID)
+	ad, err := h.DB.AccountData.Get(ctx, h.Account.UserID, event.AccountDataDirectChats)
+	if err != nil {
+		return fmt.Errorf("failed to get direct chat list: %w", err)
+	} else if ad != nil {
+		if err = json.Unmarshal(ad.Content, &content); err != nil {
+			return fmt.Errorf("failed to parse direct chat list: %w", err)
+		}
+	}
+	if !fn(content) {
+		return nil
+	}
+	err = h.Client.SetAccountData(ctx, event.AccountDataDirectChats.Type, content)
+	if err != nil {
+		return fmt.Errorf("failed to update direct chat list: %w", err)
+	}
+	return nil
+}
+
+func cmdConvertToDM(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	var userIDs []id.UserID
+	if len(ce.Args) > 0 {
+		userID, _, err := parseTargetUser(ce)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = []id.UserID{userID}
+	} else {
+		members, err := h.ClientStore.GetRoomJoinedOrInvitedMembers(ctx, ce.RoomID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get room members: %w", err)
+		}
+		userIDs = slices.DeleteFunc(members, func(userID id.UserID) bool {
+			return userID == h.Account.UserID
+		})
+		if len(userIDs) != 1 {
+			return nil, fmt.Errorf("room has %d other members, specify which one the direct chat is with", len(userIDs))
+		}
+	}
+	return nil, h.updateDirectChats(ctx, func(content map[id.UserID][]id.RoomID) bool {
+		changed := false
+		for _, userID := range userIDs {
+			if !slices.Contains(content[userID], ce.RoomID) {
+				content[userID] = append(content[userID], ce.RoomID)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+func cmdConvertToRoom(ctx context.Context, h *HiClient, ce *CommandEvent) (*database.Event, error) {
+	return nil, h.updateDirectChats(ctx, func(content map[id.UserID][]id.RoomID) bool {
+		changed := false
+		for userID, rooms := range content {
+			if idx := slices.Index(rooms, ce.RoomID); idx >= 0 {
+				content[userID] = slices.Delete(rooms, idx, idx+1)
+				if len(content[userID]) == 0 {
+					delete(content, userID)
+				}
+				changed = true
+			}
+		}
+		return changed
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		wantCmd  string
+		wantArgs string
+	}{
+		{"Not a command", "hello /me", "", ""},
+		{"Empty", "", "", ""},
+		{"No arguments", "/shrug", "shrug", ""},
+		{"With arguments", "/me waves", "me", "waves"},
+		{"Case insensitive", "/ME waves", "me", "waves"},
+		{"Alias", "/part goodbye", "leave", "goodbye"},
+		{"Only first separator is dropped", "/plain   indented", "plain", "  indented"},
+		{"Newline separator keeps formatting", "/html\n<b>hi</b>\n<i>there</i>", "html", "<b>hi</b>\n<i>there</i>"},
+		{"Unknown command", "/nonexistent args", "", "args"},
+		{"Lone slash", "/", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd, args := parseCommand(test.text)
+			var cmdName string
+			if cmd != nil {
+				cmdName = cmd.Name
+			}
+			if cmdName != test.wantCmd || args != test.wantArgs {
+				t.Errorf("parseCommand() = (%q, %q), want (%q, %q)", cmdName, args, test.wantCmd, test.wantArgs)
+			}
+		})
+	}
+}
+
+func TestNextArg(t *testing.T) {
+	tests := []struct {
+		text     string
+		wantArg  string
+		wantRest string
+	}{
+		{"", "", ""},
+		{"one", "one", ""},
+		{"one two three", "one", "two three"},
+		{"  padded  rest  ", "padded", "rest"},
+		{"tab\tseparated", "tab", "separated"},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			arg, rest := nextArg(test.text)
+			if arg != test.wantArg || rest != test.wantRest {
+				t.Errorf("nextArg() = (%q, %q), want (%q, %q)", arg, rest, test.wantArg, test.wantRest)
+			}
+		})
+	}
+}
+
+func TestCommand_CheckArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		args    string
+		wantErr bool
+	}{
+		{"No arguments needed", "shrug", "", false},
+		{"Missing argument", "me", "", true},
+		{"Whitespace isn't an argument", "me", " \n ", true},
+		{"Enough arguments", "me", "waves", false},
+		{"Too few of several", "state", "m.room.name", true},
+		{"Several arguments", "state", "m.room.name {}", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := slashCommandsByName[test.command]
+			if cmd == nil {
+				t.Fatalf("command %s not found", test.command)
+			}
+			err := cmd.checkArgs(test.args)
+			if (err != nil) != test.wantErr {
+				t.Errorf("checkArgs() error = %v, want error: %v", err, test.wantErr)
+			} else if err != nil && !errors.Is(err, ErrNotEnoughArguments) {
+				t.Errorf("checkArgs() error = %v, want %v", err, ErrNotEnoughArguments)
+			}
+		})
+	}
+}
@@ -24,6 +24,11 @@ type Database struct {
 	SessionRequest SessionRequestQuery
 	Receipt        ReceiptQuery
 	Media          MediaQuery
+	PollResponse   PollResponseQuery
+	ScheduledEvent ScheduledEventQuery
+	Draft          DraftQuery
+	URLPreview     URLPreviewQuery
+	Webhook        WebhookDeliveryQuery
 }
 
 func New(rawDB *dbutil.Database) *Database {
@@ -41,6 +46,11 @@ func New(rawDB *dbutil.Database) *Database {
 		SessionRequest: SessionRequestQuery{QueryHelper: dbutil.MakeQueryHelper(rawDB, newSessionRequest)},
 		Receipt:        ReceiptQuery{QueryHelper: dbutil.MakeQueryHelper(rawDB, newReceipt)},
 		Media:          MediaQuery{QueryHelper: dbutil.MakeQueryHelper(rawDB, newMedia)},
+		PollResponse:   PollResponseQuery{QueryHelper: dbutil.MakeQueryHelper(rawDB, newPollResponse)},
+		ScheduledEvent: ScheduledEventQuery{QueryHelper: dbutil.MakeQueryHelper(rawDB, newScheduledEvent)},
+		Draft:          DraftQuery{QueryHelper: dbutil.MakeQueryHelper(rawDB, newDraft)},
+		URLPreview:     URLPreviewQuery{QueryHelper: dbutil.MakeQueryHelper(rawDB, newURLPreview)},
+		Webhook:        WebhookDeliveryQuery{QueryHelper: dbutil.MakeQueryHelper(rawDB, newWebhookDelivery)},
 	}
 }
 
@@ -64,6 +74,26 @@ func newMedia(_ *dbutil.QueryHelper[*Media]) *Media {
 	return &Media{}
 }
 
+func newPollResponse(_ *dbutil.QueryHelper[*PollResponse]) *PollResponse {
+	return &PollResponse{}
+}
+
+func newScheduledEvent(_ *dbutil.QueryHelper[*ScheduledEvent]) *ScheduledEvent {
+	return &ScheduledEvent{}
+}
+
+func newDraft(_ *dbutil.QueryHelper[*Draft]) *Draft {
+	return &Draft{}
+}
+
+func newURLPreview(_ *dbutil.QueryHelper[*URLPreview]) *URLPreview {
+	return &URLPreview{}
+}
+
+func newWebhookDelivery(_ *dbutil.QueryHelper[*WebhookDelivery]) *WebhookDelivery {
+	return &WebhookDelivery{}
+}
+
 func newAccountData(_ *dbutil.QueryHelper[*AccountData]) *AccountData {
 	return &AccountData{}
 }
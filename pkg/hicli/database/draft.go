@@ -0,0 +1,107 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getDraftBaseQuery = `
+		SELECT room_id, thread_root, text, media, reply_to, edit_of, updated_at
+		FROM draft
+	`
+	getAllDraftsQuery    = getDraftBaseQuery + `ORDER BY updated_at DESC`
+	getDraftsInRoomQuery = getDraftBaseQuery + `WHERE room_id = $1 ORDER BY updated_at DESC`
+	getDraftQuery        = getDraftBaseQuery + `WHERE room_id = $1 AND thread_root = $2`
+	upsertDraftQuery     = `
+		INSERT INTO draft (room_id, thread_root, text, media, reply_to, edit_of, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (room_id, thread_root) DO UPDATE
+			SET text = excluded.text,
+			    media = excluded.media,
+			    reply_to = excluded.reply_to,
+			    edit_of = excluded.edit_of,
+			    updated_at = excluded.updated_at
+	`
+	deleteDraftQuery = `DELETE FROM draft WHERE room_id = $1 AND thread_root = $2`
+)
+
+type DraftQuery struct {
+	*dbutil.QueryHelper[*Draft]
+}
+
+// GetAll returns all drafts, most recently updated first.
+func (dq *DraftQuery) GetAll(ctx context.Context) ([]*Draft, error) {
+	return dq.QueryMany(ctx, getAllDraftsQuery)
+}
+
+func (dq *DraftQuery) GetAllInRoom(ctx context.Context, roomID id.RoomID) ([]*Draft, error) {
+	return dq.QueryMany(ctx, getDraftsInRoomQuery, roomID)
+}
+
+func (dq *DraftQuery) Get(ctx context.Context, roomID id.RoomID, threadRoot id.EventID) (*Draft, error) {
+	return dq.QueryOne(ctx, getDraftQuery, roomID, threadRoot)
+}
+
+func (dq *DraftQuery) Upsert(ctx context.Context, draft *Draft) error {
+	return dq.Exec(ctx, upsertDraftQuery, draft.sqlVariables()...)
+}
+
+func (dq *DraftQuery) Delete(ctx context.Context, roomID id.RoomID, threadRoot id.EventID) error {
+	return dq.Exec(ctx, deleteDraftQuery, roomID, threadRoot)
+}
+
+// Draft is an unsent message in the composer of a room or thread.
+//
+// Drafts are stored in the database rather than in the frontend so that they're shared between all clients
+// connected to the same backend. An empty ThreadRoot means the draft is for the main timeline of the room.
+type Draft struct {
+	RoomID     id.RoomID          `json:"room_id"`
+	ThreadRoot id.EventID         `json:"thread_root,omitempty"`
+	Text       string             `json:"text"`
+	Media      json.RawMessage    `json:"media,omitempty"`
+	ReplyTo    id.EventID         `json:"reply_to,omitempty"`
+	EditOf     id.EventID         `json:"edit_of,omitempty"`
+	UpdatedAt  jsontime.UnixMilli `json:"updated_at"`
+}
+
+func (d *Draft) Scan(row dbutil.Scannable) (*Draft, error) {
+	var media []byte
+	var replyTo, editOf sql.NullString
+	var updatedAt int64
+	err := row.Scan(&d.RoomID, &d.ThreadRoot, &d.Text, &media, &replyTo, &editOf, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(media) > 0 {
+		d.Media = media
+	}
+	d.ReplyTo = id.EventID(replyTo.String)
+	d.EditOf = id.EventID(editOf.String)
+	d.UpdatedAt = jsontime.UM(time.UnixMilli(updatedAt))
+	return d, nil
+}
+
+func (d *Draft) sqlVariables() []any {
+	return []any{
+		d.RoomID,
+		d.ThreadRoot,
+		d.Text,
+		unsafeJSONString(d.Media),
+		dbutil.StrPtr(d.ReplyTo),
+		dbutil.StrPtr(d.EditOf),
+		d.UpdatedAt.UnixMilli(),
+	}
+}
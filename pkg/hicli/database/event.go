@@ -35,6 +35,7 @@ const (
 	getManyEventsByRowID             = getEventBaseQuery + `WHERE rowid IN (%s)`
 	getEventByID                     = getEventBaseQuery + `WHERE event_id = $1`
 	getFailedEventsByMegolmSessionID = getEventBaseQuery + `WHERE room_id = $1 AND megolm_session_id = $2 AND decryption_error IS NOT NULL`
+	getFailedMegolmSessionsQuery     = `SELECT DISTINCT room_id, megolm_session_id FROM event WHERE decryption_error IS NOT NULL AND megolm_session_id IS NOT NULL`
 	insertEventBaseQuery             = `
 		INSERT INTO event (
 			room_id, event_id, sender, type, state_key, timestamp, content, decrypted, decrypted_type,
@@ -72,6 +73,37 @@ const (
 		  AND redacted_by IS NULL
 		  AND relates_to IN (%s)
 	`
+	getOwnReactionKeysQuery = `
+		SELECT relates_to, content ->> '$."m.relates_to".key'
+		FROM event
+		WHERE room_id = ?
+		  AND sender = ?
+		  AND type = 'm.reaction'
+		  AND relation_type = 'm.annotation'
+		  AND redacted_by IS NULL
+		  AND relates_to IN (%s)
+	`
+	getOwnReactionQuery = getEventBaseQuery + `
+		WHERE room_id = $1
+		  AND sender = $2
+		  AND relates_to = $3
+		  AND content ->> '$."m.relates_to".key' = $4
+		  AND type = 'm.reaction'
+		  AND relation_type = 'm.annotation'
+		  AND redacted_by IS NULL
+		  AND send_error IS NULL
+		ORDER BY timestamp DESC
+		LIMIT 1
+	`
+	getEventEditsQuery = getEventBaseQuery + `
+		WHERE room_id = $1
+		  AND relates_to = $2
+		  AND relation_type = 'm.replace'
+		  AND type = $3
+		  AND sender = $4
+		  AND redacted_by IS NULL
+		ORDER BY timestamp
+	`
 	getEventEditRowIDsQuery = `
 		SELECT main.event_id, edit.rowid
 		FROM event main
@@ -95,6 +127,20 @@ type EventQuery struct {
 	*dbutil.QueryHelper[*Event]
 }
 
+type FailedMegolmSession struct {
+	RoomID    id.RoomID
+	SessionID id.SessionID
+}
+
+// GetFailedMegolmSessions returns the megolm sessions of all events that have failed to decrypt.
+func (eq *EventQuery) GetFailedMegolmSessions(ctx context.Context) ([]FailedMegolmSession, error) {
+	rows, err := eq.GetDB().Query(ctx, getFailedMegolmSessionsQuery)
+	return dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (sess FailedMegolmSession, err error) {
+		err = row.Scan(&sess.RoomID, &sess.SessionID)
+		return
+	}, err).AsList()
+}
+
 func (eq *EventQuery) GetFailedByMegolmSessionID(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) ([]*Event, error) {
 	return eq.QueryMany(ctx, getFailedEventsByMegolmSessionID, roomID, sessionID)
 }
@@ -211,6 +257,48 @@ func (eq *EventQuery) FillReactionCounts(ctx context.Context, roomID id.RoomID,
 	return nil
 }
 
+// FillOwnReactions sets the OwnReactions field of events that have reactions
+// to the list of reaction keys that the given user has sent.
+func (eq *EventQuery) FillOwnReactions(ctx context.Context, roomID id.RoomID, userID id.UserID, events []*Event) error {
+	eventIDs := make([]id.EventID, 0, len(events))
+	eventMap := make(map[id.EventID]*Event)
+	for _, evt := range events {
+		if len(evt.Reactions) > 0 {
+			eventIDs = append(eventIDs, evt.ID)
+			eventMap[evt.ID] = evt
+		}
+	}
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	query, params := buildMultiEventGetFunction([]any{roomID, userID}, eventIDs, getOwnReactionKeysQuery)
+	rows, err := eq.GetDB().Query(ctx, query, params...)
+	return dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (tuple ownReactionTuple, err error) {
+		err = row.Scan(&tuple.eventID, &tuple.key)
+		return
+	}, err).Iter(func(tuple ownReactionTuple) (bool, error) {
+		evt := eventMap[tuple.eventID]
+		if evt != nil && tuple.key.Valid && !slices.Contains(evt.OwnReactions, tuple.key.String) {
+			evt.OwnReactions = append(evt.OwnReactions, tuple.key.String)
+		}
+		return true, nil
+	})
+}
+
+type ownReactionTuple struct {
+	eventID id.EventID
+	key     sql.NullString
+}
+
+// GetEdits returns all valid edits of the given event ordered by timestamp.
+func (eq *EventQuery) GetEdits(ctx context.Context, evt *Event) ([]*Event, error) {
+	return eq.QueryMany(ctx, getEventEditsQuery, evt.RoomID, evt.ID, evt.Type, evt.Sender)
+}
+
+func (eq *EventQuery) GetOwnReaction(ctx context.Context, roomID id.RoomID, userID id.UserID, eventID id.EventID, key string) (*Event, error) {
+	return eq.QueryOne(ctx, getOwnReactionQuery, roomID, userID, eventID, key)
+}
+
 func (eq *EventQuery) FillLastEditRowIDs(ctx context.Context, roomID id.RoomID, events []*Event) error {
 	eventIDs := make([]id.EventID, len(events))
 	eventMap := make(map[id.EventID]*Event)
@@ -328,6 +416,7 @@ type LocalContent struct {
 	BigEmoji      bool   `json:"big_emoji,omitempty"`
 	HasMath       bool   `json:"has_math,omitempty"`
 	EditSource    string `json:"edit_source,omitempty"`
+	Waveform      []int  `json:"waveform,omitempty"`
 }
 
 type Event struct {
@@ -358,8 +447,11 @@ type Event struct {
 	SendError       string       `json:"send_error,omitempty"`
 
 	Reactions     map[string]int `json:"reactions,omitempty"`
+	OwnReactions  []string       `json:"own_reactions,omitempty"`
+	Poll          *PollSummary   `json:"poll,omitempty"`
 	LastEditRowID *EventRowID    `json:"last_edit_rowid,omitempty"`
 	UnreadType    UnreadType     `json:"unread_type,omitempty"`
+	Ignored       bool           `json:"ignored,omitempty"`
 }
 
 func MautrixToEvent(evt *event.Event) *Event {
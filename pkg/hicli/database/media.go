@@ -44,6 +44,7 @@ const (
 		FROM media
 		WHERE mxc = $1
 	`
+	deleteMediaQuery       = `DELETE FROM media WHERE mxc = $1`
 	addMediaReferenceQuery = `
 		INSERT INTO media_reference (event_rowid, media_mxc)
 		VALUES ($1, $2)
@@ -97,6 +98,10 @@ func (mq *MediaQuery) Put(ctx context.Context, cm *Media) error {
 	return mq.Exec(ctx, upsertMediaQuery, cm.sqlVariables()...)
 }
 
+func (mq *MediaQuery) Delete(ctx context.Context, mxc id.ContentURI) error {
+	return mq.Exec(ctx, deleteMediaQuery, &mxc)
+}
+
 func (mq *MediaQuery) Get(ctx context.Context, mxc id.ContentURI) (*Media, error) {
 	return mq.QueryOne(ctx, getMediaQuery, &mxc)
 }
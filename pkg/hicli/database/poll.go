@@ -0,0 +1,157 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package database
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	upsertPollResponseQuery = `
+		INSERT INTO poll_response (event_rowid, room_id, poll_event_id, is_end, answers)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (event_rowid) DO UPDATE
+			SET poll_event_id = excluded.poll_event_id,
+			    is_end = excluded.is_end,
+			    answers = excluded.answers
+	`
+	getPollResponsesQuery = `
+		SELECT poll_response.event_rowid, poll_response.room_id, poll_response.poll_event_id,
+		       poll_response.is_end, poll_response.answers, event.sender, event.timestamp
+		FROM poll_response
+		INNER JOIN event ON event.rowid = poll_response.event_rowid
+		WHERE poll_response.room_id = ?
+		  AND event.redacted_by IS NULL
+		  AND event.send_error IS NULL
+		  AND poll_response.poll_event_id IN (%s)
+		ORDER BY event.timestamp, event.rowid
+	`
+)
+
+type PollResponseQuery struct {
+	*dbutil.QueryHelper[*PollResponse]
+}
+
+func (prq *PollResponseQuery) Put(ctx context.Context, resp *PollResponse) error {
+	return prq.Exec(ctx, upsertPollResponseQuery, resp.sqlVariables()...)
+}
+
+// GetMany returns all non-redacted responses and end events for the given polls ordered by timestamp.
+func (prq *PollResponseQuery) GetMany(ctx context.Context, roomID id.RoomID, pollEventIDs ...id.EventID) (map[id.EventID][]*PollResponse, error) {
+	output := make(map[id.EventID][]*PollResponse, len(pollEventIDs))
+	if len(pollEventIDs) == 0 {
+		return output, nil
+	}
+	query, params := buildMultiEventGetFunction([]any{roomID}, pollEventIDs, getPollResponsesQuery)
+	responses, err := prq.QueryMany(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range responses {
+		output[resp.PollEventID] = append(output[resp.PollEventID], resp)
+	}
+	return output, nil
+}
+
+type PollResponse struct {
+	EventRowID  EventRowID
+	RoomID      id.RoomID
+	PollEventID id.EventID
+	IsEnd       bool
+	Answers     []string
+
+	// These are only filled when reading from the database
+	Sender    id.UserID
+	Timestamp jsontime.UnixMilli
+}
+
+func (pr *PollResponse) Scan(row dbutil.Scannable) (*PollResponse, error) {
+	var ts int64
+	err := row.Scan(
+		&pr.EventRowID, &pr.RoomID, &pr.PollEventID, &pr.IsEnd, dbutil.JSON{Data: &pr.Answers}, &pr.Sender, &ts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	pr.Timestamp = jsontime.UM(time.UnixMilli(ts))
+	return pr, nil
+}
+
+func (pr *PollResponse) sqlVariables() []any {
+	answers := pr.Answers
+	if answers == nil {
+		answers = []string{}
+	}
+	return []any{pr.EventRowID, pr.RoomID, pr.PollEventID, pr.IsEnd, dbutil.JSON{Data: answers}}
+}
+
+// PollSummary contains the aggregated results of a poll. It's only filled for poll start events.
+type PollSummary struct {
+	Start      *PollStart         `json:"start"`
+	Tallies    map[string]int     `json:"tallies"`
+	TotalVotes int                `json:"total_votes"`
+	OwnVote    []string           `json:"own_vote,omitempty"`
+	Ended      bool               `json:"ended"`
+	EndedAt    jsontime.UnixMilli `json:"ended_at,omitempty"`
+}
+
+type PollKind string
+
+const (
+	PollKindDisclosed   PollKind = "disclosed"
+	PollKindUndisclosed PollKind = "undisclosed"
+)
+
+type PollAnswer struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// PollStart is a normalized version of a poll start event, which may be in either the stable or unstable format.
+type PollStart struct {
+	Question      string       `json:"question"`
+	Kind          PollKind     `json:"kind"`
+	MaxSelections int          `json:"max_selections"`
+	Answers       []PollAnswer `json:"answers"`
+	Stable        bool         `json:"stable"`
+}
+
+// Normalize fills default values and clamps the maximum number of selections to the number of answers.
+func (poll *PollStart) Normalize() *PollStart {
+	if poll.Kind != PollKindUndisclosed {
+		poll.Kind = PollKindDisclosed
+	}
+	poll.MaxSelections = min(max(poll.MaxSelections, 1), max(len(poll.Answers), 1))
+	return poll
+}
+
+// ValidateSelections removes unknown and duplicate answers and truncates the list to the maximum number of selections.
+// If there are no valid answers left, the vote is spoiled and nil is returned.
+func (poll *PollStart) ValidateSelections(selections []string) []string {
+	valid := make([]string, 0, poll.MaxSelections)
+	for _, selection := range selections {
+		if len(valid) >= poll.MaxSelections {
+			break
+		}
+		isKnown := slices.ContainsFunc(poll.Answers, func(answer PollAnswer) bool {
+			return answer.ID == selection
+		})
+		if isKnown && !slices.Contains(valid, selection) {
+			valid = append(valid, selection)
+		}
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	return valid
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"maps"
 	"time"
 
 	"go.mau.fi/util/dbutil"
@@ -23,12 +24,24 @@ const (
 	getRoomBaseQuery = `
 		SELECT room_id, creation_content, tombstone_content, name, name_quality, avatar, explicit_avatar, topic, canonical_alias,
 		       lazy_load_summary, encryption_event, has_member_list, preview_event_rowid, sorting_timestamp,
-		       unread_highlights, unread_notifications, unread_messages, marked_unread, prev_batch
+		       unread_highlights, unread_notifications, unread_messages, marked_unread, tags, prev_batch
 		FROM room
 	`
-	getRoomsBySortingTimestampQuery = getRoomBaseQuery + `WHERE sorting_timestamp < $1 AND sorting_timestamp > 0 ORDER BY sorting_timestamp DESC LIMIT $2`
-	getRoomByIDQuery                = getRoomBaseQuery + `WHERE room_id = $1`
-	ensureRoomExistsQuery           = `
+	// roomSectionExpression must match the logic in Room.Section
+	roomSectionExpression = `
+		CASE
+			WHEN tags -> '$."m.favourite"' IS NOT NULL THEN 0
+			WHEN tags -> '$."m.lowpriority"' IS NOT NULL THEN 2
+			ELSE 1
+		END
+	`
+	getRoomsBySortingTimestampQuery = getRoomBaseQuery + `
+		WHERE sorting_timestamp < $2 AND sorting_timestamp > 0 AND ` + roomSectionExpression + ` = $1
+		ORDER BY sorting_timestamp DESC
+		LIMIT $3
+	`
+	getRoomByIDQuery      = getRoomBaseQuery + `WHERE room_id = $1`
+	ensureRoomExistsQuery = `
 		INSERT INTO room (room_id) VALUES ($1)
 		ON CONFLICT (room_id) DO NOTHING
 	`
@@ -51,7 +64,8 @@ const (
 			unread_notifications = COALESCE($16, room.unread_notifications),
 			unread_messages = COALESCE($17, room.unread_messages),
 			marked_unread = COALESCE($18, room.marked_unread),
-			prev_batch = COALESCE($19, room.prev_batch)
+			tags = COALESCE($19, room.tags),
+			prev_batch = COALESCE($20, room.prev_batch)
 		WHERE room_id = $1
 	`
 	setRoomPrevBatchQuery = `
@@ -91,8 +105,8 @@ func (rq *RoomQuery) Get(ctx context.Context, roomID id.RoomID) (*Room, error) {
 	return rq.QueryOne(ctx, getRoomByIDQuery, roomID)
 }
 
-func (rq *RoomQuery) GetBySortTS(ctx context.Context, maxTS time.Time, limit int) ([]*Room, error) {
-	return rq.QueryMany(ctx, getRoomsBySortingTimestampQuery, maxTS.UnixMilli(), limit)
+func (rq *RoomQuery) GetBySortTS(ctx context.Context, section RoomSection, maxTS time.Time, limit int) ([]*Room, error) {
+	return rq.QueryMany(ctx, getRoomsBySortingTimestampQuery, section, maxTS.UnixMilli(), limit)
 }
 
 func (rq *RoomQuery) Upsert(ctx context.Context, room *Room) error {
@@ -136,6 +150,16 @@ const (
 	NameQualityExplicit
 )
 
+type RoomSection int
+
+const (
+	RoomSectionFavourite RoomSection = iota
+	RoomSectionNormal
+	RoomSectionLowPriority
+)
+
+var RoomSections = []RoomSection{RoomSectionFavourite, RoomSectionNormal, RoomSectionLowPriority}
+
 const PrevBatchPaginationComplete = "fi.mau.gomuks.pagination_complete"
 
 type Room struct {
@@ -160,9 +184,22 @@ type Room struct {
 	UnreadCounts
 	MarkedUnread *bool `json:"marked_unread,omitempty"`
 
+	Tags event.Tags `json:"tags,omitempty"`
+
 	PrevBatch string `json:"prev_batch"`
 }
 
+// Section returns the room list section of the room based on the m.favourite and m.lowpriority tags.
+// If the room has both tags, it's considered a favourite.
+func (r *Room) Section() RoomSection {
+	if _, ok := r.Tags[event.RoomTagFavourite]; ok {
+		return RoomSectionFavourite
+	} else if _, ok = r.Tags[event.RoomTagLowPriority]; ok {
+		return RoomSectionLowPriority
+	}
+	return RoomSectionNormal
+}
+
 func (r *Room) CheckChangesAndCopyInto(other *Room) (hasChanges bool) {
 	if r.CreationContent != nil {
 		other.CreationContent = r.CreationContent
@@ -226,6 +263,10 @@ func (r *Room) CheckChangesAndCopyInto(other *Room) (hasChanges bool) {
 		other.MarkedUnread = r.MarkedUnread
 		hasChanges = true
 	}
+	if r.Tags != nil && !maps.Equal(r.Tags, other.Tags) {
+		other.Tags = r.Tags
+		hasChanges = true
+	}
 	if r.PrevBatch != "" && other.PrevBatch == "" {
 		other.PrevBatch = r.PrevBatch
 		hasChanges = true
@@ -255,6 +296,7 @@ func (r *Room) Scan(row dbutil.Scannable) (*Room, error) {
 		&r.UnreadNotifications,
 		&r.UnreadMessages,
 		&r.MarkedUnread,
+		dbutil.JSON{Data: &r.Tags},
 		&prevBatch,
 	)
 	if err != nil {
@@ -267,6 +309,10 @@ func (r *Room) Scan(row dbutil.Scannable) (*Room, error) {
 }
 
 func (r *Room) sqlVariables() []any {
+	var tagsJSON any
+	if r.Tags != nil {
+		tagsJSON = dbutil.JSON{Data: r.Tags}
+	}
 	return []any{
 		r.ID,
 		dbutil.JSONPtr(r.CreationContent),
@@ -286,6 +332,7 @@ func (r *Room) sqlVariables() []any {
 		r.UnreadNotifications,
 		r.UnreadMessages,
 		r.MarkedUnread,
+		tagsJSON,
 		dbutil.StrPtr(r.PrevBatch),
 	}
 }
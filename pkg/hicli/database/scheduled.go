@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getScheduledEventBaseQuery = `
+		SELECT rowid, room_id, type, content, send_at, created_at, delay_id, send_error
+		FROM scheduled_event
+	`
+	getScheduledEventByRowIDQuery = getScheduledEventBaseQuery + `WHERE rowid = $1`
+	getAllScheduledEventsQuery    = getScheduledEventBaseQuery + `ORDER BY send_at, rowid`
+	getScheduledEventsInRoomQuery = getScheduledEventBaseQuery + `WHERE room_id = $1 ORDER BY send_at, rowid`
+	getNextScheduledEventQuery    = getScheduledEventBaseQuery + `WHERE send_error IS NULL ORDER BY send_at, rowid LIMIT 1`
+	insertScheduledEventQuery     = `
+		INSERT INTO scheduled_event (room_id, type, content, send_at, created_at, delay_id, send_error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING rowid
+	`
+	deleteScheduledEventQuery       = `DELETE FROM scheduled_event WHERE rowid = $1`
+	setScheduledEventSendErrorQuery = `UPDATE scheduled_event SET send_error = $2 WHERE rowid = $1`
+)
+
+type ScheduledEventQuery struct {
+	*dbutil.QueryHelper[*ScheduledEvent]
+}
+
+func (seq *ScheduledEventQuery) Get(ctx context.Context, rowID ScheduledEventRowID) (*ScheduledEvent, error) {
+	return seq.QueryOne(ctx, getScheduledEventByRowIDQuery, rowID)
+}
+
+// GetAll returns all scheduled events ordered by the time they'll be sent.
+func (seq *ScheduledEventQuery) GetAll(ctx context.Context) ([]*ScheduledEvent, error) {
+	return seq.QueryMany(ctx, getAllScheduledEventsQuery)
+}
+
+func (seq *ScheduledEventQuery) GetAllInRoom(ctx context.Context, roomID id.RoomID) ([]*ScheduledEvent, error) {
+	return seq.QueryMany(ctx, getScheduledEventsInRoomQuery, roomID)
+}
+
+// GetNext returns the scheduled event that is due next, ignoring events that already failed to send.
+func (seq *ScheduledEventQuery) GetNext(ctx context.Context) (*ScheduledEvent, error) {
+	return seq.QueryOne(ctx, getNextScheduledEventQuery)
+}
+
+func (seq *ScheduledEventQuery) Insert(ctx context.Context, evt *ScheduledEvent) error {
+	return seq.GetDB().QueryRow(ctx, insertScheduledEventQuery, evt.sqlVariables()...).Scan(&evt.RowID)
+}
+
+func (seq *ScheduledEventQuery) Delete(ctx context.Context, rowID ScheduledEventRowID) error {
+	return seq.Exec(ctx, deleteScheduledEventQuery, rowID)
+}
+
+func (seq *ScheduledEventQuery) SetSendError(ctx context.Context, rowID ScheduledEventRowID, sendError string) error {
+	return seq.Exec(ctx, setScheduledEventSendErrorQuery, rowID, sendError)
+}
+
+type ScheduledEventRowID int64
+
+// ScheduledEvent is an event that will be sent to a room at a specific time in the future.
+//
+// If DelayID is set, the event was handed over to the homeserver as an MSC4140 delayed event
+// and the homeserver is responsible for sending it.
+type ScheduledEvent struct {
+	RowID     ScheduledEventRowID `json:"rowid"`
+	RoomID    id.RoomID           `json:"room_id"`
+	Type      string              `json:"type"`
+	Content   json.RawMessage     `json:"content"`
+	SendAt    jsontime.UnixMilli  `json:"send_at"`
+	CreatedAt jsontime.UnixMilli  `json:"created_at"`
+	DelayID   string              `json:"delay_id,omitempty"`
+	SendError string              `json:"send_error,omitempty"`
+}
+
+func (se *ScheduledEvent) Scan(row dbutil.Scannable) (*ScheduledEvent, error) {
+	var sendAt, createdAt int64
+	var delayID, sendError sql.NullString
+	err := row.Scan(
+		&se.RowID, &se.RoomID, &se.Type, (*[]byte)(&se.Content), &sendAt, &createdAt, &delayID, &sendError,
+	)
+	if err != nil {
+		return nil, err
+	}
+	se.SendAt = jsontime.UM(time.UnixMilli(sendAt))
+	se.CreatedAt = jsontime.UM(time.UnixMilli(createdAt))
+	se.DelayID = delayID.String
+	se.SendError = sendError.String
+	return se, nil
+}
+
+func (se *ScheduledEvent) sqlVariables() []any {
+	return []any{
+		se.RoomID,
+		se.Type,
+		unsafeJSONString(se.Content),
+		se.SendAt.UnixMilli(),
+		se.CreatedAt.UnixMilli(),
+		dbutil.StrPtr(se.DelayID),
+		dbutil.StrPtr(se.SendError),
+	}
+}
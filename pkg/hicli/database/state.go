@@ -41,6 +41,7 @@ const (
 	getCurrentRoomStateWithoutMembersQuery = getCurrentRoomStateBaseQuery + `WHERE cs.room_id = $1 AND type<>'m.room.member'`
 	getManyCurrentRoomStateQuery           = getCurrentRoomStateBaseQuery + `WHERE (cs.room_id, cs.event_type, cs.state_key) IN (%s)`
 	getCurrentStateEventQuery              = getCurrentRoomStateBaseQuery + `WHERE cs.room_id = $1 AND cs.event_type = $2 AND cs.state_key = $3`
+	getJoinedMemberEventsOfUserQuery       = getCurrentRoomStateBaseQuery + `WHERE cs.event_type = 'm.room.member' AND cs.state_key = $1 AND cs.membership = 'join'`
 )
 
 var massInsertCurrentStateBuilder = dbutil.NewMassInsertBuilder[*CurrentStateEntry, [1]any](addCurrentStateQuery, "($1, $%d, $%d, $%d, $%d)")
@@ -111,6 +112,11 @@ func (csq *CurrentStateQuery) Get(ctx context.Context, roomID id.RoomID, eventTy
 	return csq.QueryOne(ctx, getCurrentStateEventQuery, roomID, eventType.Type, stateKey)
 }
 
+// GetJoinedMemberEventsOfUser returns the member events of the given user in all rooms they're joined to.
+func (csq *CurrentStateQuery) GetJoinedMemberEventsOfUser(ctx context.Context, userID id.UserID) ([]*Event, error) {
+	return csq.QueryMany(ctx, getJoinedMemberEventsOfUserQuery, userID)
+}
+
 func (csq *CurrentStateQuery) GetAll(ctx context.Context, roomID id.RoomID) ([]*Event, error) {
 	return csq.QueryMany(ctx, getCurrentRoomStateQuery, roomID)
 }
@@ -31,8 +31,9 @@ const (
 	checkTimelineContainsQuery = `
 		SELECT EXISTS(SELECT 1 FROM timeline WHERE room_id = $1 AND event_rowid = $2)
 	`
-	findMinRowIDQuery = `SELECT MIN(rowid) FROM timeline`
-	getTimelineQuery  = `
+	findMinRowIDQuery    = `SELECT MIN(rowid) FROM timeline`
+	getTimelineRoomQuery = `SELECT room_id FROM timeline WHERE rowid = $1`
+	getTimelineQuery     = `
 		SELECT event.rowid, timeline.rowid,
 		       event.room_id, event_id, sender, type, state_key, timestamp, content, decrypted, decrypted_type,
 		       unsigned, local_content, transaction_id, redacted_by, relates_to, relation_type,
@@ -129,6 +130,16 @@ func (tq *TimelineQuery) Get(ctx context.Context, roomID id.RoomID, limit int, b
 	return tq.QueryMany(ctx, getTimelineQuery, roomID, before, limit)
 }
 
+// GetRoomID returns the ID of the room whose timeline the given timeline row belongs to.
+// If the row doesn't exist, an empty string is returned.
+func (tq *TimelineQuery) GetRoomID(ctx context.Context, rowID TimelineRowID) (roomID id.RoomID, err error) {
+	err = tq.GetDB().QueryRow(ctx, getTimelineRoomQuery, rowID).Scan(&roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
 func (tq *TimelineQuery) Has(ctx context.Context, roomID id.RoomID, eventRowID EventRowID) (exists bool, err error) {
 	err = tq.GetDB().QueryRow(ctx, checkTimelineContainsQuery, roomID, eventRowID).Scan(&exists)
 	return
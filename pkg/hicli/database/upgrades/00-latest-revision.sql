@@ -1,4 +1,4 @@
--- v0 -> v7 (compatible with v5+): Latest revision
+-- v0 -> v13 (compatible with v5+): Latest revision
 CREATE TABLE account (
 	user_id        TEXT NOT NULL PRIMARY KEY,
 	device_id      TEXT NOT NULL,
@@ -30,6 +30,7 @@ CREATE TABLE room (
 	unread_notifications INTEGER NOT NULL DEFAULT 0,
 	unread_messages      INTEGER NOT NULL DEFAULT 0,
 	marked_unread        INTEGER NOT NULL DEFAULT false,
+	tags                 TEXT,
 
 	prev_batch           TEXT,
 
@@ -263,3 +264,64 @@ CREATE TABLE receipt (
 	CONSTRAINT receipt_room_fkey FOREIGN KEY (room_id) REFERENCES room (room_id) ON DELETE CASCADE
 	-- note: there's no foreign key on event ID because receipts could point at events that are too far in history.
 ) STRICT;
+
+CREATE TABLE poll_response (
+	event_rowid   INTEGER NOT NULL PRIMARY KEY,
+	room_id       TEXT    NOT NULL,
+	poll_event_id TEXT    NOT NULL,
+	is_end        INTEGER NOT NULL,
+	answers       TEXT    NOT NULL,
+
+	CONSTRAINT poll_response_event_fkey FOREIGN KEY (event_rowid) REFERENCES event (rowid) ON DELETE CASCADE,
+	CONSTRAINT poll_response_room_fkey FOREIGN KEY (room_id) REFERENCES room (room_id) ON DELETE CASCADE
+) STRICT;
+CREATE INDEX poll_response_poll_idx ON poll_response (room_id, poll_event_id);
+
+CREATE TABLE scheduled_event (
+	rowid      INTEGER PRIMARY KEY,
+	room_id    TEXT    NOT NULL,
+	type       TEXT    NOT NULL,
+	content    TEXT    NOT NULL,
+	send_at    INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	delay_id   TEXT,
+	send_error TEXT,
+
+	CONSTRAINT scheduled_event_room_fkey FOREIGN KEY (room_id) REFERENCES room (room_id) ON DELETE CASCADE
+) STRICT;
+CREATE INDEX scheduled_event_send_at_idx ON scheduled_event (send_at);
+
+CREATE TABLE draft (
+	room_id     TEXT    NOT NULL,
+	thread_root TEXT    NOT NULL DEFAULT '',
+	text        TEXT    NOT NULL,
+	media       TEXT,
+	reply_to    TEXT,
+	edit_of     TEXT,
+	updated_at  INTEGER NOT NULL,
+
+	PRIMARY KEY (room_id, thread_root),
+	CONSTRAINT draft_room_fkey FOREIGN KEY (room_id) REFERENCES room (room_id) ON DELETE CASCADE
+) STRICT;
+
+CREATE TABLE url_preview (
+	url        TEXT    NOT NULL PRIMARY KEY,
+	preview    TEXT,
+	error      TEXT,
+	fetched_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+) STRICT;
+CREATE INDEX url_preview_expiry_idx ON url_preview (expires_at);
+
+CREATE TABLE webhook_delivery (
+	rowid        INTEGER PRIMARY KEY,
+	webhook      TEXT    NOT NULL,
+	room_id      TEXT    NOT NULL,
+	event_id     TEXT    NOT NULL,
+	attempts     INTEGER NOT NULL,
+	status_code  INTEGER,
+	error        TEXT,
+	created_at   INTEGER NOT NULL,
+	completed_at INTEGER NOT NULL
+) STRICT;
+CREATE INDEX webhook_delivery_created_at_idx ON webhook_delivery (created_at);
@@ -0,0 +1,12 @@
+-- v8 (compatible with v5+): Add table for aggregating poll responses
+CREATE TABLE poll_response (
+	event_rowid   INTEGER NOT NULL PRIMARY KEY,
+	room_id       TEXT    NOT NULL,
+	poll_event_id TEXT    NOT NULL,
+	is_end        INTEGER NOT NULL,
+	answers       TEXT    NOT NULL,
+
+	CONSTRAINT poll_response_event_fkey FOREIGN KEY (event_rowid) REFERENCES event (rowid) ON DELETE CASCADE,
+	CONSTRAINT poll_response_room_fkey FOREIGN KEY (room_id) REFERENCES room (room_id) ON DELETE CASCADE
+) STRICT;
+CREATE INDEX poll_response_poll_idx ON poll_response (room_id, poll_event_id);
@@ -0,0 +1,8 @@
+-- v9 (compatible with v5+): Add room column for tags
+ALTER TABLE room ADD COLUMN tags TEXT;
+UPDATE room
+SET tags = (
+	SELECT content -> 'tags'
+	FROM room_account_data
+	WHERE room_account_data.room_id = room.room_id AND room_account_data.type = 'm.tag'
+);
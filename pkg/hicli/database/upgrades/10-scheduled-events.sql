@@ -0,0 +1,14 @@
+-- v10 (compatible with v5+): Add table for scheduled events
+CREATE TABLE scheduled_event (
+	rowid      INTEGER PRIMARY KEY,
+	room_id    TEXT    NOT NULL,
+	type       TEXT    NOT NULL,
+	content    TEXT    NOT NULL,
+	send_at    INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	delay_id   TEXT,
+	send_error TEXT,
+
+	CONSTRAINT scheduled_event_room_fkey FOREIGN KEY (room_id) REFERENCES room (room_id) ON DELETE CASCADE
+) STRICT;
+CREATE INDEX scheduled_event_send_at_idx ON scheduled_event (send_at);
@@ -0,0 +1,9 @@
+-- v12 (compatible with v5+): Add table for caching URL previews
+CREATE TABLE url_preview (
+	url        TEXT    NOT NULL PRIMARY KEY,
+	preview    TEXT,
+	error      TEXT,
+	fetched_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+) STRICT;
+CREATE INDEX url_preview_expiry_idx ON url_preview (expires_at);
@@ -0,0 +1,13 @@
+-- v13 (compatible with v5+): Add table for logging outgoing webhook deliveries
+CREATE TABLE webhook_delivery (
+	rowid        INTEGER PRIMARY KEY,
+	webhook      TEXT    NOT NULL,
+	room_id      TEXT    NOT NULL,
+	event_id     TEXT    NOT NULL,
+	attempts     INTEGER NOT NULL,
+	status_code  INTEGER,
+	error        TEXT,
+	created_at   INTEGER NOT NULL,
+	completed_at INTEGER NOT NULL
+) STRICT;
+CREATE INDEX webhook_delivery_created_at_idx ON webhook_delivery (created_at);
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+)
+
+const (
+	getURLPreviewQuery = `
+		SELECT url, preview, error, fetched_at, expires_at FROM url_preview WHERE url = $1
+	`
+	upsertURLPreviewQuery = `
+		INSERT INTO url_preview (url, preview, error, fetched_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (url) DO UPDATE
+			SET preview = excluded.preview,
+			    error = excluded.error,
+			    fetched_at = excluded.fetched_at,
+			    expires_at = excluded.expires_at
+	`
+	deleteExpiredURLPreviewsQuery = `DELETE FROM url_preview WHERE expires_at < $1`
+)
+
+type URLPreviewQuery struct {
+	*dbutil.QueryHelper[*URLPreview]
+}
+
+func (upq *URLPreviewQuery) Get(ctx context.Context, url string) (*URLPreview, error) {
+	return upq.QueryOne(ctx, getURLPreviewQuery, url)
+}
+
+func (upq *URLPreviewQuery) Put(ctx context.Context, preview *URLPreview) error {
+	return upq.Exec(ctx, upsertURLPreviewQuery, preview.sqlVariables()...)
+}
+
+func (upq *URLPreviewQuery) DeleteExpired(ctx context.Context) error {
+	return upq.Exec(ctx, deleteExpiredURLPreviewsQuery, time.Now().UnixMilli())
+}
+
+// URLPreview is a cached response from the homeserver's URL preview endpoint.
+//
+// Failed requests are cached too (with Error set and Preview empty),
+// so that broken links aren't re-requested every time they're rendered.
+type URLPreview struct {
+	URL       string             `json:"url"`
+	Preview   json.RawMessage    `json:"preview,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	FetchedAt jsontime.UnixMilli `json:"fetched_at"`
+	ExpiresAt jsontime.UnixMilli `json:"expires_at"`
+}
+
+func (up *URLPreview) Scan(row dbutil.Scannable) (*URLPreview, error) {
+	var preview []byte
+	var previewErr sql.NullString
+	var fetchedAt, expiresAt int64
+	err := row.Scan(&up.URL, &preview, &previewErr, &fetchedAt, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(preview) > 0 {
+		up.Preview = preview
+	}
+	up.Error = previewErr.String
+	up.FetchedAt = jsontime.UM(time.UnixMilli(fetchedAt))
+	up.ExpiresAt = jsontime.UM(time.UnixMilli(expiresAt))
+	return up, nil
+}
+
+func (up *URLPreview) IsExpired() bool {
+	return time.Now().After(up.ExpiresAt.Time)
+}
+
+func (up *URLPreview) sqlVariables() []any {
+	return []any{
+		up.URL,
+		unsafeJSONString(up.Preview),
+		dbutil.StrPtr(up.Error),
+		up.FetchedAt.UnixMilli(),
+		up.ExpiresAt.UnixMilli(),
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	insertWebhookDeliveryQuery = `
+		INSERT INTO webhook_delivery (webhook, room_id, event_id, attempts, status_code, error, created_at, completed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING rowid
+	`
+	getRecentWebhookDeliveriesQuery = `
+		SELECT rowid, webhook, room_id, event_id, attempts, status_code, error, created_at, completed_at
+		FROM webhook_delivery
+		ORDER BY created_at DESC
+		LIMIT $1
+	`
+	deleteOldWebhookDeliveriesQuery = `DELETE FROM webhook_delivery WHERE created_at < $1`
+)
+
+type WebhookDeliveryQuery struct {
+	*dbutil.QueryHelper[*WebhookDelivery]
+}
+
+func (wdq *WebhookDeliveryQuery) Insert(ctx context.Context, delivery *WebhookDelivery) error {
+	return wdq.GetDB().QueryRow(ctx, insertWebhookDeliveryQuery, delivery.sqlVariables()...).Scan(&delivery.RowID)
+}
+
+// GetRecent returns the most recent webhook deliveries, newest first.
+func (wdq *WebhookDeliveryQuery) GetRecent(ctx context.Context, limit int) ([]*WebhookDelivery, error) {
+	return wdq.QueryMany(ctx, getRecentWebhookDeliveriesQuery, limit)
+}
+
+func (wdq *WebhookDeliveryQuery) DeleteOlderThan(ctx context.Context, cutoff time.Time) error {
+	return wdq.Exec(ctx, deleteOldWebhookDeliveriesQuery, cutoff.UnixMilli())
+}
+
+// WebhookDelivery is a log entry of an event being sent to an outgoing webhook.
+// Failed deliveries have Error set after all retries have been used.
+type WebhookDelivery struct {
+	RowID       int64              `json:"rowid"`
+	Webhook     string             `json:"webhook"`
+	RoomID      id.RoomID          `json:"room_id"`
+	EventID     id.EventID         `json:"event_id"`
+	Attempts    int                `json:"attempts"`
+	StatusCode  int                `json:"status_code,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	CreatedAt   jsontime.UnixMilli `json:"created_at"`
+	CompletedAt jsontime.UnixMilli `json:"completed_at"`
+}
+
+func (wd *WebhookDelivery) Scan(row dbutil.Scannable) (*WebhookDelivery, error) {
+	var statusCode sql.NullInt64
+	var deliveryErr sql.NullString
+	var createdAt, completedAt int64
+	err := row.Scan(
+		&wd.RowID, &wd.Webhook, &wd.RoomID, &wd.EventID, &wd.Attempts, &statusCode, &deliveryErr, &createdAt, &completedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	wd.StatusCode = int(statusCode.Int64)
+	wd.Error = deliveryErr.String
+	wd.CreatedAt = jsontime.UM(time.UnixMilli(createdAt))
+	wd.CompletedAt = jsontime.UM(time.UnixMilli(completedAt))
+	return wd, nil
+}
+
+func (wd *WebhookDelivery) sqlVariables() []any {
+	return []any{
+		wd.Webhook,
+		wd.RoomID,
+		wd.EventID,
+		wd.Attempts,
+		dbutil.NumPtr(wd.StatusCode),
+		dbutil.StrPtr(wd.Error),
+		wd.CreatedAt.UnixMilli(),
+		wd.CompletedAt.UnixMilli(),
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/crypto"
@@ -20,17 +21,21 @@ import (
 )
 
 func (h *HiClient) fetchFromKeyBackup(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) (*crypto.InboundGroupSession, error) {
-	data, err := h.Client.GetKeyBackupForRoomAndSession(ctx, h.KeyBackupVersion, roomID, sessionID)
+	version, key := h.KeyBackup()
+	if version == "" || key == nil {
+		return nil, nil
+	}
+	data, err := h.Client.GetKeyBackupForRoomAndSession(ctx, version, roomID, sessionID)
 	if err != nil {
 		return nil, err
 	} else if data == nil {
 		return nil, nil
 	}
-	decrypted, err := data.SessionData.Decrypt(h.KeyBackupKey)
+	decrypted, err := data.SessionData.Decrypt(key)
 	if err != nil {
 		return nil, err
 	}
-	return h.Crypto.ImportRoomKeyFromBackup(ctx, h.KeyBackupVersion, roomID, sessionID, decrypted)
+	return h.Crypto.ImportRoomKeyFromBackup(ctx, version, roomID, sessionID, decrypted)
 }
 
 func (h *HiClient) handleReceivedMegolmSession(ctx context.Context, roomID id.RoomID, sessionID id.SessionID, firstKnownIndex uint32) {
@@ -44,6 +49,15 @@ func (h *HiClient) handleReceivedMegolmSession(ctx context.Context, roomID id.Ro
 	if ok {
 		syncCtx.shouldWakeupRequestQueue = true
 	}
+	// Bulk key backup restores retry all failed events in one go after importing every session
+	if ctx.Value(keyBackupRestoreContextKey) != nil {
+		return
+	}
+	h.retryFailedDecryption(ctx, roomID, sessionID)
+}
+
+func (h *HiClient) retryFailedDecryption(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) {
+	log := zerolog.Ctx(ctx)
 	events, err := h.DB.Event.GetFailedByMegolmSessionID(ctx, roomID, sessionID)
 	if err != nil {
 		log.Err(err).Msg("Failed to get events that failed to decrypt to retry decryption")
@@ -75,7 +89,8 @@ func (h *HiClient) handleReceivedMegolmSession(ctx context.Context, roomID id.Ro
 				if err != nil {
 					return fmt.Errorf("failed to save decrypted content for %s: %w", evt.ID, err)
 				}
-				if evt.CanUseForPreview() {
+				h.processPollRelation(ctx, evt)
+				if evt.CanUseForPreview() && !h.isUserIgnored(evt.Sender) {
 					var previewChanged bool
 					previewChanged, err = h.DB.Room.UpdatePreviewIfLaterOnTimeline(ctx, evt.RoomID, evt.RowID)
 					if err != nil {
@@ -91,6 +106,7 @@ func (h *HiClient) handleReceivedMegolmSession(ctx context.Context, roomID id.Ro
 			log.Err(err).Msg("Failed to save decrypted events")
 		} else {
 			h.EventHandler(&EventsDecrypted{Events: decrypted, PreviewEventRowID: newPreview, RoomID: roomID})
+			h.dispatchDecryptedLiveEvents(ctx, decrypted)
 		}
 	}
 }
@@ -114,6 +130,7 @@ func (h *HiClient) RunRequestQueue(ctx context.Context) {
 		if err != nil {
 			log.Err(err).Msg("Failed to fetch outdated device lists for tracked users")
 		}
+		h.checkKeyBackupVersionIfNeeded(ctx)
 		h.uploadKeysToBackup(ctx)
 		madeRequests, err := h.RequestQueuedSessions(ctx)
 		if err != nil {
@@ -125,6 +142,7 @@ func (h *HiClient) RunRequestQueue(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-h.requestQueueWakeup:
+		case <-time.After(keyBackupCheckInterval):
 		}
 	}
 }
@@ -0,0 +1,52 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"fmt"
+
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+// SaveDraft stores the composer state of a room or thread and notifies all connected clients about it.
+// Saving an empty draft deletes it instead.
+func (h *HiClient) SaveDraft(ctx context.Context, draft *database.Draft) (*database.Draft, error) {
+	if draft.RoomID == "" {
+		return nil, fmt.Errorf("room ID is required")
+	} else if draft.Text == "" && len(draft.Media) == 0 && draft.ReplyTo == "" && draft.EditOf == "" {
+		return nil, h.ClearDraft(ctx, draft.RoomID, draft.ThreadRoot)
+	}
+	draft.UpdatedAt = jsontime.UnixMilliNow()
+	err := h.DB.Draft.Upsert(ctx, draft)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save draft: %w", err)
+	}
+	h.EventHandler(&DraftChanged{RoomID: draft.RoomID, ThreadRoot: draft.ThreadRoot, Draft: draft})
+	return draft, nil
+}
+
+// GetDrafts returns the drafts in the given room, or in all rooms if the room ID is empty.
+func (h *HiClient) GetDrafts(ctx context.Context, roomID id.RoomID) ([]*database.Draft, error) {
+	if roomID == "" {
+		return h.DB.Draft.GetAll(ctx)
+	}
+	return h.DB.Draft.GetAllInRoom(ctx, roomID)
+}
+
+// ClearDraft deletes the draft of a room or thread and notifies all connected clients about it.
+func (h *HiClient) ClearDraft(ctx context.Context, roomID id.RoomID, threadRoot id.EventID) error {
+	err := h.DB.Draft.Delete(ctx, roomID, threadRoot)
+	if err != nil {
+		return fmt.Errorf("failed to clear draft: %w", err)
+	}
+	h.EventHandler(&DraftChanged{RoomID: roomID, ThreadRoot: threadRoot})
+	return nil
+}
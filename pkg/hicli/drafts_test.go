@@ -0,0 +1,89 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func TestHiClient_Drafts(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	const threadRoot = id.EventID("$thread")
+	var changes []*DraftChanged
+	h := newTestHiClient(t, func(evt any) {
+		if changed, ok := evt.(*DraftChanged); ok {
+			changes = append(changes, changed)
+		}
+	})
+	ctx := context.Background()
+	if err := h.DB.Room.CreateRow(ctx, roomID); err != nil {
+		t.Fatalf("failed to create room: %v", err)
+	}
+
+	steps := []struct {
+		name       string
+		threadRoot id.EventID
+		text       string
+		// Expected text of the main timeline and thread drafts after the step, empty means no draft
+		wantMain   string
+		wantThread string
+	}{
+		{"Save main draft", "", "main", "main", ""},
+		{"Save thread draft", threadRoot, "thread", "main", "thread"},
+		{"Update thread draft", threadRoot, "thread 2", "main", "thread 2"},
+		{"Update main draft", "", "main 2", "main 2", "thread 2"},
+		{"Clear thread draft", threadRoot, "", "main 2", ""},
+		{"Clear main draft", "", "", "", ""},
+	}
+	for _, step := range steps {
+		changes = nil
+		_, err := h.SaveDraft(ctx, &database.Draft{RoomID: roomID, ThreadRoot: step.threadRoot, Text: step.text})
+		if err != nil {
+			t.Fatalf("%s: SaveDraft() error = %v", step.name, err)
+		}
+		if len(changes) != 1 || changes[0].RoomID != roomID || changes[0].ThreadRoot != step.threadRoot {
+			t.Errorf("%s: unexpected change events %+v", step.name, changes)
+		} else if (changes[0].Draft == nil) != (step.text == "") {
+			t.Errorf("%s: change event has draft %+v", step.name, changes[0].Draft)
+		}
+		for root, want := range map[id.EventID]string{"": step.wantMain, threadRoot: step.wantThread} {
+			draft, err := h.DB.Draft.Get(ctx, roomID, root)
+			if err != nil {
+				t.Fatalf("%s: Get() error = %v", step.name, err)
+			}
+			var got string
+			if draft != nil {
+				got = draft.Text
+				if draft.ThreadRoot != root {
+					t.Errorf("%s: draft has thread root %q, want %q", step.name, draft.ThreadRoot, root)
+				}
+			}
+			if got != want {
+				t.Errorf("%s: draft for thread %q = %q, want %q", step.name, root, got, want)
+			}
+		}
+		drafts, err := h.GetDrafts(ctx, roomID)
+		if err != nil {
+			t.Fatalf("%s: GetDrafts() error = %v", step.name, err)
+		}
+		wantCount := 0
+		if step.wantMain != "" {
+			wantCount++
+		}
+		if step.wantThread != "" {
+			wantCount++
+		}
+		if len(drafts) != wantCount {
+			t.Errorf("%s: GetDrafts() returned %d drafts, want %d", step.name, len(drafts), wantCount)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+// Maximum number of /relations pages to fetch when looking for edits
+const maxEditHistoryPages = 10
+
+type respRelations struct {
+	Chunk     []*event.Event `json:"chunk"`
+	NextBatch string         `json:"next_batch"`
+}
+
+type EditHistory struct {
+	Original *database.Event   `json:"original"`
+	Edits    []*database.Event `json:"edits"`
+}
+
+// GetEditHistory returns the given event and all of its edits in chronological order.
+// Edits that aren't in the local database yet are fetched from the server first.
+func (h *HiClient) GetEditHistory(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*EditHistory, error) {
+	original, err := h.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return nil, err
+	} else if original.RelationType == event.RelReplace {
+		return nil, fmt.Errorf("can't get edit history of an edit event")
+	}
+	err = h.fetchEdits(ctx, roomID, eventID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Stringer("event_id", eventID).
+			Msg("Failed to fetch edits from server, returning locally known edits")
+	}
+	edits, err := h.DB.Event.GetEdits(ctx, original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get edits from database: %w", err)
+	}
+	for _, evt := range edits {
+		h.ReprocessExistingEvent(ctx, evt)
+	}
+	return &EditHistory{Original: original, Edits: edits}, nil
+}
+
+func (h *HiClient) fetchEdits(ctx context.Context, roomID id.RoomID, eventID id.EventID) error {
+	query := map[string]string{"limit": strconv.Itoa(100)}
+	for i := 0; i < maxEditHistoryPages; i++ {
+		var resp respRelations
+		url := h.Client.BuildURLWithQuery(
+			mautrix.ClientURLPath{"v1", "rooms", roomID, "relations", eventID, event.RelReplace},
+			query,
+		)
+		_, err := h.Client.MakeRequest(ctx, http.MethodGet, url, nil, &resp)
+		if err != nil {
+			return err
+		}
+		for _, evt := range resp.Chunk {
+			evt.RoomID = roomID
+			_, err = h.processEvent(ctx, evt, nil, nil, true)
+			if err != nil {
+				return fmt.Errorf("failed to save edit %s: %w", evt.ID, err)
+			}
+		}
+		if resp.NextBatch == "" {
+			break
+		}
+		query["from"] = resp.NextBatch
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ type SyncRoom struct {
 	Events        []*database.Event                             `json:"events"`
 	Reset         bool                                          `json:"reset"`
 	Notifications []SyncNotification                            `json:"notifications"`
+	Capabilities  *RoomCapabilities                             `json:"capabilities,omitempty"`
 }
 
 type SyncNotification struct {
@@ -70,6 +71,16 @@ type SendComplete struct {
 	Error error           `json:"error"`
 }
 
+type ScheduledEventsChanged struct {
+	RoomID id.RoomID `json:"room_id"`
+}
+
+type DraftChanged struct {
+	RoomID     id.RoomID       `json:"room_id"`
+	ThreadRoot id.EventID      `json:"thread_root,omitempty"`
+	Draft      *database.Draft `json:"draft"`
+}
+
 type ClientState struct {
 	IsLoggedIn    bool        `json:"is_logged_in"`
 	IsVerified    bool        `json:"is_verified"`
@@ -77,3 +88,38 @@ type ClientState struct {
 	DeviceID      id.DeviceID `json:"device_id,omitempty"`
 	HomeserverURL string      `json:"homeserver_url,omitempty"`
 }
+
+type UploadProgress struct {
+	UploadID string `json:"upload_id"`
+	Uploaded int64  `json:"uploaded"`
+	Total    int64  `json:"total"`
+}
+
+type ExportProgress struct {
+	ExportID string       `json:"export_id"`
+	RoomID   id.RoomID    `json:"room_id"`
+	Format   ExportFormat `json:"format"`
+	Stage    ExportStage  `json:"stage"`
+	Events   int          `json:"events"`
+	Total    int          `json:"total"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type KeyBackupRestoreStage string
+
+const (
+	KeyBackupRestoreStageFetching  KeyBackupRestoreStage = "fetching"
+	KeyBackupRestoreStageImporting KeyBackupRestoreStage = "importing"
+	KeyBackupRestoreStageRetrying  KeyBackupRestoreStage = "retrying"
+	KeyBackupRestoreStageDone      KeyBackupRestoreStage = "done"
+	KeyBackupRestoreStageFailed    KeyBackupRestoreStage = "failed"
+)
+
+type KeyBackupRestoreProgress struct {
+	Stage   KeyBackupRestoreStage `json:"stage"`
+	Version id.KeyBackupVersion   `json:"version"`
+	Done    int                   `json:"done"`
+	Failed  int                   `json:"failed"`
+	Total   int                   `json:"total"`
+	Error   string                `json:"error,omitempty"`
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+type ExportFormat string
+
+const (
+	ExportFormatHTML ExportFormat = "html"
+	ExportFormatJSON ExportFormat = "json"
+	ExportFormatText ExportFormat = "text"
+)
+
+func (ef ExportFormat) IsValid() bool {
+	switch ef {
+	case ExportFormatHTML, ExportFormatJSON, ExportFormatText:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ef ExportFormat) Extension() string {
+	switch ef {
+	case ExportFormatHTML:
+		return "html"
+	case ExportFormatJSON:
+		return "json"
+	default:
+		return "txt"
+	}
+}
+
+type ExportStage string
+
+const (
+	ExportStageCollecting ExportStage = "collecting"
+	ExportStageWriting    ExportStage = "writing"
+	ExportStageDone       ExportStage = "done"
+	ExportStageFailed     ExportStage = "failed"
+)
+
+const exportPageSize = 100
+
+// How long to wait before retrying when the room is already being paginated by someone else
+var exportPaginationRetryDelay = 1 * time.Second
+
+// CollectRoomHistory finds the row IDs of all events in the timeline of the given room in chronological order.
+//
+// The local timeline is walked first. If fetchFromServer is true, older history is then requested from the server
+// with PaginateServer until the start of the room is reached. The progress callback is called with the number of
+// events found so far after each page. If the room is already being paginated (e.g. by the UI),
+// the local timeline is re-read after the other pagination has had time to finish.
+func (h *HiClient) CollectRoomHistory(
+	ctx context.Context,
+	roomID id.RoomID,
+	fetchFromServer bool,
+	progress func(count int),
+) ([]database.EventRowID, error) {
+	var rowIDs []database.EventRowID
+	var maxTimelineID database.TimelineRowID
+	serverDone := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		evts, err := h.DB.Timeline.Get(ctx, roomID, exportPageSize, maxTimelineID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get timeline from database: %w", err)
+		} else if len(evts) > 0 {
+			for _, evt := range evts {
+				rowIDs = append(rowIDs, evt.RowID)
+			}
+			maxTimelineID = evts[len(evts)-1].TimelineRowID
+			if progress != nil {
+				progress(len(rowIDs))
+			}
+			continue
+		} else if !fetchFromServer || serverDone {
+			break
+		}
+		resp, err := h.PaginateServer(ctx, roomID, exportPageSize)
+		if errors.Is(err, ErrPaginationAlreadyInProgress) {
+			select {
+			case <-time.After(exportPaginationRetryDelay):
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to paginate from server: %w", err)
+		}
+		serverDone = !resp.HasMore
+	}
+	slices.Reverse(rowIDs)
+	return rowIDs, nil
+}
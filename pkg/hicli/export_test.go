@@ -0,0 +1,52 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func TestHiClient_CollectRoomHistoryWaitsForPagination(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	exportPaginationRetryDelay = 10 * time.Millisecond
+	h := newTestHiClient(t, func(any) {})
+	ctx := context.Background()
+	if err := h.DB.Room.CreateRow(ctx, roomID); err != nil {
+		t.Fatalf("failed to create room: %v", err)
+	} else if err = h.DB.Room.SetPrevBatch(ctx, roomID, database.PrevBatchPaginationComplete); err != nil {
+		t.Fatalf("failed to set prev batch: %v", err)
+	}
+	// Pretend that the UI is paginating the room
+	h.paginationInterrupterLock.Lock()
+	h.paginationInterrupter[roomID] = func(error) {}
+	h.paginationInterrupterLock.Unlock()
+	time.AfterFunc(50*time.Millisecond, func() {
+		h.paginationInterrupterLock.Lock()
+		delete(h.paginationInterrupter, roomID)
+		h.paginationInterrupterLock.Unlock()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.CollectRoomHistory(ctx, roomID, true, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("CollectRoomHistory() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CollectRoomHistory() didn't finish after the other pagination ended")
+	}
+}
@@ -23,7 +23,7 @@ import (
 	"go.mau.fi/util/exerrors"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
-	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 
@@ -41,15 +41,26 @@ type HiClient struct {
 
 	Verified bool
 
-	KeyBackupVersion id.KeyBackupVersion
-	KeyBackupKey     *backup.MegolmBackupKey
+	keyBackup                  atomic.Pointer[keyBackupState]
+	keyBackupRestoreInProgress atomic.Bool
+	keyBackupLock              sync.Mutex
+	lastKeyBackupCheck         time.Time
 
-	PushRules  atomic.Pointer[pushrules.PushRuleset]
-	SyncStatus atomic.Pointer[SyncStatus]
-	syncErrors int
-	lastSync   time.Time
+	PushRules    atomic.Pointer[pushrules.PushRuleset]
+	SyncStatus   atomic.Pointer[SyncStatus]
+	ignoredUsers atomic.Pointer[event.IgnoredUserListEventContent]
+	syncErrors   int
+	lastSync     time.Time
 
 	EventHandler func(evt any)
+	// LiveEventHandler is called for new timeline events received after the initial sync.
+	// Encrypted events are only passed to the handler after they've been decrypted.
+	// The handler is called synchronously from the sync loop, so it must not block.
+	LiveEventHandler func(ctx context.Context, evt *database.Event)
+	// PendingUploadResult is called when sending media to find out if the file is still being uploaded in the
+	// background (i.e. an MSC2246 asynchronous upload). If it returns a channel, the event is sent immediately
+	// and the upload error received from the channel is stored as the send error.
+	PendingUploadResult func(mxc id.ContentURIString) <-chan error
 
 	firstSyncReceived bool
 	syncingID         int
@@ -58,12 +69,16 @@ type HiClient struct {
 	encryptLock       sync.Mutex
 
 	requestQueueWakeup chan struct{}
+	schedulerWakeup    chan struct{}
 
 	jsonRequestsLock sync.Mutex
 	jsonRequests     map[int64]context.CancelCauseFunc
 
 	paginationInterrupterLock sync.Mutex
 	paginationInterrupter     map[id.RoomID]context.CancelCauseFunc
+
+	awaitingDecryptionLock sync.Mutex
+	awaitingDecryption     map[id.EventID]time.Time
 }
 
 var ErrTimelineReset = errors.New("got limited timeline sync response")
@@ -85,8 +100,10 @@ func New(rawDB, cryptoDB *dbutil.Database, log zerolog.Logger, pickleKey []byte,
 		Log: log,
 
 		requestQueueWakeup:    make(chan struct{}, 1),
+		schedulerWakeup:       make(chan struct{}, 1),
 		jsonRequests:          make(map[int64]context.CancelCauseFunc),
 		paginationInterrupter: make(map[id.RoomID]context.CancelCauseFunc),
+		awaitingDecryption:    make(map[id.EventID]time.Time),
 
 		EventHandler: evtHandler,
 	}
@@ -143,6 +160,15 @@ func (h *HiClient) IsLoggedIn() bool {
 }
 
 func (h *HiClient) Start(ctx context.Context, userID id.UserID, expectedAccount *database.Account) error {
+	err := h.Load(ctx, userID, expectedAccount)
+	if err == nil && h.Account != nil && h.Verified {
+		go h.Sync()
+	}
+	return err
+}
+
+// Load prepares the database and loads the account and encryption keys without starting to sync.
+func (h *HiClient) Load(ctx context.Context, userID id.UserID, expectedAccount *database.Account) error {
 	if expectedAccount != nil && userID != expectedAccount.UserID {
 		panic(fmt.Errorf("invalid parameters: different user ID in expected account and user ID"))
 	}
@@ -192,12 +218,15 @@ func (h *HiClient) Start(ctx context.Context, userID id.UserID, expectedAccount
 			return err
 		}
 		zerolog.Ctx(ctx).Debug().Bool("verified", h.Verified).Msg("Checked current device verification status")
+		err = h.loadIgnoredUsers(ctx)
+		if err != nil {
+			return err
+		}
 		if h.Verified {
 			err = h.loadPrivateKeys(ctx)
 			if err != nil {
 				return err
 			}
-			go h.Sync()
 		}
 	}
 	return nil
@@ -242,6 +271,7 @@ func (h *HiClient) Sync() {
 	defer cancel()
 	h.stopSync.Store(&cancel)
 	go h.RunRequestQueue(h.Log.WithContext(ctx))
+	go h.RunScheduler(h.Log.WithContext(ctx))
 	go h.LoadPushRules(h.Log.WithContext(ctx))
 	ctx = log.WithContext(ctx)
 	log.Info().Msg("Starting syncing")
@@ -0,0 +1,160 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+var ErrCantIgnoreSelf = errors.New("can't ignore own user ID")
+
+func (h *HiClient) isUserIgnored(userID id.UserID) bool {
+	ignored := h.ignoredUsers.Load()
+	if ignored == nil {
+		return false
+	}
+	_, ok := ignored.IgnoredUsers[userID]
+	return ok
+}
+
+func (h *HiClient) getIgnoredUserList(ctx context.Context) (*event.IgnoredUserListEventContent, error) {
+	var content event.IgnoredUserListEventContent
+	ad, err := h.DB.AccountData.Get(ctx, h.Account.UserID, event.AccountDataIgnoredUserList)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ignored user list: %w", err)
+	} else if ad != nil {
+		err = json.Unmarshal(ad.Content, &content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ignored user list: %w", err)
+		}
+	}
+	if content.IgnoredUsers == nil {
+		content.IgnoredUsers = make(map[id.UserID]event.IgnoredUser)
+	}
+	return &content, nil
+}
+
+func (h *HiClient) loadIgnoredUsers(ctx context.Context) error {
+	content, err := h.getIgnoredUserList(ctx)
+	if err != nil {
+		return err
+	}
+	h.ignoredUsers.Store(content)
+	return nil
+}
+
+// receiveNewIgnoredUsers replaces the in-memory ignored user list and returns true if any user was removed from it.
+func (h *HiClient) receiveNewIgnoredUsers(content *event.IgnoredUserListEventContent) (unignored bool) {
+	old := h.ignoredUsers.Swap(content)
+	if old == nil {
+		return false
+	}
+	for userID := range old.IgnoredUsers {
+		if _, stillIgnored := content.IgnoredUsers[userID]; !stillIgnored {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HiClient) updateIgnoredUserList(ctx context.Context, fn func(content *event.IgnoredUserListEventContent) bool) error {
+	content, err := h.getIgnoredUserList(ctx)
+	if err != nil {
+		return err
+	} else if !fn(content) {
+		return nil
+	}
+	err = h.Client.SetAccountData(ctx, event.AccountDataIgnoredUserList.Type, content)
+	if err != nil {
+		return fmt.Errorf("failed to update ignored user list: %w", err)
+	}
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ignored user list: %w", err)
+	}
+	_, err = h.DB.AccountData.Put(ctx, h.Account.UserID, event.AccountDataIgnoredUserList, rawContent)
+	if err != nil {
+		return fmt.Errorf("failed to save ignored user list: %w", err)
+	}
+	if h.receiveNewIgnoredUsers(content) {
+		go h.resetSync(context.WithoutCancel(ctx))
+	}
+	return nil
+}
+
+// IgnoreUser adds the given user to the ignored user list. Events from ignored users are
+// flagged with the ignored field and won't be counted as unread or trigger notifications.
+func (h *HiClient) IgnoreUser(ctx context.Context, userID id.UserID) error {
+	if userID == h.Account.UserID {
+		return ErrCantIgnoreSelf
+	}
+	return h.updateIgnoredUserList(ctx, func(content *event.IgnoredUserListEventContent) bool {
+		if _, alreadyIgnored := content.IgnoredUsers[userID]; alreadyIgnored {
+			return false
+		}
+		content.IgnoredUsers[userID] = event.IgnoredUser{}
+		return true
+	})
+}
+
+// UnignoreUser removes the given user from the ignored user list.
+//
+// The homeserver doesn't send events from ignored users at all, so unignoring someone
+// will restart syncing from scratch to fetch anything that was missed.
+func (h *HiClient) UnignoreUser(ctx context.Context, userID id.UserID) error {
+	return h.updateIgnoredUserList(ctx, func(content *event.IgnoredUserListEventContent) bool {
+		if _, ignored := content.IgnoredUsers[userID]; !ignored {
+			return false
+		}
+		delete(content.IgnoredUsers, userID)
+		return true
+	})
+}
+
+// resetSync stops the sync loop, throws away the stored sync token and starts syncing again with an initial sync.
+func (h *HiClient) resetSync(ctx context.Context) {
+	h.Client.StopSync()
+	if fn := h.stopSync.Load(); fn != nil {
+		(*fn)()
+	}
+	h.syncLock.Lock()
+	h.Account.NextBatch = ""
+	err := h.DB.Account.PutNextBatch(ctx, h.Account.UserID, "")
+	if err != nil {
+		h.syncLock.Unlock()
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to clear next_batch to reset sync")
+		return
+	}
+	h.firstSyncReceived = false
+	// Use the same high timeouts as the very first initial sync, they're lowered again in postProcessSyncResponse
+	h.Client.Client.Transport.(*http.Transport).ResponseHeaderTimeout = 300 * time.Second
+	h.Client.Client.Timeout = 300 * time.Second
+	h.syncLock.Unlock()
+	zerolog.Ctx(ctx).Info().Msg("Restarting sync from scratch")
+	go h.Sync()
+}
+
+func (h *HiClient) markIgnoredEvents(events []*database.Event) {
+	ignored := h.ignoredUsers.Load()
+	if ignored == nil || len(ignored.IgnoredUsers) == 0 {
+		return
+	}
+	for _, evt := range events {
+		_, evt.Ignored = ignored.IgnoredUsers[evt.Sender]
+	}
+}
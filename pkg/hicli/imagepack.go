@@ -0,0 +1,433 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	AccountDataImagePack      = event.Type{Type: "im.ponies.user_emotes", Class: event.AccountDataEventType}
+	AccountDataImagePackRooms = event.Type{Type: "im.ponies.emote_rooms", Class: event.AccountDataEventType}
+	StateImagePack            = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+)
+
+type ImagePackUsage string
+
+const (
+	ImagePackUsageEmoticon ImagePackUsage = "emoticon"
+	ImagePackUsageSticker  ImagePackUsage = "sticker"
+)
+
+type ImagePackImage struct {
+	URL   id.ContentURIString `json:"url"`
+	Body  string              `json:"body,omitempty"`
+	Info  *event.FileInfo     `json:"info,omitempty"`
+	Usage []ImagePackUsage    `json:"usage,omitempty"`
+}
+
+type ImagePackMeta struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	Usage       []ImagePackUsage    `json:"usage,omitempty"`
+	Attribution string              `json:"attribution,omitempty"`
+}
+
+type ImagePackContent struct {
+	Images map[string]*ImagePackImage `json:"images"`
+	Pack   ImagePackMeta              `json:"pack"`
+}
+
+type ImagePackRoomsContent struct {
+	Rooms map[id.RoomID]map[string]json.RawMessage `json:"rooms"`
+}
+
+// ImagePack is a single image pack along with information about where it's from.
+// The personal pack of the user has an empty room ID and state key.
+type ImagePack struct {
+	RoomID   id.RoomID         `json:"room_id,omitempty"`
+	StateKey string            `json:"state_key"`
+	Enabled  bool              `json:"enabled"`
+	Content  *ImagePackContent `json:"content"`
+}
+
+func (pack *ImagePack) isPersonal() bool {
+	return pack.RoomID == ""
+}
+
+var shortcodeRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-+.]+$`)
+
+func parseImagePack(content json.RawMessage) (*ImagePackContent, error) {
+	var pack ImagePackContent
+	if len(content) > 0 {
+		err := json.Unmarshal(content, &pack)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pack.Images == nil {
+		pack.Images = make(map[string]*ImagePackImage)
+	}
+	return &pack, nil
+}
+
+func (h *HiClient) getImagePackRooms(ctx context.Context) (*ImagePackRoomsContent, error) {
+	var content ImagePackRoomsContent
+	ad, err := h.DB.AccountData.Get(ctx, h.Account.UserID, AccountDataImagePackRooms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get enabled image packs: %w", err)
+	} else if ad != nil {
+		err = json.Unmarshal(ad.Content, &content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse enabled image packs: %w", err)
+		}
+	}
+	if content.Rooms == nil {
+		content.Rooms = make(map[id.RoomID]map[string]json.RawMessage)
+	}
+	return &content, nil
+}
+
+// GetImagePack returns a single image pack. If the room ID is empty, the personal pack of the user is returned.
+// If the pack doesn't exist, nil is returned.
+func (h *HiClient) GetImagePack(ctx context.Context, roomID id.RoomID, stateKey string) (*ImagePack, error) {
+	var rawContent json.RawMessage
+	if roomID == "" {
+		ad, err := h.DB.AccountData.Get(ctx, h.Account.UserID, AccountDataImagePack)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get personal image pack: %w", err)
+		} else if ad == nil {
+			return nil, nil
+		}
+		rawContent = ad.Content
+	} else {
+		evt, err := h.DB.CurrentState.Get(ctx, roomID, StateImagePack, stateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image pack state event: %w", err)
+		} else if evt == nil {
+			return nil, nil
+		}
+		rawContent = evt.Content
+	}
+	// Deleted packs are replaced with an empty object
+	if len(rawContent) == 0 || string(rawContent) == "{}" {
+		return nil, nil
+	}
+	content, err := parseImagePack(rawContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image pack: %w", err)
+	}
+	pack := &ImagePack{RoomID: roomID, StateKey: stateKey, Content: content, Enabled: roomID == ""}
+	if !pack.isPersonal() {
+		packRooms, err := h.getImagePackRooms(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, pack.Enabled = packRooms.Rooms[roomID][stateKey]
+	}
+	return pack, nil
+}
+
+// GetImagePacks returns the personal image pack of the user, all packs in the given room (if a room ID is provided)
+// and all globally enabled room packs. Room packs are sorted by room ID and state key, so the order is stable.
+func (h *HiClient) GetImagePacks(ctx context.Context, roomID id.RoomID) ([]*ImagePack, error) {
+	packs := make([]*ImagePack, 0)
+	personalPack, err := h.GetImagePack(ctx, "", "")
+	if err != nil {
+		return nil, err
+	} else if personalPack != nil {
+		packs = append(packs, personalPack)
+	}
+	type packKey struct {
+		RoomID   id.RoomID
+		StateKey string
+	}
+	seen := make(map[packKey]struct{})
+	if roomID != "" {
+		state, err := h.DB.CurrentState.GetAllExceptMembers(ctx, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get room state: %w", err)
+		}
+		var stateKeys []string
+		for _, evt := range state {
+			if evt.Type == StateImagePack.Type && evt.StateKey != nil {
+				stateKeys = append(stateKeys, *evt.StateKey)
+			}
+		}
+		slices.Sort(stateKeys)
+		for _, stateKey := range stateKeys {
+			pack, err := h.GetImagePack(ctx, roomID, stateKey)
+			if err != nil {
+				return nil, err
+			} else if pack != nil {
+				packs = append(packs, pack)
+				seen[packKey{roomID, stateKey}] = struct{}{}
+			}
+		}
+	}
+	packRooms, err := h.getImagePackRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, packRoomID := range slices.Sorted(maps.Keys(packRooms.Rooms)) {
+		for _, stateKey := range slices.Sorted(maps.Keys(packRooms.Rooms[packRoomID])) {
+			if _, alreadyAdded := seen[packKey{packRoomID, stateKey}]; alreadyAdded {
+				continue
+			}
+			pack, err := h.GetImagePack(ctx, packRoomID, stateKey)
+			if err != nil {
+				return nil, err
+			} else if pack != nil {
+				packs = append(packs, pack)
+			}
+		}
+	}
+	return packs, nil
+}
+
+func (h *HiClient) saveImagePack(ctx context.Context, roomID id.RoomID, stateKey string, content any) error {
+	if roomID == "" {
+		return h.Client.SetAccountData(ctx, AccountDataImagePack.Type, content)
+	}
+	_, err := h.SetState(ctx, roomID, StateImagePack, stateKey, content)
+	return err
+}
+
+func (h *HiClient) updateImagePack(ctx context.Context, roomID id.RoomID, stateKey string, fn func(pack *ImagePackContent) error) (*ImagePack, error) {
+	pack, err := h.GetImagePack(ctx, roomID, stateKey)
+	if err != nil {
+		return nil, err
+	} else if pack == nil {
+		return nil, fmt.Errorf("image pack not found")
+	}
+	err = fn(pack.Content)
+	if err != nil {
+		return nil, err
+	}
+	err = h.saveImagePack(ctx, roomID, stateKey, pack.Content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image pack: %w", err)
+	}
+	return pack, nil
+}
+
+// CreateImagePack creates a new empty image pack. If the room ID is empty, the personal pack of the user is created.
+func (h *HiClient) CreateImagePack(ctx context.Context, roomID id.RoomID, stateKey, displayName string) (*ImagePack, error) {
+	existing, err := h.GetImagePack(ctx, roomID, stateKey)
+	if err != nil {
+		return nil, err
+	} else if existing != nil {
+		return nil, fmt.Errorf("image pack already exists")
+	}
+	pack := &ImagePack{
+		RoomID:   roomID,
+		StateKey: stateKey,
+		Enabled:  roomID == "",
+		Content: &ImagePackContent{
+			Images: make(map[string]*ImagePackImage),
+			Pack:   ImagePackMeta{DisplayName: displayName},
+		},
+	}
+	err = h.saveImagePack(ctx, roomID, stateKey, pack.Content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image pack: %w", err)
+	}
+	return pack, nil
+}
+
+func (h *HiClient) RenameImagePack(ctx context.Context, roomID id.RoomID, stateKey, displayName string) (*ImagePack, error) {
+	return h.updateImagePack(ctx, roomID, stateKey, func(pack *ImagePackContent) error {
+		pack.Pack.DisplayName = displayName
+		return nil
+	})
+}
+
+// DeleteImagePack deletes the given pack by replacing its content with an empty object
+// and removes it from the globally enabled packs.
+func (h *HiClient) DeleteImagePack(ctx context.Context, roomID id.RoomID, stateKey string) error {
+	err := h.saveImagePack(ctx, roomID, stateKey, struct{}{})
+	if err != nil {
+		return fmt.Errorf("failed to delete image pack: %w", err)
+	}
+	if roomID != "" {
+		return h.SetImagePackEnabled(ctx, roomID, stateKey, false)
+	}
+	return nil
+}
+
+// AddImagePackImage adds an image to a pack or replaces an existing image with the same shortcode.
+// The image must already be uploaded, e.g. using the gomuks media upload endpoint.
+func (h *HiClient) AddImagePackImage(ctx context.Context, roomID id.RoomID, stateKey, shortcode string, image *ImagePackImage) (*ImagePack, error) {
+	shortcode = strings.Trim(shortcode, ":")
+	if !shortcodeRegex.MatchString(shortcode) {
+		return nil, fmt.Errorf("invalid shortcode %q", shortcode)
+	} else if image == nil || image.URL == "" {
+		return nil, fmt.Errorf("image URL is required")
+	} else if _, err := image.URL.Parse(); err != nil {
+		return nil, fmt.Errorf("invalid image URL: %w", err)
+	}
+	return h.updateImagePack(ctx, roomID, stateKey, func(pack *ImagePackContent) error {
+		pack.Images[shortcode] = image
+		return nil
+	})
+}
+
+func (h *HiClient) RemoveImagePackImage(ctx context.Context, roomID id.RoomID, stateKey, shortcode string) (*ImagePack, error) {
+	return h.updateImagePack(ctx, roomID, stateKey, func(pack *ImagePackContent) error {
+		if _, ok := pack.Images[shortcode]; !ok {
+			return fmt.Errorf("image %q not found in pack", shortcode)
+		}
+		delete(pack.Images, shortcode)
+		return nil
+	})
+}
+
+// SetImagePackEnabled adds or removes a room pack from the globally enabled packs (im.ponies.emote_rooms).
+func (h *HiClient) SetImagePackEnabled(ctx context.Context, roomID id.RoomID, stateKey string, enabled bool) error {
+	if roomID == "" {
+		return errors.New("the personal image pack is always enabled")
+	}
+	packRooms, err := h.getImagePackRooms(ctx)
+	if err != nil {
+		return err
+	}
+	_, isEnabled := packRooms.Rooms[roomID][stateKey]
+	if isEnabled == enabled {
+		return nil
+	} else if enabled {
+		if packRooms.Rooms[roomID] == nil {
+			packRooms.Rooms[roomID] = make(map[string]json.RawMessage)
+		}
+		packRooms.Rooms[roomID][stateKey] = json.RawMessage("{}")
+	} else {
+		delete(packRooms.Rooms[roomID], stateKey)
+		if len(packRooms.Rooms[roomID]) == 0 {
+			delete(packRooms.Rooms, roomID)
+		}
+	}
+	return h.Client.SetAccountData(ctx, AccountDataImagePackRooms.Type, packRooms)
+}
+
+func (img *ImagePackImage) isUsableAs(pack *ImagePackContent, usage ImagePackUsage) bool {
+	usages := img.Usage
+	if len(usages) == 0 {
+		usages = pack.Pack.Usage
+	}
+	return len(usages) == 0 || slices.Contains(usages, usage)
+}
+
+// getEmoticons returns a map from shortcode to image for all emoticons usable in the given room.
+// If multiple packs have the same shortcode, the personal pack takes priority, then packs in the room itself,
+// and finally globally enabled packs.
+func (h *HiClient) getEmoticons(ctx context.Context, roomID id.RoomID) (map[string]*ImagePackImage, error) {
+	packs, err := h.GetImagePacks(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	emoticons := make(map[string]*ImagePackImage)
+	for _, pack := range packs {
+		for shortcode, img := range pack.Content.Images {
+			if _, alreadySet := emoticons[shortcode]; alreadySet || img == nil || img.URL == "" || !img.isUsableAs(pack.Content, ImagePackUsageEmoticon) {
+				continue
+			}
+			emoticons[shortcode] = img
+		}
+	}
+	return emoticons, nil
+}
+
+var (
+	shortcodeInTextRegex = regexp.MustCompile(`:([a-zA-Z0-9_\-+.]+):`)
+	// Matches autolinks, link destinations (including titles) and bare URLs, which receiving clients linkify
+	linkInTextRegex      = regexp.MustCompile(`<[a-zA-Z][a-zA-Z0-9+.\-]{1,31}:[^<>\s]*>|\]\([^)]*\)|(?:https?://|www\.)[^\s<>]+`)
+	markdownTitleEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// resolveShortcodes replaces :shortcode: in the given markdown text with custom emoji images from the available
+// image packs. Shortcodes inside code spans, code blocks and links are left untouched.
+func (h *HiClient) resolveShortcodes(ctx context.Context, roomID id.RoomID, text string) string {
+	if !shortcodeInTextRegex.MatchString(text) {
+		return text
+	}
+	emoticons, err := h.getEmoticons(ctx, roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get image packs for resolving shortcodes")
+		return text
+	} else if len(emoticons) == 0 {
+		return text
+	}
+	return replaceShortcodes(text, emoticons)
+}
+
+// replaceShortcodes does the actual replacing for [HiClient.resolveShortcodes] using the given emoticons.
+func replaceShortcodes(text string, emoticons map[string]*ImagePackImage) string {
+	var out strings.Builder
+	for i, part := range splitCode(text) {
+		// Odd parts are code and must not be modified
+		if i%2 == 1 {
+			out.WriteString(part)
+			continue
+		}
+		for j, subpart := range splitLinks(part) {
+			if j%2 == 1 {
+				out.WriteString(subpart)
+				continue
+			}
+			out.WriteString(shortcodeInTextRegex.ReplaceAllStringFunc(subpart, func(match string) string {
+				img, ok := emoticons[strings.Trim(match, ":")]
+				if !ok {
+					return match
+				}
+				return fmt.Sprintf(`![%s](%s "%s")`, match, img.URL, markdownTitleEscaper.Replace("Emoji: "+match))
+			}))
+		}
+	}
+	return out.String()
+}
+
+// splitLinks splits markdown text into alternating non-link and link parts, like splitCode does for code.
+func splitLinks(text string) []string {
+	var parts []string
+	prevEnd := 0
+	for _, match := range linkInTextRegex.FindAllStringIndex(text, -1) {
+		parts = append(parts, text[prevEnd:match[0]], text[match[0]:match[1]])
+		prevEnd = match[1]
+	}
+	return append(parts, text[prevEnd:])
+}
+
+// splitCode splits markdown text into alternating non-code and code parts based on backtick fences.
+// The first part is never code, so code parts always have odd indexes.
+func splitCode(text string) []string {
+	var parts []string
+	for {
+		start := strings.IndexByte(text, '`')
+		if start < 0 {
+			return append(parts, text)
+		}
+		fenceLen := len(text[start:]) - len(strings.TrimLeft(text[start:], "`"))
+		fence := text[start : start+fenceLen]
+		end := strings.Index(text[start+fenceLen:], fence)
+		if end < 0 {
+			return append(parts, text)
+		}
+		end += start + fenceLen*2
+		parts = append(parts, text[:start], text[start:end])
+		text = text[end:]
+	}
+}
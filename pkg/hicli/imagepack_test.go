@@ -0,0 +1,172 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func TestSplitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"No code", "hello :wave:", []string{"hello :wave:"}},
+		{"Inline code", "a `b` c", []string{"a ", "`b`", " c"}},
+		{"Code at start", "`x` y", []string{"", "`x`", " y"}},
+		{"Multiple spans", "`a`b`c`", []string{"", "`a`", "b", "`c`", ""}},
+		{"Double backtick fence contains single backtick", "x ``a ` b`` y", []string{"x ", "``a ` b``", " y"}},
+		{"Code block", "before\n```\n:wave:\n```\nafter", []string{"before\n", "```\n:wave:\n```", "\nafter"}},
+		{"Unclosed fence", "a `b c", []string{"a `b c"}},
+		{"Unclosed fence after code", "`a` `b", []string{"", "`a`", " `b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := splitCode(test.text); !slices.Equal(got, test.want) {
+				t.Errorf("splitCode() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"No links", "hello :wave:", []string{"hello :wave:"}},
+		{"Bare URL", "see https://example.com/:x: ok", []string{"see ", "https://example.com/:x:", " ok"}},
+		{"www URL", "www.example.com/:x:", []string{"", "www.example.com/:x:", ""}},
+		{"Autolink", "<https://example.com/:x:> :y:", []string{"", "<https://example.com/:x:>", " :y:"}},
+		{"Markdown link target", "[:x:](https://example.com/:x:)", []string{"[:x:", "](https://example.com/:x:)", ""}},
+		{"Markdown link with relative target", "[a](:x:) b", []string{"[a", "](:x:)", " b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := splitLinks(test.text); !slices.Equal(got, test.want) {
+				t.Errorf("splitLinks() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReplaceShortcodes(t *testing.T) {
+	emoticons := map[string]*ImagePackImage{
+		"wave": {URL: "mxc://example.com/wave"},
+		"a+b":  {URL: "mxc://example.com/ab"},
+	}
+	const wave = `![:wave:](mxc://example.com/wave "Emoji: :wave:")`
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"Single shortcode", "hi :wave:", "hi " + wave},
+		{"Unknown shortcode", "hi :nope:", "hi :nope:"},
+		{"Multiple shortcodes", ":wave::wave:", wave + wave},
+		{"Special characters", ":a+b:", `![:a+b:](mxc://example.com/ab "Emoji: :a+b:")`},
+		{"Inline code", "`:wave:` :wave:", "`:wave:` " + wave},
+		{"Code block", "```\n:wave:\n```", "```\n:wave:\n```"},
+		{"Bare URL", "https://example.com/:wave: :wave:", "https://example.com/:wave: " + wave},
+		{"Link target", "[:wave:](https://example.com/:wave:)", "[" + wave + "](https://example.com/:wave:)"},
+		{"Autolink", "<https://example.com/:wave:>", "<https://example.com/:wave:>"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := replaceShortcodes(test.text, emoticons); got != test.want {
+				t.Errorf("replaceShortcodes() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMarkdownTitleEscaper(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Emoji: :wave:", "Emoji: :wave:"},
+		{`Emoji: :"quoted":`, `Emoji: :\"quoted\":`},
+		{`back\slash"`, `back\\slash\"`},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			if got := markdownTitleEscaper.Replace(test.in); got != test.want {
+				t.Errorf("markdownTitleEscaper.Replace() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHiClient_GetImagePacksOrder(t *testing.T) {
+	h := newTestHiClient(t, func(any) {})
+	h.Account = &database.Account{UserID: "@me:example.com"}
+	ctx := context.Background()
+	packContent := json.RawMessage(`{"images":{"meow":{"url":"mxc://example.com/meow"}}}`)
+	roomPacks := map[id.RoomID][]string{
+		"!a:example.com": {"x"},
+		"!b:example.com": {"z", "a", "m"},
+		"!c:example.com": {"y", "b"},
+	}
+	for roomID, stateKeys := range roomPacks {
+		if err := h.DB.Room.CreateRow(ctx, roomID); err != nil {
+			t.Fatalf("failed to create room: %v", err)
+		}
+		for _, stateKey := range stateKeys {
+			rowID, err := h.DB.Event.Insert(ctx, &database.Event{
+				RoomID:   roomID,
+				ID:       id.EventID(fmt.Sprintf("$%s-%s", roomID, stateKey)),
+				Sender:   h.Account.UserID,
+				Type:     StateImagePack.Type,
+				StateKey: &stateKey,
+				Content:  packContent,
+				Unsigned: json.RawMessage("{}"),
+			})
+			if err != nil {
+				t.Fatalf("failed to insert pack event: %v", err)
+			}
+			if err = h.DB.CurrentState.Set(ctx, roomID, StateImagePack, stateKey, rowID, ""); err != nil {
+				t.Fatalf("failed to set pack state: %v", err)
+			}
+		}
+	}
+	_, err := h.DB.AccountData.Put(ctx, h.Account.UserID, AccountDataImagePackRooms, json.RawMessage(
+		`{"rooms":{"!c:example.com":{"y":{},"b":{}},"!a:example.com":{"x":{}},"!b:example.com":{"m":{}}}}`,
+	))
+	if err != nil {
+		t.Fatalf("failed to save enabled packs: %v", err)
+	}
+	want := []string{
+		// Packs in the current room come first, then globally enabled packs
+		"!b:example.com/a", "!b:example.com/m", "!b:example.com/z",
+		"!a:example.com/x", "!c:example.com/b", "!c:example.com/y",
+	}
+	// Map iteration order is random, so check several times
+	for range 10 {
+		packs, err := h.GetImagePacks(ctx, "!b:example.com")
+		if err != nil {
+			t.Fatalf("GetImagePacks() error = %v", err)
+		}
+		got := make([]string, len(packs))
+		for i, pack := range packs {
+			got[i] = fmt.Sprintf("%s/%s", pack.RoomID, pack.StateKey)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("GetImagePacks() = %v, want %v", got, want)
+		}
+	}
+}
@@ -30,6 +30,10 @@ func (h *HiClient) getInitialSyncRoom(ctx context.Context, room *database.Room)
 			syncRoom.AccountData[event.Type{Type: data.Type, Class: event.AccountDataEventType}] = data
 		}
 	}
+	syncRoom.Capabilities, err = h.getRoomCapabilities(ctx, room.ID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", room.ID).Msg("Failed to get room capabilities")
+	}
 	if room.PreviewEventRowID != 0 {
 		previewEvent, err := h.DB.Event.GetByRowID(ctx, room.PreviewEventRowID)
 		if err != nil {
@@ -60,32 +64,45 @@ func (h *HiClient) getInitialSyncRoom(ctx context.Context, room *database.Room)
 	return syncRoom
 }
 
+func (h *HiClient) getInitialSyncSection(ctx context.Context, section database.RoomSection, batchSize int, yield func(*SyncComplete) bool) bool {
+	maxTS := time.Now().Add(1 * time.Hour)
+	for {
+		rooms, err := h.DB.Room.GetBySortTS(ctx, section, maxTS, batchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				zerolog.Ctx(ctx).Err(err).Msg("Failed to get initial rooms to send to client")
+			}
+			return false
+		}
+		payload := SyncComplete{
+			Rooms:       make(map[id.RoomID]*SyncRoom, len(rooms)),
+			LeftRooms:   make([]id.RoomID, 0),
+			AccountData: make(map[event.Type]*database.AccountData),
+		}
+		isLastPage := len(rooms) < batchSize
+		for _, room := range rooms {
+			// Rooms with the same timestamp as the last one are left for the next page, as maxTS is exclusive
+			if !isLastPage && room.SortingTimestamp == rooms[len(rooms)-1].SortingTimestamp {
+				break
+			}
+			maxTS = room.SortingTimestamp.Time
+			payload.Rooms[room.ID] = h.getInitialSyncRoom(ctx, room)
+		}
+		if !yield(&payload) {
+			return false
+		} else if isLastPage {
+			return true
+		}
+	}
+}
+
 func (h *HiClient) GetInitialSync(ctx context.Context, batchSize int) iter.Seq[*SyncComplete] {
 	return func(yield func(*SyncComplete) bool) {
-		maxTS := time.Now().Add(1 * time.Hour)
-		for i := 0; ; i++ {
-			rooms, err := h.DB.Room.GetBySortTS(ctx, maxTS, batchSize)
-			if err != nil {
-				if ctx.Err() == nil {
-					zerolog.Ctx(ctx).Err(err).Msg("Failed to get initial rooms to send to client")
-				}
+		// Rooms are sent grouped by section, so that favourites are always loaded first and low priority rooms last
+		for _, section := range database.RoomSections {
+			if !h.getInitialSyncSection(ctx, section, batchSize, yield) {
 				return
 			}
-			payload := SyncComplete{
-				Rooms:       make(map[id.RoomID]*SyncRoom, len(rooms)-1),
-				LeftRooms:   make([]id.RoomID, 0),
-				AccountData: make(map[event.Type]*database.AccountData),
-			}
-			for _, room := range rooms {
-				if room.SortingTimestamp == rooms[len(rooms)-1].SortingTimestamp {
-					break
-				}
-				maxTS = room.SortingTimestamp.Time
-				payload.Rooms[room.ID] = h.getInitialSyncRoom(ctx, room)
-			}
-			if !yield(&payload) || len(rooms) < batchSize {
-				break
-			}
 		}
 		// This is last so that the frontend would know about all rooms before trying to fetch custom emoji packs
 		ad, err := h.DB.AccountData.GetAllGlobal(ctx, h.Account.UserID)
@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"time"
 
+	"go.mau.fi/util/jsontime"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -44,6 +45,36 @@ func (h *HiClient) handleJSONCommand(ctx context.Context, req *JSONCommand) (any
 		return unmarshalAndCall(req.Data, func(params *sendMessageParams) (*database.Event, error) {
 			return h.SendMessage(ctx, params.RoomID, params.BaseContent, params.Text, params.RelatesTo, params.Mentions)
 		})
+	case "schedule_message":
+		return unmarshalAndCall(req.Data, func(params *scheduleMessageParams) (*database.ScheduledEvent, error) {
+			return h.ScheduleMessage(ctx, params.RoomID, params.BaseContent, params.Text, params.RelatesTo, params.Mentions, params.SendAt.Time)
+		})
+	case "list_scheduled_events":
+		return unmarshalAndCall(req.Data, func(params *listScheduledEventsParams) ([]*database.ScheduledEvent, error) {
+			return h.ListScheduledEvents(ctx, params.RoomID)
+		})
+	case "cancel_scheduled_event":
+		return unmarshalAndCall(req.Data, func(params *cancelScheduledEventParams) (bool, error) {
+			return true, h.CancelScheduledEvent(ctx, params.RowID)
+		})
+	case "save_draft":
+		return unmarshalAndCall(req.Data, func(params *database.Draft) (*database.Draft, error) {
+			return h.SaveDraft(ctx, params)
+		})
+	case "get_drafts":
+		return unmarshalAndCall(req.Data, func(params *getDraftsParams) ([]*database.Draft, error) {
+			return h.GetDrafts(ctx, params.RoomID)
+		})
+	case "clear_draft":
+		return unmarshalAndCall(req.Data, func(params *clearDraftParams) (bool, error) {
+			return true, h.ClearDraft(ctx, params.RoomID, params.ThreadRoot)
+		})
+	case "get_url_preview":
+		return unmarshalAndCall(req.Data, func(params *getURLPreviewParams) (*database.URLPreview, error) {
+			return h.GetURLPreview(ctx, params.RoomID, params.URL)
+		})
+	case "list_commands":
+		return h.ListCommands(), nil
 	case "send_event":
 		return unmarshalAndCall(req.Data, func(params *sendEventParams) (*database.Event, error) {
 			return h.Send(ctx, params.RoomID, params.EventType, params.Content)
@@ -54,9 +85,7 @@ func (h *HiClient) handleJSONCommand(ctx context.Context, req *JSONCommand) (any
 		})
 	case "redact_event":
 		return unmarshalAndCall(req.Data, func(params *redactEventParams) (*mautrix.RespSendEvent, error) {
-			return h.Client.RedactEvent(ctx, params.RoomID, params.EventID, mautrix.ReqRedact{
-				Reason: params.Reason,
-			})
+			return h.RedactEvent(ctx, params.RoomID, params.EventID, params.Reason)
 		})
 	case "set_state":
 		return unmarshalAndCall(req.Data, func(params *sendStateEventParams) (id.EventID, error) {
@@ -151,6 +180,112 @@ func (h *HiClient) handleJSONCommand(ctx context.Context, req *JSONCommand) (any
 			}
 			return cli.GetLoginFlows(ctx)
 		})
+	case "get_edit_history":
+		return unmarshalAndCall(req.Data, func(params *getEventParams) (*EditHistory, error) {
+			return h.GetEditHistory(ctx, params.RoomID, params.EventID)
+		})
+	case "get_reactions":
+		return unmarshalAndCall(req.Data, func(params *getEventParams) ([]*ReactionGroup, error) {
+			return h.GetReactions(ctx, params.RoomID, params.EventID)
+		})
+	case "toggle_reaction":
+		return unmarshalAndCall(req.Data, func(params *toggleReactionParams) (*database.Event, error) {
+			return h.ToggleReaction(ctx, params.RoomID, params.EventID, params.Key)
+		})
+	case "create_poll":
+		return unmarshalAndCall(req.Data, func(params *createPollParams) (*database.Event, error) {
+			return h.CreatePoll(ctx, params.RoomID, params.Question, params.Answers, params.MaxSelections, params.Kind)
+		})
+	case "vote_poll":
+		return unmarshalAndCall(req.Data, func(params *votePollParams) (*database.Event, error) {
+			return h.VotePoll(ctx, params.RoomID, params.EventID, params.Answers)
+		})
+	case "end_poll":
+		return unmarshalAndCall(req.Data, func(params *getEventParams) (*database.Event, error) {
+			return h.EndPoll(ctx, params.RoomID, params.EventID)
+		})
+	case "export_keys":
+		return unmarshalAndCall(req.Data, func(params *exportKeysParams) (string, error) {
+			return h.ExportRoomKeys(ctx, params.Passphrase, params.RoomID)
+		})
+	case "import_keys":
+		return unmarshalAndCall(req.Data, func(params *importKeysParams) (*KeyImportResult, error) {
+			return h.ImportRoomKeys(ctx, params.Passphrase, params.Data)
+		})
+	case "restore_key_backup":
+		return true, h.RestoreKeyBackup(ctx)
+	case "check_key_backup_version":
+		return unmarshalAndCall(req.Data, func(params *keyBackupParams) (bool, error) {
+			return true, h.CheckKeyBackupVersion(ctx, params.RecoveryKey)
+		})
+	case "create_key_backup":
+		return unmarshalAndCall(req.Data, func(params *keyBackupParams) (id.KeyBackupVersion, error) {
+			return h.CreateKeyBackup(ctx, params.RecoveryKey)
+		})
+	case "delete_key_backup":
+		return true, h.DeleteKeyBackup(ctx)
+	case "set_displayname":
+		return unmarshalAndCall(req.Data, func(params *setDisplaynameParams) (bool, error) {
+			return true, h.SetDisplayname(ctx, params.Displayname, params.Propagate)
+		})
+	case "set_avatar":
+		return unmarshalAndCall(req.Data, func(params *setAvatarParams) (bool, error) {
+			return true, h.SetAvatar(ctx, params.AvatarURL, params.Propagate)
+		})
+	case "set_room_profile":
+		return unmarshalAndCall(req.Data, func(params *setRoomProfileParams) (bool, error) {
+			return true, h.SetRoomProfile(ctx, params.RoomID, params.Displayname, params.AvatarURL, params.Reset)
+		})
+	case "ignore_user":
+		return unmarshalAndCall(req.Data, func(params *ignoreUserParams) (bool, error) {
+			return true, h.IgnoreUser(ctx, params.UserID)
+		})
+	case "unignore_user":
+		return unmarshalAndCall(req.Data, func(params *ignoreUserParams) (bool, error) {
+			return true, h.UnignoreUser(ctx, params.UserID)
+		})
+	case "join_successor":
+		return unmarshalAndCall(req.Data, func(params *joinSuccessorParams) (id.RoomID, error) {
+			return h.JoinSuccessor(ctx, params.RoomID)
+		})
+	case "add_room_tag":
+		return unmarshalAndCall(req.Data, func(params *roomTagParams) (bool, error) {
+			return true, h.Client.AddTagWithCustomData(ctx, params.RoomID, params.Tag, &event.TagMetadata{
+				Order: params.Order,
+			})
+		})
+	case "remove_room_tag":
+		return unmarshalAndCall(req.Data, func(params *roomTagParams) (bool, error) {
+			return true, h.Client.RemoveTag(ctx, params.RoomID, params.Tag)
+		})
+	case "get_image_packs":
+		return unmarshalAndCall(req.Data, func(params *getImagePacksParams) ([]*ImagePack, error) {
+			return h.GetImagePacks(ctx, params.RoomID)
+		})
+	case "create_image_pack":
+		return unmarshalAndCall(req.Data, func(params *imagePackParams) (*ImagePack, error) {
+			return h.CreateImagePack(ctx, params.RoomID, params.StateKey, params.DisplayName)
+		})
+	case "rename_image_pack":
+		return unmarshalAndCall(req.Data, func(params *imagePackParams) (*ImagePack, error) {
+			return h.RenameImagePack(ctx, params.RoomID, params.StateKey, params.DisplayName)
+		})
+	case "delete_image_pack":
+		return unmarshalAndCall(req.Data, func(params *imagePackParams) (bool, error) {
+			return true, h.DeleteImagePack(ctx, params.RoomID, params.StateKey)
+		})
+	case "add_image_pack_image":
+		return unmarshalAndCall(req.Data, func(params *imagePackImageParams) (*ImagePack, error) {
+			return h.AddImagePackImage(ctx, params.RoomID, params.StateKey, params.Shortcode, params.Image)
+		})
+	case "remove_image_pack_image":
+		return unmarshalAndCall(req.Data, func(params *imagePackImageParams) (*ImagePack, error) {
+			return h.RemoveImagePackImage(ctx, params.RoomID, params.StateKey, params.Shortcode)
+		})
+	case "set_image_pack_enabled":
+		return unmarshalAndCall(req.Data, func(params *imagePackParams) (bool, error) {
+			return true, h.SetImagePackEnabled(ctx, params.RoomID, params.StateKey, params.Enabled)
+		})
 	default:
 		return nil, fmt.Errorf("unknown command %q", req.Command)
 	}
@@ -178,6 +313,33 @@ type sendMessageParams struct {
 	Mentions    *event.Mentions            `json:"mentions"`
 }
 
+type scheduleMessageParams struct {
+	sendMessageParams
+	SendAt jsontime.UnixMilli `json:"send_at"`
+}
+
+type listScheduledEventsParams struct {
+	RoomID id.RoomID `json:"room_id,omitempty"`
+}
+
+type cancelScheduledEventParams struct {
+	RowID database.ScheduledEventRowID `json:"rowid"`
+}
+
+type getDraftsParams struct {
+	RoomID id.RoomID `json:"room_id,omitempty"`
+}
+
+type clearDraftParams struct {
+	RoomID     id.RoomID  `json:"room_id"`
+	ThreadRoot id.EventID `json:"thread_root,omitempty"`
+}
+
+type getURLPreviewParams struct {
+	RoomID id.RoomID `json:"room_id"`
+	URL    string    `json:"url"`
+}
+
 type sendEventParams struct {
 	RoomID    id.RoomID       `json:"room_id"`
 	EventType event.Type      `json:"type"`
@@ -267,6 +429,10 @@ type verifyParams struct {
 	RecoveryKey string `json:"recovery_key"`
 }
 
+type keyBackupParams struct {
+	RecoveryKey string `json:"recovery_key,omitempty"`
+}
+
 type discoverHomeserverParams struct {
 	UserID id.UserID `json:"user_id"`
 }
@@ -280,3 +446,82 @@ type paginateParams struct {
 	MaxTimelineID database.TimelineRowID `json:"max_timeline_id"`
 	Limit         int                    `json:"limit"`
 }
+
+type toggleReactionParams struct {
+	RoomID  id.RoomID  `json:"room_id"`
+	EventID id.EventID `json:"event_id"`
+	Key     string     `json:"key"`
+}
+
+type createPollParams struct {
+	RoomID        id.RoomID         `json:"room_id"`
+	Question      string            `json:"question"`
+	Answers       []string          `json:"answers"`
+	MaxSelections int               `json:"max_selections"`
+	Kind          database.PollKind `json:"kind"`
+}
+
+type votePollParams struct {
+	RoomID  id.RoomID  `json:"room_id"`
+	EventID id.EventID `json:"event_id"`
+	Answers []string   `json:"answers"`
+}
+
+type exportKeysParams struct {
+	Passphrase string    `json:"passphrase"`
+	RoomID     id.RoomID `json:"room_id,omitempty"`
+}
+
+type importKeysParams struct {
+	Passphrase string `json:"passphrase"`
+	Data       string `json:"data"`
+}
+
+type ignoreUserParams struct {
+	UserID id.UserID `json:"user_id"`
+}
+
+type setDisplaynameParams struct {
+	Displayname string `json:"displayname"`
+	Propagate   bool   `json:"propagate,omitempty"`
+}
+
+type setAvatarParams struct {
+	AvatarURL id.ContentURIString `json:"avatar_url"`
+	Propagate bool                `json:"propagate,omitempty"`
+}
+
+type setRoomProfileParams struct {
+	RoomID      id.RoomID            `json:"room_id"`
+	Displayname *string              `json:"displayname,omitempty"`
+	AvatarURL   *id.ContentURIString `json:"avatar_url,omitempty"`
+	Reset       bool                 `json:"reset,omitempty"`
+}
+
+type joinSuccessorParams struct {
+	RoomID id.RoomID `json:"room_id"`
+}
+
+type roomTagParams struct {
+	RoomID id.RoomID     `json:"room_id"`
+	Tag    event.RoomTag `json:"tag"`
+	Order  json.Number   `json:"order,omitempty"`
+}
+
+type getImagePacksParams struct {
+	RoomID id.RoomID `json:"room_id"`
+}
+
+type imagePackParams struct {
+	RoomID      id.RoomID `json:"room_id"`
+	StateKey    string    `json:"state_key"`
+	DisplayName string    `json:"display_name"`
+	Enabled     bool      `json:"enabled"`
+}
+
+type imagePackImageParams struct {
+	RoomID    id.RoomID       `json:"room_id"`
+	StateKey  string          `json:"state_key"`
+	Shortcode string          `json:"shortcode"`
+	Image     *ImagePackImage `json:"image"`
+}
@@ -43,6 +43,16 @@ func (jeh JSONEventHandler) HandleEvent(evt any) {
 		command = "send_complete"
 	case *ClientState:
 		command = "client_state"
+	case *UploadProgress:
+		command = "upload_progress"
+	case *ExportProgress:
+		command = "export_progress"
+	case *KeyBackupRestoreProgress:
+		command = "key_backup_restore_progress"
+	case *ScheduledEventsChanged:
+		command = "scheduled_events_changed"
+	case *DraftChanged:
+		command = "draft_changed"
 	default:
 		panic(fmt.Errorf("unknown event type %T", evt))
 	}
@@ -0,0 +1,259 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// How often to check if another device has replaced the key backup version
+const keyBackupCheckInterval = 1 * time.Hour
+
+var (
+	ErrSecretNotFound          = errors.New("secret not found")
+	ErrRecoveryKeyRequired     = errors.New("recovery key is required to fetch the key of the new key backup version")
+	ErrKeyBackupKeyMismatch    = errors.New("key backup public key doesn't match the stored key")
+	ErrKeyBackupNotCrossSigned = errors.New("key backup is not signed by own master key")
+	MWrongRoomKeysVersion      = mautrix.RespError{ErrCode: "M_WRONG_ROOM_KEYS_VERSION", StatusCode: http.StatusForbidden}
+)
+
+type keyBackupState struct {
+	version id.KeyBackupVersion
+	key     *backup.MegolmBackupKey
+}
+
+// KeyBackup returns the current key backup version and the key used to encrypt sessions uploaded to it.
+// The version is empty if key backup is not enabled.
+func (h *HiClient) KeyBackup() (id.KeyBackupVersion, *backup.MegolmBackupKey) {
+	state := h.keyBackup.Load()
+	if state == nil {
+		return "", nil
+	}
+	return state.version, state.key
+}
+
+func (h *HiClient) setKeyBackup(version id.KeyBackupVersion, key *backup.MegolmBackupKey) {
+	if key == nil {
+		h.keyBackup.Store(nil)
+	} else {
+		h.keyBackup.Store(&keyBackupState{version: version, key: key})
+	}
+}
+
+// getSSSSKey returns the default SSSS key using either the recovery key or the passphrase.
+func (h *HiClient) getSSSSKey(ctx context.Context, code string) (*ssss.Key, error) {
+	keyID, keyData, err := h.Crypto.SSSS.GetDefaultKeyData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default SSSS key data: %w", err)
+	}
+	key, err := keyData.VerifyRecoveryKey(keyID, code)
+	if errors.Is(err, ssss.ErrInvalidRecoveryKey) && keyData.Passphrase != nil {
+		key, err = keyData.VerifyPassphrase(keyID, code)
+	}
+	return key, err
+}
+
+// verifyKeyBackupVersion ensures that sessions uploaded to the given version can be decrypted with the given key,
+// and that the version was created by one of our own devices rather than someone with access to the server.
+func (h *HiClient) verifyKeyBackupVersion(ctx context.Context, version *mautrix.RespRoomKeysVersion[backup.MegolmAuthData], key *backup.MegolmBackupKey) error {
+	if version.Algorithm != id.KeyBackupAlgorithmMegolmBackupV1 {
+		return fmt.Errorf("unsupported key backup algorithm %s", version.Algorithm)
+	}
+	publicKey := id.Ed25519(base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes()))
+	if version.AuthData.PublicKey != publicKey {
+		return ErrKeyBackupKeyMismatch
+	}
+	crossSigningKeys := h.Crypto.GetOwnCrossSigningPublicKeys(ctx)
+	if crossSigningKeys == nil {
+		return fmt.Errorf("own cross-signing keys not found")
+	}
+	masterKey := crossSigningKeys.MasterKey
+	ok, err := signatures.VerifySignatureJSON(version.AuthData, h.Account.UserID, masterKey.String(), masterKey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrKeyBackupNotCrossSigned, err)
+	} else if !ok {
+		return ErrKeyBackupNotCrossSigned
+	}
+	return nil
+}
+
+func (h *HiClient) getKeyBackupKeyFromSSSS(ctx context.Context, ssssKey *ssss.Key) (*backup.MegolmBackupKey, error) {
+	data, err := h.Crypto.SSSS.GetDecryptedAccountData(ctx, event.AccountDataMegolmBackupKey, ssssKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get megolm backup key from SSSS: %w", err)
+	}
+	key, err := backup.MegolmBackupKeyFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse megolm backup key: %w", err)
+	}
+	return key, nil
+}
+
+// CheckKeyBackupVersion checks if the latest key backup version on the server has changed, and switches to it if it has.
+//
+// If the new version uses a different key than the stored one, the key is fetched from SSSS,
+// which requires the recovery key or passphrase. Uploads keep going to the old version until the new key is available.
+//
+// Sessions are marked with the backup version they were uploaded to,
+// so the next run of the request queue will re-upload everything to the new version.
+func (h *HiClient) CheckKeyBackupVersion(ctx context.Context, recoveryKey string) error {
+	h.keyBackupLock.Lock()
+	defer h.keyBackupLock.Unlock()
+	return h.checkKeyBackupVersion(ctx, recoveryKey)
+}
+
+func (h *HiClient) checkKeyBackupVersion(ctx context.Context, recoveryKey string) error {
+	log := zerolog.Ctx(ctx)
+	h.lastKeyBackupCheck = time.Now()
+	currentVersion, currentKey := h.KeyBackup()
+	latestVersion, err := h.Client.GetKeyBackupLatestVersion(ctx)
+	if errors.Is(err, mautrix.MNotFound) {
+		if currentVersion != "" {
+			log.Info().Str("old_version", string(currentVersion)).Msg("Key backup was deleted by another device")
+			h.setKeyBackup("", currentKey)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get key backup latest version: %w", err)
+	} else if latestVersion.Version == currentVersion {
+		return nil
+	}
+	log.Info().
+		Str("old_version", string(currentVersion)).
+		Str("new_version", string(latestVersion.Version)).
+		Msg("Key backup version changed")
+	newKey := currentKey
+	if newKey == nil || h.verifyKeyBackupVersion(ctx, latestVersion, newKey) != nil {
+		if recoveryKey == "" {
+			return ErrRecoveryKeyRequired
+		}
+		ssssKey, err := h.getSSSSKey(ctx, recoveryKey)
+		if err != nil {
+			return err
+		}
+		newKey, err = h.getKeyBackupKeyFromSSSS(ctx, ssssKey)
+		if err != nil {
+			return err
+		}
+	}
+	err = h.verifyKeyBackupVersion(ctx, latestVersion, newKey)
+	if err != nil {
+		return fmt.Errorf("refusing to use key backup version %s: %w", latestVersion.Version, err)
+	}
+	err = h.CryptoStore.PutSecret(ctx, id.SecretMegolmBackupV1, base64.StdEncoding.EncodeToString(newKey.Bytes()))
+	if err != nil {
+		return fmt.Errorf("failed to store megolm backup key: %w", err)
+	}
+	h.setKeyBackup(latestVersion.Version, newKey)
+	h.WakeupRequestQueue()
+	return nil
+}
+
+func (h *HiClient) checkKeyBackupVersionIfNeeded(ctx context.Context) {
+	if !h.Verified {
+		return
+	}
+	h.keyBackupLock.Lock()
+	defer h.keyBackupLock.Unlock()
+	if time.Since(h.lastKeyBackupCheck) < keyBackupCheckInterval {
+		return
+	}
+	err := h.checkKeyBackupVersion(ctx, "")
+	if errors.Is(err, ErrRecoveryKeyRequired) {
+		zerolog.Ctx(ctx).Warn().Msg("Key backup version changed, recovery key is needed to switch to the new version")
+	} else if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to check key backup version")
+	}
+}
+
+// CreateKeyBackup creates a new key backup version with a new key, stores the key in SSSS and starts uploading
+// all megolm sessions to it. Any previous backup version is left as-is on the server.
+//
+// The recovery key or passphrase is required to store the new key in SSSS.
+func (h *HiClient) CreateKeyBackup(ctx context.Context, recoveryKey string) (id.KeyBackupVersion, error) {
+	if recoveryKey == "" {
+		return "", ErrRecoveryKeyRequired
+	}
+	h.keyBackupLock.Lock()
+	defer h.keyBackupLock.Unlock()
+	ssssKey, err := h.getSSSSKey(ctx, recoveryKey)
+	if err != nil {
+		return "", err
+	}
+	key, err := backup.NewMegolmBackupKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key backup key: %w", err)
+	}
+	authData := backup.MegolmAuthData{
+		PublicKey: id.Ed25519(base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes())),
+	}
+	masterKey := h.Crypto.CrossSigningKeys.MasterKey
+	masterSig, err := masterKey.SignJSON(authData)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign key backup auth data with master key: %w", err)
+	}
+	deviceSig, err := h.Crypto.GetAccount().SignJSON(authData)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign key backup auth data with device key: %w", err)
+	}
+	authData.Signatures = signatures.NewSingleSignature(h.Account.UserID, id.KeyAlgorithmEd25519, masterKey.PublicKey().String(), masterSig)
+	authData.Signatures[h.Account.UserID][id.NewKeyID(id.KeyAlgorithmEd25519, h.Account.DeviceID.String())] = deviceSig
+	resp, err := h.Client.CreateKeyBackupVersion(ctx, &mautrix.ReqRoomKeysVersionCreate[backup.MegolmAuthData]{
+		Algorithm: id.KeyBackupAlgorithmMegolmBackupV1,
+		AuthData:  authData,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create key backup version: %w", err)
+	}
+	err = h.Crypto.SSSS.SetEncryptedAccountData(ctx, event.AccountDataMegolmBackupKey, key.Bytes(), ssssKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to store key backup key in SSSS: %w", err)
+	}
+	err = h.CryptoStore.PutSecret(ctx, id.SecretMegolmBackupV1, base64.StdEncoding.EncodeToString(key.Bytes()))
+	if err != nil {
+		return "", fmt.Errorf("failed to store key backup key: %w", err)
+	}
+	h.setKeyBackup(resp.Version, key)
+	h.lastKeyBackupCheck = time.Now()
+	zerolog.Ctx(ctx).Info().Str("version", string(resp.Version)).Msg("Created new key backup version")
+	h.WakeupRequestQueue()
+	return resp.Version, nil
+}
+
+// DeleteKeyBackup deletes the current key backup version from the server and stops uploading keys.
+func (h *HiClient) DeleteKeyBackup(ctx context.Context) error {
+	h.keyBackupLock.Lock()
+	defer h.keyBackupLock.Unlock()
+	version, _ := h.KeyBackup()
+	if version == "" {
+		return ErrNoKeyBackup
+	}
+	err := h.Client.DeleteKeyBackupVersion(ctx, version)
+	if err != nil {
+		return fmt.Errorf("failed to delete key backup version: %w", err)
+	}
+	h.setKeyBackup("", nil)
+	err = h.CryptoStore.DeleteSecret(ctx, id.SecretMegolmBackupV1)
+	if err != nil {
+		return fmt.Errorf("failed to delete key backup key: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().Str("version", string(version)).Msg("Deleted key backup version")
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/id"
+)
+
+// TestHiClient_VerifyKeyBackupVersion only covers the checks that happen before the cross-signing
+// signature is verified, as the signature check needs a fully set up crypto machine.
+func TestHiClient_VerifyKeyBackupVersion(t *testing.T) {
+	key, err := backup.NewMegolmBackupKey()
+	if err != nil {
+		t.Fatalf("failed to generate backup key: %v", err)
+	}
+	otherKey, err := backup.NewMegolmBackupKey()
+	if err != nil {
+		t.Fatalf("failed to generate backup key: %v", err)
+	}
+	publicKey := func(key *backup.MegolmBackupKey) id.Ed25519 {
+		return id.Ed25519(base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes()))
+	}
+	tests := []struct {
+		name        string
+		algorithm   id.KeyBackupAlgorithm
+		publicKey   id.Ed25519
+		wantErr     error
+		wantMessage string
+	}{
+		{"Unsupported algorithm", "org.example.backup.v2", publicKey(key), nil, "unsupported key backup algorithm org.example.backup.v2"},
+		{"Different public key", id.KeyBackupAlgorithmMegolmBackupV1, publicKey(otherKey), ErrKeyBackupKeyMismatch, ""},
+		{"Missing public key", id.KeyBackupAlgorithmMegolmBackupV1, "", ErrKeyBackupKeyMismatch, ""},
+	}
+	h := &HiClient{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version := &mautrix.RespRoomKeysVersion[backup.MegolmAuthData]{
+				Algorithm: test.algorithm,
+				AuthData:  backup.MegolmAuthData{PublicKey: test.publicKey},
+				Version:   id.KeyBackupVersion("1"),
+			}
+			err := h.verifyKeyBackupVersion(context.Background(), version, key)
+			if err == nil {
+				t.Fatalf("verifyKeyBackupVersion() didn't return an error")
+			} else if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("verifyKeyBackupVersion() error = %v, want %v", err, test.wantErr)
+			} else if test.wantMessage != "" && !strings.Contains(err.Error(), test.wantMessage) {
+				t.Errorf("verifyKeyBackupVersion() error = %v, want %q", err, test.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrNoKeyBackup                = errors.New("key backup is not set up")
+	ErrKeyBackupRestoreInProgress = errors.New("key backup restore is already in progress")
+)
+
+const (
+	// Number of sessions to import in a single database transaction
+	keyBackupRestoreBatchSize = 100
+	// Number of sessions to retry decryption for between progress events
+	keyBackupRestoreProgressPeriod = 500
+)
+
+type backupSessionEntry struct {
+	roomID    id.RoomID
+	sessionID id.SessionID
+	data      *backup.EncryptedSessionData[backup.MegolmSessionData]
+}
+
+// RestoreKeyBackup starts a background job that downloads every session in the current key backup version,
+// imports them and then retries decrypting all events that have failed to decrypt.
+//
+// Progress is reported using KeyBackupRestoreProgress events.
+func (h *HiClient) RestoreKeyBackup(ctx context.Context) error {
+	version, key := h.KeyBackup()
+	if version == "" || key == nil {
+		return ErrNoKeyBackup
+	} else if !h.keyBackupRestoreInProgress.CompareAndSwap(false, true) {
+		return ErrKeyBackupRestoreInProgress
+	}
+	log := h.Log.With().
+		Str("action", "restore key backup").
+		Str("key_backup_version", string(version)).
+		Logger()
+	go func() {
+		defer h.keyBackupRestoreInProgress.Store(false)
+		err := h.restoreKeyBackup(log.WithContext(context.WithoutCancel(ctx)), version, key)
+		if err != nil {
+			log.Err(err).Msg("Failed to restore key backup")
+			h.EventHandler(&KeyBackupRestoreProgress{
+				Stage:   KeyBackupRestoreStageFailed,
+				Version: version,
+				Error:   err.Error(),
+			})
+		}
+	}()
+	return nil
+}
+
+func (h *HiClient) restoreKeyBackup(ctx context.Context, version id.KeyBackupVersion, key *backup.MegolmBackupKey) error {
+	log := zerolog.Ctx(ctx)
+	progress := KeyBackupRestoreProgress{Stage: KeyBackupRestoreStageFetching, Version: version}
+	sendProgress := func() {
+		progressCopy := progress
+		h.EventHandler(&progressCopy)
+	}
+	sendProgress()
+	keys, err := h.Client.GetKeyBackup(ctx, version)
+	if err != nil {
+		return fmt.Errorf("failed to get key backup: %w", err)
+	}
+	var sessions []backupSessionEntry
+	for roomID, room := range keys.Rooms {
+		for sessionID, data := range room.Sessions {
+			sessions = append(sessions, backupSessionEntry{roomID: roomID, sessionID: sessionID, data: &data.SessionData})
+		}
+	}
+	log.Info().Int("session_count", len(sessions)).Msg("Downloaded key backup, importing sessions")
+	progress.Stage = KeyBackupRestoreStageImporting
+	progress.Total = len(sessions)
+	sendProgress()
+	// The session received callback checks this to skip retrying decryption for each session individually
+	importCtx := context.WithValue(ctx, keyBackupRestoreContextKey, true)
+	for chunk := range slices.Chunk(sessions, keyBackupRestoreBatchSize) {
+		err = h.CryptoStore.DB.DoTxn(importCtx, nil, func(ctx context.Context) error {
+			for _, sess := range chunk {
+				decrypted, err := sess.data.Decrypt(key)
+				if err == nil {
+					_, err = h.Crypto.ImportRoomKeyFromBackup(ctx, version, sess.roomID, sess.sessionID, decrypted)
+				}
+				if err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					log.Warn().Err(err).
+						Stringer("room_id", sess.roomID).
+						Stringer("session_id", sess.sessionID).
+						Msg("Failed to import session from key backup")
+					progress.Failed++
+				} else {
+					progress.Done++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to import sessions: %w", err)
+		}
+		sendProgress()
+	}
+	log.Info().
+		Int("imported_count", progress.Done).
+		Int("failed_count", progress.Failed).
+		Msg("Imported sessions from key backup, retrying decryption of failed events")
+
+	failedSessions, err := h.DB.Event.GetFailedMegolmSessions(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get sessions of events that failed to decrypt: %w", err)
+	}
+	progress.Stage = KeyBackupRestoreStageRetrying
+	progress.Total = len(failedSessions)
+	progress.Done = 0
+	progress.Failed = 0
+	sendProgress()
+	for i, failed := range failedSessions {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		sess, err := h.CryptoStore.GetGroupSession(ctx, failed.RoomID, failed.SessionID)
+		if err != nil {
+			log.Warn().Err(err).
+				Stringer("room_id", failed.RoomID).
+				Stringer("session_id", failed.SessionID).
+				Msg("Failed to get session to retry decryption")
+			progress.Failed++
+		} else if sess == nil {
+			progress.Failed++
+		} else {
+			h.handleReceivedMegolmSession(ctx, failed.RoomID, failed.SessionID, sess.Internal.FirstKnownIndex())
+			progress.Done++
+		}
+		if (i+1)%keyBackupRestoreProgressPeriod == 0 {
+			sendProgress()
+		}
+	}
+	progress.Stage = KeyBackupRestoreStageDone
+	sendProgress()
+	log.Info().
+		Int("retried_sessions", progress.Done).
+		Int("missing_sessions", progress.Failed).
+		Msg("Finished restoring key backup")
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrEmptyPassphrase = errors.New("passphrase must not be empty")
+	ErrNoKeysToExport  = errors.New("no keys to export")
+)
+
+type KeyImportResult struct {
+	Imported int `json:"imported"`
+	Total    int `json:"total"`
+}
+
+// ExportRoomKeys exports megolm sessions in the passphrase-encrypted "MEGOLM SESSION DATA" format.
+// If roomID is empty, the sessions of all rooms are exported.
+func (h *HiClient) ExportRoomKeys(ctx context.Context, passphrase string, roomID id.RoomID) (string, error) {
+	if passphrase == "" {
+		return "", ErrEmptyPassphrase
+	}
+	var sessions []*crypto.InboundGroupSession
+	var err error
+	if roomID == "" {
+		sessions, err = h.CryptoStore.GetAllGroupSessions(ctx).AsList()
+	} else {
+		sessions, err = h.CryptoStore.GetGroupSessionsForRoom(ctx, roomID).AsList()
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get megolm sessions: %w", err)
+	} else if len(sessions) == 0 {
+		return "", ErrNoKeysToExport
+	}
+	data, err := crypto.ExportKeys(passphrase, sessions)
+	if err != nil {
+		return "", fmt.Errorf("failed to export keys: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().
+		Int("session_count", len(sessions)).
+		Stringer("room_id", roomID).
+		Msg("Exported megolm sessions")
+	return string(data), nil
+}
+
+// ImportRoomKeys imports megolm sessions from a passphrase-encrypted key export file.
+//
+// Every imported session goes through the normal session received callback,
+// which retries decrypting events that previously failed to decrypt with that session.
+func (h *HiClient) ImportRoomKeys(ctx context.Context, passphrase, data string) (*KeyImportResult, error) {
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	imported, total, err := h.Crypto.ImportKeys(ctx, passphrase, []byte(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to import keys: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().
+		Int("imported_count", imported).
+		Int("total_count", total).
+		Msg("Imported megolm sessions from key export")
+	if imported > 0 {
+		// Imported sessions don't have a key backup version, so wake up the request queue to upload them
+		h.WakeupRequestQueue()
+	}
+	return &KeyImportResult{Imported: imported, Total: total}, nil
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+// How long to wait for keys of live events that couldn't be decrypted immediately.
+// Events decrypted after this are assumed to be backfilled history rather than new messages.
+const liveEventDecryptionTimeout = 1 * time.Hour
+
+func isUndecryptedEvent(evt *database.Event) bool {
+	return evt.Type == event.EventEncrypted.Type && evt.Decrypted == nil
+}
+
+// dispatchLiveEvents passes new timeline events from a sync response to LiveEventHandler.
+// Encrypted events that couldn't be decrypted yet are held back until the decryption queue decrypts them.
+func (h *HiClient) dispatchLiveEvents(ctx context.Context, evts []*database.Event) {
+	if h.LiveEventHandler == nil || len(evts) == 0 {
+		return
+	}
+	h.awaitingDecryptionLock.Lock()
+	now := time.Now()
+	for evtID, receivedAt := range h.awaitingDecryption {
+		if now.Sub(receivedAt) > liveEventDecryptionTimeout {
+			delete(h.awaitingDecryption, evtID)
+		}
+	}
+	for _, evt := range evts {
+		if isUndecryptedEvent(evt) {
+			h.awaitingDecryption[evt.ID] = now
+		}
+	}
+	h.awaitingDecryptionLock.Unlock()
+	for _, evt := range evts {
+		if !isUndecryptedEvent(evt) {
+			h.LiveEventHandler(ctx, evt)
+		}
+	}
+}
+
+// dispatchDecryptedLiveEvents passes events to LiveEventHandler if they were received from sync
+// before the keys to decrypt them arrived.
+func (h *HiClient) dispatchDecryptedLiveEvents(ctx context.Context, evts []*database.Event) {
+	if h.LiveEventHandler == nil {
+		return
+	}
+	live := make([]*database.Event, 0, len(evts))
+	h.awaitingDecryptionLock.Lock()
+	for _, evt := range evts {
+		if _, ok := h.awaitingDecryption[evt.ID]; ok {
+			delete(h.awaitingDecryption, evt.ID)
+			live = append(live, evt)
+		}
+	}
+	h.awaitingDecryptionLock.Unlock()
+	for _, evt := range live {
+		h.LiveEventHandler(ctx, evt)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var roomMentionRegex = regexp.MustCompile(`(?:^|[^\w@])@room\b`)
+
+func parseMentionLink(href string) id.UserID {
+	parsedURL, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return ""
+	}
+	var uri *id.MatrixURI
+	switch {
+	case parsedURL.Scheme == "https" && parsedURL.Host == "matrix.to":
+		uri, err = id.ProcessMatrixToURL(parsedURL)
+	case parsedURL.Scheme == "matrix":
+		uri, err = id.ProcessMatrixURI(parsedURL)
+	default:
+		return ""
+	}
+	if err != nil || uri.Sigil1 != '@' {
+		return ""
+	}
+	return uri.UserID()
+}
+
+// parseMentionsFromHTML finds user pills and @room mentions in the given HTML.
+// Anything inside code blocks, inline code or reply fallbacks is ignored.
+func parseMentionsFromHTML(body string) (userIDs []id.UserID, room bool) {
+	tz := html.NewTokenizer(strings.NewReader(body))
+	// Number of currently open tags whose contents should be ignored
+	ignoreDepth := 0
+	for {
+		switch tz.Next() {
+		case html.ErrorToken:
+			// Either the end of the input or invalid HTML, return whatever was found so far in both cases
+			return
+		case html.StartTagToken:
+			token := tz.Token()
+			switch token.DataAtom {
+			case atom.Pre, atom.Code:
+				ignoreDepth++
+			case atom.A:
+				if ignoreDepth > 0 {
+					continue
+				}
+				href, _ := getAttribute(token.Attr, "href")
+				if userID := parseMentionLink(href); userID != "" {
+					userIDs = append(userIDs, userID)
+				}
+			default:
+				if token.Data == "mx-reply" {
+					ignoreDepth++
+				}
+			}
+		case html.EndTagToken:
+			token := tz.Token()
+			if (token.DataAtom == atom.Pre || token.DataAtom == atom.Code || token.Data == "mx-reply") && ignoreDepth > 0 {
+				ignoreDepth--
+			}
+		case html.TextToken:
+			if ignoreDepth == 0 && !room && roomMentionRegex.Match(tz.Text()) {
+				room = true
+			}
+		}
+	}
+}
+
+// addAutomaticMentions adds users who are linked to in the message and @room to the intentional mentions
+// of the given content. The user's own ID is never included, and @room is dropped if the power levels
+// don't allow the user to notify the whole room.
+func (h *HiClient) addAutomaticMentions(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent) {
+	var userIDs []id.UserID
+	var roomMention bool
+	if content.Format == event.FormatHTML && content.FormattedBody != "" {
+		userIDs, roomMention = parseMentionsFromHTML(content.FormattedBody)
+	} else if content.Body != "" {
+		roomMention = roomMentionRegex.MatchString(content.Body)
+	}
+	for _, userID := range userIDs {
+		if userID != h.Account.UserID {
+			content.Mentions.Add(userID)
+		}
+	}
+	if !roomMention && !content.Mentions.Room {
+		return
+	}
+	perms, err := h.GetRoomPermissions(ctx, roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get power levels to check @room permission")
+		content.Mentions.Room = false
+	} else if err = perms.CanNotifyRoom(); err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("Not adding @room mention")
+		content.Mentions.Room = false
+	} else {
+		content.Mentions.Room = true
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"slices"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseMentionLink(t *testing.T) {
+	tests := []struct {
+		href string
+		want id.UserID
+	}{
+		{"https://matrix.to/#/@alice:example.com", "@alice:example.com"},
+		{"https://matrix.to/#/%40alice%3Aexample.com", "@alice:example.com"},
+		{" https://matrix.to/#/@alice:example.com ", "@alice:example.com"},
+		{"matrix:u/alice:example.com", "@alice:example.com"},
+		{"matrix:u/alice:example.com?action=chat", "@alice:example.com"},
+		{"https://matrix.to/#/!room:example.com", ""},
+		{"https://matrix.to/#/#alias:example.com", ""},
+		{"matrix:r/alias:example.com", ""},
+		{"https://example.com/#/@alice:example.com", ""},
+		{"http://matrix.to/#/@alice:example.com", ""},
+		{"", ""},
+		{"://", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.href, func(t *testing.T) {
+			if got := parseMentionLink(test.href); got != test.want {
+				t.Errorf("parseMentionLink() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMentionsFromHTML(t *testing.T) {
+	tests := []struct {
+		name      string
+		html      string
+		wantUsers []id.UserID
+		wantRoom  bool
+	}{
+		{"Plain text", "hello world", nil, false},
+		{"User pill", `hi <a href="https://matrix.to/#/@alice:example.com">Alice</a>`, []id.UserID{"@alice:example.com"}, false},
+		{"Multiple pills", `<a href="https://matrix.to/#/@alice:example.com">Alice</a> and <a href="matrix:u/bob:example.com">Bob</a>`,
+			[]id.UserID{"@alice:example.com", "@bob:example.com"}, false},
+		{"Non-user links are ignored", `<a href="https://matrix.to/#/!room:example.com">room</a> <a href="https://example.com">site</a>`, nil, false},
+		{"Room mention", "@room please look", nil, true},
+		{"Room mention after markup", "<b>hey</b> @room", nil, true},
+		{"Room mention requires word boundary", "@roommate and foo@room", nil, false},
+		{"Inline code is ignored", `<code>@room <a href="https://matrix.to/#/@alice:example.com">Alice</a></code>`, nil, false},
+		{"Code block is ignored", `<pre><code>@room</code></pre> ok`, nil, false},
+		{"Text after code is checked", `<code>x</code> @room`, nil, true},
+		{"Reply fallback is ignored", `<mx-reply><blockquote><a href="https://matrix.to/#/@bob:example.com">Bob</a> @room</blockquote></mx-reply>reply`, nil, false},
+		{"Pill after reply fallback", `<mx-reply>quote</mx-reply><a href="https://matrix.to/#/@alice:example.com">Alice</a>`, []id.UserID{"@alice:example.com"}, false},
+		{"Unclosed tags", `<a href="https://matrix.to/#/@alice:example.com">Alice @room`, []id.UserID{"@alice:example.com"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, room := parseMentionsFromHTML(test.html)
+			if !slices.Equal(users, test.wantUsers) {
+				t.Errorf("parseMentionsFromHTML() users = %v, want %v", users, test.wantUsers)
+			}
+			if room != test.wantRoom {
+				t.Errorf("parseMentionsFromHTML() room = %v, want %v", room, test.wantRoom)
+			}
+		})
+	}
+}
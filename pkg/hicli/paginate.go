@@ -47,17 +47,39 @@ func (h *HiClient) GetEventsByRowIDs(ctx context.Context, rowIDs []database.Even
 		if err != nil {
 			return events, fmt.Errorf("failed to fill reaction counts: %w", err)
 		}
+		err = h.fillLocalAggregations(ctx, firstRoomID, events)
+		if err != nil {
+			return events, err
+		}
 	} else {
 		// TODO slow path where events are collected and filling is done one room at a time?
 	}
 	return events, nil
 }
 
+// fillLocalAggregations fills fields of events that are calculated from other events rather than stored directly.
+func (h *HiClient) fillLocalAggregations(ctx context.Context, roomID id.RoomID, events []*database.Event) error {
+	err := h.DB.Event.FillOwnReactions(ctx, roomID, h.Account.UserID, events)
+	if err != nil {
+		return fmt.Errorf("failed to fill own reactions: %w", err)
+	}
+	err = h.FillPollSummaries(ctx, roomID, events)
+	if err != nil {
+		return fmt.Errorf("failed to fill poll summaries: %w", err)
+	}
+	h.markIgnoredEvents(events)
+	return nil
+}
+
 func (h *HiClient) GetEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*database.Event, error) {
 	if evt, err := h.DB.Event.GetByID(ctx, eventID); err != nil {
 		return nil, fmt.Errorf("failed to get event from database: %w", err)
 	} else if evt != nil {
 		h.ReprocessExistingEvent(ctx, evt)
+		err = h.fillLocalAggregations(ctx, evt.RoomID, []*database.Event{evt})
+		if err != nil {
+			return nil, err
+		}
 		return evt, nil
 	} else if serverEvt, err := h.Client.GetEvent(ctx, roomID, eventID); err != nil {
 		return nil, fmt.Errorf("failed to get event from server: %w", err)
@@ -200,7 +222,44 @@ type PaginationResponse struct {
 	HasMore bool              `json:"has_more"`
 }
 
+// Paginate returns events before the given timeline row in the given room.
+//
+// When the history of the room runs out, pagination continues into the predecessor room if the room has been
+// upgraded and the old room is known. Subsequent calls with timeline rows of the predecessor will keep paginating it.
 func (h *HiClient) Paginate(ctx context.Context, roomID id.RoomID, maxTimelineID database.TimelineRowID, limit int) (*PaginationResponse, error) {
+	paginateRoomID, err := h.findPaginationRoom(ctx, roomID, maxTimelineID)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		resp, err := h.paginateRoom(ctx, paginateRoomID, maxTimelineID, limit)
+		if err != nil || resp.HasMore || i >= maxPredecessorDepth {
+			return resp, err
+		}
+		room, err := h.DB.Room.Get(ctx, paginateRoomID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get room from database: %w", err)
+		}
+		predecessor, err := h.getValidPredecessor(ctx, room)
+		if err != nil {
+			return nil, err
+		} else if predecessor == nil {
+			return resp, nil
+		} else if len(resp.Events) > 0 {
+			// Return the last events of this room first, the next call will move to the predecessor
+			resp.HasMore = true
+			return resp, nil
+		}
+		zerolog.Ctx(ctx).Debug().
+			Stringer("room_id", paginateRoomID).
+			Stringer("predecessor_room_id", predecessor.ID).
+			Msg("Room history ran out, continuing pagination in predecessor room")
+		paginateRoomID = predecessor.ID
+		maxTimelineID = 0
+	}
+}
+
+func (h *HiClient) paginateRoom(ctx context.Context, roomID id.RoomID, maxTimelineID database.TimelineRowID, limit int) (*PaginationResponse, error) {
 	evts, err := h.DB.Timeline.Get(ctx, roomID, limit, maxTimelineID)
 	if err != nil {
 		return nil, err
@@ -208,6 +267,10 @@ func (h *HiClient) Paginate(ctx context.Context, roomID id.RoomID, maxTimelineID
 		for _, evt := range evts {
 			h.ReprocessExistingEvent(ctx, evt)
 		}
+		err = h.fillLocalAggregations(ctx, roomID, evts)
+		if err != nil {
+			return nil, err
+		}
 		return &PaginationResponse{Events: evts, HasMore: true}, nil
 	} else {
 		return h.PaginateServer(ctx, roomID, limit)
@@ -219,6 +282,7 @@ func (h *HiClient) PaginateServer(ctx context.Context, roomID id.RoomID, limit i
 	h.paginationInterrupterLock.Lock()
 	if _, alreadyPaginating := h.paginationInterrupter[roomID]; alreadyPaginating {
 		h.paginationInterrupterLock.Unlock()
+		cancel(nil)
 		return nil, ErrPaginationAlreadyInProgress
 	}
 	h.paginationInterrupter[roomID] = cancel
@@ -227,6 +291,7 @@ func (h *HiClient) PaginateServer(ctx context.Context, roomID id.RoomID, limit i
 		h.paginationInterrupterLock.Lock()
 		delete(h.paginationInterrupter, roomID)
 		h.paginationInterrupterLock.Unlock()
+		cancel(nil)
 	}()
 
 	room, err := h.DB.Room.Get(ctx, roomID)
@@ -292,6 +357,10 @@ func (h *HiClient) PaginateServer(ctx context.Context, roomID id.RoomID, limit i
 		if err != nil {
 			return fmt.Errorf("failed to fill last edit row IDs: %w", err)
 		}
+		err = h.fillLocalAggregations(ctx, roomID, events)
+		if err != nil {
+			return err
+		}
 		err = h.DB.Event.FillLastEditRowIDs(ctx, roomID, events)
 		if err != nil {
 			return fmt.Errorf("failed to fill last edit row IDs: %w", err)
@@ -0,0 +1,230 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrInsufficientPowerLevel = errors.New("insufficient power level")
+
+// The default level required for sending @room mentions if the power levels don't specify it
+const defaultNotifyRoomLevel = 50
+
+// RoomPermissions answers questions about what the current user is allowed to do in a room.
+//
+// If the room has no power levels event, all actions are allowed and the homeserver is left to decide.
+type RoomPermissions struct {
+	RoomID id.RoomID
+	UserID id.UserID
+	Levels *event.PowerLevelsEventContent
+}
+
+// RoomCapabilities is a precalculated summary of RoomPermissions that is sent to clients in the sync payload.
+type RoomCapabilities struct {
+	PowerLevel   int                 `json:"power_level"`
+	SendMessages bool                `json:"send_messages"`
+	React        bool                `json:"react"`
+	RedactOwn    bool                `json:"redact_own"`
+	RedactOthers bool                `json:"redact_others"`
+	Invite       bool                `json:"invite"`
+	Kick         bool                `json:"kick"`
+	Ban          bool                `json:"ban"`
+	NotifyRoom   bool                `json:"notify_room"`
+	StateDefault bool                `json:"state_default"`
+	State        map[event.Type]bool `json:"state"`
+}
+
+// Common state event types that are included in RoomCapabilities
+var capabilityStateTypes = []event.Type{
+	event.StateRoomName,
+	event.StateTopic,
+	event.StateRoomAvatar,
+	event.StateCanonicalAlias,
+	event.StatePinnedEvents,
+	event.StatePowerLevels,
+	event.StateJoinRules,
+	event.StateHistoryVisibility,
+	event.StateEncryption,
+	event.StateTombstone,
+	StateImagePack,
+}
+
+func (h *HiClient) GetRoomPermissions(ctx context.Context, roomID id.RoomID) (*RoomPermissions, error) {
+	pl, err := h.ClientStore.GetPowerLevels(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get power levels: %w", err)
+	}
+	return &RoomPermissions{RoomID: roomID, UserID: h.Account.UserID, Levels: pl}, nil
+}
+
+func (h *HiClient) getRoomCapabilities(ctx context.Context, roomID id.RoomID) (*RoomCapabilities, error) {
+	perms, err := h.GetRoomPermissions(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return perms.Capabilities(), nil
+}
+
+// forUser returns permissions with the same power levels for another user, e.g. to validate events they've sent.
+func (rp *RoomPermissions) forUser(userID id.UserID) *RoomPermissions {
+	return &RoomPermissions{RoomID: rp.RoomID, UserID: userID, Levels: rp.Levels}
+}
+
+func (rp *RoomPermissions) ownLevel() int {
+	return rp.Levels.GetUserLevel(rp.UserID)
+}
+
+func (rp *RoomPermissions) check(action string, required int) error {
+	if rp.Levels == nil {
+		return nil
+	} else if own := rp.ownLevel(); own < required {
+		return fmt.Errorf("%w: %s requires power level %d, but you have %d", ErrInsufficientPowerLevel, action, required, own)
+	}
+	return nil
+}
+
+// CanSend checks if the user can send message events of the given type.
+func (rp *RoomPermissions) CanSend(evtType event.Type) error {
+	if rp.Levels == nil {
+		return nil
+	}
+	return rp.check(fmt.Sprintf("sending %s events", evtType.Type), rp.Levels.GetEventLevel(evtType))
+}
+
+// CanSetState checks if the user can send a state event with the given type.
+//
+// Member events for other users should be checked with CanChangeMembership instead.
+func (rp *RoomPermissions) CanSetState(evtType event.Type) error {
+	if rp.Levels == nil {
+		return nil
+	}
+	evtType.Class = event.StateEventType
+	return rp.check(fmt.Sprintf("setting %s state", evtType.Type), rp.Levels.GetEventLevel(evtType))
+}
+
+// CanChangeMembership checks if the user can change the membership of another user from current to the given value.
+func (rp *RoomPermissions) CanChangeMembership(target id.UserID, current, membership event.Membership) error {
+	if target == rp.UserID {
+		// Own membership and profile changes are governed by join rules rather than power levels
+		return nil
+	}
+	switch membership {
+	case event.MembershipInvite:
+		return rp.CanInvite()
+	case event.MembershipBan:
+		return rp.CanBan(target)
+	case event.MembershipLeave:
+		if current == event.MembershipBan {
+			return rp.CanUnban(target)
+		}
+		return rp.CanKick(target)
+	default:
+		return fmt.Errorf("%w: can't set membership of other users to %s", ErrInsufficientPowerLevel, membership)
+	}
+}
+
+// CanRedact checks if the user can redact an event sent by the given user.
+func (rp *RoomPermissions) CanRedact(sender id.UserID) error {
+	if rp.Levels == nil {
+		return nil
+	}
+	err := rp.check("sending redactions", rp.Levels.GetEventLevel(event.EventRedaction))
+	if err != nil || sender == rp.UserID {
+		return err
+	}
+	return rp.check("redacting events of other users", rp.Levels.Redact())
+}
+
+func (rp *RoomPermissions) CanInvite() error {
+	if rp.Levels == nil {
+		return nil
+	}
+	return rp.check("inviting users", rp.Levels.Invite())
+}
+
+// CanKick checks if the user can kick the given user. The target must also have a lower power level.
+func (rp *RoomPermissions) CanKick(target id.UserID) error {
+	if rp.Levels == nil {
+		return nil
+	}
+	err := rp.check("kicking users", rp.Levels.Kick())
+	if err != nil {
+		return err
+	} else if target != "" && target != rp.UserID && rp.Levels.GetUserLevel(target) >= rp.ownLevel() {
+		return fmt.Errorf("%w: can't kick users with an equal or higher power level", ErrInsufficientPowerLevel)
+	}
+	return nil
+}
+
+// CanBan checks if the user can ban the given user. The target must also have a lower power level.
+func (rp *RoomPermissions) CanBan(target id.UserID) error {
+	if rp.Levels == nil {
+		return nil
+	}
+	err := rp.check("banning users", rp.Levels.Ban())
+	if err != nil {
+		return err
+	} else if target != "" && target != rp.UserID && rp.Levels.GetUserLevel(target) >= rp.ownLevel() {
+		return fmt.Errorf("%w: can't ban users with an equal or higher power level", ErrInsufficientPowerLevel)
+	}
+	return nil
+}
+
+// CanUnban checks if the user can unban the given user.
+//
+// Unbanning requires the ban level, and as it's done with a leave event, the same checks as kicking apply too.
+func (rp *RoomPermissions) CanUnban(target id.UserID) error {
+	if rp.Levels == nil {
+		return nil
+	}
+	err := rp.check("unbanning users", rp.Levels.Ban())
+	if err != nil {
+		return err
+	}
+	return rp.CanKick(target)
+}
+
+// CanNotifyRoom checks if the user can send @room mentions.
+func (rp *RoomPermissions) CanNotifyRoom() error {
+	if rp.Levels == nil {
+		return nil
+	}
+	required := defaultNotifyRoomLevel
+	if rp.Levels.Notifications != nil {
+		required = rp.Levels.Notifications.Room()
+	}
+	return rp.check("mentioning the whole room", required)
+}
+
+// Capabilities returns a summary of the most common permissions.
+func (rp *RoomPermissions) Capabilities() *RoomCapabilities {
+	caps := &RoomCapabilities{
+		SendMessages: rp.CanSend(event.EventMessage) == nil,
+		React:        rp.CanSend(event.EventReaction) == nil,
+		RedactOwn:    rp.CanRedact(rp.UserID) == nil,
+		RedactOthers: rp.CanRedact("") == nil,
+		Invite:       rp.CanInvite() == nil,
+		Kick:         rp.CanKick("") == nil,
+		Ban:          rp.CanBan("") == nil,
+		NotifyRoom:   rp.CanNotifyRoom() == nil,
+		StateDefault: rp.Levels == nil || rp.ownLevel() >= rp.Levels.StateDefault(),
+		State:        make(map[event.Type]bool, len(capabilityStateTypes)),
+	}
+	if rp.Levels != nil {
+		caps.PowerLevel = rp.ownLevel()
+	}
+	for _, evtType := range capabilityStateTypes {
+		caps.State[evtType] = rp.CanSetState(evtType) == nil
+	}
+	return caps
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	permsOwnUser   = id.UserID("@me:example.com")
+	permsPeerUser  = id.UserID("@peer:example.com")
+	permsLowUser   = id.UserID("@low:example.com")
+	permsAdminUser = id.UserID("@admin:example.com")
+)
+
+func makeTestPermissions(t *testing.T, levels string) *RoomPermissions {
+	t.Helper()
+	rp := &RoomPermissions{RoomID: "!room:example.com", UserID: permsOwnUser}
+	if levels != "" {
+		rp.Levels = &event.PowerLevelsEventContent{}
+		if err := json.Unmarshal([]byte(levels), rp.Levels); err != nil {
+			t.Fatalf("failed to parse power levels: %v", err)
+		}
+	}
+	return rp
+}
+
+const (
+	permsUsers = `"users":{"@me:example.com":50,"@peer:example.com":50,"@low:example.com":10,"@admin:example.com":100}`
+	// The user is a moderator who can kick and ban
+	permsModerator = `{` + permsUsers + `,"ban":50,"kick":50,"invite":0}`
+	// The user can ban, but kicking and inviting require a higher level
+	permsStrictKick = `{` + permsUsers + `,"ban":50,"kick":60,"invite":60}`
+	// The user can kick, but banning requires a higher level
+	permsStrictBan = `{` + permsUsers + `,"ban":75,"kick":50}`
+)
+
+func TestRoomPermissions_CanBan(t *testing.T) {
+	tests := []struct {
+		name    string
+		levels  string
+		target  id.UserID
+		wantErr bool
+	}{
+		{"No power levels", "", permsAdminUser, false},
+		{"Lower target", permsModerator, permsLowUser, false},
+		{"Equal target", permsModerator, permsPeerUser, true},
+		{"Higher target", permsModerator, permsAdminUser, true},
+		{"Unknown target uses default level", permsModerator, "@stranger:example.com", false},
+		{"No specific target", permsModerator, "", false},
+		{"Ban level too high", permsStrictBan, permsLowUser, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := makeTestPermissions(t, test.levels).CanBan(test.target)
+			if (err != nil) != test.wantErr {
+				t.Errorf("CanBan() error = %v, want error: %v", err, test.wantErr)
+			} else if err != nil && !errors.Is(err, ErrInsufficientPowerLevel) {
+				t.Errorf("CanBan() error = %v, want %v", err, ErrInsufficientPowerLevel)
+			}
+		})
+	}
+}
+
+func TestRoomPermissions_CanUnban(t *testing.T) {
+	tests := []struct {
+		name    string
+		levels  string
+		target  id.UserID
+		wantErr bool
+	}{
+		{"No power levels", "", permsLowUser, false},
+		{"Lower target", permsModerator, permsLowUser, false},
+		{"Equal target", permsModerator, permsPeerUser, true},
+		{"Ban level too high", permsStrictBan, permsLowUser, true},
+		{"Kick level too high", permsStrictKick, permsLowUser, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := makeTestPermissions(t, test.levels).CanUnban(test.target)
+			if (err != nil) != test.wantErr {
+				t.Errorf("CanUnban() error = %v, want error: %v", err, test.wantErr)
+			} else if err != nil && !errors.Is(err, ErrInsufficientPowerLevel) {
+				t.Errorf("CanUnban() error = %v, want %v", err, ErrInsufficientPowerLevel)
+			}
+		})
+	}
+}
+
+func TestRoomPermissions_CanChangeMembership(t *testing.T) {
+	tests := []struct {
+		name       string
+		levels     string
+		target     id.UserID
+		current    event.Membership
+		membership event.Membership
+		wantErr    bool
+	}{
+		{"Own membership is always allowed", permsStrictKick, permsOwnUser, event.MembershipJoin, event.MembershipLeave, false},
+		{"Invite", permsModerator, permsLowUser, event.MembershipLeave, event.MembershipInvite, false},
+		{"Invite level too high", permsStrictKick, permsLowUser, event.MembershipLeave, event.MembershipInvite, true},
+		{"Kick", permsModerator, permsLowUser, event.MembershipJoin, event.MembershipLeave, false},
+		{"Kick level too high", permsStrictKick, permsLowUser, event.MembershipJoin, event.MembershipLeave, true},
+		{"Kick equal user", permsModerator, permsPeerUser, event.MembershipJoin, event.MembershipLeave, true},
+		{"Ban", permsStrictKick, permsLowUser, event.MembershipJoin, event.MembershipBan, false},
+		{"Ban level too high", permsStrictBan, permsLowUser, event.MembershipJoin, event.MembershipBan, true},
+		{"Unban", permsModerator, permsLowUser, event.MembershipBan, event.MembershipLeave, false},
+		{"Unban needs ban level", permsStrictBan, permsLowUser, event.MembershipBan, event.MembershipLeave, true},
+		{"Unban needs kick level", permsStrictKick, permsLowUser, event.MembershipBan, event.MembershipLeave, true},
+		{"Can't join other users", "", permsLowUser, event.MembershipInvite, event.MembershipJoin, true},
+		{"Can't knock for other users", permsModerator, permsLowUser, event.MembershipLeave, event.MembershipKnock, true},
+		{"No power levels", "", permsAdminUser, event.MembershipJoin, event.MembershipBan, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := makeTestPermissions(t, test.levels).CanChangeMembership(test.target, test.current, test.membership)
+			if (err != nil) != test.wantErr {
+				t.Errorf("CanChangeMembership() error = %v, want error: %v", err, test.wantErr)
+			} else if err != nil && !errors.Is(err, ErrInsufficientPowerLevel) {
+				t.Errorf("CanChangeMembership() error = %v, want %v", err, ErrInsufficientPowerLevel)
+			}
+		})
+	}
+}
+
+func TestRoomPermissions_Capabilities(t *testing.T) {
+	tests := []struct {
+		name   string
+		levels string
+		want   RoomCapabilities
+	}{
+		{"No power levels", "", RoomCapabilities{
+			SendMessages: true, React: true, RedactOwn: true, RedactOthers: true, Invite: true,
+			Kick: true, Ban: true, NotifyRoom: true, StateDefault: true,
+		}},
+		{"Moderator", permsModerator, RoomCapabilities{
+			PowerLevel: 50, SendMessages: true, React: true, RedactOwn: true, RedactOthers: true, Invite: true,
+			Kick: true, Ban: true, NotifyRoom: true, StateDefault: true,
+		}},
+		{"Restricted", `{"users":{"@me:example.com":10},"events":{"m.reaction":20},"redact":20,"notifications":{"room":20}}`, RoomCapabilities{
+			PowerLevel: 10, SendMessages: true, RedactOwn: true, Invite: true,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			caps := makeTestPermissions(t, test.levels).Capabilities()
+			if caps.State[event.StateRoomName] != test.want.StateDefault {
+				t.Errorf("room name state capability = %v, want %v", caps.State[event.StateRoomName], test.want.StateDefault)
+			}
+			caps.State = nil
+			if !reflect.DeepEqual(*caps, test.want) {
+				t.Errorf("Capabilities() = %+v, want %+v", *caps, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+var (
+	EventPollStart            = event.Type{Type: "m.poll.start", Class: event.MessageEventType}
+	EventPollResponse         = event.Type{Type: "m.poll.response", Class: event.MessageEventType}
+	EventPollEnd              = event.Type{Type: "m.poll.end", Class: event.MessageEventType}
+	EventUnstablePollStart    = event.Type{Type: "org.matrix.msc3381.poll.start", Class: event.MessageEventType}
+	EventUnstablePollResponse = event.Type{Type: "org.matrix.msc3381.poll.response", Class: event.MessageEventType}
+	EventUnstablePollEnd      = event.Type{Type: "org.matrix.msc3381.poll.end", Class: event.MessageEventType}
+)
+
+type msc1767TextBlock struct {
+	Body     string `json:"body"`
+	MimeType string `json:"mimetype,omitempty"`
+}
+
+type msc1767Text []msc1767TextBlock
+
+func (t msc1767Text) String() string {
+	for _, block := range t {
+		if block.MimeType == "" || block.MimeType == "text/plain" {
+			return block.Body
+		}
+	}
+	return ""
+}
+
+type stablePollStartContent struct {
+	Text msc1767Text      `json:"m.text,omitempty"`
+	Poll *stablePollStart `json:"m.poll"`
+}
+
+type stablePollStart struct {
+	Kind          string `json:"kind"`
+	MaxSelections int    `json:"max_selections"`
+	Question      struct {
+		Text msc1767Text `json:"m.text"`
+	} `json:"question"`
+	Answers []stablePollAnswer `json:"answers"`
+}
+
+type stablePollAnswer struct {
+	ID   string      `json:"m.id"`
+	Text msc1767Text `json:"m.text"`
+}
+
+type unstablePollStartContent struct {
+	Text string             `json:"org.matrix.msc1767.text,omitempty"`
+	Poll *unstablePollStart `json:"org.matrix.msc3381.poll.start"`
+}
+
+type unstablePollStart struct {
+	Kind          string `json:"kind"`
+	MaxSelections int    `json:"max_selections"`
+	Question      struct {
+		Text string `json:"org.matrix.msc1767.text"`
+		Body string `json:"body,omitempty"`
+	} `json:"question"`
+	Answers []unstablePollAnswer `json:"answers"`
+}
+
+type unstablePollAnswer struct {
+	ID   string `json:"id"`
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+type unstablePollResponse struct {
+	Answers []string `json:"answers"`
+}
+
+type unstablePollResponseContent struct {
+	Response  *unstablePollResponse `json:"org.matrix.msc3381.poll.response"`
+	RelatesTo *event.RelatesTo      `json:"m.relates_to,omitempty"`
+}
+
+type stablePollResponseContent struct {
+	Selections []string         `json:"m.selections"`
+	RelatesTo  *event.RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+func parsePollStart(evtType string, content json.RawMessage) *database.PollStart {
+	switch evtType {
+	case EventPollStart.Type:
+		var parsed stablePollStartContent
+		if json.Unmarshal(content, &parsed) != nil || parsed.Poll == nil {
+			return nil
+		}
+		poll := &database.PollStart{
+			Question:      parsed.Poll.Question.Text.String(),
+			Kind:          database.PollKind(strings.TrimPrefix(parsed.Poll.Kind, "m.")),
+			MaxSelections: parsed.Poll.MaxSelections,
+			Answers:       make([]database.PollAnswer, len(parsed.Poll.Answers)),
+			Stable:        true,
+		}
+		for i, answer := range parsed.Poll.Answers {
+			poll.Answers[i] = database.PollAnswer{ID: answer.ID, Text: answer.Text.String()}
+		}
+		return poll.Normalize()
+	case EventUnstablePollStart.Type:
+		var parsed unstablePollStartContent
+		if json.Unmarshal(content, &parsed) != nil || parsed.Poll == nil {
+			return nil
+		}
+		poll := &database.PollStart{
+			Question:      parsed.Poll.Question.Text,
+			Kind:          database.PollKind(strings.TrimPrefix(parsed.Poll.Kind, "org.matrix.msc3381.poll.")),
+			MaxSelections: parsed.Poll.MaxSelections,
+			Answers:       make([]database.PollAnswer, len(parsed.Poll.Answers)),
+		}
+		if poll.Question == "" {
+			poll.Question = parsed.Poll.Question.Body
+		}
+		for i, answer := range parsed.Poll.Answers {
+			poll.Answers[i] = database.PollAnswer{ID: answer.ID, Text: answer.Text}
+		}
+		return poll.Normalize()
+	default:
+		return nil
+	}
+}
+
+func getEventTypeAndContent(evt *database.Event) (string, json.RawMessage) {
+	if evt.DecryptedType != "" {
+		return evt.DecryptedType, evt.Decrypted
+	}
+	return evt.Type, evt.Content
+}
+
+func isPollStart(evt *database.Event) bool {
+	evtType, _ := getEventTypeAndContent(evt)
+	return evtType == EventPollStart.Type || evtType == EventUnstablePollStart.Type
+}
+
+func isPollRelation(evt *database.Event) bool {
+	if evt.RelationType != event.RelReference {
+		return false
+	}
+	switch evtType, _ := getEventTypeAndContent(evt); evtType {
+	case EventPollResponse.Type, EventUnstablePollResponse.Type, EventPollEnd.Type, EventUnstablePollEnd.Type:
+		return true
+	default:
+		return false
+	}
+}
+
+// processPollRelation stores poll responses and end events in the database so that they can be aggregated later.
+func (h *HiClient) processPollRelation(ctx context.Context, evt *database.Event) {
+	if !isPollRelation(evt) || evt.RelatesTo == "" || evt.RowID == 0 {
+		return
+	}
+	resp := &database.PollResponse{
+		EventRowID:  evt.RowID,
+		RoomID:      evt.RoomID,
+		PollEventID: evt.RelatesTo,
+	}
+	switch evtType, content := getEventTypeAndContent(evt); evtType {
+	case EventPollResponse.Type:
+		var parsed stablePollResponseContent
+		_ = json.Unmarshal(content, &parsed)
+		resp.Answers = parsed.Selections
+	case EventUnstablePollResponse.Type:
+		var parsed unstablePollResponseContent
+		_ = json.Unmarshal(content, &parsed)
+		if parsed.Response != nil {
+			resp.Answers = parsed.Response.Answers
+		}
+	case EventPollEnd.Type, EventUnstablePollEnd.Type:
+		resp.IsEnd = true
+	}
+	err := h.DB.PollResponse.Put(ctx, resp)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).
+			Stringer("event_id", evt.ID).
+			Stringer("poll_event_id", evt.RelatesTo).
+			Msg("Failed to save poll response")
+	}
+}
+
+// summarizePoll calculates the results of a poll from the given responses, which must be sorted by timestamp.
+//
+// Only the latest vote of each user is counted, and votes sent after the poll was ended are ignored.
+// As per MSC3381, polls can be ended by their creator or by anyone who can redact the creator's events.
+// The permissions are used to check that and to find the own vote.
+func summarizePoll(poll *database.PollStart, pollEvt *database.Event, responses []*database.PollResponse, perms *RoomPermissions) *database.PollSummary {
+	summary := &database.PollSummary{
+		Start:   poll,
+		Tallies: make(map[string]int, len(poll.Answers)),
+	}
+	for _, answer := range poll.Answers {
+		summary.Tallies[answer.ID] = 0
+	}
+	latestVotes := make(map[id.UserID][]string)
+	for _, resp := range responses {
+		if resp.IsEnd {
+			// Without power levels, only the creator is trusted to end the poll
+			if resp.Sender == pollEvt.Sender || (perms.Levels != nil && perms.forUser(resp.Sender).CanRedact(pollEvt.Sender) == nil) {
+				summary.Ended = true
+				summary.EndedAt = resp.Timestamp
+				break
+			}
+			continue
+		}
+		latestVotes[resp.Sender] = poll.ValidateSelections(resp.Answers)
+	}
+	for userID, answers := range latestVotes {
+		if answers == nil {
+			continue
+		}
+		summary.TotalVotes++
+		for _, answer := range answers {
+			summary.Tallies[answer]++
+		}
+		if userID == perms.UserID {
+			summary.OwnVote = answers
+		}
+	}
+	return summary
+}
+
+// FillPollSummaries sets the Poll field of all poll start events in the given list.
+func (h *HiClient) FillPollSummaries(ctx context.Context, roomID id.RoomID, events []*database.Event) error {
+	polls := make(map[id.EventID]*database.PollStart)
+	pollEvents := make(map[id.EventID]*database.Event)
+	pollEventIDs := make([]id.EventID, 0)
+	for _, evt := range events {
+		if !isPollStart(evt) || evt.RedactedBy != "" {
+			continue
+		}
+		poll := parsePollStart(getEventTypeAndContent(evt))
+		if poll == nil {
+			continue
+		}
+		polls[evt.ID] = poll
+		pollEvents[evt.ID] = evt
+		pollEventIDs = append(pollEventIDs, evt.ID)
+	}
+	if len(pollEventIDs) == 0 {
+		return nil
+	}
+	responses, err := h.DB.PollResponse.GetMany(ctx, roomID, pollEventIDs...)
+	if err != nil {
+		return err
+	}
+	perms, err := h.GetRoomPermissions(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	for evtID, poll := range polls {
+		pollEvents[evtID].Poll = summarizePoll(poll, pollEvents[evtID], responses[evtID], perms)
+	}
+	return nil
+}
+
+func (h *HiClient) getPoll(ctx context.Context, roomID id.RoomID, pollEventID id.EventID) (*database.Event, *database.PollStart, error) {
+	evt, err := h.GetEvent(ctx, roomID, pollEventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	poll := parsePollStart(getEventTypeAndContent(evt))
+	if poll == nil {
+		return nil, nil, fmt.Errorf("event is not a poll")
+	}
+	err = h.FillPollSummaries(ctx, roomID, []*database.Event{evt})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get poll results: %w", err)
+	}
+	return evt, poll, nil
+}
+
+func pollFallbackText(question string, answers []string) string {
+	var buf strings.Builder
+	buf.WriteString(question)
+	for i, answer := range answers {
+		_, _ = fmt.Fprintf(&buf, "\n%d. %s", i+1, answer)
+	}
+	return buf.String()
+}
+
+// CreatePoll sends a new poll to the given room. Polls are sent in the unstable MSC3381 format,
+// as that's what most clients currently understand.
+func (h *HiClient) CreatePoll(ctx context.Context, roomID id.RoomID, question string, answers []string, maxSelections int, kind database.PollKind) (*database.Event, error) {
+	if question == "" {
+		return nil, fmt.Errorf("poll question can't be empty")
+	} else if len(answers) < 1 {
+		return nil, fmt.Errorf("poll must have at least one answer")
+	} else if slices.Contains(answers, "") {
+		return nil, fmt.Errorf("poll answers can't be empty")
+	}
+	if kind == "" {
+		kind = database.PollKindDisclosed
+	} else if kind != database.PollKindDisclosed && kind != database.PollKindUndisclosed {
+		return nil, fmt.Errorf("invalid poll kind %q", kind)
+	}
+	poll := &unstablePollStart{
+		Kind:          "org.matrix.msc3381.poll." + string(kind),
+		MaxSelections: min(max(maxSelections, 1), len(answers)),
+		Answers:       make([]unstablePollAnswer, len(answers)),
+	}
+	poll.Question.Text = question
+	poll.Question.Body = question
+	for i, answer := range answers {
+		poll.Answers[i] = unstablePollAnswer{ID: random.String(12), Text: answer}
+	}
+	return h.Send(ctx, roomID, EventUnstablePollStart, &unstablePollStartContent{
+		Text: pollFallbackText(question, answers),
+		Poll: poll,
+	})
+}
+
+// VotePoll sends a response to the given poll. The response uses the same format (stable or unstable) as the poll.
+func (h *HiClient) VotePoll(ctx context.Context, roomID id.RoomID, pollEventID id.EventID, answers []string) (*database.Event, error) {
+	pollEvt, poll, err := h.getPoll(ctx, roomID, pollEventID)
+	if err != nil {
+		return nil, err
+	} else if pollEvt.Poll != nil && pollEvt.Poll.Ended {
+		return nil, fmt.Errorf("poll has already ended")
+	}
+	answers = poll.ValidateSelections(answers)
+	if answers == nil {
+		return nil, fmt.Errorf("no valid answers selected")
+	}
+	relatesTo := &event.RelatesTo{Type: event.RelReference, EventID: pollEventID}
+	if poll.Stable {
+		return h.Send(ctx, roomID, EventPollResponse, &stablePollResponseContent{
+			Selections: answers,
+			RelatesTo:  relatesTo,
+		})
+	}
+	return h.Send(ctx, roomID, EventUnstablePollResponse, &unstablePollResponseContent{
+		Response:  &unstablePollResponse{Answers: answers},
+		RelatesTo: relatesTo,
+	})
+}
+
+// EndPoll closes the given poll. Only the sender of the poll can end it.
+func (h *HiClient) EndPoll(ctx context.Context, roomID id.RoomID, pollEventID id.EventID) (*database.Event, error) {
+	pollEvt, poll, err := h.getPoll(ctx, roomID, pollEventID)
+	if err != nil {
+		return nil, err
+	} else if pollEvt.Sender != h.Account.UserID {
+		return nil, fmt.Errorf("only the creator of the poll can end it")
+	} else if pollEvt.Poll != nil && pollEvt.Poll.Ended {
+		return nil, fmt.Errorf("poll has already ended")
+	}
+	relatesTo := &event.RelatesTo{Type: event.RelReference, EventID: pollEventID}
+	if poll.Stable {
+		return h.Send(ctx, roomID, EventPollEnd, map[string]any{
+			"m.text":       msc1767Text{{Body: "The poll has ended"}},
+			"m.relates_to": relatesTo,
+		})
+	}
+	return h.Send(ctx, roomID, EventUnstablePollEnd, map[string]any{
+		"org.matrix.msc3381.poll.end": map[string]any{},
+		"org.matrix.msc1767.text":     "The poll has ended",
+		"m.relates_to":                relatesTo,
+	})
+}
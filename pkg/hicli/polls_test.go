@@ -0,0 +1,150 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func TestSummarizePoll(t *testing.T) {
+	const (
+		creator = id.UserID("@creator:example.com")
+		alice   = id.UserID("@alice:example.com")
+		bob     = id.UserID("@bob:example.com")
+		mod     = id.UserID("@mod:example.com")
+	)
+	var levels event.PowerLevelsEventContent
+	err := json.Unmarshal([]byte(`{"users":{"@mod:example.com":50},"redact":50}`), &levels)
+	if err != nil {
+		t.Fatalf("failed to parse power levels: %v", err)
+	}
+	perms := &RoomPermissions{RoomID: "!room:example.com", UserID: alice, Levels: &levels}
+	poll := &database.PollStart{
+		Question:      "Pick",
+		Kind:          database.PollKindDisclosed,
+		MaxSelections: 2,
+		Answers:       []database.PollAnswer{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}, {ID: "c", Text: "C"}},
+	}
+	pollEvt := &database.Event{ID: "$poll", Sender: creator}
+	vote := func(sender id.UserID, ts int64, answers ...string) *database.PollResponse {
+		return &database.PollResponse{Sender: sender, Answers: answers, Timestamp: jsontime.UM(time.UnixMilli(ts))}
+	}
+	end := func(sender id.UserID, ts int64) *database.PollResponse {
+		return &database.PollResponse{Sender: sender, IsEnd: true, Timestamp: jsontime.UM(time.UnixMilli(ts))}
+	}
+	tests := []struct {
+		name        string
+		responses   []*database.PollResponse
+		wantTallies map[string]int
+		wantTotal   int
+		wantOwnVote []string
+		wantEndedAt int64
+	}{
+		{"No votes", nil, map[string]int{"a": 0, "b": 0, "c": 0}, 0, nil, 0},
+		{"Multiple voters", []*database.PollResponse{
+			vote(alice, 1, "a"),
+			vote(bob, 2, "a", "b"),
+		}, map[string]int{"a": 2, "b": 1, "c": 0}, 2, []string{"a"}, 0},
+		{"Only latest vote counts", []*database.PollResponse{
+			vote(alice, 1, "a"),
+			vote(alice, 2, "c"),
+		}, map[string]int{"a": 0, "b": 0, "c": 1}, 1, []string{"c"}, 0},
+		{"Own vote", []*database.PollResponse{
+			vote(bob, 1, "b"),
+			vote(alice, 2, "a", "c"),
+		}, map[string]int{"a": 1, "b": 1, "c": 1}, 2, []string{"a", "c"}, 0},
+		{"Invalid and excess selections are dropped", []*database.PollResponse{
+			vote(bob, 1, "x", "b", "b", "c", "a"),
+		}, map[string]int{"a": 0, "b": 1, "c": 1}, 1, nil, 0},
+		{"Invalid vote replaces earlier valid vote", []*database.PollResponse{
+			vote(bob, 1, "a"),
+			vote(bob, 2, "x"),
+		}, map[string]int{"a": 0, "b": 0, "c": 0}, 0, nil, 0},
+		{"Votes after end are ignored", []*database.PollResponse{
+			vote(alice, 1, "a"),
+			end(creator, 2),
+			vote(alice, 3, "b"),
+			vote(bob, 4, "b"),
+		}, map[string]int{"a": 1, "b": 0, "c": 0}, 1, []string{"a"}, 2},
+		{"End from users who can't redact is ignored", []*database.PollResponse{
+			end(bob, 1),
+			vote(bob, 2, "c"),
+		}, map[string]int{"a": 0, "b": 0, "c": 1}, 1, nil, 0},
+		{"End from users who can redact is accepted", []*database.PollResponse{
+			vote(bob, 1, "b"),
+			end(mod, 2),
+			vote(alice, 3, "a"),
+		}, map[string]int{"a": 0, "b": 1, "c": 0}, 1, nil, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			summary := summarizePoll(poll, pollEvt, test.responses, perms)
+			if summary.Start != poll {
+				t.Errorf("summary doesn't reference the poll start")
+			}
+			if !maps.Equal(summary.Tallies, test.wantTallies) {
+				t.Errorf("tallies = %v, want %v", summary.Tallies, test.wantTallies)
+			}
+			if summary.TotalVotes != test.wantTotal {
+				t.Errorf("total votes = %d, want %d", summary.TotalVotes, test.wantTotal)
+			}
+			if !slices.Equal(summary.OwnVote, test.wantOwnVote) {
+				t.Errorf("own vote = %v, want %v", summary.OwnVote, test.wantOwnVote)
+			}
+			if summary.Ended != (test.wantEndedAt != 0) {
+				t.Errorf("ended = %v, want %v", summary.Ended, test.wantEndedAt != 0)
+			} else if summary.Ended && summary.EndedAt.UnixMilli() != test.wantEndedAt {
+				t.Errorf("ended at = %d, want %d", summary.EndedAt.UnixMilli(), test.wantEndedAt)
+			}
+		})
+	}
+}
+
+func TestParsePollStart(t *testing.T) {
+	tests := []struct {
+		name    string
+		evtType string
+		content string
+		want    *database.PollStart
+	}{
+		{"Stable", EventPollStart.Type, `{"m.poll":{"kind":"m.undisclosed","max_selections":2,"question":{"m.text":[{"body":"Q?"}]},"answers":[{"m.id":"a","m.text":[{"body":"A"}]},{"m.id":"b","m.text":[{"body":"B"}]}]}}`,
+			&database.PollStart{Question: "Q?", Kind: database.PollKindUndisclosed, MaxSelections: 2, Answers: []database.PollAnswer{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, Stable: true}},
+		{"Unstable", EventUnstablePollStart.Type, `{"org.matrix.msc3381.poll.start":{"kind":"org.matrix.msc3381.poll.disclosed","max_selections":1,"question":{"org.matrix.msc1767.text":"Q?"},"answers":[{"id":"a","org.matrix.msc1767.text":"A"}]}}`,
+			&database.PollStart{Question: "Q?", Kind: database.PollKindDisclosed, MaxSelections: 1, Answers: []database.PollAnswer{{ID: "a", Text: "A"}}}},
+		{"Unstable question body fallback", EventUnstablePollStart.Type, `{"org.matrix.msc3381.poll.start":{"question":{"body":"Q?"},"answers":[{"id":"a","org.matrix.msc1767.text":"A"}]}}`,
+			&database.PollStart{Question: "Q?", Kind: database.PollKindDisclosed, MaxSelections: 1, Answers: []database.PollAnswer{{ID: "a", Text: "A"}}}},
+		{"Max selections is clamped to answer count", EventUnstablePollStart.Type, `{"org.matrix.msc3381.poll.start":{"kind":"unknown","max_selections":10,"question":{"org.matrix.msc1767.text":"Q?"},"answers":[{"id":"a","org.matrix.msc1767.text":"A"},{"id":"b","org.matrix.msc1767.text":"B"}]}}`,
+			&database.PollStart{Question: "Q?", Kind: database.PollKindDisclosed, MaxSelections: 2, Answers: []database.PollAnswer{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}},
+		{"Missing poll", EventPollStart.Type, `{"m.text":[{"body":"Q?"}]}`, nil},
+		{"Invalid JSON", EventUnstablePollStart.Type, `{`, nil},
+		{"Other event type", "m.room.message", `{"m.poll":{}}`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parsePollStart(test.evtType, json.RawMessage(test.content))
+			if (got == nil) != (test.want == nil) {
+				t.Fatalf("parsePollStart() = %+v, want %+v", got, test.want)
+			} else if got == nil {
+				return
+			}
+			if got.Question != test.want.Question || got.Kind != test.want.Kind || got.MaxSelections != test.want.MaxSelections ||
+				got.Stable != test.want.Stable || !slices.Equal(got.Answers, test.want.Answers) {
+				t.Errorf("parsePollStart() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
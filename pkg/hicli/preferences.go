@@ -0,0 +1,32 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// AccountDataGomuksPreferences contains the preferences set in the web frontend.
+// The global account data event holds account-wide preferences, while room account data overrides them per room.
+var AccountDataGomuksPreferences = event.Type{Type: "fi.mau.gomuks.preferences", Class: event.AccountDataEventType}
+
+// getRoomPreference returns the value of the given preference key in the room's preference account data.
+// The result doesn't exist if the room has no preferences or the key isn't set.
+func (h *HiClient) getRoomPreference(ctx context.Context, roomID id.RoomID, key string) (gjson.Result, error) {
+	prefs, err := h.DB.AccountData.GetRoom(ctx, h.Account.UserID, roomID, AccountDataGomuksPreferences)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("failed to get room preferences: %w", err)
+	} else if prefs == nil {
+		return gjson.Result{}, nil
+	}
+	return gjson.GetBytes(prefs.Content, key), nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// How long to let the homeserver propagate a profile change to member events before checking which rooms it missed
+	profilePropagationGracePeriod = 1 * time.Minute
+	// Delay between member event updates when propagating profile changes to rooms
+	profilePropagationDelay = 1 * time.Second
+	// Delay to use when a rate limit error doesn't specify how long to wait
+	defaultRateLimitDelay = 5 * time.Second
+	// Maximum number of times to retry a single room after being rate limited
+	maxRateLimitRetries = 5
+)
+
+// SetDisplayname changes the user's global display name.
+//
+// Homeservers normally update the member events in all joined rooms themselves. If propagate is true,
+// rooms where the server didn't update a member event that still had the old global name are updated
+// in the background. Rooms with a per-room name are left alone.
+func (h *HiClient) SetDisplayname(ctx context.Context, displayname string, propagate bool) error {
+	oldProfile, err := h.Client.GetProfile(ctx, h.Account.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get current profile: %w", err)
+	}
+	err = h.Client.SetDisplayName(ctx, displayname)
+	if err != nil {
+		return fmt.Errorf("failed to set display name: %w", err)
+	}
+	if propagate && oldProfile.DisplayName != displayname {
+		go h.propagateProfileChange(context.WithoutCancel(ctx), "displayname", oldProfile.DisplayName, displayname)
+	}
+	return nil
+}
+
+// SetAvatar changes the user's global avatar. An empty URL removes the avatar.
+//
+// The propagate flag works the same way as in SetDisplayname.
+func (h *HiClient) SetAvatar(ctx context.Context, avatarURL id.ContentURIString, propagate bool) error {
+	var parsedURL id.ContentURI
+	if avatarURL != "" {
+		var err error
+		parsedURL, err = avatarURL.Parse()
+		if err != nil {
+			return fmt.Errorf("invalid avatar URL: %w", err)
+		}
+	}
+	oldProfile, err := h.Client.GetProfile(ctx, h.Account.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get current profile: %w", err)
+	}
+	err = h.Client.SetAvatarURL(ctx, parsedURL)
+	if err != nil {
+		return fmt.Errorf("failed to set avatar: %w", err)
+	}
+	oldAvatarURL := oldProfile.AvatarURL.String()
+	if propagate && oldAvatarURL != string(avatarURL) {
+		go h.propagateProfileChange(context.WithoutCancel(ctx), "avatar_url", oldAvatarURL, string(avatarURL))
+	}
+	return nil
+}
+
+// propagateProfileChange updates the given member event field in joined rooms where the homeserver didn't replace
+// the old value itself.
+//
+// The rooms that have the old value are collected first, and they're checked again after the homeserver has had time
+// to propagate the change, so that only the rooms it skipped are updated. Rooms are updated one by one with a delay in
+// between, and rate limit errors are retried after the delay requested by the server.
+func (h *HiClient) propagateProfileChange(ctx context.Context, field, oldValue, newValue string) {
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "propagate profile change").
+		Str("field", field).
+		Logger()
+	ctx = log.WithContext(ctx)
+	memberEvts, err := h.DB.CurrentState.GetJoinedMemberEventsOfUser(ctx, h.Account.UserID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get own member events")
+		return
+	}
+	candidates := make(map[id.RoomID]struct{})
+	for _, evt := range memberEvts {
+		if gjson.GetBytes(evt.Content, field).Str == oldValue {
+			candidates[evt.RoomID] = struct{}{}
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	time.Sleep(profilePropagationGracePeriod)
+	memberEvts, err = h.DB.CurrentState.GetJoinedMemberEventsOfUser(ctx, h.Account.UserID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get own member events after waiting for server propagation")
+		return
+	}
+	var updated, failed int
+	for _, evt := range memberEvts {
+		if _, ok := candidates[evt.RoomID]; !ok || gjson.GetBytes(evt.Content, field).Str != oldValue {
+			continue
+		}
+		if updated > 0 || failed > 0 {
+			time.Sleep(profilePropagationDelay)
+		}
+		err = h.updateMemberFieldWithRetry(ctx, evt.RoomID, field, newValue)
+		if err != nil {
+			log.Err(err).Stringer("room_id", evt.RoomID).Msg("Failed to update member event")
+			failed++
+		} else {
+			updated++
+		}
+	}
+	log.Info().
+		Int("candidates", len(candidates)).
+		Int("updated", updated).
+		Int("failed", failed).
+		Msg("Finished propagating profile change to rooms the server didn't update")
+}
+
+func (h *HiClient) updateMemberFieldWithRetry(ctx context.Context, roomID id.RoomID, field, value string) error {
+	for attempt := 0; ; attempt++ {
+		err := h.updateOwnMemberEvent(ctx, roomID, func(content map[string]any) {
+			if value == "" {
+				delete(content, field)
+			} else {
+				content[field] = value
+			}
+		})
+		if err == nil || attempt >= maxRateLimitRetries || !errors.Is(err, mautrix.MLimitExceeded) {
+			return err
+		}
+		delay := getRateLimitDelay(err)
+		zerolog.Ctx(ctx).Debug().
+			Stringer("room_id", roomID).
+			Dur("delay", delay).
+			Msg("Rate limited while updating member event, waiting before retrying")
+		time.Sleep(delay)
+	}
+}
+
+func getRateLimitDelay(err error) time.Duration {
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) && httpErr.RespError != nil {
+		if retryAfter, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok && retryAfter > 0 {
+			return time.Duration(retryAfter) * time.Millisecond
+		}
+	}
+	return defaultRateLimitDelay
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/tidwall/gjson"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+type ReactionSender struct {
+	Sender    id.UserID          `json:"sender"`
+	EventID   id.EventID         `json:"event_id"`
+	Timestamp jsontime.UnixMilli `json:"timestamp"`
+}
+
+type ReactionGroup struct {
+	Key     string            `json:"key"`
+	Count   int               `json:"count"`
+	Own     bool              `json:"own"`
+	Senders []*ReactionSender `json:"senders"`
+}
+
+// GetReactions returns the reactions to the given event grouped by key.
+// The groups are sorted by count, with ties broken by which key was used first.
+func (h *HiClient) GetReactions(ctx context.Context, roomID id.RoomID, eventID id.EventID) ([]*ReactionGroup, error) {
+	result, err := h.DB.Event.GetReactions(ctx, roomID, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reactions from database: %w", err)
+	}
+	return groupReactions(result[eventID].Events, h.Account.UserID), nil
+}
+
+// groupReactions groups reaction events by key and sorts the groups as described in [HiClient.GetReactions].
+func groupReactions(events []*database.Event, ownUserID id.UserID) []*ReactionGroup {
+	groupMap := make(map[string]*ReactionGroup)
+	groups := make([]*ReactionGroup, 0)
+	for _, evt := range events {
+		key := gjson.GetBytes(evt.Content, `m\.relates_to.key`)
+		if key.Type != gjson.String {
+			continue
+		}
+		group, ok := groupMap[key.Str]
+		if !ok {
+			group = &ReactionGroup{Key: key.Str}
+			groupMap[key.Str] = group
+			groups = append(groups, group)
+		}
+		group.Count++
+		group.Own = group.Own || evt.Sender == ownUserID
+		group.Senders = append(group.Senders, &ReactionSender{
+			Sender:    evt.Sender,
+			EventID:   evt.ID,
+			Timestamp: evt.Timestamp,
+		})
+	}
+	for _, group := range groups {
+		slices.SortFunc(group.Senders, func(a, b *ReactionSender) int {
+			return a.Timestamp.Compare(b.Timestamp.Time)
+		})
+	}
+	slices.SortStableFunc(groups, func(a, b *ReactionGroup) int {
+		if a.Count != b.Count {
+			return cmp.Compare(b.Count, a.Count)
+		}
+		return a.Senders[0].Timestamp.Compare(b.Senders[0].Timestamp.Time)
+	})
+	return groups
+}
+
+// ToggleReaction sends a reaction with the given key to the given event,
+// or redacts the existing reaction if the user has already reacted with the key.
+//
+// The returned event is the new reaction event, or nil if an existing reaction was removed.
+func (h *HiClient) ToggleReaction(ctx context.Context, roomID id.RoomID, eventID id.EventID, key string) (*database.Event, error) {
+	existing, err := h.DB.Event.GetOwnReaction(ctx, roomID, h.Account.UserID, eventID, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for existing reaction: %w", err)
+	} else if existing != nil {
+		_, err = h.RedactEvent(ctx, roomID, existing.ID, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to redact existing reaction: %w", err)
+		}
+		return nil, nil
+	}
+	return h.Send(ctx, roomID, event.EventReaction, &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{
+			Type:    event.RelAnnotation,
+			EventID: eventID,
+			Key:     key,
+		},
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func makeReaction(sender id.UserID, key string, ts int64) *database.Event {
+	return &database.Event{
+		ID:        id.EventID(fmt.Sprintf("$%s-%d", sender, ts)),
+		Sender:    sender,
+		Timestamp: jsontime.UM(time.UnixMilli(ts)),
+		Content:   json.RawMessage(fmt.Sprintf(`{"m.relates_to":{"rel_type":"m.annotation","event_id":"$target","key":%q}}`, key)),
+	}
+}
+
+func TestGroupReactions(t *testing.T) {
+	const own = id.UserID("@me:example.com")
+	type wantGroup struct {
+		key     string
+		own     bool
+		senders []id.UserID
+	}
+	tests := []struct {
+		name   string
+		events []*database.Event
+		want   []wantGroup
+	}{
+		{"No reactions", nil, []wantGroup{}},
+		{"Single reaction", []*database.Event{
+			makeReaction("@alice:example.com", "👍", 1),
+		}, []wantGroup{{"👍", false, []id.UserID{"@alice:example.com"}}}},
+		{"Sorted by count", []*database.Event{
+			makeReaction("@alice:example.com", "👍", 1),
+			makeReaction("@alice:example.com", "🎉", 2),
+			makeReaction("@bob:example.com", "🎉", 3),
+		}, []wantGroup{
+			{"🎉", false, []id.UserID{"@alice:example.com", "@bob:example.com"}},
+			{"👍", false, []id.UserID{"@alice:example.com"}},
+		}},
+		{"Ties broken by first use", []*database.Event{
+			makeReaction("@bob:example.com", "🎉", 5),
+			makeReaction("@alice:example.com", "👍", 2),
+		}, []wantGroup{
+			{"👍", false, []id.UserID{"@alice:example.com"}},
+			{"🎉", false, []id.UserID{"@bob:example.com"}},
+		}},
+		{"Senders sorted by timestamp", []*database.Event{
+			makeReaction("@bob:example.com", "👍", 9),
+			makeReaction("@alice:example.com", "👍", 4),
+			makeReaction("@carol:example.com", "👍", 6),
+		}, []wantGroup{
+			{"👍", false, []id.UserID{"@alice:example.com", "@carol:example.com", "@bob:example.com"}},
+		}},
+		{"Own reaction is flagged", []*database.Event{
+			makeReaction("@alice:example.com", "👍", 1),
+			makeReaction(own, "👍", 2),
+			makeReaction("@alice:example.com", "👎", 3),
+		}, []wantGroup{
+			{"👍", true, []id.UserID{"@alice:example.com", own}},
+			{"👎", false, []id.UserID{"@alice:example.com"}},
+		}},
+		{"Reactions without a key are skipped", []*database.Event{
+			{ID: "$nokey", Sender: "@alice:example.com", Content: json.RawMessage(`{"m.relates_to":{"rel_type":"m.annotation"}}`)},
+			{ID: "$numkey", Sender: "@alice:example.com", Content: json.RawMessage(`{"m.relates_to":{"key":1}}`)},
+			makeReaction("@bob:example.com", "👍", 1),
+		}, []wantGroup{{"👍", false, []id.UserID{"@bob:example.com"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groups := groupReactions(test.events, own)
+			if len(groups) != len(test.want) {
+				t.Fatalf("groupReactions() returned %d groups, want %d", len(groups), len(test.want))
+			}
+			for i, group := range groups {
+				want := test.want[i]
+				senders := make([]id.UserID, len(group.Senders))
+				for j, sender := range group.Senders {
+					senders[j] = sender.Sender
+				}
+				if group.Key != want.key || group.Own != want.own || group.Count != len(want.senders) || !slices.Equal(senders, want.senders) {
+					t.Errorf("group %d = {%s own=%v count=%d senders=%v}, want {%s own=%v senders=%v}",
+						i, group.Key, group.Own, group.Count, senders, want.key, want.own, want.senders)
+				}
+			}
+		})
+	}
+}
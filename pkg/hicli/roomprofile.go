@@ -0,0 +1,146 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+// SetRoomProfile changes the user's display name and/or avatar in a single room.
+//
+// Nil values are left unchanged, while empty strings remove the field from the member event.
+// If reset is true, both fields are replaced with the user's current global profile.
+func (h *HiClient) SetRoomProfile(ctx context.Context, roomID id.RoomID, displayname *string, avatarURL *id.ContentURIString, reset bool) error {
+	if reset {
+		profile, err := h.Client.GetProfile(ctx, h.Account.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get global profile: %w", err)
+		}
+		displayname = &profile.DisplayName
+		globalAvatarURL := profile.AvatarURL.CUString()
+		avatarURL = &globalAvatarURL
+	} else if displayname == nil && avatarURL == nil {
+		return nil
+	}
+	if avatarURL != nil && *avatarURL != "" {
+		if _, err := avatarURL.Parse(); err != nil {
+			return fmt.Errorf("invalid avatar URL: %w", err)
+		}
+	}
+	return h.updateOwnMemberEvent(ctx, roomID, func(content map[string]any) {
+		if displayname != nil {
+			if *displayname == "" {
+				delete(content, "displayname")
+			} else {
+				content["displayname"] = *displayname
+			}
+		}
+		if avatarURL != nil {
+			if *avatarURL == "" {
+				delete(content, "avatar_url")
+			} else {
+				content["avatar_url"] = string(*avatarURL)
+			}
+		}
+	})
+}
+
+// updateOwnMemberEvent changes fields in the user's own member event in the given room.
+// The content is handled as a raw map so that unknown fields in the existing event are preserved.
+func (h *HiClient) updateOwnMemberEvent(ctx context.Context, roomID id.RoomID, fn func(content map[string]any)) error {
+	stateKey := h.Account.UserID.String()
+	memberEvt, err := h.DB.CurrentState.Get(ctx, roomID, event.StateMember, stateKey)
+	if err != nil {
+		return fmt.Errorf("failed to get own member event: %w", err)
+	} else if memberEvt == nil {
+		return fmt.Errorf("own member event not found")
+	}
+	var content map[string]any
+	if err = json.Unmarshal(memberEvt.Content, &content); err != nil {
+		return fmt.Errorf("failed to parse own member event: %w", err)
+	} else if content == nil {
+		content = make(map[string]any)
+	}
+	if membership, _ := content["membership"].(string); event.Membership(membership) != event.MembershipJoin {
+		return fmt.Errorf("can't change profile in a room you're not in")
+	}
+	// Reasons and join authorisation only make sense for the original membership change
+	delete(content, "reason")
+	delete(content, "join_authorised_via_users_server")
+	fn(content)
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("failed to marshal member event: %w", err)
+	}
+	eventID, err := h.SetState(ctx, roomID, event.StateMember, stateKey, json.RawMessage(rawContent))
+	if err != nil {
+		return err
+	}
+	err = h.applyLocalStateEvent(ctx, roomID, event.StateMember, stateKey, eventID, rawContent)
+	if err != nil {
+		// The event was sent successfully, so it'll be applied when it comes down sync anyway
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("event_id", eventID).Msg("Failed to apply own member event locally")
+	}
+	return nil
+}
+
+// applyLocalStateEvent processes a state event that was just sent as if it had been received in the state
+// section of a sync response, so that the change is visible before the event comes down the actual sync.
+func (h *HiClient) applyLocalStateEvent(
+	ctx context.Context,
+	roomID id.RoomID,
+	evtType event.Type,
+	stateKey string,
+	eventID id.EventID,
+	content json.RawMessage,
+) error {
+	evtType.Class = event.StateEventType
+	evt := &event.Event{
+		Sender:    h.Account.UserID,
+		Type:      evtType,
+		StateKey:  &stateKey,
+		Timestamp: time.Now().UnixMilli(),
+		ID:        eventID,
+		RoomID:    roomID,
+		Content:   event.Content{VeryRaw: content},
+	}
+	syncCtx := &syncContext{evt: &SyncComplete{
+		Rooms:       make(map[id.RoomID]*SyncRoom, 1),
+		AccountData: make(map[event.Type]*database.AccountData),
+		LeftRooms:   make([]id.RoomID, 0),
+	}}
+	ctx = context.WithValue(ctx, syncContextKey, syncCtx)
+	err := h.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		existingEvt, err := h.DB.Event.GetByID(ctx, eventID)
+		if err != nil {
+			return fmt.Errorf("failed to check if event exists: %w", err)
+		} else if existingEvt != nil {
+			// The real sync was faster, no need to do anything
+			return nil
+		}
+		return h.processSyncJoinedRoom(ctx, roomID, &mautrix.SyncJoinedRoom{
+			State: mautrix.SyncEventsList{Events: []*event.Event{evt}},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if !syncCtx.evt.IsEmpty() {
+		h.EventHandler(syncCtx.evt)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+var ErrRoomNotTombstoned = errors.New("room doesn't have a replacement room")
+
+// Maximum number of room upgrades to follow backwards when paginating
+const maxPredecessorDepth = 10
+
+// getValidPredecessor returns the room that the given room replaced, if it's known locally and
+// its tombstone points back to the given room.
+func (h *HiClient) getValidPredecessor(ctx context.Context, room *database.Room) (*database.Room, error) {
+	if room == nil || room.CreationContent == nil || room.CreationContent.Predecessor == nil ||
+		room.CreationContent.Predecessor.RoomID == "" || room.CreationContent.Predecessor.RoomID == room.ID {
+		return nil, nil
+	}
+	predecessor, err := h.DB.Room.Get(ctx, room.CreationContent.Predecessor.RoomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get predecessor room: %w", err)
+	} else if predecessor == nil || predecessor.Tombstone == nil || predecessor.Tombstone.ReplacementRoom != room.ID {
+		return nil, nil
+	}
+	return predecessor, nil
+}
+
+// findPaginationRoom finds the room that should be paginated when the given timeline row is the oldest loaded
+// row in the given room. This is normally the room itself, but if the row belongs to a predecessor room that
+// was already stitched into the timeline, the predecessor is returned instead.
+func (h *HiClient) findPaginationRoom(ctx context.Context, roomID id.RoomID, maxTimelineID database.TimelineRowID) (id.RoomID, error) {
+	if maxTimelineID == 0 {
+		return roomID, nil
+	}
+	timelineRoomID, err := h.DB.Timeline.GetRoomID(ctx, maxTimelineID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get room of timeline row: %w", err)
+	} else if timelineRoomID == "" || timelineRoomID == roomID {
+		return roomID, nil
+	}
+	room, err := h.DB.Room.Get(ctx, roomID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get room from database: %w", err)
+	}
+	for i := 0; i < maxPredecessorDepth && room != nil; i++ {
+		room, err = h.getValidPredecessor(ctx, room)
+		if err != nil {
+			return "", err
+		} else if room != nil && room.ID == timelineRoomID {
+			return room.ID, nil
+		}
+	}
+	return roomID, nil
+}
+
+// JoinSuccessor joins the room that replaced the given room according to its m.room.tombstone event.
+func (h *HiClient) JoinSuccessor(ctx context.Context, roomID id.RoomID) (id.RoomID, error) {
+	room, err := h.DB.Room.Get(ctx, roomID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get room from database: %w", err)
+	} else if room == nil || room.Tombstone == nil || room.Tombstone.ReplacementRoom == "" {
+		return "", ErrRoomNotTombstoned
+	}
+	replacementRoom := room.Tombstone.ReplacementRoom
+	var via string
+	tombstoneEvt, err := h.DB.CurrentState.Get(ctx, roomID, event.StateTombstone, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to get tombstone event: %w", err)
+	} else if tombstoneEvt != nil {
+		// The user who upgraded the room is always in the replacement room
+		_, via, _ = tombstoneEvt.Sender.Parse()
+	}
+	resp, err := h.Client.JoinRoom(ctx, replacementRoom.String(), via, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to join replacement room: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().
+		Stringer("old_room_id", roomID).
+		Stringer("new_room_id", resp.RoomID).
+		Msg("Joined replacement room")
+	return resp.RoomID, nil
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+var (
+	ErrScheduledTimeInPast    = errors.New("scheduled time must be in the future")
+	ErrScheduledEventNotFound = errors.New("scheduled event not found")
+)
+
+const (
+	// The unstable feature flag that homeservers advertise in /versions if they support MSC4140 delayed events
+	delayedEventsUnstableFeature = "org.matrix.msc4140"
+	delayedEventsQueryParam      = "org.matrix.msc4140.delay"
+
+	// Maximum time for the scheduler to sleep if there are no scheduled events
+	maxSchedulerSleep = 1 * time.Hour
+	// Time to wait before trying again if the scheduler fails to read the database
+	schedulerErrorRetryInterval = 1 * time.Minute
+)
+
+type respSendDelayedEvent struct {
+	DelayID string `json:"delay_id"`
+}
+
+func (h *HiClient) supportsDelayedEvents() bool {
+	versions := h.Client.SpecVersions
+	return versions != nil && versions.UnstableFeatures[delayedEventsUnstableFeature]
+}
+
+// WakeupScheduler makes the scheduler re-check the next scheduled event immediately.
+func (h *HiClient) WakeupScheduler() {
+	select {
+	case h.schedulerWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// ScheduleMessage renders a message the same way as SendMessage, but stores it to be sent at the given time.
+func (h *HiClient) ScheduleMessage(
+	ctx context.Context,
+	roomID id.RoomID,
+	base *event.MessageEventContent,
+	text string,
+	relatesTo *event.RelatesTo,
+	mentions *event.Mentions,
+	sendAt time.Time,
+) (*database.ScheduledEvent, error) {
+	content, err := h.buildMessageContent(ctx, roomID, base, text, relatesTo, mentions)
+	if err != nil {
+		return nil, err
+	}
+	return h.ScheduleEvent(ctx, roomID, event.EventMessage, content, sendAt)
+}
+
+// ScheduleEvent stores an event to be sent at the given time.
+//
+// If the homeserver supports MSC4140, the event is sent as a delayed event immediately,
+// which means it'll be sent even if this client isn't running at the scheduled time.
+// Otherwise, the event is stored locally and sent by the scheduler loop when it's due.
+func (h *HiClient) ScheduleEvent(ctx context.Context, roomID id.RoomID, evtType event.Type, content any, sendAt time.Time) (*database.ScheduledEvent, error) {
+	if !sendAt.After(time.Now()) {
+		return nil, ErrScheduledTimeInPast
+	}
+	room, err := h.DB.Room.Get(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room metadata: %w", err)
+	} else if room == nil {
+		return nil, fmt.Errorf("unknown room")
+	}
+	perms, err := h.GetRoomPermissions(ctx, room.ID)
+	if err != nil {
+		return nil, err
+	} else if err = perms.CanSend(evtType); err != nil {
+		return nil, err
+	}
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event content: %w", err)
+	}
+	evtType.Class = event.MessageEventType
+	scheduled := &database.ScheduledEvent{
+		RoomID:    room.ID,
+		Type:      evtType.Type,
+		Content:   rawContent,
+		SendAt:    jsontime.UM(sendAt),
+		CreatedAt: jsontime.UnixMilliNow(),
+	}
+	log := zerolog.Ctx(ctx).With().
+		Stringer("room_id", room.ID).
+		Time("send_at", sendAt).
+		Logger()
+	if h.supportsDelayedEvents() {
+		scheduled.DelayID, err = h.sendDelayedEvent(ctx, room, evtType, rawContent, time.Until(sendAt))
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to send delayed event, falling back to local scheduling")
+		}
+	}
+	err = h.DB.ScheduledEvent.Insert(ctx, scheduled)
+	if err != nil {
+		if scheduled.DelayID != "" {
+			// Don't leave the event to be sent by the server if it isn't tracked locally
+			if cancelErr := h.updateDelayedEvent(ctx, scheduled.DelayID, "cancel"); cancelErr != nil {
+				log.Err(cancelErr).Str("delay_id", scheduled.DelayID).Msg("Failed to cancel delayed event after database error")
+			}
+		}
+		return nil, fmt.Errorf("failed to save scheduled event: %w", err)
+	}
+	log.Debug().
+		Int64("scheduled_rowid", int64(scheduled.RowID)).
+		Str("delay_id", scheduled.DelayID).
+		Msg("Scheduled event")
+	h.WakeupScheduler()
+	h.EventHandler(&ScheduledEventsChanged{RoomID: room.ID})
+	return scheduled, nil
+}
+
+// sendDelayedEvent sends an event using MSC4140, encrypting it first if the room is encrypted.
+func (h *HiClient) sendDelayedEvent(ctx context.Context, room *database.Room, evtType event.Type, content json.RawMessage, delay time.Duration) (string, error) {
+	var payload any = content
+	if room.EncryptionEvent != nil && evtType != event.EventReaction {
+		encrypted, err := h.Encrypt(ctx, room, evtType, content)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt: %w", err)
+		}
+		evtType = event.EventEncrypted
+		payload = encrypted
+	}
+	url := h.Client.BuildURLWithQuery(
+		mautrix.ClientURLPath{"v3", "rooms", room.ID, "send", evtType.String(), h.Client.TxnID()},
+		map[string]string{delayedEventsQueryParam: strconv.FormatInt(delay.Milliseconds(), 10)},
+	)
+	var resp respSendDelayedEvent
+	_, err := h.Client.MakeRequest(ctx, http.MethodPut, url, payload, &resp)
+	if err != nil {
+		return "", err
+	} else if resp.DelayID == "" {
+		return "", fmt.Errorf("server didn't return a delay ID")
+	}
+	return resp.DelayID, nil
+}
+
+func (h *HiClient) updateDelayedEvent(ctx context.Context, delayID, action string) error {
+	url := h.Client.BuildClientURL("unstable", delayedEventsUnstableFeature, "delayed_events", delayID)
+	_, err := h.Client.MakeRequest(ctx, http.MethodPost, url, map[string]string{"action": action}, nil)
+	return err
+}
+
+// ListScheduledEvents returns scheduled events in the given room, or in all rooms if the room ID is empty.
+func (h *HiClient) ListScheduledEvents(ctx context.Context, roomID id.RoomID) ([]*database.ScheduledEvent, error) {
+	if roomID == "" {
+		return h.DB.ScheduledEvent.GetAll(ctx)
+	}
+	return h.DB.ScheduledEvent.GetAllInRoom(ctx, roomID)
+}
+
+// CancelScheduledEvent removes a scheduled event so that it won't be sent.
+func (h *HiClient) CancelScheduledEvent(ctx context.Context, rowID database.ScheduledEventRowID) error {
+	scheduled, err := h.DB.ScheduledEvent.Get(ctx, rowID)
+	if err != nil {
+		return fmt.Errorf("failed to get scheduled event: %w", err)
+	} else if scheduled == nil {
+		return ErrScheduledEventNotFound
+	}
+	if scheduled.DelayID != "" {
+		err = h.updateDelayedEvent(ctx, scheduled.DelayID, "cancel")
+		// If the server doesn't know about the delayed event anymore, it was most likely already sent
+		if err != nil && !errors.Is(err, mautrix.MNotFound) {
+			return fmt.Errorf("failed to cancel delayed event: %w", err)
+		}
+	}
+	err = h.DB.ScheduledEvent.Delete(ctx, rowID)
+	if err != nil {
+		return fmt.Errorf("failed to delete scheduled event: %w", err)
+	}
+	h.EventHandler(&ScheduledEventsChanged{RoomID: scheduled.RoomID})
+	return nil
+}
+
+// RunScheduler sends locally scheduled events when they're due. Events that were due while the client
+// wasn't running are sent immediately on startup.
+func (h *HiClient) RunScheduler(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("action", "scheduler").Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("Starting scheduled event sender")
+	defer func() {
+		log.Info().Msg("Stopping scheduled event sender")
+	}()
+	for {
+		waitFor, err := h.sendDueScheduledEvents(ctx)
+		if err != nil {
+			log.Err(err).Msg("Failed to send due scheduled events")
+			waitFor = schedulerErrorRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.schedulerWakeup:
+		case <-time.After(waitFor):
+		}
+	}
+}
+
+// sendDueScheduledEvents sends all events that are due and returns the time until the next one.
+func (h *HiClient) sendDueScheduledEvents(ctx context.Context) (time.Duration, error) {
+	for {
+		next, err := h.DB.ScheduledEvent.GetNext(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get next scheduled event: %w", err)
+		} else if next == nil {
+			return maxSchedulerSleep, nil
+		} else if waitFor := time.Until(next.SendAt.Time); waitFor > 0 {
+			return min(waitFor, maxSchedulerSleep), nil
+		} else if err = h.sendScheduledEvent(ctx, next); err != nil {
+			return 0, err
+		} else if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (h *HiClient) sendScheduledEvent(ctx context.Context, scheduled *database.ScheduledEvent) error {
+	log := zerolog.Ctx(ctx).With().
+		Int64("scheduled_rowid", int64(scheduled.RowID)).
+		Stringer("room_id", scheduled.RoomID).
+		Logger()
+	// Delayed events are sent by the homeserver, so they only need to be removed from the local list
+	if scheduled.DelayID == "" {
+		evtType := event.Type{Type: scheduled.Type, Class: event.MessageEventType}
+		_, err := h.send(ctx, scheduled.RoomID, evtType, scheduled.Content, "", nil)
+		if err != nil {
+			log.Err(err).Msg("Failed to send scheduled event")
+			err = h.DB.ScheduledEvent.SetSendError(ctx, scheduled.RowID, err.Error())
+			if err != nil {
+				return fmt.Errorf("failed to save send error of scheduled event: %w", err)
+			}
+			h.EventHandler(&ScheduledEventsChanged{RoomID: scheduled.RoomID})
+			return nil
+		}
+		log.Debug().Msg("Sent scheduled event")
+	}
+	err := h.DB.ScheduledEvent.Delete(ctx, scheduled.RowID)
+	if err != nil {
+		return fmt.Errorf("failed to delete sent scheduled event: %w", err)
+	}
+	h.EventHandler(&ScheduledEventsChanged{RoomID: scheduled.RoomID})
+	return nil
+}
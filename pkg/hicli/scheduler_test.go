@@ -0,0 +1,141 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	_ "go.mau.fi/util/dbutil/litestream"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func newTestHiClient(t *testing.T, evtHandler func(any)) *HiClient {
+	t.Helper()
+	rawDB, err := dbutil.NewFromConfig("gomuks", dbutil.Config{
+		PoolConfig: dbutil.PoolConfig{
+			Type:         "sqlite3-fk-wal",
+			URI:          ":memory:?_txlock=immediate",
+			MaxOpenConns: 1,
+			MaxIdleConns: 1,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	h := New(rawDB, nil, zerolog.Nop(), []byte("meow"), evtHandler)
+	if err = h.DB.Upgrade(context.Background()); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = h.DB.Close()
+	})
+	return h
+}
+
+// TestHiClient_SendDueScheduledEvents uses events that were handed over to the homeserver as delayed events,
+// as those are only removed locally when they're due and don't need a homeserver to talk to.
+func TestHiClient_SendDueScheduledEvents(t *testing.T) {
+	type scheduled struct {
+		roomID    id.RoomID
+		sendAt    time.Duration
+		sendError string
+	}
+	tests := []struct {
+		name          string
+		events        []scheduled
+		wantOrder     []id.RoomID
+		wantRemaining []id.RoomID
+		wantSleep     time.Duration
+	}{
+		{"Nothing scheduled", nil, nil, nil, maxSchedulerSleep},
+		{"Sent in order of send time", []scheduled{
+			{"!a:example.com", -3 * time.Minute, ""},
+			{"!b:example.com", -5 * time.Minute, ""},
+			{"!c:example.com", -1 * time.Minute, ""},
+		}, []id.RoomID{"!b:example.com", "!a:example.com", "!c:example.com"}, nil, maxSchedulerSleep},
+		{"Ties are sent in insertion order", []scheduled{
+			{"!a:example.com", -time.Minute, ""},
+			{"!b:example.com", -2 * time.Minute, ""},
+			{"!c:example.com", -time.Minute, ""},
+		}, []id.RoomID{"!b:example.com", "!a:example.com", "!c:example.com"}, nil, maxSchedulerSleep},
+		{"Future events are left alone", []scheduled{
+			{"!a:example.com", 10 * time.Minute, ""},
+			{"!b:example.com", -time.Minute, ""},
+		}, []id.RoomID{"!b:example.com"}, []id.RoomID{"!a:example.com"}, 10 * time.Minute},
+		{"Sleep is capped", []scheduled{
+			{"!a:example.com", 2 * maxSchedulerSleep, ""},
+		}, nil, []id.RoomID{"!a:example.com"}, maxSchedulerSleep},
+		{"Failed events are skipped", []scheduled{
+			{"!a:example.com", -10 * time.Minute, "failed to send"},
+			{"!b:example.com", -time.Minute, ""},
+		}, []id.RoomID{"!b:example.com"}, []id.RoomID{"!a:example.com"}, maxSchedulerSleep},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sentOrder []id.RoomID
+			h := newTestHiClient(t, func(evt any) {
+				if changed, ok := evt.(*ScheduledEventsChanged); ok {
+					sentOrder = append(sentOrder, changed.RoomID)
+				}
+			})
+			ctx := context.Background()
+			now := time.Now()
+			for i, evt := range test.events {
+				err := h.DB.Room.CreateRow(ctx, evt.roomID)
+				if err != nil {
+					t.Fatalf("failed to create room: %v", err)
+				}
+				err = h.DB.ScheduledEvent.Insert(ctx, &database.ScheduledEvent{
+					RoomID:    evt.roomID,
+					Type:      "m.room.message",
+					Content:   json.RawMessage(`{"msgtype":"m.text","body":"hi"}`),
+					SendAt:    jsontime.UM(now.Add(evt.sendAt)),
+					CreatedAt: jsontime.UM(now),
+					DelayID:   fmt.Sprintf("delay%d", i),
+					SendError: evt.sendError,
+				})
+				if err != nil {
+					t.Fatalf("failed to insert scheduled event: %v", err)
+				}
+			}
+
+			sleep, err := h.sendDueScheduledEvents(ctx)
+			if err != nil {
+				t.Fatalf("sendDueScheduledEvents() error = %v", err)
+			}
+			if !slices.Equal(sentOrder, test.wantOrder) {
+				t.Errorf("events were sent in order %v, want %v", sentOrder, test.wantOrder)
+			}
+			// Allow some slack for the time that passed since the events were inserted
+			if sleep > test.wantSleep || sleep < test.wantSleep-time.Second {
+				t.Errorf("sendDueScheduledEvents() sleep = %s, want %s", sleep, test.wantSleep)
+			}
+			remaining, err := h.DB.ScheduledEvent.GetAll(ctx)
+			if err != nil {
+				t.Fatalf("GetAll() error = %v", err)
+			}
+			remainingRooms := make([]id.RoomID, len(remaining))
+			for i, evt := range remaining {
+				remainingRooms[i] = evt.RoomID
+			}
+			if !slices.Equal(remainingRooms, test.wantRemaining) {
+				t.Errorf("remaining scheduled events are in rooms %v, want %v", remainingRooms, test.wantRemaining)
+			}
+		})
+	}
+}
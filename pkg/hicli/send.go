@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
 	"github.com/yuin/goldmark"
 	"go.mau.fi/util/jsontime"
 	"go.mau.fi/util/ptr"
@@ -70,47 +71,70 @@ func (h *HiClient) SendMessage(
 	relatesTo *event.RelatesTo,
 	mentions *event.Mentions,
 ) (*database.Event, error) {
-	if strings.HasPrefix(text, "/raw ") {
-		parts := strings.SplitN(text, " ", 3)
-		if len(parts) < 2 || len(parts[1]) == 0 {
-			return nil, fmt.Errorf("invalid /raw command")
-		}
-		var content json.RawMessage
-		if len(parts) == 3 {
-			content = json.RawMessage(parts[2])
-		} else {
-			content = json.RawMessage("{}")
-		}
-		if !json.Valid(content) {
-			return nil, fmt.Errorf("invalid JSON in /raw command")
+	cmd, rawArgs := parseMessageCommand(text, base, relatesTo)
+	if cmd != nil && cmd.Handler != nil {
+		return h.runCommand(ctx, &CommandEvent{
+			RoomID:  roomID,
+			Command: cmd,
+			Text:    text,
+			RawArgs: rawArgs,
+			Args:    strings.Fields(rawArgs),
+		})
+	}
+	content, err := h.buildMessageContent(ctx, roomID, base, text, relatesTo, mentions)
+	if err != nil {
+		return nil, err
+	}
+	var uploadResult <-chan error
+	if base != nil && h.PendingUploadResult != nil {
+		mediaURL := base.URL
+		if base.File != nil {
+			mediaURL = base.File.URL
 		}
-		return h.send(ctx, roomID, event.Type{Type: parts[1]}, content, "")
+		uploadResult = h.PendingUploadResult(mediaURL)
 	}
+	return h.send(ctx, roomID, event.EventMessage, content, text, uploadResult)
+}
+
+// parseMessageCommand parses a slash command from the text of a message.
+//
+// Commands with handlers are only used in new text messages, so that e.g. editing a message to /ban doesn't ban anyone.
+// Message type and formatting commands like /me and /html are also allowed in edits and captions.
+func parseMessageCommand(text string, base *event.MessageEventContent, relatesTo *event.RelatesTo) (*Command, string) {
+	cmd, rawArgs := parseCommand(text)
+	if cmd != nil && cmd.Handler != nil && (base != nil || relatesTo.GetReplaceID() != "") {
+		return nil, ""
+	}
+	return cmd, rawArgs
+}
+
+// buildMessageContent renders the text from the composer into message content, including message commands like
+// /me and /rainbow. The text is merged into the base content if one is provided (i.e. it's used as a caption for media).
+func (h *HiClient) buildMessageContent(
+	ctx context.Context,
+	roomID id.RoomID,
+	base *event.MessageEventContent,
+	text string,
+	relatesTo *event.RelatesTo,
+	mentions *event.Mentions,
+) (*event.MessageEventContent, error) {
 	var content event.MessageEventContent
-	msgType := event.MsgText
-	origText := text
-	if strings.HasPrefix(text, "/me ") {
-		msgType = event.MsgEmote
-		text = strings.TrimPrefix(text, "/me ")
-	} else if strings.HasPrefix(text, "/notice ") {
-		msgType = event.MsgNotice
-		text = strings.TrimPrefix(text, "/notice ")
-	}
-	if strings.HasPrefix(text, "/rainbow ") {
-		text = strings.TrimPrefix(text, "/rainbow ")
-		content = format.RenderMarkdownCustom(text, rainbowWithHTML)
-		content.FormattedBody = rainbow.ApplyColor(content.FormattedBody)
-	} else if strings.HasPrefix(text, "/plain ") {
-		text = strings.TrimPrefix(text, "/plain ")
-		content = format.TextToContent(text)
-	} else if strings.HasPrefix(text, "/html ") {
-		text = strings.TrimPrefix(text, "/html ")
-		text = strings.Replace(text, "\n", "<br>", -1)
-		content = format.HTMLToContent(text)
+	cmd, rawArgs := parseMessageCommand(text, base, relatesTo)
+	if cmd != nil {
+		if cmd.Handler != nil {
+			return nil, fmt.Errorf("/%s doesn't produce a message", cmd.Name)
+		}
+		var err error
+		content, err = h.formatCommand(ctx, roomID, cmd, rawArgs)
+		if err != nil {
+			return nil, err
+		}
 	} else if text != "" {
-		content = format.RenderMarkdownCustom(text, defaultNoHTML)
+		content = formatMarkdown(ctx, h, roomID, text)
+	}
+	if content.MsgType == "" {
+		content.MsgType = event.MsgText
 	}
-	content.MsgType = msgType
 	if base != nil {
 		if text != "" {
 			base.Body = content.Body
@@ -130,6 +154,7 @@ func (h *HiClient) SendMessage(
 			}
 		}
 	}
+	h.addAutomaticMentions(ctx, roomID, &content)
 	if relatesTo != nil {
 		if relatesTo.Type == event.RelReplace {
 			contentCopy := content
@@ -147,7 +172,7 @@ func (h *HiClient) SendMessage(
 			content.RelatesTo = relatesTo
 		}
 	}
-	return h.send(ctx, roomID, event.EventMessage, &content, origText)
+	return &content, nil
 }
 
 func (h *HiClient) MarkRead(ctx context.Context, roomID id.RoomID, eventID id.EventID, receiptType event.ReceiptType) error {
@@ -198,6 +223,23 @@ func (h *HiClient) SetState(
 	} else if room == nil {
 		return "", fmt.Errorf("unknown room")
 	}
+	perms, err := h.GetRoomPermissions(ctx, room.ID)
+	if err != nil {
+		return "", err
+	}
+	if evtType == event.StateMember {
+		var current *event.MemberEventContent
+		current, err = h.ClientStore.GetMember(ctx, room.ID, id.UserID(stateKey))
+		if err != nil {
+			return "", fmt.Errorf("failed to get current membership: %w", err)
+		}
+		err = perms.CanChangeMembership(id.UserID(stateKey), current.Membership, getMembershipFromContent(content))
+	} else {
+		err = perms.CanSetState(evtType)
+	}
+	if err != nil {
+		return "", err
+	}
 	resp, err := h.Client.SendStateEvent(ctx, room.ID, evtType, stateKey, content)
 	if err != nil {
 		return "", err
@@ -205,13 +247,58 @@ func (h *HiClient) SetState(
 	return resp.EventID, nil
 }
 
+func getMembershipFromContent(content any) event.Membership {
+	rawContent, ok := content.(json.RawMessage)
+	if !ok {
+		var err error
+		rawContent, err = json.Marshal(content)
+		if err != nil {
+			return ""
+		}
+	}
+	return event.Membership(gjson.GetBytes(rawContent, "membership").Str)
+}
+
+// RedactEvent redacts the given event after checking that the user has the power level to do so.
+func (h *HiClient) RedactEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID, reason string) (*mautrix.RespSendEvent, error) {
+	perms, err := h.GetRoomPermissions(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	// If the event isn't known locally, assume it's someone else's to require the higher level
+	var sender id.UserID
+	evt, err := h.DB.Event.GetByID(ctx, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target event: %w", err)
+	} else if evt != nil {
+		sender = evt.Sender
+	}
+	if err = perms.CanRedact(sender); err != nil {
+		return nil, err
+	}
+	return h.Client.RedactEvent(ctx, roomID, eventID, mautrix.ReqRedact{Reason: reason})
+}
+
 func (h *HiClient) Send(
 	ctx context.Context,
 	roomID id.RoomID,
 	evtType event.Type,
 	content any,
 ) (*database.Event, error) {
-	return h.send(ctx, roomID, evtType, content, "")
+	return h.send(ctx, roomID, evtType, content, "", nil)
+}
+
+// SendWithPendingUpload sends an event that refers to media which is still being uploaded in the background
+// (i.e. an MSC2246 asynchronous upload). The event is sent immediately, but it won't be marked as fully sent
+// until a value is received from uploadResult. If the upload fails, the error is stored as the send error.
+func (h *HiClient) SendWithPendingUpload(
+	ctx context.Context,
+	roomID id.RoomID,
+	evtType event.Type,
+	content any,
+	uploadResult <-chan error,
+) (*database.Event, error) {
+	return h.send(ctx, roomID, evtType, content, "", uploadResult)
 }
 
 func (h *HiClient) send(
@@ -220,6 +307,7 @@ func (h *HiClient) send(
 	evtType event.Type,
 	content any,
 	overrideEditSource string,
+	uploadResult <-chan error,
 ) (*database.Event, error) {
 	room, err := h.DB.Room.Get(ctx, roomID)
 	if err != nil {
@@ -227,6 +315,18 @@ func (h *HiClient) send(
 	} else if room == nil {
 		return nil, fmt.Errorf("unknown room")
 	}
+	// Check permissions before creating the local echo, so that forbidden events don't end up in the timeline
+	perms, err := h.GetRoomPermissions(ctx, room.ID)
+	if err != nil {
+		return nil, err
+	} else if err = perms.CanSend(evtType); err != nil {
+		return nil, err
+	} else if room.EncryptionEvent != nil && evtType != event.EventReaction {
+		// The server checks the level of the encrypted event type, so make sure that's allowed too
+		if err = perms.CanSend(event.EventEncrypted); err != nil {
+			return nil, err
+		}
+	}
 	txnID := "hicli-" + h.Client.TxnID()
 	dbEvt := &database.Event{
 		RoomID:          room.ID,
@@ -271,6 +371,7 @@ func (h *HiClient) send(
 	for _, uri := range inlineImages {
 		h.addMediaCache(ctx, dbEvt.RowID, uri.CUString(), nil, nil, "")
 	}
+	h.processPollRelation(ctx, dbEvt)
 	ctx = context.WithoutCancel(ctx)
 	go func() {
 		err := h.SetTyping(ctx, room.ID, 0)
@@ -331,6 +432,13 @@ func (h *HiClient) send(
 		err = h.DB.Event.UpdateID(ctx, dbEvt.RowID, dbEvt.ID)
 		if err != nil {
 			err = fmt.Errorf("failed to update event ID in database: %w", err)
+			return
+		}
+		if uploadResult != nil {
+			if uploadErr := <-uploadResult; uploadErr != nil {
+				dbEvt.SendError = fmt.Sprintf("failed to upload media: %v", uploadErr)
+				err = fmt.Errorf("failed to upload media: %w", uploadErr)
+			}
 		}
 	}()
 	return dbEvt, nil
@@ -0,0 +1,85 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+func TestHiClient_BuildMessageContent(t *testing.T) {
+	edit := &event.RelatesTo{Type: event.RelReplace, EventID: "$original"}
+	reply := (&event.RelatesTo{}).SetReplyTo("$parent")
+	image := func() *event.MessageEventContent {
+		return &event.MessageEventContent{MsgType: event.MsgImage, Body: "image.png", URL: "mxc://example.com/image"}
+	}
+	tests := []struct {
+		name          string
+		base          *event.MessageEventContent
+		text          string
+		relatesTo     *event.RelatesTo
+		wantErr       bool
+		wantMsgType   event.MessageType
+		wantBody      string
+		wantFormatted string
+	}{
+		{"Plain message", nil, "hello", nil, false, event.MsgText, "hello", ""},
+		{"Emote", nil, "/me waves", nil, false, event.MsgEmote, "waves", ""},
+		{"Emote reply", nil, "/me waves", reply, false, event.MsgEmote, "waves", ""},
+		{"HTML", nil, "/html <b>hi</b>", nil, false, event.MsgText, "", "<b>hi</b>"},
+		{"Handler command", nil, "/ban @bob:example.com", nil, true, "", "", ""},
+		{"Edit to emote", nil, "/me waves again", edit, false, event.MsgEmote, "waves again", ""},
+		{"Edit to notice", nil, "/notice beep", edit, false, event.MsgNotice, "beep", ""},
+		{"Edit with HTML", nil, "/html <i>fixed</i>", edit, false, event.MsgText, "", "<i>fixed</i>"},
+		{"Edit with handler command is literal", nil, "/ban @bob:example.com", edit, false, event.MsgText, "/ban @bob:example.com", ""},
+		{"Caption with HTML", image(), "/html <b>cap</b>", nil, false, event.MsgImage, "", "<b>cap</b>"},
+		{"Caption with handler command is literal", image(), "/kick @bob:example.com", nil, false, event.MsgImage, "/kick @bob:example.com", ""},
+	}
+	h := &HiClient{Account: &database.Account{UserID: "@me:example.com"}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, err := h.buildMessageContent(context.Background(), "!room:example.com", test.base, test.text, test.relatesTo, nil)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("buildMessageContent() didn't return an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("buildMessageContent() error = %v", err)
+			}
+			if test.relatesTo.GetReplaceID() != "" {
+				if content.RelatesTo.GetReplaceID() != test.relatesTo.GetReplaceID() {
+					t.Errorf("edit doesn't replace the original event: %+v", content.RelatesTo)
+				} else if content.NewContent == nil {
+					t.Fatalf("edit doesn't have new content")
+				} else if content.MsgType != test.wantMsgType {
+					t.Errorf("edit msgtype = %s, want %s", content.MsgType, test.wantMsgType)
+				}
+				content = content.NewContent
+			} else if test.relatesTo != nil && content.RelatesTo.GetReplyTo() != test.relatesTo.GetReplyTo() {
+				t.Errorf("reply relation was lost: %+v", content.RelatesTo)
+			}
+			if content.MsgType != test.wantMsgType {
+				t.Errorf("msgtype = %s, want %s", content.MsgType, test.wantMsgType)
+			}
+			if test.wantBody != "" && content.Body != test.wantBody {
+				t.Errorf("body = %q, want %q", content.Body, test.wantBody)
+			}
+			if test.wantFormatted != "" && (content.Format != event.FormatHTML || content.FormattedBody != test.wantFormatted) {
+				t.Errorf("formatted body = %q (%s), want %q", content.FormattedBody, content.Format, test.wantFormatted)
+			}
+			if test.base != nil && content.URL != id.ContentURIString("mxc://example.com/image") {
+				t.Errorf("caption lost the media URL: %q", content.URL)
+			}
+		})
+	}
+}
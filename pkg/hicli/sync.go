@@ -8,6 +8,7 @@ package hicli
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -35,8 +36,10 @@ import (
 
 type syncContext struct {
 	shouldWakeupRequestQueue bool
+	shouldResetSync          bool
 
-	evt *SyncComplete
+	evt        *SyncComplete
+	liveEvents []*database.Event
 }
 
 func (h *HiClient) markSyncErrored(err error) {
@@ -96,6 +99,9 @@ func (h *HiClient) postProcessSyncResponse(ctx context.Context, resp *mautrix.Re
 	if syncCtx.shouldWakeupRequestQueue {
 		h.WakeupRequestQueue()
 	}
+	if syncCtx.shouldResetSync {
+		go h.resetSync(h.Log.WithContext(context.Background()))
+	}
 	if !h.firstSyncReceived {
 		h.firstSyncReceived = true
 		h.Client.Client.Transport.(*http.Transport).ResponseHeaderTimeout = 60 * time.Second
@@ -104,6 +110,7 @@ func (h *HiClient) postProcessSyncResponse(ctx context.Context, resp *mautrix.Re
 	if !syncCtx.evt.IsEmpty() {
 		h.EventHandler(syncCtx.evt)
 	}
+	h.dispatchLiveEvents(ctx, syncCtx.liveEvents)
 }
 
 func (h *HiClient) asyncPostProcessSyncResponse(ctx context.Context, resp *mautrix.RespSync, since string) {
@@ -145,6 +152,20 @@ func (h *HiClient) processSyncResponse(ctx context.Context, resp *mautrix.RespSy
 				h.receiveNewPushRules(ctx, pushRules.Ruleset)
 				zerolog.Ctx(ctx).Debug().Msg("Updated push rules from sync")
 			}
+		} else if evt.Type == event.AccountDataIgnoredUserList {
+			err = evt.Content.ParseRaw(evt.Type)
+			if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to parse ignored user list in sync")
+			} else if ignored, ok := evt.Content.Parsed.(*event.IgnoredUserListEventContent); ok {
+				if ignored.IgnoredUsers == nil {
+					ignored.IgnoredUsers = make(map[id.UserID]event.IgnoredUser)
+				}
+				if h.receiveNewIgnoredUsers(ignored) {
+					// The server won't resend events that were filtered while the users were ignored without an initial sync
+					ctx.Value(syncContextKey).(*syncContext).shouldResetSync = true
+				}
+				zerolog.Ctx(ctx).Debug().Int("count", len(ignored.IgnoredUsers)).Msg("Updated ignored user list from sync")
+			}
 		}
 	}
 	ctx.Value(syncContextKey).(*syncContext).evt.AccountData = accountData
@@ -441,6 +462,10 @@ func (h *HiClient) calculateLocalContent(ctx context.Context, dbEvt *database.Ev
 			}
 			wasPlaintext = true
 		}
+		var waveform []int
+		if content.MSC3245Voice != nil && content.MSC1767Audio != nil {
+			waveform = normalizeWaveform(content.MSC1767Audio.Waveform)
+		}
 		return &database.LocalContent{
 			SanitizedHTML: sanitizedHTML,
 			HTMLVersion:   CurrentHTMLSanitizerVersion,
@@ -448,12 +473,43 @@ func (h *HiClient) calculateLocalContent(ctx context.Context, dbEvt *database.Ev
 			BigEmoji:      bigEmoji,
 			HasMath:       hasMath,
 			EditSource:    editSource,
+			Waveform:      waveform,
 		}, inlineImages
 	}
 	return nil, nil
 }
 
-const CurrentHTMLSanitizerVersion = 8
+const normalizedWaveformLength = 100
+
+// MaxWaveformValue is the maximum value in voice message waveforms as defined by MSC3246.
+const MaxWaveformValue = 1024
+
+// normalizeWaveform resamples a voice message waveform to a fixed number of bars.
+// Values are clamped to be non-negative, and the waveform is scaled down if it exceeds MaxWaveformValue.
+// Waveforms that stay within the range aren't scaled up.
+func normalizeWaveform(waveform []int) []int {
+	if len(waveform) == 0 {
+		return nil
+	}
+	bars := min(len(waveform), normalizedWaveformLength)
+	output := make([]int, bars)
+	maxValue := 0
+	for i := range output {
+		for _, value := range waveform[i*len(waveform)/bars : (i+1)*len(waveform)/bars] {
+			output[i] = max(output[i], value)
+		}
+		maxValue = max(maxValue, output[i])
+	}
+	for i, value := range output {
+		if maxValue > MaxWaveformValue {
+			value = value * MaxWaveformValue / maxValue
+		}
+		output[i] = max(value, 0)
+	}
+	return output
+}
+
+const CurrentHTMLSanitizerVersion = 9
 
 func (h *HiClient) ReprocessExistingEvent(ctx context.Context, evt *database.Event) {
 	if (evt.Type != event.EventMessage.Type && evt.DecryptedType != event.EventMessage.Type) ||
@@ -473,7 +529,9 @@ func (h *HiClient) postDecryptProcess(ctx context.Context, llSummary *mautrix.La
 	if dbEvt.RowID != 0 {
 		h.cacheMedia(ctx, evt, dbEvt.RowID)
 	}
-	if evt.Sender != h.Account.UserID {
+	if h.isUserIgnored(evt.Sender) {
+		dbEvt.UnreadType = database.UnreadTypeNone
+	} else if evt.Sender != h.Account.UserID {
 		dbEvt.UnreadType = h.evaluatePushRules(ctx, llSummary, dbEvt.GetNonPushUnreadType(), evt)
 	}
 	dbEvt.LocalContent, inlineImages = h.calculateLocalContent(ctx, dbEvt, evt)
@@ -533,6 +591,7 @@ func (h *HiClient) processEvent(
 	} else {
 		h.cacheMedia(ctx, evt, dbEvt.RowID)
 	}
+	h.processPollRelation(ctx, dbEvt)
 	for _, uri := range inlineImages {
 		h.addMediaCache(ctx, dbEvt.RowID, uri.CUString(), nil, nil, "")
 	}
@@ -622,7 +681,7 @@ func (h *HiClient) processStateAndTimeline(
 		if dbEvt.UnreadType > 0 {
 			unreadMessagesWereMaybeRedacted = true
 		}
-		if dbEvt.RelationType == event.RelReplace || dbEvt.RelationType == event.RelAnnotation {
+		if dbEvt.RelationType == event.RelReplace || dbEvt.RelationType == event.RelAnnotation || isPollRelation(dbEvt) {
 			_, err = addOldEvent(0, dbEvt.RelatesTo)
 			if err != nil {
 				return fmt.Errorf("failed to get relation target of redaction target: %w", err)
@@ -650,7 +709,11 @@ func (h *HiClient) processStateAndTimeline(
 			newUnreadCounts.AddOne(dbEvt.UnreadType)
 		}
 		if isTimeline {
-			if dbEvt.CanUseForPreview() {
+			if h.firstSyncReceived && h.LiveEventHandler != nil {
+				syncCtx := ctx.Value(syncContextKey).(*syncContext)
+				syncCtx.liveEvents = append(syncCtx.liveEvents, dbEvt)
+			}
+			if dbEvt.CanUseForPreview() && !h.isUserIgnored(dbEvt.Sender) {
 				updatedRoom.PreviewEventRowID = dbEvt.RowID
 				recalculatePreviewEvent = false
 			}
@@ -678,7 +741,7 @@ func (h *HiClient) processStateAndTimeline(
 			if err != nil {
 				return -1, fmt.Errorf("failed to process redaction: %w", err)
 			}
-		} else if dbEvt.RelationType == event.RelReplace || dbEvt.RelationType == event.RelAnnotation {
+		} else if dbEvt.RelationType == event.RelReplace || dbEvt.RelationType == event.RelAnnotation || isPollRelation(dbEvt) {
 			_, err = addOldEvent(0, dbEvt.RelatesTo)
 			if err != nil {
 				return -1, fmt.Errorf("failed to get relation target of event: %w", err)
@@ -799,6 +862,19 @@ func (h *HiClient) processStateAndTimeline(
 	if ok {
 		updatedRoom.MarkedUnread = ptr.Ptr(gjson.GetBytes(mu.Content, "unread").Bool())
 	}
+	tags, ok := accountData[event.AccountDataRoomTags]
+	if ok {
+		var tagContent event.TagEventContent
+		err = json.Unmarshal(tags.Content, &tagContent)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to parse room tags")
+		} else {
+			if tagContent.Tags == nil {
+				tagContent.Tags = make(event.Tags)
+			}
+			updatedRoom.Tags = tagContent.Tags
+		}
+	}
 
 	if len(receipts) > 0 {
 		err = h.DB.Receipt.PutMany(ctx, room.ID, receipts...)
@@ -824,8 +900,19 @@ func (h *HiClient) processStateAndTimeline(
 			return fmt.Errorf("failed to save room data: %w", err)
 		}
 	}
+	err = h.fillLocalAggregations(ctx, room.ID, allNewEvents)
+	if err != nil {
+		return err
+	}
+	var capabilities *RoomCapabilities
+	if _, powerLevelsChanged := changedState[event.StatePowerLevels]; powerLevelsChanged {
+		capabilities, err = h.getRoomCapabilities(ctx, room.ID)
+		if err != nil {
+			return err
+		}
+	}
 	// TODO why is *old* unread count sometimes zero when processing the read receipt that is making it zero?
-	if roomChanged || len(accountData) > 0 || len(newOwnReceipts) > 0 || len(timelineRowTuples) > 0 || len(allNewEvents) > 0 {
+	if roomChanged || len(accountData) > 0 || len(newOwnReceipts) > 0 || len(timelineRowTuples) > 0 || len(allNewEvents) > 0 || capabilities != nil {
 		ctx.Value(syncContextKey).(*syncContext).evt.Rooms[room.ID] = &SyncRoom{
 			Meta:          room,
 			Timeline:      timelineRowTuples,
@@ -834,6 +921,7 @@ func (h *HiClient) processStateAndTimeline(
 			Reset:         timeline.Limited,
 			Events:        allNewEvents,
 			Notifications: newNotifications,
+			Capabilities:  capabilities,
 		}
 	}
 	return nil
@@ -0,0 +1,46 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeWaveform(t *testing.T) {
+	long := make([]int, 250)
+	for i := range long {
+		long[i] = i
+	}
+	wantLong := make([]int, normalizedWaveformLength)
+	for i := range wantLong {
+		// Each bar is the maximum of the 2 or 3 input values it covers
+		wantLong[i] = (i+1)*len(long)/normalizedWaveformLength - 1
+	}
+	tests := []struct {
+		name  string
+		input []int
+		want  []int
+	}{
+		{"Empty", []int{}, nil},
+		{"Nil", nil, nil},
+		{"All zero", []int{0, 0, 0}, []int{0, 0, 0}},
+		{"In range isn't scaled up", []int{1, 2, 3}, []int{1, 2, 3}},
+		{"Maximum value", []int{0, MaxWaveformValue}, []int{0, MaxWaveformValue}},
+		{"Too large values are scaled down", []int{0, 2048, 1024}, []int{0, MaxWaveformValue, 512}},
+		{"Negative values are clamped", []int{-5, 10, -1}, []int{0, 10, 0}},
+		{"Too long", long, wantLong},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := normalizeWaveform(test.input)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("normalizeWaveform() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -23,6 +23,7 @@ type contextKey int
 
 const (
 	syncContextKey contextKey = iota
+	keyBackupRestoreContextKey
 )
 
 func (h *hiSyncer) ProcessResponse(ctx context.Context, resp *mautrix.RespSync, since string) error {
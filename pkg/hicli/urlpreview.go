@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hicli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+var ErrURLPreviewsDisabled = errors.New("URL previews are not enabled in this encrypted room")
+
+const (
+	urlPreviewCacheTime      = 24 * time.Hour
+	urlPreviewErrorCacheTime = 1 * time.Hour
+
+	// The room preference that must be set in encrypted rooms before previews are fetched.
+	// Previews are disabled by default in encrypted rooms, as fetching them leaks the URL to the homeserver.
+	encryptedURLPreviewsPreference = "encrypted_url_previews"
+)
+
+// GetURLPreview returns a preview of the given URL, either from the local cache or from the homeserver.
+// The room ID is required, as previews may be disabled in encrypted rooms.
+func (h *HiClient) GetURLPreview(ctx context.Context, roomID id.RoomID, previewURL string) (*database.URLPreview, error) {
+	parsedURL, err := url.Parse(previewURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	} else if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, fmt.Errorf("only http and https URLs can be previewed")
+	}
+	if roomID == "" {
+		return nil, fmt.Errorf("room ID is required")
+	} else if err = h.checkURLPreviewsAllowed(ctx, roomID); err != nil {
+		return nil, err
+	}
+	cached, err := h.DB.URLPreview.Get(ctx, previewURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cached URL preview: %w", err)
+	} else if cached != nil && !cached.IsExpired() {
+		return cached, nil
+	}
+	preview := &database.URLPreview{
+		URL:       previewURL,
+		FetchedAt: jsontime.UnixMilliNow(),
+	}
+	resp, err := h.Client.GetURLPreview(ctx, previewURL)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		preview.Error = err.Error()
+		preview.ExpiresAt = jsontime.UM(time.Now().Add(urlPreviewErrorCacheTime))
+	} else {
+		preview.Preview, err = json.Marshal(resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal URL preview: %w", err)
+		}
+		preview.ExpiresAt = jsontime.UM(time.Now().Add(urlPreviewCacheTime))
+		h.addURLPreviewImageToMediaCache(ctx, resp.ImageURL)
+	}
+	if err = h.DB.URLPreview.DeleteExpired(ctx); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to delete expired URL previews")
+	}
+	if err = h.DB.URLPreview.Put(ctx, preview); err != nil {
+		return nil, fmt.Errorf("failed to save URL preview: %w", err)
+	}
+	return preview, nil
+}
+
+func (h *HiClient) checkURLPreviewsAllowed(ctx context.Context, roomID id.RoomID) error {
+	room, err := h.DB.Room.Get(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room metadata: %w", err)
+	} else if room == nil {
+		return fmt.Errorf("unknown room")
+	} else if room.EncryptionEvent == nil {
+		return nil
+	}
+	allowed, err := h.getRoomPreference(ctx, roomID, encryptedURLPreviewsPreference)
+	if err != nil {
+		return err
+	} else if !allowed.Bool() {
+		return ErrURLPreviewsDisabled
+	}
+	return nil
+}
+
+// addURLPreviewImageToMediaCache registers the preview image in the media cache,
+// so that the frontend can load it through the normal media download endpoint.
+func (h *HiClient) addURLPreviewImageToMediaCache(ctx context.Context, imageURL id.ContentURIString) {
+	if imageURL == "" {
+		return
+	}
+	mxc, err := imageURL.Parse()
+	if err != nil || !mxc.IsValid() {
+		return
+	}
+	err = h.DB.Media.Add(ctx, &database.Media{MXC: mxc})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("mxc", mxc).Msg("Failed to add URL preview image to media cache")
+	}
+}
@@ -11,12 +11,13 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/crypto/backup"
 	"maunium.net/go/mautrix/crypto/ssss"
-	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -34,23 +35,31 @@ func (h *HiClient) checkIsCurrentDeviceVerified(ctx context.Context) (bool, erro
 
 func (h *HiClient) fetchKeyBackupKey(ctx context.Context, ssssKey *ssss.Key) error {
 	latestVersion, err := h.Client.GetKeyBackupLatestVersion(ctx)
-	if err != nil {
+	if errors.Is(err, mautrix.MNotFound) {
+		zerolog.Ctx(ctx).Debug().Msg("No key backup found")
+		h.setKeyBackup("", nil)
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("failed to get key backup latest version: %w", err)
 	}
-	h.KeyBackupVersion = latestVersion.Version
-	data, err := h.Crypto.SSSS.GetDecryptedAccountData(ctx, event.AccountDataMegolmBackupKey, ssssKey)
+	key, err := h.getKeyBackupKeyFromSSSS(ctx, ssssKey)
 	if err != nil {
-		return fmt.Errorf("failed to get megolm backup key from SSSS: %w", err)
+		return err
 	}
-	key, err := backup.MegolmBackupKeyFromBytes(data)
+	err = h.verifyKeyBackupVersion(ctx, latestVersion, key)
 	if err != nil {
-		return fmt.Errorf("failed to parse megolm backup key: %w", err)
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Str("key_backup_version", string(latestVersion.Version)).
+			Msg("Not using latest key backup version")
+		h.setKeyBackup("", nil)
+		return nil
 	}
 	err = h.CryptoStore.PutSecret(ctx, id.SecretMegolmBackupV1, base64.StdEncoding.EncodeToString(key.Bytes()))
 	if err != nil {
 		return fmt.Errorf("failed to store megolm backup key: %w", err)
 	}
-	h.KeyBackupKey = key
+	h.setKeyBackup(latestVersion.Version, key)
+	h.lastKeyBackupCheck = time.Now()
 	return nil
 }
 
@@ -59,7 +68,7 @@ func (h *HiClient) getAndDecodeSecret(ctx context.Context, secret id.Secret) ([]
 	if err != nil {
 		return nil, fmt.Errorf("failed to get secret %s: %w", secret, err)
 	} else if secretData == "" {
-		return nil, fmt.Errorf("secret %s not found", secret)
+		return nil, fmt.Errorf("%w: %s", ErrSecretNotFound, secret)
 	}
 	data, err := base64.StdEncoding.DecodeString(secretData)
 	if err != nil {
@@ -92,19 +101,32 @@ func (h *HiClient) loadPrivateKeys(ctx context.Context) error {
 	}
 	zerolog.Ctx(ctx).Debug().Msg("Loading key backup key")
 	keyBackupKey, err := h.getAndDecodeSecret(ctx, id.SecretMegolmBackupV1)
-	if err != nil {
+	if errors.Is(err, ErrSecretNotFound) {
+		zerolog.Ctx(ctx).Debug().Msg("Key backup key not found, key backup is disabled")
+	} else if err != nil {
 		return fmt.Errorf("failed to get megolm backup key: %w", err)
+	} else {
+		key, err := backup.MegolmBackupKeyFromBytes(keyBackupKey)
+		if err != nil {
+			return fmt.Errorf("failed to parse megolm backup key: %w", err)
+		}
+		zerolog.Ctx(ctx).Debug().Msg("Fetching key backup version")
+		latestVersion, err := h.Client.GetKeyBackupLatestVersion(ctx)
+		if errors.Is(err, mautrix.MNotFound) {
+			zerolog.Ctx(ctx).Debug().Msg("No key backup found on server")
+			h.setKeyBackup("", key)
+		} else if err != nil {
+			return fmt.Errorf("failed to get key backup latest version: %w", err)
+		} else if err = h.verifyKeyBackupVersion(ctx, latestVersion, key); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).
+				Str("key_backup_version", string(latestVersion.Version)).
+				Msg("Latest key backup version can't be used with stored key")
+			h.setKeyBackup("", key)
+		} else {
+			h.setKeyBackup(latestVersion.Version, key)
+		}
+		h.lastKeyBackupCheck = time.Now()
 	}
-	h.KeyBackupKey, err = backup.MegolmBackupKeyFromBytes(keyBackupKey)
-	if err != nil {
-		return fmt.Errorf("failed to parse megolm backup key: %w", err)
-	}
-	zerolog.Ctx(ctx).Debug().Msg("Fetching key backup version")
-	latestVersion, err := h.Client.GetKeyBackupLatestVersion(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get key backup latest version: %w", err)
-	}
-	h.KeyBackupVersion = latestVersion.Version
 	zerolog.Ctx(ctx).Debug().Msg("Secrets loaded")
 	return nil
 }
@@ -128,14 +150,7 @@ func (h *HiClient) storeCrossSigningPrivateKeys(ctx context.Context) error {
 
 func (h *HiClient) Verify(ctx context.Context, code string) error {
 	defer h.dispatchCurrentState()
-	keyID, keyData, err := h.Crypto.SSSS.GetDefaultKeyData(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get default SSSS key data: %w", err)
-	}
-	key, err := keyData.VerifyRecoveryKey(keyID, code)
-	if errors.Is(err, ssss.ErrInvalidRecoveryKey) && keyData.Passphrase != nil {
-		key, err = keyData.VerifyPassphrase(keyID, code)
-	}
+	key, err := h.getSSSSKey(ctx, code)
 	if err != nil {
 		return err
 	}
@@ -155,7 +170,9 @@ func (h *HiClient) Verify(ctx context.Context, code string) error {
 	if err != nil {
 		return fmt.Errorf("failed to store cross-signing private keys: %w", err)
 	}
+	h.keyBackupLock.Lock()
 	err = h.fetchKeyBackupKey(ctx, key)
+	h.keyBackupLock.Unlock()
 	if err != nil {
 		return fmt.Errorf("failed to fetch key backup key: %w", err)
 	}
@@ -13,7 +13,7 @@
 //
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
-import { CachedEventDispatcher, NonNullCachedEventDispatcher } from "../util/eventdispatcher.ts"
+import { CachedEventDispatcher, EventDispatcher, NonNullCachedEventDispatcher } from "../util/eventdispatcher.ts"
 import RPCClient, { SendMessageParams } from "./rpc.ts"
 import { RoomStateStore, StateStore } from "./statestore"
 import type {
@@ -22,9 +22,11 @@ import type {
 	EventID,
 	EventType,
 	ImagePackRooms,
+	MediaMessageEventContent,
 	RPCEvent,
 	RoomID,
 	RoomStateGUID,
+	SlashCommand,
 	SyncStatus,
 	UserID,
 } from "./types"
@@ -33,9 +35,11 @@ export default class Client {
 	readonly state = new CachedEventDispatcher<ClientState>()
 	readonly syncStatus = new NonNullCachedEventDispatcher<SyncStatus>({ type: "waiting", error_count: 0 })
 	readonly store = new StateStore()
+	readonly scheduledEventsChanged = new EventDispatcher<RoomID>()
 	#stateRequests: RoomStateGUID[] = []
 	#stateRequestQueued = false
 	#gcInterval: number | undefined
+	#commands: Promise<SlashCommand[]> | null = null
 
 	constructor(readonly rpc: RPCClient) {
 		this.rpc.event.listen(this.#handleEvent)
@@ -89,6 +93,15 @@ export default class Client {
 	#handleEvent = (ev: RPCEvent) => {
 		if (ev.command === "client_state") {
 			this.state.emit(ev.data)
+			if (ev.data.is_logged_in) {
+				this.rpc.getDrafts().then(
+					drafts => {
+						this.store.applyDrafts(drafts)
+						this.#migrateLocalStorageDrafts()
+					},
+					err => console.error("Failed to load drafts", err),
+				)
+			}
 		} else if (ev.command === "sync_status") {
 			this.syncStatus.emit(ev.data)
 		} else if (ev.command === "sync_complete") {
@@ -99,6 +112,44 @@ export default class Client {
 			this.store.applySendComplete(ev.data)
 		} else if (ev.command === "image_auth_token") {
 			this.store.imageAuthToken = ev.data
+		} else if (ev.command === "draft_changed") {
+			this.store.applyDraftChange(ev.data)
+		} else if (ev.command === "scheduled_events_changed") {
+			this.scheduledEventsChanged.emit(ev.data.room_id)
+		}
+	}
+
+	// Older versions stored drafts in localStorage, move them to the backend so they aren't lost.
+	// Drafts that already exist on the backend are newer, so the local ones are just discarded in that case.
+	#migrateLocalStorageDrafts() {
+		const keys: string[] = []
+		for (let i = 0; i < localStorage.length; i++) {
+			const key = localStorage.key(i)
+			if (key?.startsWith("draft-")) {
+				keys.push(key)
+			}
+		}
+		for (const key of keys) {
+			const roomID = key.slice("draft-".length) as RoomID
+			let draft: { text?: string, media?: MediaMessageEventContent | null, replyTo?: EventID | null }
+			try {
+				draft = JSON.parse(localStorage.getItem(key) ?? "{}")
+			} catch {
+				draft = {}
+			}
+			if (this.store.getDraft(roomID) || (!draft.text && !draft.media && !draft.replyTo)) {
+				localStorage.removeItem(key)
+				continue
+			}
+			this.rpc.saveDraft({
+				room_id: roomID,
+				text: draft.text ?? "",
+				media: draft.media ?? undefined,
+				reply_to: draft.replyTo ?? undefined,
+			}).then(
+				() => localStorage.removeItem(key),
+				err => console.error("Failed to migrate draft in", roomID, err),
+			)
 		}
 	}
 
@@ -174,13 +225,22 @@ export default class Client {
 			throw new Error("Room not found")
 		}
 		const dbEvent = await this.rpc.sendMessage(params)
-		if (!room.eventsByRowID.has(dbEvent.rowid)) {
+		// Slash commands that only perform an action don't return an event
+		if (dbEvent && !room.eventsByRowID.has(dbEvent.rowid)) {
 			room.pendingEvents.push(dbEvent.rowid)
 			room.applyEvent(dbEvent, true)
 			room.notifyTimelineSubscribers()
 		}
 	}
 
+	getCommands(): Promise<SlashCommand[]> {
+		if (!this.#commands) {
+			this.#commands = this.rpc.listCommands()
+			this.#commands.catch(() => this.#commands = null)
+		}
+		return this.#commands
+	}
+
 	async subscribeToEmojiPack(pack: RoomStateGUID, subscribe: boolean = true) {
 		const emoteRooms = (this.store.accountData.get("im.ponies.emote_rooms") ?? {}) as ImagePackRooms
 		if (!emoteRooms.rooms) {
@@ -17,24 +17,36 @@ import { CachedEventDispatcher, EventDispatcher } from "../util/eventdispatcher.
 import { CancellablePromise } from "../util/promise.ts"
 import type {
 	ClientWellKnown,
+	ContentURI,
+	DBDraft,
+	EditHistory,
 	EventID,
 	EventRowID,
 	EventType,
+	ImagePackEntry,
+	ImagePackInfo,
+	KeyImportResult,
 	LoginFlowsResponse,
 	LoginRequest,
 	Mentions,
 	MessageEventContent,
 	PaginationResponse,
+	PollStart,
 	RPCCommand,
 	RPCEvent,
 	RawDBEvent,
+	ReactionGroup,
 	ReceiptType,
 	RelatesTo,
 	ResolveAliasResponse,
 	RoomAlias,
 	RoomID,
 	RoomStateGUID,
+	ScheduledEvent,
+	ScheduledEventRowID,
+	SlashCommand,
 	TimelineRowID,
+	URLPreview,
 	UserID,
 	UserProfile,
 } from "./types"
@@ -50,6 +62,13 @@ export class ErrorResponse extends Error {
 	}
 }
 
+export interface SetRoomProfileParams {
+	room_id: RoomID
+	displayname?: string
+	avatar_url?: ContentURI
+	reset?: boolean
+}
+
 export interface SendMessageParams {
 	room_id: RoomID
 	base_content?: MessageEventContent
@@ -59,6 +78,12 @@ export interface SendMessageParams {
 	mentions?: Mentions
 }
 
+export type SaveDraftParams = Omit<DBDraft, "updated_at">
+
+export interface ScheduleMessageParams extends SendMessageParams {
+	send_at: number
+}
+
 export default abstract class RPCClient {
 	public readonly connect: CachedEventDispatcher<ConnectionEvent> = new CachedEventDispatcher()
 	public readonly event: EventDispatcher<RPCEvent> = new EventDispatcher()
@@ -128,10 +153,42 @@ export default abstract class RPCClient {
 		}, this.cancelRequest.bind(this, request_id))
 	}
 
-	sendMessage(params: SendMessageParams): Promise<RawDBEvent> {
+	sendMessage(params: SendMessageParams): Promise<RawDBEvent | null> {
 		return this.request("send_message", params)
 	}
 
+	scheduleMessage(params: ScheduleMessageParams): Promise<ScheduledEvent> {
+		return this.request("schedule_message", params)
+	}
+
+	listScheduledEvents(room_id?: RoomID): Promise<ScheduledEvent[]> {
+		return this.request("list_scheduled_events", { room_id })
+	}
+
+	cancelScheduledEvent(rowid: ScheduledEventRowID): Promise<boolean> {
+		return this.request("cancel_scheduled_event", { rowid })
+	}
+
+	saveDraft(draft: SaveDraftParams): Promise<DBDraft | null> {
+		return this.request("save_draft", draft)
+	}
+
+	getDrafts(room_id?: RoomID): Promise<DBDraft[]> {
+		return this.request("get_drafts", { room_id })
+	}
+
+	clearDraft(room_id: RoomID, thread_root?: EventID): Promise<boolean> {
+		return this.request("clear_draft", { room_id, thread_root })
+	}
+
+	getURLPreview(url: string, room_id: RoomID): Promise<URLPreview> {
+		return this.request("get_url_preview", { url, room_id })
+	}
+
+	listCommands(): Promise<SlashCommand[]> {
+		return this.request("list_commands", {})
+	}
+
 	sendEvent(room_id: RoomID, type: EventType, content: unknown): Promise<RawDBEvent> {
 		return this.request("send_event", { room_id, type, content })
 	}
@@ -219,4 +276,116 @@ export default abstract class RPCClient {
 	verify(recovery_key: string): Promise<boolean> {
 		return this.request("verify", { recovery_key })
 	}
+
+	getEditHistory(room_id: RoomID, event_id: EventID): Promise<EditHistory> {
+		return this.request("get_edit_history", { room_id, event_id })
+	}
+
+	getReactions(room_id: RoomID, event_id: EventID): Promise<ReactionGroup[]> {
+		return this.request("get_reactions", { room_id, event_id })
+	}
+
+	toggleReaction(room_id: RoomID, event_id: EventID, key: string): Promise<RawDBEvent | null> {
+		return this.request("toggle_reaction", { room_id, event_id, key })
+	}
+
+	createPoll(
+		room_id: RoomID, question: string, answers: string[], max_selections = 1, kind: PollStart["kind"] = "disclosed",
+	): Promise<RawDBEvent> {
+		return this.request("create_poll", { room_id, question, answers, max_selections, kind })
+	}
+
+	votePoll(room_id: RoomID, event_id: EventID, answers: string[]): Promise<RawDBEvent> {
+		return this.request("vote_poll", { room_id, event_id, answers })
+	}
+
+	endPoll(room_id: RoomID, event_id: EventID): Promise<RawDBEvent> {
+		return this.request("end_poll", { room_id, event_id })
+	}
+
+	exportKeys(passphrase: string, room_id?: RoomID): Promise<string> {
+		return this.request("export_keys", { passphrase, room_id })
+	}
+
+	importKeys(passphrase: string, data: string): Promise<KeyImportResult> {
+		return this.request("import_keys", { passphrase, data })
+	}
+
+	restoreKeyBackup(): Promise<boolean> {
+		return this.request("restore_key_backup", {})
+	}
+
+	checkKeyBackupVersion(recovery_key?: string): Promise<boolean> {
+		return this.request("check_key_backup_version", { recovery_key })
+	}
+
+	createKeyBackup(recovery_key: string): Promise<string> {
+		return this.request("create_key_backup", { recovery_key })
+	}
+
+	deleteKeyBackup(): Promise<boolean> {
+		return this.request("delete_key_backup", {})
+	}
+
+	joinSuccessor(room_id: RoomID): Promise<RoomID> {
+		return this.request("join_successor", { room_id })
+	}
+
+	addRoomTag(room_id: RoomID, tag: string, order?: number): Promise<boolean> {
+		return this.request("add_room_tag", { room_id, tag, order })
+	}
+
+	removeRoomTag(room_id: RoomID, tag: string): Promise<boolean> {
+		return this.request("remove_room_tag", { room_id, tag })
+	}
+
+	setDisplayname(displayname: string, propagate: boolean): Promise<boolean> {
+		return this.request("set_displayname", { displayname, propagate })
+	}
+
+	setAvatar(avatar_url: ContentURI, propagate: boolean): Promise<boolean> {
+		return this.request("set_avatar", { avatar_url, propagate })
+	}
+
+	setRoomProfile(params: SetRoomProfileParams): Promise<boolean> {
+		return this.request("set_room_profile", params)
+	}
+
+	ignoreUser(user_id: UserID): Promise<boolean> {
+		return this.request("ignore_user", { user_id })
+	}
+
+	unignoreUser(user_id: UserID): Promise<boolean> {
+		return this.request("unignore_user", { user_id })
+	}
+
+	getImagePacks(room_id?: RoomID): Promise<ImagePackInfo[]> {
+		return this.request("get_image_packs", { room_id })
+	}
+
+	createImagePack(room_id: RoomID | undefined, state_key: string, display_name: string): Promise<ImagePackInfo> {
+		return this.request("create_image_pack", { room_id, state_key, display_name })
+	}
+
+	renameImagePack(room_id: RoomID | undefined, state_key: string, display_name: string): Promise<ImagePackInfo> {
+		return this.request("rename_image_pack", { room_id, state_key, display_name })
+	}
+
+	deleteImagePack(room_id: RoomID | undefined, state_key: string): Promise<boolean> {
+		return this.request("delete_image_pack", { room_id, state_key })
+	}
+
+	addImagePackImage(
+		room_id: RoomID | undefined, state_key: string, shortcode: string, image: ImagePackEntry,
+	): Promise<ImagePackInfo> {
+		return this.request("add_image_pack_image", { room_id, state_key, shortcode, image })
+	}
+
+	removeImagePackImage(room_id: RoomID | undefined, state_key: string, shortcode: string): Promise<ImagePackInfo> {
+		return this.request("remove_image_pack_image", { room_id, state_key, shortcode })
+	}
+
+	setImagePackEnabled(room_id: RoomID, state_key: string, enabled: boolean): Promise<boolean> {
+		return this.request("set_image_pack_enabled", { room_id, state_key, enabled })
+	}
 }
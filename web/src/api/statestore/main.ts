@@ -22,6 +22,10 @@ import toSearchableString from "@/util/searchablestring.ts"
 import Subscribable, { MultiSubscribable, NoDataSubscribable } from "@/util/subscribable.ts"
 import {
 	ContentURI,
+	DBDraft,
+	DBRoom,
+	DraftChangedData,
+	EventID,
 	EventRowID,
 	EventsDecryptedData,
 	ImagePack,
@@ -38,9 +42,17 @@ import {
 } from "../types"
 import { RoomStateStore } from "./room.ts"
 
+export enum RoomListSection {
+	Favourite = 0,
+	Normal = 1,
+	LowPriority = 2,
+}
+
 export interface RoomListEntry {
 	room_id: RoomID
 	dm_user_id?: UserID
+	section: RoomListSection
+	tag_order?: number
 	sorting_timestamp: number
 	preview_event?: MemDBEvent
 	preview_sender?: MemDBEvent
@@ -53,6 +65,34 @@ export interface RoomListEntry {
 	marked_unread: boolean
 }
 
+function getRoomListSection(meta: DBRoom): [RoomListSection, number | undefined] {
+	// This must match the logic in Room.Section on the backend
+	const favourite = meta.tags?.["m.favourite"]
+	if (favourite) {
+		return [RoomListSection.Favourite, favourite.order]
+	}
+	const lowPriority = meta.tags?.["m.lowpriority"]
+	if (lowPriority) {
+		return [RoomListSection.LowPriority, lowPriority.order]
+	}
+	return [RoomListSection.Normal, undefined]
+}
+
+// Drafts are stored per room and thread, an empty thread root is the main timeline of the room
+export const draftKey = (roomID: RoomID, threadRoot?: EventID) => `${roomID}/${threadRoot ?? ""}`
+
+// The room list is sorted in reverse, so entries that are rendered first must compare as greater
+function compareRoomListEntries(r1: RoomListEntry, r2: RoomListEntry): number {
+	if (r1.section !== r2.section) {
+		return r2.section - r1.section
+	}
+	if (r1.tag_order !== r2.tag_order) {
+		// Tagged rooms without an order go after ones with an order
+		return (r2.tag_order ?? Infinity) - (r1.tag_order ?? Infinity)
+	}
+	return r1.sorting_timestamp - r2.sorting_timestamp
+}
+
 export interface GCSettings {
 	interval: number,
 	lastOpenedCutoff: number,
@@ -72,6 +112,8 @@ export class StateStore {
 	readonly accountData: Map<string, UnknownEventContent> = new Map()
 	readonly accountDataSubs = new MultiSubscribable()
 	readonly emojiRoomsSub = new Subscribable()
+	readonly drafts: Map<string, DBDraft> = new Map()
+	readonly draftSubs = new MultiSubscribable()
 	readonly preferences: Preferences = getPreferenceProxy(this)
 	#frequentlyUsedEmoji: Map<string, number> | null = null
 	#emojiPackKeys: RoomStateGUID[] | null = null
@@ -111,7 +153,11 @@ export class StateStore {
 	}
 
 	#roomListEntryChanged(entry: SyncRoom, oldEntry: RoomStateStore): boolean {
+		const [newSection, newOrder] = getRoomListSection(entry.meta)
+		const [oldSection, oldOrder] = getRoomListSection(oldEntry.meta.current)
 		return entry.meta.sorting_timestamp !== oldEntry.meta.current.sorting_timestamp ||
+			newSection !== oldSection || newOrder !== oldOrder ||
+			entry.meta.tombstone?.replacement_room !== oldEntry.meta.current.tombstone?.replacement_room ||
 			entry.meta.unread_messages !== oldEntry.meta.current.unread_messages ||
 			entry.meta.unread_notifications !== oldEntry.meta.current.unread_notifications ||
 			entry.meta.unread_highlights !== oldEntry.meta.current.unread_highlights ||
@@ -130,10 +176,13 @@ export class StateStore {
 		const preview_event = room?.eventsByRowID.get(entry.meta.preview_event_rowid)
 		const preview_sender = preview_event && room?.getStateEvent("m.room.member", preview_event.sender)
 		const name = entry.meta.name ?? "Unnamed room"
+		const [section, tag_order] = getRoomListSection(entry.meta)
 		return {
 			room_id: entry.meta.room_id,
 			dm_user_id: entry.meta.lazy_load_summary?.heroes?.length === 1
 				? entry.meta.lazy_load_summary.heroes[0] : undefined,
+			section,
+			tag_order,
 			sorting_timestamp: entry.meta.sorting_timestamp,
 			preview_event,
 			preview_sender,
@@ -203,22 +252,21 @@ export class StateStore {
 			updatedRoomList = Object.values(sync.rooms)
 				.map(entry => this.#makeRoomListEntry(entry))
 				.filter(entry => entry !== null)
-			updatedRoomList.sort((r1, r2) => r1.sorting_timestamp - r2.sorting_timestamp)
+			updatedRoomList.sort(compareRoomListEntries)
 		} else if (changedRoomListEntries.size > 0) {
 			updatedRoomList = this.roomList.current.filter(entry => !changedRoomListEntries.has(entry.room_id))
 			for (const entry of changedRoomListEntries.values()) {
 				if (!entry) {
 					continue
 				}
-				if (updatedRoomList.length === 0 || entry.sorting_timestamp >=
-					updatedRoomList[updatedRoomList.length - 1].sorting_timestamp) {
+				if (updatedRoomList.length === 0 ||
+					compareRoomListEntries(entry, updatedRoomList[updatedRoomList.length - 1]) >= 0) {
 					updatedRoomList.push(entry)
-				} else if (entry.sorting_timestamp <= 0 ||
-					entry.sorting_timestamp < updatedRoomList[0]?.sorting_timestamp) {
+				} else if (compareRoomListEntries(entry, updatedRoomList[0]) < 0) {
 					updatedRoomList.unshift(entry)
 				} else {
 					const indexToPushAt = updatedRoomList.findLastIndex(val =>
-						val.sorting_timestamp <= entry.sorting_timestamp)
+						compareRoomListEntries(val, entry) <= 0)
 					updatedRoomList.splice(indexToPushAt + 1, 0, entry)
 				}
 			}
@@ -343,6 +391,33 @@ export class StateStore {
 		}
 	}
 
+	getDraft(roomID: RoomID, threadRoot?: EventID): DBDraft | null {
+		return this.drafts.get(draftKey(roomID, threadRoot)) ?? null
+	}
+
+	applyDrafts(drafts: DBDraft[]) {
+		const changedKeys = new Set(this.drafts.keys())
+		this.drafts.clear()
+		for (const draft of drafts) {
+			const key = draftKey(draft.room_id, draft.thread_root)
+			this.drafts.set(key, draft)
+			changedKeys.add(key)
+		}
+		for (const key of changedKeys) {
+			this.draftSubs.notify(key)
+		}
+	}
+
+	applyDraftChange(data: DraftChangedData) {
+		const key = draftKey(data.room_id, data.thread_root)
+		if (data.draft) {
+			this.drafts.set(key, data.draft)
+		} else {
+			this.drafts.delete(key)
+		}
+		this.draftSubs.notify(key)
+	}
+
 	applySendComplete(data: SendCompleteData) {
 		const room = this.rooms.get(data.event.room_id)
 		if (!room) {
@@ -15,7 +15,7 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 import { Preferences, getLocalStoragePreferences, getPreferenceProxy } from "@/api/types/preferences"
 import { CustomEmojiPack, parseCustomEmojiPack } from "@/util/emoji"
-import { NonNullCachedEventDispatcher } from "@/util/eventdispatcher.ts"
+import { CachedEventDispatcher, NonNullCachedEventDispatcher } from "@/util/eventdispatcher.ts"
 import toSearchableString from "@/util/searchablestring.ts"
 import Subscribable, { MultiSubscribable, NoDataSubscribable } from "@/util/subscribable.ts"
 import { getDisplayname } from "@/util/validation.ts"
@@ -33,6 +33,7 @@ import {
 	MemberEventContent,
 	PowerLevelEventContent,
 	RawDBEvent,
+	RoomCapabilities,
 	RoomID,
 	SyncRoom,
 	TimelineRowTuple,
@@ -70,7 +71,8 @@ function visibleMetaIsEqual(meta1: DBRoom, meta2: DBRoom): boolean {
 		meta1.canonical_alias === meta2.canonical_alias &&
 		llSummaryIsEqual(meta1.lazy_load_summary, meta2.lazy_load_summary) &&
 		meta1.encryption_event?.algorithm === meta2.encryption_event?.algorithm &&
-		meta1.has_member_list === meta2.has_member_list
+		meta1.has_member_list === meta2.has_member_list &&
+		meta1.tombstone?.replacement_room === meta2.tombstone?.replacement_room
 }
 
 export interface AutocompleteMemberEntry {
@@ -83,6 +85,7 @@ export interface AutocompleteMemberEntry {
 export class RoomStateStore {
 	readonly roomID: RoomID
 	readonly meta: NonNullCachedEventDispatcher<DBRoom>
+	readonly capabilities = new CachedEventDispatcher<RoomCapabilities>()
 	timeline: TimelineRowTuple[] = []
 	timelineCache: (MemDBEvent | null)[] = []
 	state: Map<EventType, Map<string, EventRowID>> = new Map()
@@ -325,6 +328,9 @@ export class RoomStateStore {
 		} else {
 			this.meta.emit(sync.meta)
 		}
+		if (sync.capabilities) {
+			this.capabilities.emit(sync.capabilities)
+		}
 		for (const ad of Object.values(sync.account_data)) {
 			if (ad.type === "fi.mau.gomuks.preferences") {
 				this.serverPreferenceCache = ad.content
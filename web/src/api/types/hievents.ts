@@ -15,14 +15,17 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 import {
 	DBAccountData,
+	DBDraft,
 	DBRoom,
 	DBRoomAccountData,
 	EventRowID,
 	RawDBEvent,
+	RoomCapabilities,
 	TimelineRowTuple,
 } from "./hitypes.ts"
 import {
 	DeviceID,
+	EventID,
 	EventType,
 	RoomID,
 	UserID,
@@ -74,6 +77,7 @@ export interface SyncRoom {
 	reset: boolean
 	notifications: SyncNotification[]
 	account_data: Record<EventType, DBRoomAccountData>
+	capabilities?: RoomCapabilities
 }
 
 export interface SyncNotification {
@@ -118,6 +122,61 @@ export interface SyncStatusEvent extends RPCCommand<SyncStatus> {
 	command: "sync_status"
 }
 
+export interface UploadProgressData {
+	upload_id: string
+	uploaded: number
+	total: number
+}
+
+export interface UploadProgressEvent extends RPCCommand<UploadProgressData> {
+	command: "upload_progress"
+}
+
+export interface ExportProgressData {
+	export_id: string
+	room_id: RoomID
+	format: "html" | "json" | "text"
+	stage: "collecting" | "writing" | "done" | "failed"
+	events: number
+	total: number
+	error?: string
+}
+
+export interface ExportProgressEvent extends RPCCommand<ExportProgressData> {
+	command: "export_progress"
+}
+
+export interface KeyBackupRestoreProgressData {
+	stage: "fetching" | "importing" | "retrying" | "done" | "failed"
+	version: string
+	done: number
+	failed: number
+	total: number
+	error?: string
+}
+
+export interface KeyBackupRestoreProgressEvent extends RPCCommand<KeyBackupRestoreProgressData> {
+	command: "key_backup_restore_progress"
+}
+
+export interface ScheduledEventsChangedData {
+	room_id: RoomID
+}
+
+export interface ScheduledEventsChangedEvent extends RPCCommand<ScheduledEventsChangedData> {
+	command: "scheduled_events_changed"
+}
+
+export interface DraftChangedData {
+	room_id: RoomID
+	thread_root?: EventID
+	draft: DBDraft | null
+}
+
+export interface DraftChangedEvent extends RPCCommand<DraftChangedData> {
+	command: "draft_changed"
+}
+
 export type RPCEvent =
 	ClientStateEvent |
 	SyncStatusEvent |
@@ -125,4 +184,9 @@ export type RPCEvent =
 	SendCompleteEvent |
 	EventsDecryptedEvent |
 	SyncCompleteEvent |
-	ImageAuthTokenEvent
+	ImageAuthTokenEvent |
+	UploadProgressEvent |
+	ExportProgressEvent |
+	KeyBackupRestoreProgressEvent |
+	ScheduledEventsChangedEvent |
+	DraftChangedEvent
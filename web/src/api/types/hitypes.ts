@@ -20,7 +20,9 @@ import {
 	EncryptionEventContent,
 	EventID,
 	EventType,
+	ImagePack,
 	LazyLoadSummary,
+	MediaMessageEventContent,
 	RelationType,
 	RoomAlias,
 	RoomID,
@@ -66,9 +68,29 @@ export interface DBRoom {
 	unread_messages: number
 	marked_unread: boolean
 
+	tags?: Record<string, RoomTagMetadata>
+
 	prev_batch: string
 }
 
+export interface RoomCapabilities {
+	power_level: number
+	send_messages: boolean
+	react: boolean
+	redact_own: boolean
+	redact_others: boolean
+	invite: boolean
+	kick: boolean
+	ban: boolean
+	notify_room: boolean
+	state_default: boolean
+	state: Record<EventType, boolean>
+}
+
+export interface RoomTagMetadata {
+	order?: number
+}
+
 //eslint-disable-next-line @typescript-eslint/no-explicit-any
 export type UnknownEventContent = Record<string, any>
 
@@ -87,6 +109,7 @@ export interface LocalContent {
 	was_plaintext?: boolean
 	big_emoji?: boolean
 	has_math?: boolean
+	waveform?: number[]
 }
 
 export interface BaseDBEvent {
@@ -114,8 +137,11 @@ export interface BaseDBEvent {
 	send_error?: string
 
 	reactions?: Record<string, number>
+	own_reactions?: string[]
+	poll?: PollSummary
 	last_edit_rowid?: EventRowID
 	unread_type: UnreadType
+	ignored?: boolean
 }
 
 export interface RawDBEvent extends BaseDBEvent {
@@ -174,6 +200,58 @@ export interface ClientWellKnown {
 	}
 }
 
+export interface KeyImportResult {
+	imported: number
+	total: number
+}
+
+export interface PollAnswer {
+	id: string
+	text: string
+}
+
+export interface PollStart {
+	question: string
+	kind: "disclosed" | "undisclosed"
+	max_selections: number
+	answers: PollAnswer[]
+	stable: boolean
+}
+
+export interface PollSummary {
+	start: PollStart
+	tallies: Record<string, number>
+	total_votes: number
+	own_vote?: string[]
+	ended: boolean
+	ended_at?: number
+}
+
+export interface EditHistory {
+	original: RawDBEvent
+	edits: RawDBEvent[]
+}
+
+export interface ReactionSender {
+	sender: UserID
+	event_id: EventID
+	timestamp: number
+}
+
+export interface ReactionGroup {
+	key: string
+	count: number
+	own: boolean
+	senders: ReactionSender[]
+}
+
+export interface ImagePackInfo {
+	room_id?: RoomID
+	state_key: string
+	enabled: boolean
+	content: ImagePack
+}
+
 export function roomStateGUIDToString(guid: RoomStateGUID): string {
 	return `${encodeURIComponent(guid.room_id)}/${guid.type}/${encodeURIComponent(guid.state_key)}`
 }
@@ -193,6 +271,54 @@ export function stringToRoomStateGUID(str?: string | null): RoomStateGUID | unde
 	}
 }
 
+export interface SlashCommand {
+	name: string
+	aliases?: string[]
+	args?: string
+	description: string
+	min_args?: number
+}
+
+export type ScheduledEventRowID = number
+
+export interface ScheduledEvent {
+	rowid: ScheduledEventRowID
+	room_id: RoomID
+	type: EventType
+	content: unknown
+	send_at: number
+	created_at: number
+	delay_id?: string
+	send_error?: string
+}
+
+export interface DBDraft {
+	room_id: RoomID
+	thread_root?: EventID
+	text: string
+	media?: MediaMessageEventContent
+	reply_to?: EventID
+	edit_of?: EventID
+	updated_at: number
+}
+
+export interface URLPreviewContent {
+	"og:title"?: string
+	"og:description"?: string
+	"og:image"?: ContentURI
+	"og:image:width"?: number
+	"og:image:height"?: number
+	"og:url"?: string
+}
+
+export interface URLPreview {
+	url: string
+	preview?: URLPreviewContent
+	error?: string
+	fetched_at: number
+	expires_at: number
+}
+
 export interface RoomStateGUID {
 	room_id: RoomID
 	type: EventType
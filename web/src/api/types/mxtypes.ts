@@ -133,6 +133,11 @@ export interface MediaMessageEventContent extends BaseMessageEventContent {
 	url?: ContentURI
 	file?: EncryptedFile
 	info?: MediaInfo
+	"org.matrix.msc1767.audio"?: {
+		duration?: number
+		waveform?: number[]
+	}
+	"org.matrix.msc3245.voice"?: Record<string, never>
 }
 
 export interface ReactionEventContent {
@@ -163,6 +168,7 @@ export interface MediaInfo {
 	thumbnail_url?: ContentURI
 	thumbnail_file?: EncryptedFile
 	thumbnail_info?: MediaInfo
+	"xyz.amorgan.blurhash"?: string
 
 	"fi.mau.hide_controls"?: boolean
 	"fi.mau.loop"?: boolean
@@ -14,7 +14,7 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 import type { ContentURI } from "../../types"
-import { Preference, anyContext } from "./types.ts"
+import { Preference, PreferenceContext, anyContext } from "./types.ts"
 
 export const codeBlockStyles = [
 	"auto", "abap", "algol_nu", "algol", "arduino", "autumn", "average", "base16-snazzy", "borland", "bw",
@@ -98,6 +98,18 @@ export const preferences = {
 		allowedContexts: anyContext,
 		defaultValue: true,
 	}),
+	show_url_previews: new Preference<boolean>({
+		displayName: "Show URL previews",
+		description: "Whether to show previews of links in messages.",
+		allowedContexts: anyContext,
+		defaultValue: true,
+	}),
+	encrypted_url_previews: new Preference<boolean>({
+		displayName: "Show URL previews in encrypted room",
+		description: "Whether to fetch previews of links in this encrypted room. Fetching previews sends the URLs to your homeserver.",
+		allowedContexts: [PreferenceContext.RoomAccount],
+		defaultValue: false,
+	}),
 	custom_notification_sound: new Preference<ContentURI>({
 		displayName: "Custom notification sound",
 		description: "The mxc:// URI to a custom notification sound.",
@@ -13,9 +13,10 @@
 //
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
-import { JSX, RefObject, use, useEffect } from "react"
+import { JSX, RefObject, use, useEffect, useMemo, useState } from "react"
 import { getAvatarURL, getMediaURL } from "@/api/media.ts"
 import { RoomStateStore, useCustomEmojis } from "@/api/statestore"
+import type { SlashCommand } from "@/api/types"
 import { Emoji, emojiToMarkdown, useSortedAndFilteredEmojis } from "@/util/emoji"
 import { escapeMarkdown } from "@/util/markdown.ts"
 import useEvent from "@/util/useEvent.ts"
@@ -25,7 +26,7 @@ import { AutocompleteUser, useFilteredMembers } from "./userautocomplete.ts"
 import "./Autocompleter.css"
 
 export interface AutocompleteQuery {
-	type: "user" | "room" | "emoji"
+	type: "user" | "room" | "emoji" | "command"
 	query: string
 	startPos: number
 	endPos: number
@@ -150,6 +151,31 @@ export const UserAutocompleter = ({ params, room, ...rest }: AutocompleterProps)
 	return useAutocompleter({ params, room, ...rest, items, ...userFuncs })
 }
 
+const commandFuncs = {
+	getText: (cmd: SlashCommand) => `/${cmd.name} `,
+	getKey: (cmd: SlashCommand) => cmd.name,
+	render: (cmd: SlashCommand) => <>
+		<code className="command-usage">/{cmd.name}{cmd.args ? ` ${cmd.args}` : ""}</code>
+		<span className="command-description">{cmd.description}</span>
+	</>,
+}
+
+export const CommandAutocompleter = ({ params, ...rest }: AutocompleterProps) => {
+	const client = use(ClientContext)!
+	const [commands, setCommands] = useState<SlashCommand[]>([])
+	useEffect(() => {
+		client.getCommands().then(
+			setCommands,
+			err => console.error("Failed to load command list:", err),
+		)
+	}, [client])
+	const query = (params.frozenQuery ?? params.query).slice(1).toLowerCase()
+	const items = useMemo(() => commands.filter(cmd =>
+		cmd.name.startsWith(query) || cmd.aliases?.some(alias => alias.startsWith(query)),
+	), [commands, query])
+	return useAutocompleter({ params, ...rest, items, ...commandFuncs })
+}
+
 export const RoomAutocompleter = ({ params }: AutocompleterProps) => {
 	return <div className="autocompletions">
 		Autocomplete {params.type} {params.query}
@@ -15,15 +15,16 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 import React, { use, useCallback, useEffect, useLayoutEffect, useReducer, useRef, useState } from "react"
 import { ScaleLoader } from "react-spinners"
-import { useRoomEvent } from "@/api/statestore"
+import type { SendMessageParams } from "@/api/rpc.ts"
+import { draftKey, useRoomEvent } from "@/api/statestore"
 import type {
+	DBDraft,
 	EventID,
 	MediaMessageEventContent,
 	MemDBEvent,
 	Mentions,
 	MessageEventContent,
 	RelatesTo,
-	RoomID,
 } from "@/api/types"
 import { PartialEmoji, emojiToMarkdown } from "@/util/emoji"
 import { escapeMarkdown } from "@/util/markdown.ts"
@@ -35,11 +36,13 @@ import { ModalContext } from "../modal/Modal.tsx"
 import { useRoomContext } from "../roomview/roomcontext.ts"
 import { ReplyBody } from "../timeline/ReplyBody.tsx"
 import { useMediaContent } from "../timeline/content/useMediaContent.tsx"
+import ScheduleMessageModal from "./ScheduleMessageModal.tsx"
 import type { AutocompleteQuery } from "./Autocompleter.tsx"
 import { charToAutocompleteType, emojiQueryRegex, getAutocompleter } from "./getAutocompleter.ts"
 import AttachIcon from "@/icons/attach.svg?react"
 import CloseIcon from "@/icons/close.svg?react"
 import EmojiIcon from "@/icons/emoji-categories/smileys-emotion.svg?react"
+import ScheduleIcon from "@/icons/schedule.svg?react"
 import SendIcon from "@/icons/send.svg?react"
 import "./MessageComposer.css"
 
@@ -58,21 +61,19 @@ const uninitedComposer: ComposerState = { ...emptyComposer, uninited: true }
 const composerReducer = (state: ComposerState, action: Partial<ComposerState>) =>
 	({ ...state, ...action, uninited: undefined })
 
-const draftStore = {
-	get: (roomID: RoomID): ComposerState | null => {
-		const data = localStorage.getItem(`draft-${roomID}`)
-		if (!data) {
-			return null
-		}
-		try {
-			return JSON.parse(data)
-		} catch {
-			return null
-		}
-	},
-	set: (roomID: RoomID, data: ComposerState) => localStorage.setItem(`draft-${roomID}`, JSON.stringify(data)),
-	clear: (roomID: RoomID) => localStorage.removeItem(`draft-${roomID}`),
-}
+const draftToComposer = (draft: DBDraft | null): ComposerState => draft ? {
+	text: draft.text,
+	media: draft.media ?? null,
+	replyTo: draft.reply_to ?? null,
+} : emptyComposer
+
+const isDraftEqual = (draft: DBDraft | null, state: ComposerState, editing: MemDBEvent | null) =>
+	(draft?.text ?? "") === state.text
+	&& (draft?.media ?? null) === state.media
+	&& (draft?.reply_to ?? null) === state.replyTo
+	&& (draft?.edit_of ?? null) === (editing?.event_id ?? null)
+
+const DRAFT_SAVE_DELAY = 500
 
 type CaretEvent<T> = React.MouseEvent<T> | React.KeyboardEvent<T> | React.ChangeEvent<T>
 
@@ -90,7 +91,14 @@ const MessageComposer = () => {
 	const composerRef = useRef<HTMLDivElement>(null)
 	const textRows = useRef(1)
 	const typingSentAt = useRef(0)
+	const draftBeforeEdit = useRef<ComposerState | null>(null)
+	const pendingDraftSave = useRef<(() => void) | null>(null)
 	const replyToEvt = useRoomEvent(room, state.replyTo)
+	const applyDraft = useEvent((draft: DBDraft | null) => {
+		setState(draftToComposer(draft))
+		rawSetEditing(draft?.edit_of ? room.eventsByID.get(draft.edit_of) ?? null : null)
+		draftBeforeEdit.current = null
+	})
 	roomCtx.insertText = useCallback((text: string) => {
 		textInput.current?.focus()
 		document.execCommand("insertText", false, text)
@@ -99,12 +107,16 @@ const MessageComposer = () => {
 		setState({ replyTo: evt })
 		textInput.current?.focus()
 	}, [])
-	roomCtx.setEditing = useCallback((evt: MemDBEvent | null) => {
+	roomCtx.setEditing = useEvent((evt: MemDBEvent | null) => {
 		if (evt === null) {
 			rawSetEditing(null)
-			setState(draftStore.get(room.roomID) ?? emptyComposer)
+			setState(draftBeforeEdit.current ?? emptyComposer)
+			draftBeforeEdit.current = null
 			return
 		}
+		if (!editing) {
+			draftBeforeEdit.current = state
+		}
 		const evtContent = evt.content as MessageEventContent
 		const mediaMsgTypes = ["m.image", "m.audio", "m.video", "m.file"]
 		const isMedia = mediaMsgTypes.includes(evtContent.msgtype)
@@ -118,14 +130,15 @@ const MessageComposer = () => {
 			replyTo: null,
 		})
 		textInput.current?.focus()
-	}, [room.roomID])
-	const sendMessage = useEvent((evt: React.FormEvent) => {
-		evt.preventDefault()
+	})
+	// Builds the send parameters from the current composer state and resets the composer
+	const takeSendParams = (): SendMessageParams | null => {
 		if (state.text === "" && !state.media) {
-			return
+			return null
 		}
 		if (editing) {
-			setState(draftStore.get(room.roomID) ?? emptyComposer)
+			setState(draftBeforeEdit.current ?? emptyComposer)
+			draftBeforeEdit.current = null
 		} else {
 			setState(emptyComposer)
 		}
@@ -156,13 +169,36 @@ const MessageComposer = () => {
 				relates_to.is_falling_back = false
 			}
 		}
-		client.sendMessage({
+		return {
 			room_id: room.roomID,
 			base_content: state.media ?? undefined,
 			text: state.text,
 			relates_to,
 			mentions,
-		}).catch(err => window.alert("Failed to send message: " + err))
+		}
+	}
+	const sendMessage = useEvent((evt: React.FormEvent) => {
+		evt.preventDefault()
+		const params = takeSendParams()
+		if (params) {
+			client.sendMessage(params).catch(err => window.alert("Failed to send message: " + err))
+		}
+	})
+	const scheduleMessage = useEvent((sendAt: number) => {
+		const params = takeSendParams()
+		if (params) {
+			client.rpc.scheduleMessage({ ...params, send_at: sendAt })
+				.catch(err => window.alert("Failed to schedule message: " + err))
+		}
+	})
+	const openScheduleModal = useEvent(() => {
+		openModal({
+			dimmed: true,
+			boxed: true,
+			innerBoxClass: "schedule-message-modal",
+			content: <ScheduleMessageModal roomID={room.roomID} onSchedule={scheduleMessage}/>,
+			onClose: () => textInput.current?.focus(),
+		})
 	})
 	const onComposerCaretChange = useEvent((evt: CaretEvent<HTMLTextAreaElement>, newText?: string) => {
 		const area = evt.currentTarget
@@ -188,8 +224,11 @@ const MessageComposer = () => {
 			if (
 				acType && (
 					area.selectionStart === 1
-					|| newText?.[area.selectionStart - 2] === " "
-					|| newText?.[area.selectionStart - 2] === "\n"
+					// Commands are only autocompleted at the start of the message
+					|| (acType !== "command" && (
+						newText?.[area.selectionStart - 2] === " "
+						|| newText?.[area.selectionStart - 2] === "\n"
+					))
 				)
 			) {
 				setAutocomplete({
@@ -320,10 +359,11 @@ const MessageComposer = () => {
 	// To ensure the cursor jumps to the end, do this in an effect rather than as the initial value of useState
 	// To try to avoid the input bar flashing, use useLayoutEffect instead of useEffect
 	useLayoutEffect(() => {
-		const draft = draftStore.get(room.roomID)
-		setState(draft ?? emptyComposer)
+		applyDraft(client.store.getDraft(room.roomID))
 		setAutocomplete(null)
 		return () => {
+			pendingDraftSave.current?.()
+			pendingDraftSave.current = null
 			if (typingSentAt.current > 0) {
 				typingSentAt.current = 0
 				if (room.preferences.send_typing_notifications) {
@@ -346,18 +386,47 @@ const MessageComposer = () => {
 		// This has to be called unconditionally, because setting rows = 1 messes up the scroll state otherwise
 		roomCtx.scrollToBottom()
 	}, [state, roomCtx])
-	// Saving to localStorage could be done in the reducer, but that's not very proper, so do it in an effect.
+	// Drafts are saved on the backend so that they're shared with other sessions.
+	// Saving is debounced to avoid sending a request on every keypress.
 	useEffect(() => {
 		roomCtx.isEditing.emit(editing !== null)
-		if (state.uninited || editing) {
+		if (state.uninited || isDraftEqual(client.store.getDraft(room.roomID), state, editing)) {
 			return
 		}
-		if (!state.text && !state.media && !state.replyTo) {
-			draftStore.clear(room.roomID)
-		} else {
-			draftStore.set(room.roomID, state)
+		const save = () => {
+			const req = (!state.text && !state.media && !state.replyTo && !editing)
+				? client.rpc.clearDraft(room.roomID)
+				: client.rpc.saveDraft({
+					room_id: room.roomID,
+					text: state.text,
+					media: state.media ?? undefined,
+					reply_to: state.replyTo ?? undefined,
+					edit_of: editing?.event_id,
+				})
+			req.catch(err => console.error("Failed to save draft:", err))
+		}
+		pendingDraftSave.current = save
+		const timeout = setTimeout(() => {
+			pendingDraftSave.current = null
+			save()
+		}, DRAFT_SAVE_DELAY)
+		return () => clearTimeout(timeout)
+	}, [client, roomCtx, room, state, editing])
+	// Apply draft changes made in other sessions, unless the user is currently typing in this one
+	const onDraftChanged = useEvent(() => {
+		const isTyping = document.hasFocus() && document.activeElement === textInput.current
+		if (isTyping && !isDraftEqual(null, state, editing)) {
+			return
 		}
-	}, [roomCtx, room, state, editing])
+		const draft = client.store.getDraft(room.roomID)
+		if (!isDraftEqual(draft, state, editing)) {
+			applyDraft(draft)
+		}
+	})
+	useEffect(
+		() => client.store.draftSubs.getSubscriber(draftKey(room.roomID))(onDraftChanged),
+		[client, room, onDraftChanged],
+	)
 	const openFilePicker = useCallback(() => fileInput.current!.click(), [])
 	const clearMedia = useCallback(() => setState({ media: null }), [])
 	const closeReply = useCallback((evt: React.MouseEvent) => {
@@ -431,6 +500,11 @@ const MessageComposer = () => {
 					disabled={!!state.media || loadingMedia}
 					title={state.media ? "You can only attach one file at a time" : ""}
 				><AttachIcon/></button>
+				<button
+					onClick={openScheduleModal}
+					disabled={(!state.text && !state.media) || loadingMedia || !!editing}
+					title="Schedule message"
+				><ScheduleIcon/></button>
 				<button
 					onClick={sendMessage}
 					disabled={(!state.text && !state.media) || loadingMedia}
@@ -0,0 +1,108 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+import React, { use, useCallback, useEffect, useState } from "react"
+import { RoomID, ScheduledEvent } from "@/api/types"
+import useEvent from "@/util/useEvent.ts"
+import ClientContext from "../ClientContext.ts"
+import { ModalCloseContext } from "../modal/Modal.tsx"
+import CloseIcon from "@/icons/close.svg?react"
+
+interface ScheduleMessageModalProps {
+	roomID: RoomID
+	onSchedule: (sendAt: number) => void
+}
+
+const pad = (num: number) => num.toString().padStart(2, "0")
+
+// datetime-local inputs use local time without a timezone suffix
+const toDateTimeLocal = (date: Date) =>
+	`${date.getFullYear()}-${pad(date.getMonth() + 1)}-${pad(date.getDate())}T${pad(date.getHours())}:${pad(date.getMinutes())}`
+
+const getScheduledBody = (evt: ScheduledEvent) => {
+	const body = (evt.content as { body?: unknown } | null)?.body
+	return typeof body === "string" ? body : evt.type
+}
+
+const ScheduleMessageModal = ({ roomID, onSchedule }: ScheduleMessageModalProps) => {
+	const client = use(ClientContext)!
+	const closeModal = use(ModalCloseContext)
+	const [sendAt, setSendAt] = useState(() => toDateTimeLocal(new Date(Date.now() + 60 * 60 * 1000)))
+	const [scheduled, setScheduled] = useState<ScheduledEvent[] | null>(null)
+	useEffect(() => {
+		const load = () => {
+			client.rpc.listScheduledEvents(roomID).then(
+				setScheduled,
+				err => console.error("Failed to list scheduled events", err),
+			)
+		}
+		load()
+		return client.scheduledEventsChanged.listen(changedRoomID => {
+			if (changedRoomID === roomID) {
+				load()
+			}
+		})
+	}, [client, roomID])
+	const onSubmit = useEvent((evt: React.FormEvent) => {
+		evt.preventDefault()
+		const ts = new Date(sendAt).getTime()
+		if (isNaN(ts) || ts <= Date.now()) {
+			window.alert("The scheduled time must be in the future")
+			return
+		}
+		closeModal()
+		onSchedule(ts)
+	})
+	const onChangeSendAt = useCallback((evt: React.ChangeEvent<HTMLInputElement>) => {
+		setSendAt(evt.target.value)
+	}, [])
+	const cancelScheduled = useCallback((evt: React.MouseEvent<HTMLButtonElement>) => {
+		const rowid = Number(evt.currentTarget.getAttribute("data-rowid"))
+		client.rpc.cancelScheduledEvent(rowid).catch(
+			err => window.alert("Failed to cancel scheduled message: " + err),
+		)
+	}, [client])
+	return <form onSubmit={onSubmit}>
+		<h3>Schedule Message</h3>
+		<input
+			autoFocus
+			type="datetime-local"
+			value={sendAt}
+			min={toDateTimeLocal(new Date())}
+			onChange={onChangeSendAt}
+		/>
+		<div className="confirm-buttons">
+			<button type="button" onClick={closeModal}>Cancel</button>
+			<button type="submit">Schedule</button>
+		</div>
+		{scheduled && scheduled.length > 0 && <>
+			<h4>Scheduled in this room</h4>
+			<ul className="scheduled-messages">
+				{scheduled.map(evt => <li key={evt.rowid} className={evt.send_error ? "failed" : undefined}>
+					<span className="send-at">{new Date(evt.send_at).toLocaleString()}</span>
+					<span className="body" title={evt.send_error}>{getScheduledBody(evt)}</span>
+					<button
+						type="button"
+						data-rowid={evt.rowid}
+						onClick={cancelScheduled}
+						title="Cancel scheduled message"
+					><CloseIcon/></button>
+				</li>)}
+			</ul>
+		</>}
+	</form>
+}
+
+export default ScheduleMessageModal
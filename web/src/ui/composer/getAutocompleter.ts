@@ -18,6 +18,7 @@ import { RoomStateStore } from "@/api/statestore"
 import {
 	AutocompleteQuery,
 	AutocompleterProps,
+	CommandAutocompleter,
 	EmojiAutocompleter,
 	RoomAutocompleter,
 	UserAutocompleter,
@@ -31,6 +32,8 @@ export function charToAutocompleteType(newChar?: string): AutocompleteQuery["typ
 		return "user"
 	case "#":
 		return "room"
+	case "/":
+		return "command"
 	default:
 		return null
 	}
@@ -65,6 +68,8 @@ export function getAutocompleter(
 			return null
 		}
 		return RoomAutocompleter
+	case "command":
+		return CommandAutocompleter
 	default:
 		return null
 	}
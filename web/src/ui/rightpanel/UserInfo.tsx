@@ -16,7 +16,7 @@
 import { use, useEffect, useState } from "react"
 import { PuffLoader } from "react-spinners"
 import { getAvatarURL } from "@/api/media.ts"
-import { useRoomState } from "@/api/statestore"
+import { useAccountData, useRoomState } from "@/api/statestore"
 import { MemberEventContent, UserID, UserProfile } from "@/api/types"
 import { getDisplayname } from "@/util/validation.ts"
 import ClientContext from "../ClientContext.ts"
@@ -77,6 +77,95 @@ function renderUserInfo({ userID, profile, error, openLightbox }: RenderUserInfo
 		<div className="displayname" title={displayname}>{displayname}</div>
 		<div className="userid" title={userID}>{userID}</div>
 		{error ? <div className="error">{`${error}`}</div> : null}
+		<IgnoreButton userID={userID}/>
+		<OwnProfileEditor userID={userID}/>
+	</>
+}
+
+const OwnProfileEditor = ({ userID }: UserInfoProps) => {
+	const client = use(ClientContext)!
+	const [displayname, setDisplayname] = useState("")
+	const [propagate, setPropagate] = useState(true)
+	const [busy, setBusy] = useState(false)
+	const [error, setError] = useState<unknown>(null)
+	const isOwnUser = userID === client.userID
+	useEffect(() => {
+		if (isOwnUser) {
+			client.rpc.getProfile(client.userID).then(profile => setDisplayname(profile.displayname ?? ""), setError)
+		}
+	}, [client, isOwnUser])
+	if (!isOwnUser) {
+		return null
+	}
+	const run = (fn: () => Promise<unknown>) => {
+		setBusy(true)
+		setError(null)
+		fn().catch(setError).finally(() => setBusy(false))
+	}
+	const onSubmitDisplayname = (evt: React.FormEvent) => {
+		evt.preventDefault()
+		run(() => client.rpc.setDisplayname(displayname, propagate))
+	}
+	const onSelectAvatar = (evt: React.ChangeEvent<HTMLInputElement>) => {
+		const file = evt.target.files?.[0]
+		if (!file) {
+			return
+		}
+		run(async () => {
+			const res = await fetch(`_gomuks/upload?encrypt=false&filename=${encodeURIComponent(file.name)}`, {
+				method: "POST",
+				body: file,
+			})
+			const json = await res.json()
+			if (!res.ok) {
+				throw new Error(json.error)
+			}
+			await client.rpc.setAvatar(json.url, propagate)
+		})
+	}
+	return <div className="own-profile-editor">
+		<form onSubmit={onSubmitDisplayname}>
+			<input
+				type="text"
+				value={displayname}
+				placeholder="Display name"
+				onChange={evt => setDisplayname(evt.target.value)}
+				disabled={busy}
+			/>
+			<button type="submit" disabled={busy}>Save</button>
+		</form>
+		<label className="avatar-upload">
+			Change avatar
+			<input type="file" accept="image/*" onChange={onSelectAvatar} disabled={busy}/>
+		</label>
+		<label>
+			<input type="checkbox" checked={propagate} onChange={evt => setPropagate(evt.target.checked)}/>
+			Also update rooms the server misses (without a per-room profile)
+		</label>
+		{error ? <div className="error">{`${error}`}</div> : null}
+	</div>
+}
+
+interface IgnoredUserList {
+	ignored_users?: Record<UserID, unknown>
+}
+
+const IgnoreButton = ({ userID }: UserInfoProps) => {
+	const client = use(ClientContext)!
+	const ignoredUsers = useAccountData(client.store, "m.ignored_user_list") as IgnoredUserList | null
+	const [error, setError] = useState<unknown>(null)
+	if (userID === client.userID) {
+		return null
+	}
+	const isIgnored = Boolean(ignoredUsers?.ignored_users?.[userID])
+	const onClick = () => {
+		setError(null)
+		const promise = isIgnored ? client.rpc.unignoreUser(userID) : client.rpc.ignoreUser(userID)
+		promise.catch(setError)
+	}
+	return <>
+		<button className="ignore-user" onClick={onClick}>{isIgnored ? "Unignore user" : "Ignore user"}</button>
+		{error ? <div className="error">{`${error}`}</div> : null}
 	</>
 }
 
@@ -15,10 +15,12 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 import { JSX, useRef } from "react"
 import { RoomStateStore } from "@/api/statestore"
+import { useEventAsState } from "@/util/eventdispatcher.ts"
 import MessageComposer from "../composer/MessageComposer.tsx"
 import RightPanel, { RightPanelProps } from "../rightpanel/RightPanel.tsx"
 import TimelineView from "../timeline/TimelineView.tsx"
 import RoomViewHeader from "./RoomViewHeader.tsx"
+import TombstoneNotice from "./TombstoneNotice.tsx"
 import { RoomContext, RoomContextData } from "./roomcontext.ts"
 import "./RoomView.css"
 
@@ -33,11 +35,17 @@ const RoomView = ({ room, rightPanelResizeHandle, rightPanel }: RoomViewProps) =
 	if (roomContextDataRef.current === undefined) {
 		roomContextDataRef.current = new RoomContextData(room)
 	}
+	const tombstone = useEventAsState(room.meta).tombstone
+	const capabilities = useEventAsState(room.capabilities)
 	return <RoomContext value={roomContextDataRef.current}>
 		<div className="room-view">
 			<RoomViewHeader room={room}/>
 			<TimelineView/>
-			<MessageComposer/>
+			{tombstone?.replacement_room
+				? <TombstoneNotice room={room} tombstone={tombstone}/>
+				: capabilities?.send_messages === false
+					? <div className="composer-notice">You don't have permission to send messages in this room</div>
+					: <MessageComposer/>}
 		</div>
 		{rightPanelResizeHandle}
 		{rightPanel && <RightPanel {...rightPanel}/>}
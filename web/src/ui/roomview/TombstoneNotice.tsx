@@ -0,0 +1,58 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+import { use, useState } from "react"
+import { RoomStateStore } from "@/api/statestore"
+import { TombstoneEventContent } from "@/api/types"
+import ClientContext from "../ClientContext.ts"
+import MainScreenContext from "../MainScreenContext.ts"
+
+interface TombstoneNoticeProps {
+	room: RoomStateStore
+	tombstone: TombstoneEventContent
+}
+
+const TombstoneNotice = ({ room, tombstone }: TombstoneNoticeProps) => {
+	const client = use(ClientContext)!
+	const mainScreen = use(MainScreenContext)
+	const [joining, setJoining] = useState(false)
+	const [error, setError] = useState<unknown>(null)
+	const successorJoined = client.store.rooms.has(tombstone.replacement_room)
+	const onClick = () => {
+		if (successorJoined) {
+			mainScreen.setActiveRoom(tombstone.replacement_room)
+			return
+		}
+		setJoining(true)
+		setError(null)
+		client.rpc.joinSuccessor(room.roomID).then(
+			newRoomID => {
+				if (client.store.rooms.has(newRoomID)) {
+					mainScreen.setActiveRoom(newRoomID)
+				}
+			},
+			setError,
+		).finally(() => setJoining(false))
+	}
+	return <div className="tombstone-notice">
+		<span>{tombstone.body || "This room has been replaced."}</span>
+		<button onClick={onClick} disabled={joining}>
+			{successorJoined ? "Go to new room" : joining ? "Joining..." : "Join new room"}
+		</button>
+		{error ? <div className="error">{`${error}`}</div> : null}
+	</div>
+}
+
+export default TombstoneNotice
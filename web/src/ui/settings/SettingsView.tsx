@@ -14,7 +14,8 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 import { use, useCallback, useState } from "react"
-import { RoomStateStore, usePreferences } from "@/api/statestore"
+import { RoomStateStore, usePreferences, useRoomAccountData } from "@/api/statestore"
+import type { RoomTagMetadata } from "@/api/types"
 import { Preference, PreferenceContext, PreferenceValueType, Preferences, preferences } from "@/api/types/preferences"
 import useEvent from "@/util/useEvent.ts"
 import ClientContext from "../ClientContext.ts"
@@ -95,7 +96,9 @@ const PreferenceRow = ({
 		val: PreferenceValueType | undefined,
 		inheritedVal: PreferenceValueType,
 	) => {
-		if (prefType === "boolean") {
+		if (!pref.allowedContexts.includes(context)) {
+			return null
+		} else if (prefType === "boolean") {
 			return <BooleanPreferenceCell
 				name={name}
 				setPref={setPref}
@@ -208,6 +211,31 @@ const AppliedSettingsView = ({ room }: SettingsViewProps) => {
 	</div>
 }
 
+const roomTagToggles = [
+	{ tag: "m.favourite", label: "Favourite" },
+	{ tag: "m.lowpriority", label: "Low priority" },
+]
+
+const RoomTagsView = ({ room }: SettingsViewProps) => {
+	const client = use(ClientContext)!
+	const tagContent = useRoomAccountData(room, "m.tag") as { tags?: Record<string, RoomTagMetadata> } | null
+	const tags = tagContent?.tags ?? {}
+	return <div className="room-tags">
+		{roomTagToggles.map(({ tag, label }) => {
+			const onChange = (evt: React.ChangeEvent<HTMLInputElement>) => {
+				const promise = evt.target.checked
+					? client.rpc.addRoomTag(room.roomID, tag)
+					: client.rpc.removeRoomTag(room.roomID, tag)
+				promise.catch(err => window.alert(`Failed to update room tag: ${err}`))
+			}
+			return <label key={tag}>
+				<Toggle checked={tag in tags} onChange={onChange}/>
+				{label}
+			</label>
+		})}
+	</div>
+}
+
 const SettingsView = ({ room }: SettingsViewProps) => {
 	const client = use(ClientContext)!
 	const setPref = useCallback((context: PreferenceContext, key: keyof Preferences, value: PreferenceValueType | undefined) => {
@@ -243,6 +271,7 @@ const SettingsView = ({ room }: SettingsViewProps) => {
 	return <>
 		<h2>Settings</h2>
 		<code>{room.roomID}</code>
+		<RoomTagsView room={room}/>
 		<table>
 			<thead>
 				<tr>
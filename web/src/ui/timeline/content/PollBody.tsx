@@ -0,0 +1,61 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+import { use } from "react"
+import ClientContext from "../../ClientContext.ts"
+import EventContentProps from "./props.ts"
+
+const PollBody = ({ event }: EventContentProps) => {
+	const client = use(ClientContext)!
+	const poll = event.poll
+	if (!poll) {
+		return <div className="poll-body">Invalid poll</div>
+	}
+	const showResults = poll.ended || (poll.start.kind === "disclosed" && !!poll.own_vote)
+	const vote = (answerID: string) => {
+		if (poll.ended || event.pending) {
+			return
+		}
+		let answers = [answerID]
+		if (poll.start.max_selections > 1) {
+			const current = poll.own_vote ?? []
+			answers = current.includes(answerID)
+				? current.filter(id => id !== answerID)
+				: [...current, answerID].slice(-poll.start.max_selections)
+		}
+		client.rpc.votePoll(event.room_id, event.event_id, answers)
+			.catch(err => window.alert(`Failed to vote: ${err}`))
+	}
+	return <div className="poll-body">
+		<div className="poll-question">{poll.start.question}</div>
+		<ul className="poll-answers">
+			{poll.start.answers.map(answer => <li
+				key={answer.id}
+				className={poll.own_vote?.includes(answer.id) ? "selected" : undefined}
+			>
+				<button disabled={poll.ended || event.pending} onClick={() => vote(answer.id)}>{answer.text}</button>
+				{showResults ? <span className="tally">{poll.tallies[answer.id] ?? 0}</span> : null}
+			</li>)}
+		</ul>
+		<div className="poll-footer">
+			{poll.ended ? "Poll ended" : null} {poll.total_votes} {poll.total_votes === 1 ? "vote" : "votes"}
+			{!poll.ended && event.sender === client.userID ? <button
+				onClick={() => client.rpc.endPoll(event.room_id, event.event_id)}
+			>End poll</button> : null}
+		</div>
+	</div>
+}
+
+export default PollBody
@@ -15,6 +15,7 @@
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 import { MessageEventContent } from "@/api/types"
 import { getDisplayname } from "@/util/validation.ts"
+import URLPreviews from "./URLPreviews.tsx"
 import EventContentProps from "./props.ts"
 
 function isImageElement(elem: EventTarget): elem is HTMLImageElement {
@@ -74,7 +75,8 @@ function importMath() {
 	)
 }
 
-const TextMessageBody = ({ event, sender }: EventContentProps) => {
+const TextMessageBody = (props: EventContentProps) => {
+	const { event, sender } = props
 	const content = event.content as MessageEventContent
 	const classNames = ["message-text"]
 	let eventSenderName: string | undefined
@@ -96,14 +98,20 @@ const TextMessageBody = ({ event, sender }: EventContentProps) => {
 	}
 	if (event.local_content?.sanitized_html) {
 		classNames.push("html-body")
-		return <div
-			onClick={onClickHTML}
-			className={classNames.join(" ")}
-			data-event-sender={eventSenderName}
-			dangerouslySetInnerHTML={{ __html: event.local_content.sanitized_html }}
-		/>
+		return <>
+			<div
+				onClick={onClickHTML}
+				className={classNames.join(" ")}
+				data-event-sender={eventSenderName}
+				dangerouslySetInnerHTML={{ __html: event.local_content.sanitized_html }}
+			/>
+			<URLPreviews {...props}/>
+		</>
 	}
-	return <div className={classNames.join(" ")} data-event-sender={eventSenderName}>{content.body}</div>
+	return <>
+		<div className={classNames.join(" ")} data-event-sender={eventSenderName}>{content.body}</div>
+		<URLPreviews {...props}/>
+	</>
 }
 
 export default TextMessageBody
@@ -0,0 +1,80 @@
+// gomuks - A Matrix client written in Go.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+import { use, useEffect, useMemo, useState } from "react"
+import { getMediaURL } from "@/api/media.ts"
+import { usePreferences } from "@/api/statestore"
+import { MessageEventContent, RoomID, URLPreview } from "@/api/types"
+import ClientContext from "../../ClientContext.ts"
+import EventContentProps from "./props.ts"
+
+const MAX_PREVIEWS = 3
+const urlRegex = /https?:\/\/[^\s<>"]+[^\s<>".,;:!?)\]'}]/g
+
+const extractURLs = (body?: string) => {
+	if (typeof body !== "string") {
+		return []
+	}
+	return [...new Set(body.match(urlRegex) ?? [])].slice(0, MAX_PREVIEWS)
+}
+
+const URLPreviewCard = ({ url, roomID }: { url: string, roomID: RoomID }) => {
+	const client = use(ClientContext)!
+	const [preview, setPreview] = useState<URLPreview | null>(null)
+	useEffect(() => {
+		let cancelled = false
+		client.rpc.getURLPreview(url, roomID).then(
+			resp => {
+				if (!cancelled) {
+					setPreview(resp)
+				}
+			},
+			err => console.warn("Failed to get URL preview for", url, err),
+		)
+		return () => {
+			cancelled = true
+		}
+	}, [client, url, roomID])
+	const content = preview?.preview
+	if (!content || (!content["og:title"] && !content["og:description"])) {
+		return null
+	}
+	const imageURL = getMediaURL(content["og:image"])
+	return <a className="url-preview" href={url} target="_blank" rel="noreferrer noopener">
+		{imageURL && <img className="url-preview-image" src={imageURL} alt="" loading="lazy"/>}
+		<div className="url-preview-text">
+			{content["og:title"] && <div className="url-preview-title">{content["og:title"]}</div>}
+			{content["og:description"] && <div className="url-preview-description">{content["og:description"]}</div>}
+		</div>
+	</a>
+}
+
+const URLPreviews = ({ room, event }: EventContentProps) => {
+	const client = use(ClientContext)!
+	usePreferences(client.store, room)
+	const body = (event.content as MessageEventContent).body
+	const urls = useMemo(() => extractURLs(body), [body])
+	// Previews in encrypted rooms must be enabled per room, because fetching them leaks the URL to the server
+	const enabled = room.preferences.show_url_previews
+		&& (!room.meta.current.encryption_event || room.preferences.encrypted_url_previews)
+	if (!enabled || urls.length === 0) {
+		return null
+	}
+	return <div className="url-previews">
+		{urls.map(url => <URLPreviewCard key={url} url={url} roomID={room.roomID}/>)}
+	</div>
+}
+
+export default URLPreviews
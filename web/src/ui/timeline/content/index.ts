@@ -6,6 +6,7 @@ import HiddenEvent from "./HiddenEvent.tsx"
 import MediaMessageBody from "./MediaMessageBody.tsx"
 import MemberBody from "./MemberBody.tsx"
 import PinnedEventsBody from "./PinnedEventsBody.tsx"
+import PollBody from "./PollBody.tsx"
 import PowerLevelBody from "./PowerLevelBody.tsx"
 import RedactedBody from "./RedactedBody.tsx"
 import TextMessageBody from "./TextMessageBody.tsx"
@@ -20,6 +21,7 @@ export { default as HiddenEvent } from "./HiddenEvent.tsx"
 export { default as MediaMessageBody } from "./MediaMessageBody.tsx"
 export { default as MemberBody } from "./MemberBody.tsx"
 export { default as PinnedEventsBody } from "./PinnedEventsBody.tsx"
+export { default as PollBody } from "./PollBody.tsx"
 export { default as PowerLevelBody } from "./PowerLevelBody.tsx"
 export { default as RedactedBody } from "./RedactedBody.tsx"
 export { default as TextMessageBody } from "./TextMessageBody.tsx"
@@ -27,7 +29,7 @@ export { default as UnknownMessageBody } from "./UnknownMessageBody.tsx"
 export type { default as EventContentProps } from "./props.ts"
 
 export function getBodyType(evt: MemDBEvent, forReply = false): React.FunctionComponent<EventContentProps> {
-	if (evt.relation_type === "m.replace") {
+	if (evt.relation_type === "m.replace" || evt.ignored) {
 		return HiddenEvent
 	}
 	switch (evt.type) {
@@ -61,6 +63,14 @@ export function getBodyType(evt: MemDBEvent, forReply = false): React.FunctionCo
 			return TextMessageBody
 		}
 		return MediaMessageBody
+	case "m.poll.start":
+	case "org.matrix.msc3381.poll.start":
+		if (evt.redacted_by) {
+			return RedactedBody
+		} else if (forReply) {
+			return TextMessageBody
+		}
+		return PollBody
 	case "m.room.encrypted":
 		if (evt.redacted_by) {
 			return RedactedBody